@@ -0,0 +1,355 @@
+// Package ay emulates the General Instrument AY-3-8910 sound generator,
+// as fitted to the 128K Spectrums, and turns its output into audio
+// samples.
+//
+// The chip has three square wave tone channels, a noise generator and an
+// envelope generator that can shape the volume of any channel. It is
+// programmed through sixteen registers: the CPU selects a register and
+// then reads or writes it.
+package ay
+
+// Registers
+const (
+	ToneAFine = iota
+	ToneACoarse
+	ToneBFine
+	ToneBCoarse
+	ToneCFine
+	ToneCCoarse
+	NoisePeriod
+	Mixer // Bits 0-2 turn off tone and 3-5 noise, for A, B and C
+	AmplitudeA
+	AmplitudeB
+	AmplitudeC
+	EnvelopeFine
+	EnvelopeCoarse
+	EnvelopeShape
+	IOPortA
+	IOPortB
+	NumRegisters
+)
+
+// registerMasks holds the bits of each register the chip implements;
+// the others read as zero
+var registerMasks = [NumRegisters]byte{
+	0xFF, 0x0F, 0xFF, 0x0F, 0xFF, 0x0F, 0x1F, 0xFF,
+	0x1F, 0x1F, 0x1F, 0xFF, 0xFF, 0x0F, 0xFF, 0xFF,
+}
+
+// Amplitude register bit that hands the volume to the envelope generator
+const useEnvelope = 0x10
+
+// Envelope shape bits
+const (
+	envelopeHold      = 0x01
+	envelopeAlternate = 0x02
+	envelopeAttack    = 0x04
+	envelopeContinue  = 0x08
+)
+
+// levels is the output of a channel at each of the 16 volumes, which
+// are roughly 3dB apart, as measured on a real chip
+var levels = [16]float32{
+	0.0, 0.00999465934234, 0.0144502937362, 0.0210574502174,
+	0.0307011520562, 0.0455481803616, 0.0644998855573, 0.107362478065,
+	0.126588845655, 0.20498970016, 0.292210269322, 0.372838941024,
+	0.492530708782, 0.635324635691, 0.805584802014, 1.0,
+}
+
+// HighPass is the pole of the DC-blocking filter on the output
+const HighPass = 0.995
+
+// The tone, noise and envelope counters all advance once every
+// stepClocks cycles of the chip's clock
+const stepClocks = 8
+
+// AY is one AY-3-8910
+type AY struct {
+	clockRate  int // Rate at which Tick is called
+	chipClock  int // The chip's own clock
+	sampleRate int
+
+	regs     [NumRegisters]byte
+	selected byte
+
+	divider int // Chip clocks towards the next step, in units of 1/clockRate
+
+	toneCounter [3]uint16
+	toneOut     [3]bool
+
+	noiseCounter uint16
+	noiseShift   uint32 // 17-bit shift register
+	noiseOut     bool
+
+	envelopeCounter uint32
+	envelopePos     int // Step within the current ramp, 0-15
+	envelopeAttack  bool
+	envelopeHolding bool
+	envelopeVolume  int
+
+	level float32 // Current output, the average of the three channels
+	sum   float32 // Output summed over the ticks of the current sample
+	ticks int
+	phase int // Position in the current output sample, in units of 1/clockRate
+
+	lastIn  float32
+	lastOut float32
+
+	samples []float32
+
+	// Volume scales the output samples
+	Volume float32
+}
+
+// New creates an AY clocked at chipClock Hz, whose Tick is called
+// clockRate times a second (such as by the CPU clock), producing
+// sampleRate samples per second
+func New(clockRate, chipClock, sampleRate int) *AY {
+	a := &AY{
+		clockRate:  clockRate,
+		chipClock:  chipClock,
+		sampleRate: sampleRate,
+		Volume:     0.25,
+	}
+	a.Reset()
+	return a
+}
+
+// Reset clears the registers, silencing the chip
+func (a *AY) Reset() {
+	a.regs = [NumRegisters]byte{}
+	a.selected = 0
+	a.toneCounter = [3]uint16{}
+	a.toneOut = [3]bool{}
+	a.noiseCounter = 0
+	a.noiseShift = 1
+	a.noiseOut = false
+	a.resetEnvelope()
+	a.update()
+}
+
+// Select chooses the register that Read and Write access. Values of 16
+// and over select nothing.
+func (a *AY) Select(reg byte) {
+	a.selected = reg
+}
+
+// Selected returns the register last selected
+func (a *AY) Selected() byte {
+	return a.selected
+}
+
+// Read returns the selected register
+func (a *AY) Read() byte {
+	if a.selected >= NumRegisters {
+		return 0xFF
+	}
+	return a.regs[a.selected]
+}
+
+// Write sets the selected register
+func (a *AY) Write(value byte) {
+	if a.selected >= NumRegisters {
+		return
+	}
+	a.regs[a.selected] = value & registerMasks[a.selected]
+	if a.selected == EnvelopeShape {
+		a.resetEnvelope()
+	}
+	a.update()
+}
+
+// Registers returns the contents of all the registers
+func (a *AY) Registers() [NumRegisters]byte {
+	return a.regs
+}
+
+// SetRegisters loads all the registers and selects reg, as when
+// restoring a snapshot. The envelope restarts.
+func (a *AY) SetRegisters(regs [NumRegisters]byte, reg byte) {
+	for i, value := range regs {
+		a.regs[i] = value & registerMasks[i]
+	}
+	a.selected = reg
+	a.resetEnvelope()
+	a.update()
+}
+
+// SampleRate returns the output sample rate
+func (a *AY) SampleRate() int {
+	return a.sampleRate
+}
+
+// Tick advances the chip by one tick of the driving clock
+func (a *AY) Tick() {
+	a.divider += a.chipClock
+	for a.divider >= stepClocks*a.clockRate {
+		a.divider -= stepClocks * a.clockRate
+		a.step()
+	}
+
+	a.sum += a.level
+	a.ticks++
+	a.phase += a.sampleRate
+	if a.phase >= a.clockRate {
+		a.phase -= a.clockRate
+		a.emit()
+	}
+}
+
+// period returns a 12 or 16-bit period from a pair of registers, where
+// zero acts as one
+func (a *AY) period(fine, coarse int) uint32 {
+	p := uint32(a.regs[fine]) | uint32(a.regs[coarse])<<8
+	if p == 0 {
+		return 1
+	}
+	return p
+}
+
+// step advances the tone, noise and envelope generators
+func (a *AY) step() {
+	for ch := range a.toneCounter {
+		a.toneCounter[ch]++
+		if uint32(a.toneCounter[ch]) >= a.period(ToneAFine+2*ch, ToneACoarse+2*ch) {
+			a.toneCounter[ch] = 0
+			a.toneOut[ch] = !a.toneOut[ch]
+		}
+	}
+
+	// Noise and the envelope run at half the rate of the tones
+	noisePeriod := uint16(a.regs[NoisePeriod])
+	if noisePeriod == 0 {
+		noisePeriod = 1
+	}
+	a.noiseCounter++
+	if a.noiseCounter >= 2*noisePeriod {
+		a.noiseCounter = 0
+		bit := (a.noiseShift ^ a.noiseShift>>3) & 1
+		a.noiseShift = a.noiseShift>>1 | bit<<16
+		a.noiseOut = a.noiseShift&1 != 0
+	}
+
+	a.envelopeCounter++
+	if a.envelopeCounter >= 2*a.period(EnvelopeFine, EnvelopeCoarse) {
+		a.envelopeCounter = 0
+		a.stepEnvelope()
+	}
+	a.update()
+}
+
+// resetEnvelope starts the envelope from the beginning of its shape
+func (a *AY) resetEnvelope() {
+	a.envelopeCounter = 0
+	a.envelopePos = 0
+	a.envelopeAttack = a.regs[EnvelopeShape]&envelopeAttack != 0
+	a.envelopeHolding = false
+	a.setEnvelopeVolume()
+}
+
+// stepEnvelope moves the envelope one step along its ramp. At the end of
+// a ramp it stops, holds or starts another, as the shape says.
+func (a *AY) stepEnvelope() {
+	if a.envelopeHolding {
+		return
+	}
+	a.envelopePos++
+	if a.envelopePos < 16 {
+		a.setEnvelopeVolume()
+		return
+	}
+
+	shape := a.regs[EnvelopeShape]
+	switch {
+	case shape&envelopeContinue == 0:
+		a.envelopeHolding = true
+		a.envelopeVolume = 0
+	case shape&envelopeHold != 0:
+		// Hold the end of the ramp, or its start when alternating
+		a.envelopeHolding = true
+		a.envelopeVolume = 0
+		if a.envelopeAttack != (shape&envelopeAlternate != 0) {
+			a.envelopeVolume = 15
+		}
+	default:
+		if shape&envelopeAlternate != 0 {
+			a.envelopeAttack = !a.envelopeAttack
+		}
+		a.envelopePos = 0
+		a.setEnvelopeVolume()
+	}
+}
+
+func (a *AY) setEnvelopeVolume() {
+	if a.envelopeAttack {
+		a.envelopeVolume = a.envelopePos
+	} else {
+		a.envelopeVolume = 15 - a.envelopePos
+	}
+}
+
+// update works out the output level from the generators and registers
+func (a *AY) update() {
+	mixer := a.regs[Mixer]
+	var level float32
+	for ch := range 3 {
+		toneOff := mixer&(1<<ch) != 0
+		noiseOff := mixer&(8<<ch) != 0
+		if !(a.toneOut[ch] || toneOff) || !(a.noiseOut || noiseOff) {
+			continue
+		}
+		amplitude := a.regs[AmplitudeA+ch]
+		volume := int(amplitude & 0x0F)
+		if amplitude&useEnvelope != 0 {
+			volume = a.envelopeVolume
+		}
+		level += levels[volume]
+	}
+	a.level = level / 3
+}
+
+// emit finishes an output sample, averaging the level over its ticks
+func (a *AY) emit() {
+	in := a.sum / float32(a.ticks)
+	a.sum = 0
+	a.ticks = 0
+
+	out := in - a.lastIn + HighPass*a.lastOut
+	a.lastIn = in
+	a.lastOut = out
+	a.samples = append(a.samples, out*a.Volume)
+}
+
+// Samples returns the samples produced so far and removes them from the
+// chip. The returned slice is only valid until the next call to Tick.
+func (a *AY) Samples() []float32 {
+	samples := a.samples
+	a.samples = a.samples[:0]
+	return samples
+}
+
+// Pending returns the number of samples waiting to be collected
+func (a *AY) Pending() int {
+	return len(a.samples)
+}
+
+// State is the chip's registers and where it is in making its sound,
+// apart from the samples waiting to be collected
+type State struct {
+	a AY
+}
+
+// State returns the chip's state, to be put back with SetState
+func (a *AY) State() State {
+	s := State{*a}
+	s.a.samples = nil
+	return s
+}
+
+// SetState puts the chip back in a state returned by State, keeping the
+// samples waiting to be collected and the volume
+func (a *AY) SetState(s State) {
+	samples, volume := a.samples, a.Volume
+	*a = s.a
+	a.samples, a.Volume = samples, volume
+}
@@ -0,0 +1,91 @@
+package ay
+
+import "testing"
+
+func TestRegisterMasks(t *testing.T) {
+	a := New(3546900, 1773450, 44100)
+	for reg := range byte(NumRegisters) {
+		a.Select(reg)
+		a.Write(0xFF)
+		if got := a.Read(); got != registerMasks[reg] {
+			t.Errorf("register %d reads 0x%02X after writing 0xFF", reg, got)
+		}
+	}
+	a.Select(16)
+	a.Write(0x12)
+	if got := a.Read(); got != 0xFF {
+		t.Errorf("register 16 reads 0x%02X", got)
+	}
+}
+
+// envelope runs the envelope generator for three ramps and returns the
+// volume at the start of each ramp and at its last step
+func envelope(shape byte) []int {
+	a := New(1, 1, 1)
+	a.Select(EnvelopeShape)
+	a.Write(shape)
+	var volumes []int
+	for range 3 {
+		volumes = append(volumes, a.envelopeVolume)
+		for range 15 {
+			a.stepEnvelope()
+		}
+		volumes = append(volumes, a.envelopeVolume)
+		a.stepEnvelope()
+	}
+	return volumes
+}
+
+func TestEnvelopeShapes(t *testing.T) {
+	tests := []struct {
+		shape byte
+		want  []int
+	}{
+		{0x00, []int{15, 0, 0, 0, 0, 0}},     // \___
+		{0x04, []int{0, 15, 0, 0, 0, 0}},     // /___
+		{0x08, []int{15, 0, 15, 0, 15, 0}},   // \\\\
+		{0x09, []int{15, 0, 0, 0, 0, 0}},     // \___
+		{0x0A, []int{15, 0, 0, 15, 15, 0}},   // \/\/
+		{0x0B, []int{15, 0, 15, 15, 15, 15}}, // \```
+		{0x0C, []int{0, 15, 0, 15, 0, 15}},   // ////
+		{0x0D, []int{0, 15, 15, 15, 15, 15}}, // /```
+		{0x0E, []int{0, 15, 15, 0, 0, 15}},   // /\/\
+		{0x0F, []int{0, 15, 0, 0, 0, 0}},     // /___
+	}
+	for _, test := range tests {
+		got := envelope(test.shape)
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("shape 0x%X gave volumes %v, want %v", test.shape, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestToneFrequency(t *testing.T) {
+	// 440Hz from a 1.7734MHz clock is a period of 252
+	const clock = 1773450
+	a := New(clock, clock, 44100)
+	for reg, value := range map[byte]byte{
+		ToneAFine: 252, Mixer: 0x3E, AmplitudeA: 15,
+	} {
+		a.Select(reg)
+		a.Write(value)
+	}
+	edges := 0
+	last := a.toneOut[0]
+	for range clock {
+		a.Tick()
+		if a.toneOut[0] != last {
+			edges++
+			last = a.toneOut[0]
+		}
+	}
+	if want := clock / (16 * 252) * 2; edges < want-2 || edges > want+2 {
+		t.Errorf("tone changed %d times in a second, want %d", edges, want)
+	}
+	if n := len(a.Samples()); n < 44099 || n > 44101 {
+		t.Errorf("produced %d samples in a second, want 44100", n)
+	}
+}
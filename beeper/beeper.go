@@ -0,0 +1,177 @@
+// Package beeper emulates a 1-bit speaker, such as the Spectrum's, and
+// turns its output into audio samples.
+//
+// The speaker level is set by the emulated system at exact clock ticks.
+// Each level change is rendered as a band-limited step (a BLEP built from
+// a windowed sinc), so the output is free of the aliasing a plain
+// point-sampled square wave would have, whatever the ratio between the
+// emulated clock and the output sample rate.
+package beeper
+
+import "math"
+
+// Resampling kernel dimensions
+const (
+	kernelWidth  = 16 // Output samples touched by each level change
+	kernelPhases = 64 // Sub-sample resolution of level changes
+)
+
+// kernel[p] is the band-limited impulse for a level change at phase p/kernelPhases
+// of an output sample period. Each row sums to one.
+var kernel = makeKernel()
+
+func makeKernel() [kernelPhases][kernelWidth]float32 {
+	const cutoff = 0.9 // Fraction of the output Nyquist frequency kept
+	var k [kernelPhases][kernelWidth]float32
+	for p := 0; p < kernelPhases; p++ {
+		frac := float64(p) / kernelPhases
+		sum := 0.0
+		var row [kernelWidth]float64
+		for i := 0; i < kernelWidth; i++ {
+			x := float64(i-kernelWidth/2) + 1 - frac
+			sinc := cutoff
+			if x != 0 {
+				sinc = math.Sin(math.Pi*cutoff*x) / (math.Pi * x)
+			}
+			// Blackman window over the kernel width
+			w := float64(i) + 1 - frac
+			n := float64(kernelWidth)
+			window := 0.42 - 0.5*math.Cos(2*math.Pi*w/n) + 0.08*math.Cos(4*math.Pi*w/n)
+			row[i] = sinc * window
+			sum += row[i]
+		}
+		for i := range row {
+			k[p][i] = float32(row[i] / sum)
+		}
+	}
+	return k
+}
+
+// HighPass is the pole of the DC-blocking filter, modelling the coupling
+// capacitor in front of the speaker
+const HighPass = 0.995
+
+// Beeper converts speaker level changes into samples
+type Beeper struct {
+	clockRate  int
+	sampleRate int
+
+	level float32 // Current speaker level
+	phase int     // Position in the current output sample, in units of 1/clockRate
+
+	// pending[(head+i)%kernelWidth] holds level changes that still have to
+	// reach the output i samples from now
+	pending [kernelWidth]float32
+	head    int
+
+	integrator float32
+	lastIn     float32
+	lastOut    float32
+
+	samples []float32
+
+	// Volume scales the output samples
+	Volume float32
+}
+
+// New creates a beeper driven by a clock of clockRate Hz (such as the
+// CPU clock) producing sampleRate samples per second
+func New(clockRate, sampleRate int) *Beeper {
+	return &Beeper{
+		clockRate:  clockRate,
+		sampleRate: sampleRate,
+		Volume:     0.25,
+	}
+}
+
+// SampleRate returns the output sample rate
+func (b *Beeper) SampleRate() int {
+	return b.sampleRate
+}
+
+// ClockRate returns the rate at which Tick is called
+func (b *Beeper) ClockRate() int {
+	return b.clockRate
+}
+
+// Level returns the current speaker level
+func (b *Beeper) Level() float32 {
+	return b.level
+}
+
+// SetLevel moves the speaker to level (nominally 0 to 1) at the current
+// clock tick
+func (b *Beeper) SetLevel(level float32) {
+	delta := level - b.level
+	if delta == 0 {
+		return
+	}
+	b.level = level
+
+	p := b.phase * kernelPhases / b.clockRate
+	for i, k := range kernel[p] {
+		b.pending[(b.head+i)%kernelWidth] += delta * k
+	}
+}
+
+// Tick advances the beeper by one clock tick
+func (b *Beeper) Tick() {
+	b.phase += b.sampleRate
+	if b.phase >= b.clockRate {
+		b.phase -= b.clockRate
+		b.emit()
+	}
+}
+
+// TickN advances the beeper by n clock ticks
+func (b *Beeper) TickN(n int) {
+	for ; n > 0; n-- {
+		b.Tick()
+	}
+}
+
+// emit finishes the oldest pending output sample
+func (b *Beeper) emit() {
+	b.integrator += b.pending[b.head]
+	b.pending[b.head] = 0
+	b.head = (b.head + 1) % kernelWidth
+
+	out := b.integrator - b.lastIn + HighPass*b.lastOut
+	b.lastIn = b.integrator
+	b.lastOut = out
+	b.samples = append(b.samples, out*b.Volume)
+}
+
+// Samples returns the samples produced so far and removes them from the
+// beeper. The returned slice is only valid until the next call to Tick.
+func (b *Beeper) Samples() []float32 {
+	samples := b.samples
+	b.samples = b.samples[:0]
+	return samples
+}
+
+// Pending returns the number of samples waiting to be collected
+func (b *Beeper) Pending() int {
+	return len(b.samples)
+}
+
+// State is where a beeper is in making its sound, apart from the samples
+// waiting to be collected
+type State struct {
+	b Beeper
+}
+
+// State returns the beeper's state, to be put back with SetState
+func (b *Beeper) State() State {
+	s := State{*b}
+	s.b.samples = nil
+	return s
+}
+
+// SetState puts the beeper back in a state returned by State, keeping the
+// samples waiting to be collected and the volume
+func (b *Beeper) SetState(s State) {
+	samples, volume := b.samples, b.Volume
+	*b = s.b
+	b.samples, b.Volume = samples, volume
+}
@@ -0,0 +1,107 @@
+package beeper
+
+import (
+	"math"
+	"testing"
+)
+
+const (
+	clockRate  = 3500000
+	sampleRate = 48000
+)
+
+func TestSampleCount(t *testing.T) {
+	b := New(clockRate, sampleRate)
+	b.TickN(clockRate)
+	if got := b.Pending(); got != sampleRate {
+		t.Errorf("a second of ticks made %d samples; want %d", got, sampleRate)
+	}
+	for i, sample := range b.Samples() {
+		if sample != 0 {
+			t.Fatalf("sample %d of silence = %g", i, sample)
+		}
+	}
+	if b.Pending() != 0 {
+		t.Error("samples left after Samples")
+	}
+}
+
+// firstLoud returns the first sample louder than half the volume
+func firstLoud(samples []float32, volume float32) int {
+	for i, sample := range samples {
+		if math.Abs(float64(sample)) > float64(volume)/2 {
+			return i
+		}
+	}
+	return -1
+}
+
+// TestEdgeTiming checks a level change comes out at the sample its tick
+// falls in, delayed by half the kernel, whatever its phase in the sample
+func TestEdgeTiming(t *testing.T) {
+	for _, at := range []int{1000, 1000*clockRate/sampleRate + 40} {
+		b := New(clockRate, sampleRate)
+		b.TickN(at)
+		b.SetLevel(1)
+		b.TickN(clockRate / 10)
+		samples := b.Samples()
+		want := at*sampleRate/clockRate + kernelWidth/2
+		if got := firstLoud(samples, b.Volume); got < want-1 || got > want+1 {
+			t.Errorf("edge at tick %d came out at sample %d; want %d", at, got, want)
+		}
+	}
+}
+
+// TestSquareWave plays a 1 kHz square wave and counts its cycles, and
+// checks it is centred on zero by the DC blocking
+func TestSquareWave(t *testing.T) {
+	b := New(clockRate, sampleRate)
+	const half = clockRate / 2000
+	level := float32(0)
+	for range 2000 {
+		level = 1 - level
+		b.SetLevel(level)
+		b.TickN(half)
+	}
+	samples := b.Samples()
+	// Once the DC blocking has settled, in the second half
+	rises := 0
+	sum := 0.0
+	for i := len(samples) / 2; i < len(samples); i++ {
+		if samples[i-1] < 0 && samples[i] >= 0 {
+			rises++
+		}
+		sum += float64(samples[i])
+	}
+	if rises < 499 || rises > 501 {
+		t.Errorf("half a second of 1 kHz square wave crossed zero upwards %d times; want 500", rises)
+	}
+	if mean := sum / float64(len(samples)/2); math.Abs(mean) > 0.01 {
+		t.Errorf("square wave has a DC offset of %g", mean)
+	}
+}
+
+func TestState(t *testing.T) {
+	b := New(clockRate, sampleRate)
+	b.SetLevel(1)
+	b.TickN(1234)
+	b.Samples()
+	state := b.State()
+	b.TickN(5000)
+	want := append([]float32(nil), b.Samples()...)
+
+	b.SetLevel(0)
+	b.TickN(777)
+	b.Samples()
+	b.SetState(state)
+	b.TickN(5000)
+	got := b.Samples()
+	if len(got) != len(want) {
+		t.Fatalf("after SetState, %d samples; want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("after SetState, sample %d = %g; want %g", i, got[i], want[i])
+		}
+	}
+}
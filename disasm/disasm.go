@@ -0,0 +1,348 @@
+// Package disasm disassembles Z80 machine code, undocumented instructions
+// included.
+//
+// Instructions are written in Zilog's syntax in upper case, with numbers
+// in hex after a dollar sign. Relative jumps show the address they go to.
+// A prefix that the next byte cancels, and ED opcodes that do nothing, are
+// shown as NOP*.
+package disasm
+
+import "fmt"
+
+// Operand tables, indexed by fields of the opcode
+var (
+	registers     = [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+	registerPairs = [4]string{"BC", "DE", "HL", "SP"}
+	stackPairs    = [4]string{"BC", "DE", "HL", "AF"}
+	conditions    = [8]string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+	arithmetic    = [8]string{"ADD A,", "ADC A,", "SUB ", "SBC A,", "AND ", "XOR ", "OR ", "CP "}
+	rotations     = [8]string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SLL", "SRL"}
+	interrupts    = [8]string{"0", "0/1", "1", "2", "0", "0/1", "1", "2"}
+	accumulator   = [8]string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}
+	specialLoads  = [8]string{"LD I,A", "LD R,A", "LD A,I", "LD A,R", "RRD", "RLD", "NOP*", "NOP*"}
+	blockOps      = [4][4]string{
+		{"LDI", "CPI", "INI", "OUTI"},
+		{"LDD", "CPD", "IND", "OUTD"},
+		{"LDIR", "CPIR", "INIR", "OTIR"},
+		{"LDDR", "CPDR", "INDR", "OTDR"},
+	}
+)
+
+// decoder reads an instruction a byte at a time
+type decoder struct {
+	read  func(addr uint16) byte
+	addr  uint16 // Next byte
+	index string // "IX" or "IY" after a prefix, otherwise ""
+	disp  *int8  // Displacement of an indexed instruction, once read
+}
+
+// Instruction disassembles the instruction at addr, reading memory with
+// read. It returns the instruction and its length in bytes.
+func Instruction(read func(addr uint16) byte, addr uint16) (string, int) {
+	d := &decoder{read: read, addr: addr}
+	text := d.decode()
+	return text, int(d.addr - addr)
+}
+
+// Back returns the address of the instruction n instructions before addr,
+// as best it can: code can't be reliably disassembled backwards, so it
+// looks for the furthest start from which the instructions run into addr.
+func Back(read func(addr uint16) byte, addr uint16, n int) uint16 {
+	for distance := 4 * n; distance >= n; distance-- {
+		start := addr - uint16(distance)
+		var starts []uint16
+		offset := 0
+		for offset < distance {
+			starts = append(starts, start+uint16(offset))
+			_, length := Instruction(read, start+uint16(offset))
+			offset += length
+		}
+		if offset == distance && len(starts) >= n {
+			return starts[len(starts)-n]
+		}
+	}
+	return addr - uint16(n)
+}
+
+func (d *decoder) byte() byte {
+	b := d.read(d.addr)
+	d.addr++
+	return b
+}
+
+func (d *decoder) n() string {
+	return fmt.Sprintf("$%02X", d.byte())
+}
+
+func (d *decoder) nn() string {
+	lo := d.byte()
+	return fmt.Sprintf("$%04X", uint16(d.byte())<<8|uint16(lo))
+}
+
+// relative reads a jump's displacement and returns where it goes
+func (d *decoder) relative() string {
+	e := int8(d.byte())
+	return fmt.Sprintf("$%04X", d.addr+uint16(e))
+}
+
+func (d *decoder) decode() string {
+	op := d.byte()
+	switch op {
+	case 0xCB:
+		return d.bitOp(d.byte())
+	case 0xED:
+		return d.extended(d.byte())
+	case 0xDD, 0xFD:
+		if next := d.read(d.addr); next == 0xDD || next == 0xED || next == 0xFD {
+			return "NOP*"
+		}
+		d.index = "IX"
+		if op == 0xFD {
+			d.index = "IY"
+		}
+		op = d.byte()
+		if op == 0xCB {
+			// The displacement comes before the opcode
+			d.readDisp()
+			return d.bitOp(d.byte())
+		}
+	}
+	return d.main(op)
+}
+
+// readDisp reads an indexed instruction's displacement
+func (d *decoder) readDisp() {
+	disp := int8(d.byte())
+	d.disp = &disp
+}
+
+// hl returns HL or the index register replacing it
+func (d *decoder) hl() string {
+	if d.index != "" {
+		return d.index
+	}
+	return "HL"
+}
+
+// memory returns (HL), or (IX+d) or (IY+d) reading the displacement if
+// it hasn't been read yet
+func (d *decoder) memory() string {
+	if d.index == "" {
+		return "(HL)"
+	}
+	if d.disp == nil {
+		d.readDisp()
+	}
+	if *d.disp < 0 {
+		return fmt.Sprintf("(%s-$%02X)", d.index, -int(*d.disp))
+	}
+	return fmt.Sprintf("(%s+$%02X)", d.index, *d.disp)
+}
+
+// reg returns register r, with H and L the halves of an index register
+// after a prefix
+func (d *decoder) reg(r byte) string {
+	switch {
+	case r == 6:
+		return d.memory()
+	case d.index != "" && (r == 4 || r == 5):
+		return d.index + registers[r][:1]
+	}
+	return registers[r]
+}
+
+func (d *decoder) pair(p byte) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return registerPairs[p]
+}
+
+func (d *decoder) stackPair(p byte) string {
+	if p == 2 {
+		return d.hl()
+	}
+	return stackPairs[p]
+}
+
+// main decodes an unprefixed opcode, or one after DD or FD
+func (d *decoder) main(op byte) string {
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch y {
+			case 0:
+				return "NOP"
+			case 1:
+				return "EX AF,AF'"
+			case 2:
+				return "DJNZ " + d.relative()
+			case 3:
+				return "JR " + d.relative()
+			}
+			return "JR " + conditions[y-4] + "," + d.relative()
+		case 1:
+			if q == 0 {
+				return "LD " + d.pair(p) + "," + d.nn()
+			}
+			return "ADD " + d.hl() + "," + d.pair(p)
+		case 2:
+			switch op {
+			case 0x02:
+				return "LD (BC),A"
+			case 0x12:
+				return "LD (DE),A"
+			case 0x22:
+				return "LD (" + d.nn() + ")," + d.hl()
+			case 0x32:
+				return "LD (" + d.nn() + "),A"
+			case 0x0A:
+				return "LD A,(BC)"
+			case 0x1A:
+				return "LD A,(DE)"
+			case 0x2A:
+				return "LD " + d.hl() + ",(" + d.nn() + ")"
+			}
+			return "LD A,(" + d.nn() + ")"
+		case 3:
+			if q == 0 {
+				return "INC " + d.pair(p)
+			}
+			return "DEC " + d.pair(p)
+		case 4:
+			return "INC " + d.reg(y)
+		case 5:
+			return "DEC " + d.reg(y)
+		case 6:
+			dst := d.reg(y)
+			return "LD " + dst + "," + d.n()
+		}
+		return accumulator[y]
+	case 1:
+		if y == 6 && z == 6 {
+			return "HALT"
+		}
+		if y == 6 || z == 6 {
+			// An indexed load leaves H and L alone
+			mem := d.memory()
+			if y == 6 {
+				return "LD " + mem + "," + registers[z]
+			}
+			return "LD " + registers[y] + "," + mem
+		}
+		return "LD " + d.reg(y) + "," + d.reg(z)
+	case 2:
+		return arithmetic[y] + d.reg(z)
+	}
+
+	switch z {
+	case 0:
+		return "RET " + conditions[y]
+	case 1:
+		if q == 0 {
+			return "POP " + d.stackPair(p)
+		}
+		return [4]string{"RET", "EXX", "JP (" + d.hl() + ")", "LD SP," + d.hl()}[p]
+	case 2:
+		return "JP " + conditions[y] + "," + d.nn()
+	case 3:
+		switch y {
+		case 0:
+			return "JP " + d.nn()
+		case 2:
+			return "OUT (" + d.n() + "),A"
+		case 3:
+			return "IN A,(" + d.n() + ")"
+		case 4:
+			return "EX (SP)," + d.hl()
+		case 5:
+			return "EX DE,HL"
+		case 6:
+			return "DI"
+		}
+		// y == 1 is the CB prefix, handled in decode
+		return "EI"
+	case 4:
+		return "CALL " + conditions[y] + "," + d.nn()
+	case 5:
+		if q == 0 {
+			return "PUSH " + d.stackPair(p)
+		}
+		// The other values of p are prefixes, handled in decode
+		return "CALL " + d.nn()
+	case 6:
+		return arithmetic[y] + d.n()
+	}
+	return fmt.Sprintf("RST $%02X", y*8)
+}
+
+// bitOp decodes a CB-prefixed opcode. After DD CB or FD CB it works on
+// memory, also copying the result to a register unless z is 6.
+func (d *decoder) bitOp(op byte) string {
+	x, y, z := op>>6, op>>3&7, op&7
+	var operand string
+	if d.index != "" {
+		operand = d.memory()
+		if z != 6 && x != 1 {
+			operand += "," + registers[z]
+		}
+	} else {
+		operand = registers[z]
+	}
+	switch x {
+	case 0:
+		return rotations[y] + " " + operand
+	case 1:
+		return fmt.Sprintf("BIT %d,%s", y, operand)
+	case 2:
+		return fmt.Sprintf("RES %d,%s", y, operand)
+	}
+	return fmt.Sprintf("SET %d,%s", y, operand)
+}
+
+// extended decodes an ED-prefixed opcode
+func (d *decoder) extended(op byte) string {
+	x, y, z := op>>6, op>>3&7, op&7
+	p, q := y>>1, y&1
+	if x == 2 && z <= 3 && y >= 4 {
+		return blockOps[y-4][z]
+	}
+	if x != 1 {
+		return "NOP*"
+	}
+	switch z {
+	case 0:
+		if y == 6 {
+			return "IN (C)"
+		}
+		return "IN " + registers[y] + ",(C)"
+	case 1:
+		if y == 6 {
+			return "OUT (C),0"
+		}
+		return "OUT (C)," + registers[y]
+	case 2:
+		if q == 0 {
+			return "SBC HL," + registerPairs[p]
+		}
+		return "ADC HL," + registerPairs[p]
+	case 3:
+		if q == 0 {
+			return "LD (" + d.nn() + ")," + registerPairs[p]
+		}
+		return "LD " + registerPairs[p] + ",(" + d.nn() + ")"
+	case 4:
+		return "NEG"
+	case 5:
+		if y == 1 {
+			return "RETI"
+		}
+		return "RETN"
+	case 6:
+		return "IM " + interrupts[y]
+	}
+	return specialLoads[y]
+}
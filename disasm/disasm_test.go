@@ -0,0 +1,79 @@
+package disasm
+
+import "testing"
+
+func TestInstruction(t *testing.T) {
+	tests := []struct {
+		code []byte
+		want string
+	}{
+		{[]byte{0x00}, "NOP"},
+		{[]byte{0x01, 0x34, 0x12}, "LD BC,$1234"},
+		{[]byte{0x08}, "EX AF,AF'"},
+		{[]byte{0x10, 0xFE}, "DJNZ $8000"},
+		{[]byte{0x20, 0x10}, "JR NZ,$8012"},
+		{[]byte{0x2A, 0x00, 0x5C}, "LD HL,($5C00)"},
+		{[]byte{0x36, 0xFF}, "LD (HL),$FF"},
+		{[]byte{0x76}, "HALT"},
+		{[]byte{0x78}, "LD A,B"},
+		{[]byte{0x96}, "SUB (HL)"},
+		{[]byte{0xC3, 0x00, 0x80}, "JP $8000"},
+		{[]byte{0xD3, 0xFE}, "OUT ($FE),A"},
+		{[]byte{0xE9}, "JP (HL)"},
+		{[]byte{0xF5}, "PUSH AF"},
+		{[]byte{0xFE, 0x1F}, "CP $1F"},
+		{[]byte{0xFF}, "RST $38"},
+		{[]byte{0xCB, 0x7E}, "BIT 7,(HL)"},
+		{[]byte{0xCB, 0x37}, "SLL A"},
+		{[]byte{0xED, 0xB0}, "LDIR"},
+		{[]byte{0xED, 0x43, 0x00, 0x60}, "LD ($6000),BC"},
+		{[]byte{0xED, 0x5E}, "IM 2"},
+		{[]byte{0xED, 0x70}, "IN (C)"},
+		{[]byte{0xED, 0x00}, "NOP*"},
+		{[]byte{0xDD, 0x21, 0x00, 0x40}, "LD IX,$4000"},
+		{[]byte{0xDD, 0x36, 0x05, 0x42}, "LD (IX+$05),$42"},
+		{[]byte{0xFD, 0x7E, 0xFB}, "LD A,(IY-$05)"},
+		{[]byte{0xDD, 0x66, 0x01}, "LD H,(IX+$01)"},
+		{[]byte{0xDD, 0x64}, "LD IXH,IXH"},
+		{[]byte{0xFD, 0x85}, "ADD A,IYL"},
+		{[]byte{0xDD, 0xE9}, "JP (IX)"},
+		{[]byte{0xDD, 0xEB}, "EX DE,HL"},
+		{[]byte{0xDD, 0xCB, 0x02, 0x46}, "BIT 0,(IX+$02)"},
+		{[]byte{0xFD, 0xCB, 0xFF, 0xC0}, "SET 0,(IY-$01),B"},
+		{[]byte{0xDD, 0xDD}, "NOP*"},
+	}
+	for _, test := range tests {
+		mem := make([]byte, 0x10000)
+		copy(mem[0x8000:], test.code)
+		read := func(addr uint16) byte { return mem[addr] }
+		got, length := Instruction(read, 0x8000)
+		want := len(test.code)
+		if test.want == "NOP*" && test.code[0] != 0xED {
+			want = 1
+		}
+		if got != test.want || length != want {
+			t.Errorf("% X: got %q, %d bytes, want %q, %d bytes", test.code, got, length, test.want, want)
+		}
+	}
+}
+
+func TestBack(t *testing.T) {
+	// LD A,$3E four times over: from the wrong byte it looks like
+	// LD A,$3E too, so only the alignment with the target tells
+	mem := make([]byte, 0x10000)
+	code := []byte{
+		0x01, 0x00, 0x00, // LD BC,$0000
+		0xDD, 0x21, 0x00, 0x40, // LD IX,$4000
+		0x3E, 0x3E, // LD A,$3E
+		0x3E, 0x3E, // LD A,$3E
+		0xC9, // RET
+	}
+	copy(mem[0x1000:], code)
+	read := func(addr uint16) byte { return mem[addr] }
+	if got := Back(read, 0x100B, 2); got != 0x1007 {
+		t.Errorf("two instructions before the RET start at $%04X, want $1007", got)
+	}
+	if got := Back(read, 0x100B, 4); got != 0x1000 {
+		t.Errorf("four instructions before the RET start at $%04X, want $1000", got)
+	}
+}
@@ -0,0 +1,285 @@
+// Package dsk reads and writes .dsk floppy disk images, the format used
+// for the Spectrum +3 and the Amstrad CPC. Both the original format, where
+// every track has the same size, and the extended one, which can hold
+// unformatted tracks, odd sector sizes and the FDC status of each sector
+// for copy protection, are read; images are always written in the extended
+// format.
+package dsk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Signatures at the start of the two formats. Only the first few bytes
+// are checked, as not every program writes the rest the same way.
+const (
+	StandardSignature = "MV - CPCEMU Disk-File\r\nDisk-Info\r\n"
+	ExtendedSignature = "EXTENDED CPC DSK File\r\nDisk-Info\r\n"
+	trackSignature    = "Track-Info\r\n"
+)
+
+// Sizes of the parts of an image
+const (
+	headerLength    = 0x100
+	trackInfoLength = 0x100
+	sectorInfoStart = 0x18
+	sectorInfoSize  = 8
+	maxSectors      = (trackInfoLength - sectorInfoStart) / sectorInfoSize
+	maxTrackLength  = 0xFF00 // The most a track's size byte can give
+	creatorLength   = 14
+)
+
+// Creator is written into the header of images this package writes
+const Creator = "chips-to-go"
+
+// SectorSize returns the size of a sector with size code n. Codes over 6
+// give the 6K the controller transfers for them, as the .dsk format
+// records.
+func SectorSize(n byte) int {
+	if n > 6 {
+		n = 6
+	}
+	size := 128 << n
+	if size > 0x1800 {
+		size = 0x1800
+	}
+	return size
+}
+
+// Fits reports whether a track formatted with a number of sectors of size
+// code n can be written to a .dsk image
+func Fits(sectors int, n byte) bool {
+	return sectors <= maxSectors && trackInfoLength+sectors*SectorSize(n) <= maxTrackLength
+}
+
+// Sector is one sector of a track
+type Sector struct {
+	C, H, R, N byte // The sector's ID field
+	ST1, ST2   byte // FDC status bits reading the sector sets, for errors and deleted data
+
+	// Data holds the sector's contents. A sector that reads differently
+	// each time (a weak sector) holds several copies one after another.
+	Data []byte
+}
+
+// Copies returns the number of versions of the data a sector holds
+func (s *Sector) Copies() int {
+	size := SectorSize(s.N)
+	if len(s.Data) > size && len(s.Data)%size == 0 {
+		return len(s.Data) / size
+	}
+	return 1
+}
+
+// Track is one formatted track on one side of a disk
+type Track struct {
+	Cylinder, Side byte
+	N              byte // Sector size code the track was formatted with
+	Gap3           byte
+	Filler         byte
+	Sectors        []*Sector
+}
+
+// Disk is a disk image
+type Disk struct {
+	Cylinders int
+	Sides     int
+	tracks    []*Track // Indexed by cylinder*Sides+side, nil if unformatted
+}
+
+// New creates an unformatted disk
+func New(cylinders, sides int) *Disk {
+	return &Disk{
+		Cylinders: cylinders,
+		Sides:     sides,
+		tracks:    make([]*Track, cylinders*sides),
+	}
+}
+
+// Format creates a disk with every track formatted with the given number
+// of sectors, numbered from first, of size code n, and filled with filler
+func Format(cylinders, sides, sectors int, first, n, filler byte) *Disk {
+	d := New(cylinders, sides)
+	for c := range cylinders {
+		for h := range sides {
+			t := &Track{Cylinder: byte(c), Side: byte(h), N: n, Gap3: 0x52, Filler: filler}
+			for i := range sectors {
+				t.Sectors = append(t.Sectors, &Sector{
+					C: byte(c), H: byte(h), R: first + byte(i), N: n,
+					Data: bytes.Repeat([]byte{filler}, SectorSize(n)),
+				})
+			}
+			d.tracks[c*sides+h] = t
+		}
+	}
+	return d
+}
+
+// Track returns the track at a cylinder and side, or nil if it is out of
+// range or unformatted
+func (d *Disk) Track(cylinder, side int) *Track {
+	if cylinder < 0 || cylinder >= d.Cylinders || side < 0 || side >= d.Sides {
+		return nil
+	}
+	return d.tracks[cylinder*d.Sides+side]
+}
+
+// SetTrack replaces the track at a cylinder and side, as formatting does,
+// adding cylinders to the disk if needed. Sides can't be added.
+func (d *Disk) SetTrack(cylinder, side int, t *Track) error {
+	if side < 0 || side >= d.Sides {
+		return fmt.Errorf("disk has no side %d", side)
+	}
+	if cylinder < 0 || cylinder > 0xFF {
+		return fmt.Errorf("cylinder %d is out of range", cylinder)
+	}
+	for d.Cylinders <= cylinder {
+		d.tracks = append(d.tracks, make([]*Track, d.Sides)...)
+		d.Cylinders++
+	}
+	d.tracks[cylinder*d.Sides+side] = t
+	return nil
+}
+
+// Read reads a .dsk image in either format
+func Read(r io.Reader) (*Disk, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerLength {
+		return nil, fmt.Errorf("truncated .dsk header")
+	}
+	var extended bool
+	switch {
+	case strings.HasPrefix(string(data), ExtendedSignature[:8]):
+		extended = true
+	case strings.HasPrefix(string(data), StandardSignature[:8]):
+	default:
+		return nil, fmt.Errorf("not a .dsk image")
+	}
+
+	header := data[:headerLength]
+	d := New(int(header[0x30]), int(header[0x31]))
+	if d.Sides < 1 || d.Sides > 2 {
+		return nil, fmt.Errorf(".dsk image has %d sides", d.Sides)
+	}
+	if extended && d.Cylinders*d.Sides > headerLength-0x34 {
+		return nil, fmt.Errorf(".dsk image has too many tracks: %d", d.Cylinders*d.Sides)
+	}
+
+	offset := headerLength
+	for i := range d.tracks {
+		size := int(binary.LittleEndian.Uint16(header[0x32:]))
+		if extended {
+			size = int(header[0x34+i]) << 8
+		}
+		if size == 0 {
+			continue // Unformatted
+		}
+		if offset+size > len(data) {
+			// Some programs leave off trailing tracks
+			if offset == len(data) {
+				break
+			}
+			return nil, fmt.Errorf("truncated .dsk track %d", i/d.Sides)
+		}
+		t, err := readTrack(data[offset:offset+size], extended)
+		if err != nil {
+			return nil, fmt.Errorf(".dsk track %d: %v", i/d.Sides, err)
+		}
+		d.tracks[i] = t
+		offset += size
+	}
+	return d, nil
+}
+
+// readTrack reads a track information block and the sectors after it
+func readTrack(block []byte, extended bool) (*Track, error) {
+	if len(block) < trackInfoLength || !strings.HasPrefix(string(block), trackSignature[:10]) {
+		return nil, fmt.Errorf("missing track information block")
+	}
+	t := &Track{
+		Cylinder: block[0x10],
+		Side:     block[0x11],
+		N:        block[0x14],
+		Gap3:     block[0x16],
+		Filler:   block[0x17],
+	}
+	count := int(block[0x15])
+	if count > maxSectors {
+		return nil, fmt.Errorf("%d sectors don't fit in the track information", count)
+	}
+
+	offset := trackInfoLength
+	for i := range count {
+		info := block[sectorInfoStart+i*sectorInfoSize:]
+		s := &Sector{C: info[0], H: info[1], R: info[2], N: info[3], ST1: info[4], ST2: info[5]}
+		size := SectorSize(t.N)
+		if extended {
+			size = int(binary.LittleEndian.Uint16(info[6:]))
+		}
+		if offset+size > len(block) {
+			return nil, fmt.Errorf("truncated sector %d", s.R)
+		}
+		s.Data = append([]byte(nil), block[offset:offset+size]...)
+		offset += size
+		t.Sectors = append(t.Sectors, s)
+	}
+	return t, nil
+}
+
+// Write writes a disk as an extended .dsk image
+func Write(w io.Writer, d *Disk) error {
+	if len(d.tracks) > headerLength-0x34 {
+		return fmt.Errorf("too many tracks for a .dsk image: %d", len(d.tracks))
+	}
+	header := make([]byte, headerLength)
+	copy(header, ExtendedSignature)
+	copy(header[len(ExtendedSignature):len(ExtendedSignature)+creatorLength], Creator)
+	header[0x30] = byte(d.Cylinders)
+	header[0x31] = byte(d.Sides)
+
+	var tracks bytes.Buffer
+	for i, t := range d.tracks {
+		if t == nil {
+			continue
+		}
+		if len(t.Sectors) > maxSectors {
+			return fmt.Errorf("track %d has too many sectors for a .dsk image: %d", i/d.Sides, len(t.Sectors))
+		}
+		block := make([]byte, trackInfoLength)
+		copy(block, trackSignature)
+		block[0x10] = t.Cylinder
+		block[0x11] = t.Side
+		block[0x14] = t.N
+		block[0x15] = byte(len(t.Sectors))
+		block[0x16] = t.Gap3
+		block[0x17] = t.Filler
+		for j, s := range t.Sectors {
+			info := block[sectorInfoStart+j*sectorInfoSize:]
+			copy(info, []byte{s.C, s.H, s.R, s.N, s.ST1, s.ST2})
+			binary.LittleEndian.PutUint16(info[6:], uint16(len(s.Data)))
+			block = append(block, s.Data...)
+		}
+		// Tracks are stored in whole 256 byte units
+		for len(block)%0x100 != 0 {
+			block = append(block, 0)
+		}
+		if len(block) > maxTrackLength {
+			return fmt.Errorf("track %d is too long for a .dsk image: %d bytes", i/d.Sides, len(block))
+		}
+		header[0x34+i] = byte(len(block) >> 8)
+		tracks.Write(block)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(tracks.Bytes())
+	return err
+}
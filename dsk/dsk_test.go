@@ -0,0 +1,107 @@
+package dsk
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	d := Format(40, 1, 9, 1, 2, 0xE5)
+	d.Track(0, 0).Sectors[0].Data[0] = 0x42
+	d.Track(3, 0).Sectors[4].ST2 = 0x40
+	// A weak sector and an unformatted track
+	weak := d.Track(5, 0).Sectors[2]
+	weak.Data = append(weak.Data, bytes.Repeat([]byte{0x12}, 512)...)
+	d.tracks[7] = nil
+
+	var buf bytes.Buffer
+	if err := Write(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, d) {
+		t.Error("disk changed writing and reading it")
+	}
+	if n := got.Track(5, 0).Sectors[2].Copies(); n != 2 {
+		t.Errorf("weak sector has %d copies", n)
+	}
+	if got.Track(7, 0) != nil {
+		t.Error("unformatted track was read as formatted")
+	}
+}
+
+func TestReadStandard(t *testing.T) {
+	image := make([]byte, 0x100)
+	copy(image, StandardSignature)
+	image[0x30], image[0x31] = 2, 1
+	image[0x32], image[0x33] = 0x00, 0x03 // 0x100 information and two 256 byte sectors
+	for c := range 2 {
+		track := make([]byte, 0x300)
+		copy(track, trackSignature)
+		track[0x10], track[0x14], track[0x15] = byte(c), 1, 2
+		for i := range 2 {
+			copy(track[0x18+8*i:], []byte{byte(c), 0, byte(0xC1 + i), 1})
+			track[0x100+0x100*i] = byte(c<<4 | i)
+		}
+		image = append(image, track...)
+	}
+
+	d, err := Read(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Cylinders != 2 || d.Sides != 1 {
+		t.Fatalf("read %d cylinders and %d sides", d.Cylinders, d.Sides)
+	}
+	s := d.Track(1, 0).Sectors[1]
+	if s.C != 1 || s.R != 0xC2 || len(s.Data) != 256 || s.Data[0] != 0x11 {
+		t.Errorf("read sector %+v", s)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, Format(2, 1, 9, 1, 2, 0xE5)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, n := range []int{0, 100, 0x180, len(data) - 1} {
+		if _, err := Read(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("read an image cut to %d bytes", n)
+		}
+	}
+	if _, err := Read(bytes.NewReader(make([]byte, 0x200))); err == nil {
+		t.Error("read an image without a signature")
+	}
+}
+
+func TestSetTrack(t *testing.T) {
+	d := New(1, 2)
+	if err := d.SetTrack(2, 1, &Track{Cylinder: 2, Side: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if d.Cylinders != 3 || d.Track(2, 1) == nil || d.Track(2, 0) != nil {
+		t.Errorf("disk has %d cylinders after formatting cylinder 2", d.Cylinders)
+	}
+	if err := d.SetTrack(0, 2, &Track{}); err == nil {
+		t.Error("formatted a third side")
+	}
+}
+
+// TestFits checks Fits agrees with what Write can save
+func TestFits(t *testing.T) {
+	for _, test := range []struct {
+		sectors int
+		n       byte
+	}{{29, 1}, {30, 1}, {9, 2}, {10, 6}, {11, 6}, {18, 3}} {
+		err := Write(io.Discard, Format(1, 1, test.sectors, 1, test.n, 0xE5))
+		if fits := Fits(test.sectors, test.n); fits != (err == nil) {
+			t.Errorf("Fits(%d, %d) = %v, but writing gave %v", test.sectors, test.n, fits, err)
+		}
+	}
+}
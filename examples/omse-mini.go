@@ -5,185 +5,201 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"image"
+	"image/color"
 	"io"
+	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 	"unsafe"
 
-	"github.com/imneme/chips-to-go/z80"
+	"github.com/imneme/chips-to-go/disasm"
+	"github.com/imneme/chips-to-go/joystick"
+	"github.com/imneme/chips-to-go/kbd"
+	"github.com/imneme/chips-to-go/savestate"
+	"github.com/imneme/chips-to-go/spectrum"
 	"github.com/veandco/go-sdl2/sdl"
 )
 
-// Timing constants (all in T-states)
-const (
-	TStatesPerLine  = 224
-	TStatesPerFrame = 69888     // (64+192+56)*224
-	ClockRate       = 3_500_000 // 3.5MHz
-)
-
-// Memory system - implements what's needed for display
-type Memory struct {
-	ram []byte
+// DisplayOptions chooses how the picture is shown in the window
+type DisplayOptions struct {
+	Scale      float64 // Window pixels to a line of the picture, at first
+	Integer    bool    // Scale by whole numbers only when fitting the window
+	Aspect     bool    // Give the picture a TV's 4:3 shape, not square pixels
+	Interlace  bool    // Simulate interlaced fields and phosphor persistence
+	Palette    string  // One of Palettes
+	Filter     string  // One of Filters
+	Fullscreen bool
+	VSync      bool // Wait for the display's refresh to show each picture
 }
 
-func NewMemory() *Memory {
-	mem := &Memory{
-		ram: make([]byte, 0x10000), // 64K of RAM
-	}
-
-	// Create a recognizable pattern in screen memory
-	for y := uint16(0); y < 192; y++ {
-		for x := uint16(0); x < 32; x++ {
-			addr := 0x4000 + (y * 32) + x
-			// Create diagonal stripes
-			if ((x + (y / 8)) & 0x07) != 0 {
-				mem.ram[addr] = 0xAA
-			} else {
-				mem.ram[addr] = 0x55
-			}
-		}
-	}
-
-	// Set attributes to alternate colors
-	for y := uint16(0); y < 24; y++ {
-		for x := uint16(0); x < 32; x++ {
-			attrAddr := 0x5800 + (y * 32) + x
-			// Alternate between cyan on black and yellow on blue
-			if ((x + y) & 1) != 0 {
-				mem.ram[attrAddr] = 0x45
-			} else {
-				mem.ram[attrAddr] = 0x16
-			}
-		}
+// DefaultDisplayOptions shows a TV-shaped picture, twice the size of the
+// Spectrum's, with the interlace simulation on and no filter
+func DefaultDisplayOptions() DisplayOptions {
+	return DisplayOptions{
+		Scale:     2,
+		Aspect:    true,
+		Interlace: true,
+		Palette:   "measured",
+		Filter:    "none",
 	}
-
-	return mem
 }
 
-func (m *Memory) Read(address uint16) byte {
-	return m.ram[address]
+// PixelAspect is the width of a Spectrum pixel over its height on a 4:3
+// TV. The ULA's pixel clock is 7 MHz, a PAL picture has square pixels at
+// 14.75 MHz, and each line of a field is two lines of the picture tall.
+const PixelAspect = 14.75 / 7 / 2
+
+// Palettes holds the colours the picture can be drawn in, the eight normal
+// colours followed by their bright versions: the levels measured from a
+// real machine, or pure RGB with bright colours at full strength and the
+// others at three quarters
+var Palettes = map[string]*[16]uint32{
+	"measured": measuredPalette(),
+	"pure":     purePalette(),
 }
 
-func (m *Memory) Write(address uint16, value byte) {
-	if address < 0x4000 {
-		return // Ignore writes to ROM
+func measuredPalette() *[16]uint32 {
+	var p [16]uint32
+	for i := range p {
+		p[i] = rgba(spectrum.Palette[i].(color.RGBA))
 	}
-	m.ram[address] = value
+	return &p
 }
 
-func (m *Memory) LoadFromFile(filename string, addr uint16, size uint16) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("could not open file: %s: %v", filename, err)
-	}
-	defer file.Close()
-
-	// Get file size
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("could not get file info: %v", err)
-	}
-
-	// Check if we have enough data
-	if fileInfo.Size() < int64(size) {
-		return fmt.Errorf("file too small: need at least %d bytes", size)
+func purePalette() *[16]uint32 {
+	var p [16]uint32
+	for i := range p {
+		level := byte(0xC0)
+		if i >= 8 {
+			level = 0xFF
+		}
+		var c color.RGBA
+		if i&2 != 0 {
+			c.R = level
+		}
+		if i&4 != 0 {
+			c.G = level
+		}
+		if i&1 != 0 {
+			c.B = level
+		}
+		c.A = 0xFF
+		p[i] = rgba(c)
 	}
-
-	return m.LoadFromReader(file, addr, size)
+	return &p
 }
 
-func (m *Memory) LoadFromReader(r io.Reader, addr uint16, size uint16) error {
-	_, err := io.ReadFull(r, m.ram[addr:uint32(addr)+uint32(size)])
-	return err
+// rgba packs a colour as a pixel of the screen texture
+func rgba(c color.RGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
 }
 
 // CRT display using SDL
 type CRT struct {
 	window        *sdl.Window
 	renderer      *sdl.Renderer
-	screenTexture *sdl.Texture
-	pixels        []uint32
+	presenter     Presenter
+	options       DisplayOptions
+	palette       *[16]uint32
+	pixels        []uint32 // The picture, spectrum.TotalWidth wide
+	lines         int      // Lines of the picture, two to a line of the frame when interlacing
 	oddField      bool
 	flashInverted bool
+	panelWidth    int32               // Width of the side panel at the right of the window
+	refresh       time.Duration       // Time between the display's refreshes
+	ulaplus       *spectrum.ULAplus   // The machine's palette extension, if it has one
+	overlay       func(*sdl.Renderer) // Draws over the picture, if set
 }
 
-// CRT constants
-const (
-	TotalWidth     = 352            // 352 pixels
-	Columns        = TotalWidth / 8 // 352/8 columns
-	FieldLines     = 312            // Total PAL lines per field
-	TopBlanking    = 16             // Lines before visible area
-	BottomBlanking = 4              // Lines after visible area
-	VisibleLines   = FieldLines - TopBlanking - BottomBlanking
-	CRTLines       = VisibleLines * 2 // Two fields
-)
+// CRTLines is the height of the interlaced picture, two fields
+const CRTLines = spectrum.VisibleLines * 2
 
-// RGBA color table
-var rgbaColorTable = []uint32{
-	0x00000000, // Black
-	0x0000FFFF, // Blue
-	0xFF000000, // Red
-	0xFF00FFFF, // Magenta
-	0x00FF0000, // Green
-	0x00FFFFFF, // Cyan
-	0xFFFF0000, // Yellow
-	0xFFFFFFFF, // White
-}
+// DefaultRefreshRate is the display's refresh rate, in Hz, when SDL can't
+// tell
+const DefaultRefreshRate = 60
+
+func NewCRT(options DisplayOptions) (*CRT, error) {
+	palette, ok := Palettes[options.Palette]
+	if !ok {
+		return nil, fmt.Errorf("unknown palette %q", options.Palette)
+	}
+	filter, ok := Filters[options.Filter]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter %q", options.Filter)
+	}
+	if options.Scale <= 0 {
+		return nil, fmt.Errorf("bad scale %g", options.Scale)
+	}
 
-func NewCRT() (*CRT, error) {
 	if err := sdl.Init(sdl.INIT_VIDEO); err != nil {
 		return nil, fmt.Errorf("SDL initialization failed: %v", err)
 	}
 
-	// Scale up 2x for better visibility
+	c := &CRT{
+		options: options,
+		palette: palette,
+		lines:   spectrum.VisibleLines,
+	}
+	if options.Interlace {
+		c.lines = CRTLines
+	}
+	c.pixels = make([]uint32, spectrum.TotalWidth*c.lines)
+	if filter == nil {
+		c.presenter = &scaledPresenter{}
+	} else {
+		c.presenter = &filterPresenter{filter: filter}
+	}
+
+	var flags uint32 = sdl.WINDOW_SHOWN | sdl.WINDOW_RESIZABLE
+	if options.Fullscreen {
+		flags |= sdl.WINDOW_FULLSCREEN_DESKTOP
+	}
+	width, height := c.pictureSize(options.Scale)
 	window, err := sdl.CreateWindow(
 		"OMSE — One More Spectrum Emulator (Go Port)",
 		sdl.WINDOWPOS_CENTERED,
 		sdl.WINDOWPOS_CENTERED,
-		TotalWidth*2,
-		CRTLines,
-		sdl.WINDOW_SHOWN,
+		width,
+		height,
+		flags,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("window creation failed: %v", err)
 	}
+	c.window = window
 
-	renderer, err := sdl.CreateRenderer(window, -1, sdl.RENDERER_ACCELERATED)
+	var rendererFlags uint32 = sdl.RENDERER_ACCELERATED
+	if options.VSync {
+		rendererFlags |= sdl.RENDERER_PRESENTVSYNC
+	}
+	renderer, err := sdl.CreateRenderer(window, -1, rendererFlags)
 	if err != nil {
 		window.Destroy()
 		return nil, fmt.Errorf("renderer creation failed: %v", err)
 	}
+	c.renderer = renderer
 
-	screenTexture, err := renderer.CreateTexture(
-		sdl.PIXELFORMAT_RGBA8888,
-		sdl.TEXTUREACCESS_STREAMING,
-		TotalWidth,
-		CRTLines,
-	)
-	if err != nil {
-		renderer.Destroy()
-		window.Destroy()
-		return nil, fmt.Errorf("texture creation failed: %v", err)
+	// Showing pictures faster than the display refreshes is wasted work
+	c.refresh = time.Second / DefaultRefreshRate
+	if index, err := window.GetDisplayIndex(); err == nil {
+		if mode, err := sdl.GetCurrentDisplayMode(index); err == nil && mode.RefreshRate > 0 {
+			c.refresh = time.Second / time.Duration(mode.RefreshRate)
+		}
 	}
-
-	// Set up 2x scaling horizontally, 1x vertically
-	renderer.SetScale(2.0, 1.0)
-
-	return &CRT{
-		window:        window,
-		renderer:      renderer,
-		screenTexture: screenTexture,
-		pixels:        make([]uint32, TotalWidth*CRTLines),
-		oddField:      false,
-		flashInverted: false,
-	}, nil
+	return c, nil
 }
 
 func (c *CRT) Close() {
-	if c.screenTexture != nil {
-		c.screenTexture.Destroy()
+	if c.presenter != nil {
+		c.presenter.Destroy()
 	}
 	if c.renderer != nil {
 		c.renderer.Destroy()
@@ -194,18 +210,106 @@ func (c *CRT) Close() {
 	sdl.Quit()
 }
 
+// pictureSize returns the size of the picture at a scale
+func (c *CRT) pictureSize(scale float64) (width, height int32) {
+	aspect := 1.0
+	if c.options.Aspect {
+		aspect = PixelAspect
+	}
+	return int32(spectrum.TotalWidth*aspect*scale + 0.5), int32(spectrum.VisibleLines*scale + 0.5)
+}
+
+// pictureRect returns where the picture goes: as large as fits in the
+// window beside the side panel, keeping its shape, and centred
+func (c *CRT) pictureRect() sdl.Rect {
+	width, height, _ := c.renderer.GetOutputSize()
+	width -= c.panelWidth
+	w, h := c.pictureSize(1)
+	scale := min(float64(width)/float64(w), float64(height)/float64(h))
+	if c.options.Integer && scale >= 1 {
+		scale = math.Floor(scale)
+	}
+	w, h = c.pictureSize(scale)
+	return sdl.Rect{X: (width - w) / 2, Y: (height - h) / 2, W: w, H: h}
+}
+
+// SetPanel makes room for a panel of the given width at the right of the
+// window, or takes it away for zero, keeping the picture the same size
+// unless the window fills the screen. The panel is at least minHeight
+// tall.
+func (c *CRT) SetPanel(width, minHeight int32) {
+	if c.window.GetFlags()&sdl.WINDOW_FULLSCREEN_DESKTOP == 0 {
+		w, h := c.window.GetSize()
+		c.window.SetSize(w-c.panelWidth+width, max(h, minHeight))
+	}
+	c.panelWidth = width
+}
+
+// PanelLeft returns where the side panel starts
+func (c *CRT) PanelLeft() int32 {
+	width, _, _ := c.renderer.GetOutputSize()
+	return width - c.panelWidth
+}
+
+// ToggleFullscreen switches between a window and the whole screen
+func (c *CRT) ToggleFullscreen() {
+	if c.window.GetFlags()&sdl.WINDOW_FULLSCREEN_DESKTOP != 0 {
+		c.window.SetFullscreen(0)
+	} else {
+		c.window.SetFullscreen(sdl.WINDOW_FULLSCREEN_DESKTOP)
+	}
+}
+
 // UpdatePixels updates a group of 8 pixels at the specified location
 func (c *CRT) UpdatePixels(line uint32, column uint32, displayByte byte, attrByte byte) {
 	// Assertions/bounds checking
-	if line >= FieldLines || column >= Columns {
+	if line >= spectrum.FieldLines || column >= spectrum.Columns {
 		return
 	}
 
 	// Ignore updates in blanking intervals
-	if line < TopBlanking || line >= (TopBlanking+VisibleLines) {
+	if line < spectrum.TopBlanking || line >= (spectrum.TopBlanking+spectrum.VisibleLines) {
+		return
+	}
+	line -= spectrum.TopBlanking // Adjust for top blanking
+
+	// Convert attribute byte
+	flash := (attrByte & 0x80) != 0
+	bright := (attrByte & 0x40) != 0
+	paper := (attrByte >> 3) & 0x07
+	ink := attrByte & 0x07
+	if bright {
+		paper += 8
+		ink += 8
+	}
+
+	if flash && c.flashInverted && (c.ulaplus == nil || !c.ulaplus.Enabled) {
+		// Swap paper and ink
+		paper, ink = ink, paper
+	}
+
+	// Create RGB colors
+	paperColor := c.palette[paper]
+	inkColor := c.palette[ink]
+	if c.ulaplus != nil && c.ulaplus.Enabled {
+		// The palette replaces FLASH and BRIGHT
+		inkEntry, paperEntry := c.ulaplus.Entries(line+spectrum.TopBlanking, column, attrByte)
+		inkColor = rgba(c.ulaplus.Color(inkEntry))
+		paperColor = rgba(c.ulaplus.Color(paperEntry))
+		bright = false
+	}
+
+	if !c.options.Interlace {
+		offset := line*spectrum.TotalWidth + column*8
+		for bit := range uint32(8) {
+			if displayByte&(0x80>>bit) != 0 {
+				c.pixels[offset+bit] = inkColor
+			} else {
+				c.pixels[offset+bit] = paperColor
+			}
+		}
 		return
 	}
-	line -= TopBlanking // Adjust for top blanking
 
 	// Interlace fields
 	var interlacedLine uint32
@@ -216,31 +320,16 @@ func (c *CRT) UpdatePixels(line uint32, column uint32, displayByte byte, attrByt
 	}
 
 	// Update 8 pixels at once
-	offset := (interlacedLine * TotalWidth) + (column * 8)
+	offset := (interlacedLine * spectrum.TotalWidth) + (column * 8)
 
 	// To bleed into the other line
 	var bleedOffset uint32
 	if c.oddField {
-		bleedOffset = offset - TotalWidth
+		bleedOffset = offset - spectrum.TotalWidth
 	} else {
-		bleedOffset = offset + TotalWidth
-	}
-
-	// Convert attribute byte
-	flash := (attrByte & 0x80) != 0
-	bright := (attrByte & 0x40) != 0
-	paper := (attrByte >> 3) & 0x07
-	ink := attrByte & 0x07
-
-	if flash && c.flashInverted {
-		// Swap paper and ink
-		paper, ink = ink, paper
+		bleedOffset = offset + spectrum.TotalWidth
 	}
 
-	// Create RGB colors
-	paperColor := rgbaColorTable[paper]
-	inkColor := rgbaColorTable[ink]
-
 	// Update 8 pixels - note MSB is leftmost pixel
 	for bit := 7; bit >= 0; bit-- {
 		pixelSet := (displayByte & (1 << bit)) != 0
@@ -265,544 +354,2068 @@ func (c *CRT) UpdatePixels(line uint32, column uint32, displayByte byte, attrByt
 	}
 }
 
-func (c *CRT) Refresh() {
-	c.screenTexture.Update(nil, unsafe.Pointer(&c.pixels[0]), TotalWidth*4)
+// Refresh draws the picture in the window, with the overlay over it
+func (c *CRT) Refresh() error {
+	c.renderer.SetDrawColor(0, 0, 0, 0xFF)
 	c.renderer.Clear()
-	c.renderer.Copy(c.screenTexture, nil, nil)
+	if err := c.presenter.Present(c.renderer, c.pixels, spectrum.TotalWidth, c.lines, c.pictureRect()); err != nil {
+		return err
+	}
+	if c.overlay != nil {
+		c.overlay(c.renderer)
+	}
 	c.renderer.Present()
+	return nil
+}
+
+// SetULAplus draws with the colours of the machine's ULAplus whenever its
+// palette is on
+func (c *CRT) SetULAplus(p *spectrum.ULAplus) {
+	c.ulaplus = p
 }
 
 func (c *CRT) ToggleFlash() {
 	c.flashInverted = !c.flashInverted
 }
 
-// IODevice interface for devices that support read and write
-type IODevice interface {
-	Read(addr uint16) byte
-	Write(addr uint16, value byte)
+// EndFrame does nothing; Run presents the picture with Refresh at its own
+// pace
+func (c *CRT) EndFrame() {}
+
+// Presenter draws the picture, a slice of pixels width by height, into a
+// rectangle of the window
+type Presenter interface {
+	Present(r *sdl.Renderer, picture []uint32, width, height int, dst sdl.Rect) error
+	Destroy()
 }
 
-// IODeviceBus for I/O devices
-type IODeviceBus struct {
-	devices map[uint16]IODevice // mask -> device
+// scaledPresenter leaves the scaling to the renderer
+type scaledPresenter struct {
+	texture       *sdl.Texture
+	width, height int
 }
 
-func NewIODeviceBus() *IODeviceBus {
-	return &IODeviceBus{
-		devices: make(map[uint16]IODevice),
+func (p *scaledPresenter) Present(r *sdl.Renderer, picture []uint32, width, height int, dst sdl.Rect) error {
+	if p.texture == nil || p.width != width || p.height != height {
+		p.Destroy()
+		texture, err := r.CreateTexture(sdl.PIXELFORMAT_RGBA8888, sdl.TEXTUREACCESS_STREAMING,
+			int32(width), int32(height))
+		if err != nil {
+			return fmt.Errorf("texture creation failed: %v", err)
+		}
+		p.texture, p.width, p.height = texture, width, height
 	}
+	p.texture.Update(nil, unsafe.Pointer(&picture[0]), width*4)
+	return r.Copy(p.texture, nil, &dst)
 }
 
-func (b *IODeviceBus) AddDevice(mask uint16, device IODevice) {
-	b.devices[mask] = device
+func (p *scaledPresenter) Destroy() {
+	if p.texture != nil {
+		p.texture.Destroy()
+		p.texture = nil
+	}
 }
 
-func (b *IODeviceBus) Read(addr uint16) byte {
-	for mask, device := range b.devices {
-		if ((^addr) & mask) == mask {
-			return device.Read(addr)
-		}
-	}
-	return 0xff // Default to all bits set
+// Filter darkens a pixel of the scaled up picture the way the tube of a TV
+// would. It is given the column of the window the pixel is in, and how far
+// down the line of the frame it is, from 0 at the top to 1 at the bottom.
+type Filter func(pixel uint32, x int, within float64) uint32
+
+// Filters are done on the CPU as the picture is scaled up. "none" leaves
+// the scaling to the renderer.
+var Filters = map[string]Filter{
+	"none":      nil,
+	"scanlines": scanlines,
+	"mask":      shadowMask,
+	"tv": func(pixel uint32, x int, within float64) uint32 {
+		return shadowMask(scanlines(pixel, x, within), x, within)
+	},
 }
 
-func (b *IODeviceBus) Write(addr uint16, value byte) {
-	for mask, device := range b.devices {
-		if ((^addr) & mask) == mask {
-			device.Write(addr, value)
-			return
-		}
+// scanlines darkens the bottom of each line, leaving gaps between them as
+// the beam of a TV does
+func scanlines(pixel uint32, x int, within float64) uint32 {
+	if within < 0.6 {
+		return pixel
 	}
+	return pixel>>1&0x7F7F7F7F | 0xFF
 }
 
-// CPU implementation using our Z80 wrapper
-type CPU struct {
-	*z80.CPU      // Embed our Z80 CPU implementation
-	memory        *Memory
-	bus           *IODeviceBus
-	interruptFlag bool
-	pins          uint64
+// shadowMask lets red, green and blue through in turn, one to a column,
+// dimming the other two
+func shadowMask(pixel uint32, x int, within float64) uint32 {
+	keep := [3]uint32{0xFF000000, 0x00FF0000, 0x0000FF00}[x%3]
+	return pixel&keep | (pixel>>2&0x3F3F3F3F)*3&^keep | 0xFF
 }
 
-func NewCPU(memory *Memory, bus *IODeviceBus) *CPU {
-	z80cpu, pins := z80.New()
-	return &CPU{
-		CPU:    z80cpu,
-		memory: memory,
-		bus:    bus,
-		pins:   pins, // Store initial pin state
-	}
+// filterPresenter scales the picture up itself, filtering it as it goes
+type filterPresenter struct {
+	filter  Filter
+	texture *sdl.Texture
+	size    sdl.Rect
+	pixels  []uint32
+	columns []int // Column of the picture for each column of the window
 }
 
-func (c *CPU) Tick() {
-	// Update pin state with any pending interrupt
-	if c.interruptFlag {
-		c.pins |= z80.INT
-	} else {
-		c.pins &= ^z80.INT
-	}
-
-	// Perform one Z80 tick
-	c.pins = c.CPU.Tick(c.pins)
-
-	// Process memory and I/O transactions
-	c.transact()
-}
-
-func (c *CPU) transact() {
-	// Handle memory access
-	if c.pins&z80.MREQ != 0 {
-		addr := z80.GetAddr(c.pins)
-		if c.pins&z80.RD != 0 {
-			// Memory read
-			data := c.memory.Read(addr)
-			z80.SetData(&c.pins, data)
-		} else if c.pins&z80.WR != 0 {
-			// Memory write
-			data := z80.GetData(c.pins)
-			c.memory.Write(addr, data)
-		}
-	} else if c.pins&z80.IORQ != 0 {
-		// I/O access
-		if c.pins&z80.M1 != 0 {
-			// Interrupt acknowledge
-			z80.SetData(&c.pins, 0xFF)
-		} else {
-			addr := z80.GetAddr(c.pins)
-			if c.pins&z80.RD != 0 {
-				// IO read
-				data := c.bus.Read(addr)
-				z80.SetData(&c.pins, data)
-			} else if c.pins&z80.WR != 0 {
-				// IO write
-				data := z80.GetData(c.pins)
-				c.bus.Write(addr, data)
-			}
+func (p *filterPresenter) Present(r *sdl.Renderer, picture []uint32, width, height int, dst sdl.Rect) error {
+	if dst.W <= 0 || dst.H <= 0 {
+		return nil
+	}
+	if p.texture == nil || p.size.W != dst.W || p.size.H != dst.H {
+		p.Destroy()
+		texture, err := r.CreateTexture(sdl.PIXELFORMAT_RGBA8888, sdl.TEXTUREACCESS_STREAMING, dst.W, dst.H)
+		if err != nil {
+			return fmt.Errorf("texture creation failed: %v", err)
+		}
+		p.texture, p.size = texture, dst
+		p.pixels = make([]uint32, dst.W*dst.H)
+		p.columns = make([]int, dst.W)
+		for x := range p.columns {
+			p.columns[x] = x * width / int(dst.W)
 		}
 	}
-}
 
-func (c *CPU) SetInterrupt(status bool) {
-	c.interruptFlag = status
+	w, h := int(dst.W), int(dst.H)
+	for y := range h {
+		row := picture[y*height/h*width:]
+		within := float64(y) * spectrum.VisibleLines / float64(h)
+		within -= math.Floor(within)
+		out := p.pixels[y*w : (y+1)*w]
+		for x := range out {
+			out[x] = p.filter(row[p.columns[x]], x, within)
+		}
+	}
+	p.texture.Update(nil, unsafe.Pointer(&p.pixels[0]), w*4)
+	return r.Copy(p.texture, nil, &dst)
 }
 
-func (c *CPU) SetPC(addr uint16) {
-	c.pins = c.CPU.Prefetch(addr)
+func (p *filterPresenter) Destroy() {
+	if p.texture != nil {
+		p.texture.Destroy()
+		p.texture = nil
+	}
 }
 
-// ULA (Uncommitted Logic Array) - the Spectrum's custom chip
-type ULA struct {
-	memory       *Memory
-	crt          *CRT
-	cpu          *CPU
-	borderColor  byte
-	flashFlipper byte
-
-	// Current position tracking
-	line          uint32 // Current scanline (0-311)
-	lineCycle     uint32 // Current cycle within line (0-223)
-	currentColumn uint32
+// Audio output using SDL
+type Audio struct {
+	device     sdl.AudioDeviceID
+	sampleRate int
 }
 
+// Audio constants
 const (
-	ScreenStartLine    = 64
-	ScreenStartColumn  = 6 // 48 pixels / 8
-	ScreenWidthBytes   = 32
-	ScreenHeight       = 192
-	BorderTStates      = ScreenStartColumn * 4
-	ScreenWidthTStates = ScreenWidthBytes * 4
-	FlashRate          = 16
-	InterruptDuration  = 32
+	SampleRate    = 48000            // Preferred rate, the device may choose another
+	AudioLatency  = 2048             // Samples kept queued when audio is the master clock
+	MaxAudioQueue = 4 * AudioLatency // Beyond this, sound is dropped to catch up
 )
 
-func NewULA(memory *Memory, cpu *CPU, crt *CRT) *ULA {
-	return &ULA{
-		memory:        memory,
-		crt:           crt,
-		cpu:           cpu,
-		borderColor:   0,
-		flashFlipper:  FlashRate,
-		line:          0,
-		lineCycle:     BorderTStates,
-		currentColumn: 0,
+func NewAudio() (*Audio, error) {
+	if err := sdl.InitSubSystem(sdl.INIT_AUDIO); err != nil {
+		return nil, fmt.Errorf("SDL audio initialization failed: %v", err)
 	}
-}
-
-// Read and write to I/O ports
-func (u *ULA) Read(addr uint16) byte {
-	return 0xff
-}
-
-func (u *ULA) Write(addr uint16, value byte) {
-	u.SetBorderColor(value)
-}
-
-func (u *ULA) Tick() {
-	u.cpu.Tick()
-
-	// Check if we're in the visible (non-blanking) area
-	visible := (u.line >= TopBlanking) && (u.line < (FieldLines - BottomBlanking))
-
-	if visible && u.lineCycle < (Columns*4) {
-		// Every 4 cycles we output 8 pixels
-		inScreenLine := (u.line >= ScreenStartLine) && (u.line < (ScreenStartLine + ScreenHeight))
 
-		if u.lineCycle%4 == 0 {
-			u.currentColumn = u.lineCycle / 4
-			inScreenCol := (u.currentColumn >= ScreenStartColumn) &&
-				(u.currentColumn < (ScreenStartColumn + ScreenWidthBytes))
-
-			if inScreenLine && inScreenCol {
-				// We're in the actual screen area - fetch and display pixels
-				screenLine := u.line - ScreenStartLine
-				screenCol := u.currentColumn - ScreenStartColumn
-
-				addr := u.calculateDisplayAddress(screenLine, screenCol)
-				displayByte := u.memory.Read(addr)
-				attrByte := u.memory.Read(u.calculateAttrAddress(screenLine, screenCol))
-
-				u.crt.UpdatePixels(u.line, u.currentColumn, displayByte, attrByte)
-			} else {
-				// Border area
-				borderAttr := (u.borderColor << 3)
-				u.crt.UpdatePixels(u.line, u.currentColumn, 0x00, borderAttr)
-			}
-		}
+	desired := sdl.AudioSpec{
+		Freq:     SampleRate,
+		Format:   sdl.AUDIO_F32SYS,
+		Channels: 1,
+		Samples:  512,
 	}
-
-	// Update position counters
-	u.lineCycle++
-	if u.line == 0 && u.lineCycle == BorderTStates {
-		u.cpu.SetInterrupt(true)
-	} else if u.line == 0 && u.lineCycle == BorderTStates+InterruptDuration {
-		u.cpu.SetInterrupt(false)
+	var obtained sdl.AudioSpec
+	device, err := sdl.OpenAudioDevice("", false, &desired, &obtained, sdl.AUDIO_ALLOW_FREQUENCY_CHANGE)
+	if err != nil {
+		sdl.QuitSubSystem(sdl.INIT_AUDIO)
+		return nil, fmt.Errorf("audio device creation failed: %v", err)
 	}
+	sdl.PauseAudioDevice(device, false)
 
-	if u.lineCycle >= TStatesPerLine {
-		u.lineCycle = 0
-		u.line++
-		if u.line >= FieldLines {
-			u.line = 0
-			u.flashFlipper--
-			if u.flashFlipper == 0 {
-				u.flashFlipper = FlashRate
-				u.crt.ToggleFlash()
-			}
-		}
-	}
+	return &Audio{
+		device:     device,
+		sampleRate: int(obtained.Freq),
+	}, nil
 }
 
-func (u *ULA) SetBorderColor(color byte) {
-	u.borderColor = color & 0x07
+func (a *Audio) Close() {
+	sdl.CloseAudioDevice(a.device)
+	sdl.QuitSubSystem(sdl.INIT_AUDIO)
 }
 
-func (u *ULA) GetBorderColor() byte {
-	return u.borderColor
+// Queue sends samples to the sound card
+func (a *Audio) Queue(samples []float32) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&samples[0])), len(samples)*4)
+	return sdl.QueueAudio(a.device, data)
 }
 
-func (u *ULA) calculateDisplayAddress(line, col uint32) uint16 {
-	// Start of screen memory
-	addr := uint16(0x4000)
-
-	// Add Y portion
-	addr |= uint16((line & 0xC0) << 5) // Which third of the screen
-	addr |= uint16((line & 0x07) << 8) // Which character cell row
-	addr |= uint16((line & 0x38) << 2) // Remaining bits wherever
+// Clear throws away the samples the sound card has yet to play
+func (a *Audio) Clear() {
+	sdl.ClearQueuedAudio(a.device)
+}
 
-	// Add X portion
-	addr |= uint16(col & 0b00011111) // 5 bits of X go to bits 0-4
+// Queued returns the number of samples the sound card has yet to play
+func (a *Audio) Queued() int {
+	return int(sdl.GetQueuedAudioSize(a.device) / 4)
+}
 
-	return addr
+// WaitForQueue blocks until no more than samples are left to play
+func (a *Audio) WaitForQueue(samples int) {
+	for a.Queued() > samples {
+		sdl.Delay(1)
+	}
 }
 
-func (u *ULA) calculateAttrAddress(line, col uint32) uint16 {
-	return 0x5800 + uint16((line>>3)*32) + uint16(col)
+// sdlKeyToSpectrum maps a host key to the Spectrum key it stands for.
+// Shift is CAPS SHIFT and Ctrl is SYMBOL SHIFT, so the host keyboard
+// behaves like the Spectrum's own; a few host keys press a combination.
+func sdlKeyToSpectrum(sym sdl.Keycode) (kbd.Key, bool) {
+	switch {
+	case sym >= sdl.K_a && sym <= sdl.K_z, sym >= sdl.K_0 && sym <= sdl.K_9:
+		// SDL uses lower case ASCII for these
+		return kbd.Key(sym), true
+	}
+	switch sym {
+	case sdl.K_SPACE:
+		return spectrum.KeySpace, true
+	case sdl.K_RETURN, sdl.K_KP_ENTER:
+		return spectrum.KeyEnter, true
+	case sdl.K_LSHIFT, sdl.K_RSHIFT:
+		return spectrum.KeyCapsShift, true
+	case sdl.K_LCTRL, sdl.K_RCTRL:
+		return spectrum.KeySymbolShift, true
+	case sdl.K_BACKSPACE:
+		return spectrum.KeyDelete, true
+	case sdl.K_ESCAPE:
+		return spectrum.KeyBreak, true
+	case sdl.K_LEFT:
+		return spectrum.KeyLeft, true
+	case sdl.K_RIGHT:
+		return spectrum.KeyRight, true
+	case sdl.K_UP:
+		return spectrum.KeyUp, true
+	case sdl.K_DOWN:
+		return spectrum.KeyDown, true
+	case sdl.K_COMMA, sdl.K_PERIOD, sdl.K_SLASH, sdl.K_SEMICOLON,
+		sdl.K_QUOTE, sdl.K_MINUS, sdl.K_EQUALS:
+		// Same ASCII character, typed with SYMBOL SHIFT
+		return kbd.Key(sym), true
+	}
+	return 0, false
 }
 
-// System combines all components
+// System is a Spectrum with a window, sound and game controllers, or
+// headless with only a framebuffer
 type System struct {
-	memory        *Memory
-	bus           *IODeviceBus
-	crt           *CRT
-	cpu           *CPU
-	ula           *ULA
-	currentTState uint64
+	*spectrum.Machine
+	crt          *CRT                            // nil when headless
+	framebuffer  *spectrum.Framebuffer           // A copy of the picture, for screenshots
+	audio        *Audio                          // nil if there is no sound card
+	joystickKeys map[sdl.Keycode]joystick.Button // Host keys that work the first joystick
+	keyButtons   joystick.Button                 // Switches closed by those keys
+	hostButtons  [2]joystick.Button              // Switches closed by host input, per player
+	controllers  map[sdl.JoystickID]*controller
+	replaying    bool    // An RZX replay hasn't been reported finished
+	speed        float64 // 1 for the real speed
+	warp         bool    // Run as fast as possible, whatever the speed
+	autoWarp     bool    // Run as fast as possible while the tape plays
+	sync         Sync
+	speedometer  Speedometer
+	slots        *savestate.Store // nil until UseSlotsFor
+	media        []string         // Files loaded, for the slots' info
+	slot         int              // Slot F2 saves to and F3 loads from
+	browser      SlotBrowser
+	debugger     Debugger
 }
 
 const (
-	ChunkSize = 13 * 8 * 224 // Execute this many T-states at once
+	ChunkSize             = 13 * 8 * 224           // Execute this many T-states at once
+	DefaultHeadlessFrames = 250                    // Five seconds
+	RewindFrames          = 50                     // F9 goes back a second
+	MaxLag                = 100 * time.Millisecond // Falling further behind than this isn't caught up
+)
+
+// Sync is what keeps the machine running at its speed
+type Sync int
+
+const (
+	SyncAudio Sync = iota // Keep the sound card's queue short
+	SyncVsync             // Run whole frames between the display's refreshes
+	SyncTimer             // Sleep until the clock catches up
 )
 
-func NewSystem() (*System, error) {
-	memory := NewMemory()
-	bus := NewIODeviceBus()
+// Syncs are the ways of keeping time, by name. Only sound played at the
+// real speed can keep time, so otherwise SyncAudio falls back on the
+// timer.
+var Syncs = map[string]Sync{
+	"audio": SyncAudio,
+	"vsync": SyncVsync,
+	"timer": SyncTimer,
+}
+
+// SpeedSteps are the speeds Alt+Plus and Alt+Minus step through, as
+// multiples of the real speed
+var SpeedSteps = []float64{0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10}
+
+// NewSystem creates a Spectrum in a window, or without one if headless.
+// A headless Spectrum never touches SDL, and ignores the display and
+// sound options.
+func NewSystem(o *Options) (*System, error) {
+	s := &System{
+		framebuffer:  spectrum.NewFramebuffer(),
+		joystickKeys: DefaultJoystickKeys(),
+		controllers:  make(map[sdl.JoystickID]*controller),
+		speed:        o.Speed,
+		autoWarp:     o.AutoWarp,
+		sync:         o.Sync,
+		slot:         1,
+	}
+	if o.Speed == 0 {
+		s.speed = 1
+		s.warp = true
+	}
+	s.speedometer.visible = o.ShowSpeed
+	if o.Headless {
+		s.Machine = spectrum.NewMachine(o.Model, s.framebuffer, SampleRate)
+		if o.ULAplus {
+			s.AddULAplus()
+		}
+		return s, nil
+	}
 
-	crt, err := NewCRT()
+	crt, err := NewCRT(o.Display)
 	if err != nil {
 		return nil, err
 	}
+	s.crt = crt
 
-	cpu := NewCPU(memory, bus)
-	ula := NewULA(memory, cpu, crt)
+	// Without a sound card, keep going silently. The machine makes sound
+	// either way, for recordings.
+	sampleRate := SampleRate
+	if o.Sound {
+		audio, err := NewAudio()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v, continuing without sound\n", err)
+		} else {
+			s.audio = audio
+			sampleRate = audio.sampleRate
+		}
+	}
 
-	// Initialize subsystems
-	bus.AddDevice(0x0001, ula)
+	// Game controllers are optional
+	if err := sdl.InitSubSystem(sdl.INIT_GAMECONTROLLER); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v, continuing without game controllers\n", err)
+	}
 
-	return &System{
-		memory:        memory,
-		bus:           bus,
-		crt:           crt,
-		cpu:           cpu,
-		ula:           ula,
-		currentTState: 0,
-	}, nil
+	s.Machine = spectrum.NewMachine(o.Model, spectrum.MultiDisplay(crt, s.framebuffer), sampleRate)
+	if o.ULAplus {
+		s.AddULAplus()
+	}
+	s.debugger.selected = -1
+	crt.overlay = s.drawOverlay
+	s.EnableRewind(spectrum.DefaultRewindInterval, spectrum.DefaultRewindPoints)
+	return s, nil
 }
 
 func (s *System) Close() {
-	s.crt.Close()
+	if err := s.Machine.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	for id, c := range s.controllers {
+		c.Close()
+		delete(s.controllers, id)
+	}
+	if s.audio != nil {
+		s.audio.Close()
+	}
+	if s.crt != nil {
+		s.browser.clear()
+		s.crt.Close()
+	}
 }
 
-func (s *System) Run() error {
-	quit := false
-
-	// Track both virtual and real time
-	startTime := time.Now()
-	nextRefreshTState := s.currentTState
-
-	for !quit {
-		// Handle SDL events
-		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
-			switch event.(type) {
-			case *sdl.QuitEvent:
-				quit = true
-			}
+func (s *System) handleKeyEvent(event *sdl.KeyboardEvent) {
+	if event.Repeat != 0 {
+		return
+	}
+	if event.Type == sdl.KEYDOWN {
+		if event.Keysym.Sym == sdl.K_RETURN && event.Keysym.Mod&sdl.KMOD_ALT != 0 {
+			s.crt.ToggleFullscreen()
+			return
 		}
-
-		// Process a chunk of cycles
-		targetTState := s.currentTState + ChunkSize
-		for s.currentTState < targetTState {
-			s.ula.Tick()
-			s.currentTState++
+		if event.Keysym.Mod&sdl.KMOD_ALT != 0 && s.handleSpeedKey(event.Keysym.Sym) {
+			return
 		}
-
-		// Check if we need to refresh the display
-		if s.currentTState >= nextRefreshTState {
-			s.crt.Refresh()
-			nextRefreshTState += TStatesPerFrame
+		if s.handleDebugKey(event.Keysym.Sym) {
+			return
 		}
-
-		// Sleep if we're ahead
-		elapsedTime := time.Since(startTime)
-		expectedTime := time.Duration(s.currentTState*1000000/ClockRate) * time.Microsecond
-
-		if expectedTime > elapsedTime {
-			aheadBy := expectedTime - elapsedTime
-			if aheadBy.Milliseconds() > 1 {
-				time.Sleep(aheadBy - time.Millisecond)
+		if s.browser.visible {
+			s.handleBrowserKey(event.Keysym.Sym)
+			return
+		}
+		switch event.Keysym.Sym {
+		case sdl.K_F1:
+			s.toggleSlotBrowser()
+			return
+		case sdl.K_F2:
+			s.quickSave()
+			return
+		case sdl.K_F3:
+			s.quickLoad()
+			return
+		case sdl.K_F4:
+			s.slot = s.slot%SlotCount + 1
+			fmt.Printf("Slot %d\n", s.slot)
+			return
+		case sdl.K_F5:
+			s.cycleJoystick(0)
+			return
+		case sdl.K_F6:
+			s.cycleJoystick(1)
+			return
+		case sdl.K_F7:
+			s.toggleRecording()
+			return
+		case sdl.K_F8:
+			s.toggleRZXRecording()
+			return
+		case sdl.K_F9:
+			if _, err := s.Rewind(RewindFrames); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			}
+			return
 		}
 	}
-
-	return nil
+	if button, ok := s.joystickKeys[event.Keysym.Sym]; ok && s.Joystick(0).Interface != joystick.None {
+		if event.Type == sdl.KEYDOWN {
+			s.keyButtons |= button
+		} else {
+			s.keyButtons &^= button
+		}
+		s.updateJoystick(0)
+		return
+	}
+	key, ok := sdlKeyToSpectrum(event.Keysym.Sym)
+	if !ok {
+		return
+	}
+	if event.Type == sdl.KEYDOWN {
+		s.KeyDown(key)
+	} else {
+		s.KeyUp(key)
+	}
 }
 
-func (s *System) LoadSNA(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("could not open file: %s: %v", filename, err)
+// toggleRecording starts recording a GIF named for the time, or stops the
+// recording in progress
+func (s *System) toggleRecording() {
+	if filename := s.Recording(); filename != "" {
+		if err := s.StopRecording(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Recorded %s\n", filename)
+		return
 	}
-	defer file.Close()
-
-	readByte := func() (byte, error) {
-		var b [1]byte
-		_, err := file.Read(b[:])
-		return b[0], err
+	filename := time.Now().Format("omse-20060102-150405.gif")
+	if err := s.StartRecording(filename); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
 	}
+	fmt.Printf("Recording %s\n", filename)
+}
 
-	readWord := func() (uint16, error) {
-		var b [2]byte
-		_, err := file.Read(b[:])
-		return uint16(b[0]) | (uint16(b[1]) << 8), err
+// toggleRZXRecording starts recording input to an RZX file named for the
+// time, or stops the recording in progress
+func (s *System) toggleRZXRecording() {
+	if filename := s.RZXRecording(); filename != "" {
+		if err := s.StopRZXRecording(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Recorded %s\n", filename)
+		return
 	}
+	filename := time.Now().Format("omse-20060102-150405.rzx")
+	if err := s.StartRZXRecording(filename); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Recording input to %s\n", filename)
+}
 
-	// Set PC to the standard SNA return address
-	s.cpu.SetPC(0x0072)
-
-	// Read registers
-	var err2 error
-
-	// I register
-	i, err := readByte()
-	if err != nil {
+// PlayRZX replays an RZX file, to be reported on when it finishes
+func (s *System) PlayRZX(filename string) error {
+	if err := s.Machine.PlayRZX(filename); err != nil {
 		return err
 	}
-	// We need to add a method to set the I register in our Z80 wrapper
-	s.cpu.SetI(i)
+	s.replaying = true
+	return nil
+}
 
-	// Alternative register set
-	hl2, err2 := readWord()
-	if err2 != nil {
-		return err2
+// reportReplay says when an RZX replay has finished, and why if it
+// stopped early
+func (s *System) reportReplay() {
+	if !s.replaying || s.PlayingRZX() {
+		return
 	}
-	s.cpu.SetHL2(hl2)
-
-	de2, err2 := readWord()
-	if err2 != nil {
-		return err2
+	s.replaying = false
+	if err := s.RZXError(); err != nil {
+		fmt.Fprintf(os.Stderr, "Replay stopped: %v\n", err)
+		return
 	}
-	s.cpu.SetDE2(de2)
+	fmt.Println("Replay finished")
+}
 
-	bc2, err2 := readWord()
-	if err2 != nil {
-		return err2
+// DefaultJoystickKeys maps the keypad to the first joystick: 8, 2, 4 and 6
+// move it and 0 is fire
+func DefaultJoystickKeys() map[sdl.Keycode]joystick.Button {
+	return map[sdl.Keycode]joystick.Button{
+		sdl.K_KP_8: joystick.Up,
+		sdl.K_KP_2: joystick.Down,
+		sdl.K_KP_4: joystick.Left,
+		sdl.K_KP_6: joystick.Right,
+		sdl.K_KP_0: joystick.Fire,
 	}
-	s.cpu.SetBC2(bc2)
+}
 
-	af2, err2 := readWord()
-	if err2 != nil {
-		return err2
+// ParseJoystickKeys reads a keyboard mapping for the first joystick, the
+// SDL names of the keys for up, down, left, right and fire separated by
+// commas, such as "Q,A,O,P,Space"
+func ParseJoystickKeys(names string) (map[sdl.Keycode]joystick.Button, error) {
+	buttons := []joystick.Button{joystick.Up, joystick.Down, joystick.Left, joystick.Right, joystick.Fire}
+	fields := strings.Split(names, ",")
+	if len(fields) != len(buttons) {
+		return nil, fmt.Errorf("joystick keys need up, down, left, right and fire: %q", names)
 	}
-	s.cpu.SetAF2(af2)
-
-	// Main register set
-	hl, err2 := readWord()
-	if err2 != nil {
-		return err2
+	keys := make(map[sdl.Keycode]joystick.Button)
+	for i, name := range fields {
+		key := sdl.GetKeyFromName(strings.TrimSpace(name))
+		if key == sdl.K_UNKNOWN {
+			return nil, fmt.Errorf("unknown key: %q", name)
+		}
+		keys[key] |= buttons[i]
 	}
-	s.cpu.SetHL(hl)
+	return keys, nil
+}
 
-	de, err2 := readWord()
-	if err2 != nil {
-		return err2
-	}
-	s.cpu.SetDE(de)
+// SetJoystickKeys sets the host keys that work the first joystick. While
+// it is plugged in, those keys no longer reach the Spectrum's keyboard.
+func (s *System) SetJoystickKeys(keys map[sdl.Keycode]joystick.Button) {
+	s.joystickKeys = keys
+	s.keyButtons = 0
+	s.updateJoystick(0)
+}
 
-	bc, err2 := readWord()
-	if err2 != nil {
-		return err2
-	}
-	s.cpu.SetBC(bc)
+// SetJoystick plugs a player's joystick into an interface
+func (s *System) SetJoystick(player int, iface joystick.Interface) {
+	s.Machine.SetJoystick(player, iface)
+	s.hostButtons[player] = 0
+	s.updateJoystick(player)
+}
 
-	iy, err2 := readWord()
-	if err2 != nil {
-		return err2
+// cycleJoystick moves a player's joystick to the next interface
+func (s *System) cycleJoystick(player int) {
+	current := s.Joystick(player).Interface
+	for i, iface := range joystick.Interfaces {
+		if iface == current {
+			current = joystick.Interfaces[(i+1)%len(joystick.Interfaces)]
+			break
+		}
 	}
-	s.cpu.SetIY(iy)
+	s.SetJoystick(player, current)
+	fmt.Printf("Joystick %d: %v\n", player+1, current)
+}
 
-	ix, err2 := readWord()
-	if err2 != nil {
-		return err2
+// updateJoystick works a player's joystick from the keys and game
+// controllers working it. Only the switches whose host input changed are
+// pressed or released, so those worked through the Joystick API stay as
+// they are.
+func (s *System) updateJoystick(player int) {
+	var state joystick.Button
+	if player == 0 {
+		state = s.keyButtons
 	}
-	s.cpu.SetIX(ix)
-
-	// Interrupt status
-	intByte, err := readByte()
-	if err != nil {
-		return err
+	for _, c := range s.controllers {
+		if c.player == player {
+			state |= c.buttons | c.stick
+		}
 	}
-	s.cpu.SetIFF2((intByte & 0x04) != 0)
+	j := s.Joystick(player)
+	old := s.hostButtons[player]
+	j.Release(old &^ state)
+	j.Press(state &^ old)
+	s.hostButtons[player] = state
+}
 
-	// R register
-	r, err := readByte()
-	if err != nil {
-		return err
-	}
-	s.cpu.SetR(r)
+// controller is an SDL game controller working one of the joysticks
+type controller struct {
+	*sdl.GameController
+	player  int
+	buttons joystick.Button // From the d-pad and face buttons
+	stick   joystick.Button // From the left stick
+}
 
-	// AF and SP registers
-	af, err2 := readWord()
-	if err2 != nil {
-		return err2
-	}
-	s.cpu.SetAF(af)
+// StickDeadZone is how far a controller's stick must move to count
+const StickDeadZone = 8000
+
+// controllerButtons maps game controller buttons to joystick switches
+var controllerButtons = map[uint8]joystick.Button{
+	sdl.CONTROLLER_BUTTON_DPAD_UP:    joystick.Up,
+	sdl.CONTROLLER_BUTTON_DPAD_DOWN:  joystick.Down,
+	sdl.CONTROLLER_BUTTON_DPAD_LEFT:  joystick.Left,
+	sdl.CONTROLLER_BUTTON_DPAD_RIGHT: joystick.Right,
+	sdl.CONTROLLER_BUTTON_A:          joystick.Fire,
+	sdl.CONTROLLER_BUTTON_B:          joystick.Fire,
+	sdl.CONTROLLER_BUTTON_X:          joystick.Fire,
+	sdl.CONTROLLER_BUTTON_Y:          joystick.Fire,
+}
+
+// handleControllerEvent opens and closes game controllers as they come
+// and go, giving each new one the first player without one, and works the
+// joysticks from them
+func (s *System) handleControllerEvent(event sdl.Event) {
+	switch event := event.(type) {
+	case *sdl.ControllerDeviceEvent:
+		switch event.Type {
+		case sdl.CONTROLLERDEVICEADDED:
+			gc := sdl.GameControllerOpen(int(event.Which))
+			if gc == nil {
+				return
+			}
+			used := [2]bool{}
+			for _, c := range s.controllers {
+				used[c.player] = true
+			}
+			player := 0
+			if used[0] && !used[1] {
+				player = 1
+			}
+			s.controllers[gc.Joystick().InstanceID()] = &controller{GameController: gc, player: player}
+		case sdl.CONTROLLERDEVICEREMOVED:
+			if c, ok := s.controllers[event.Which]; ok {
+				c.Close()
+				delete(s.controllers, event.Which)
+				s.updateJoystick(c.player)
+			}
+		}
+
+	case *sdl.ControllerButtonEvent:
+		c, ok := s.controllers[event.Which]
+		if !ok {
+			return
+		}
+		if event.State == sdl.PRESSED {
+			c.buttons |= controllerButtons[event.Button]
+		} else {
+			c.buttons &^= controllerButtons[event.Button]
+		}
+		s.updateJoystick(c.player)
+
+	case *sdl.ControllerAxisEvent:
+		c, ok := s.controllers[event.Which]
+		if !ok {
+			return
+		}
+		var low, high joystick.Button
+		switch event.Axis {
+		case sdl.CONTROLLER_AXIS_LEFTX:
+			low, high = joystick.Left, joystick.Right
+		case sdl.CONTROLLER_AXIS_LEFTY:
+			low, high = joystick.Up, joystick.Down
+		default:
+			return
+		}
+		c.stick &^= low | high
+		if event.Value < -StickDeadZone {
+			c.stick |= low
+		} else if event.Value > StickDeadZone {
+			c.stick |= high
+		}
+		s.updateJoystick(c.player)
+	}
+}
+
+// The debugger panel sits beside the screen. Its text is drawn a pixel at
+// a time from a 5x7 font, doubled in size.
+const (
+	DebugPanelWidth = 360
+	fontScale       = 2
+	charWidth       = 6 * fontScale
+	charHeight      = 9 * fontScale
+
+	debugRegisterRow    = 1
+	debugRasterRow      = 9
+	debugDisassemblyRow = 11
+	debugDisassembly    = 12 // Lines of disassembly
+	debugMemoryRow      = 24
+	debugMemoryRows     = 8
+	debugMemoryColumns  = 8
+)
+
+// font5x7 holds the characters from space to underscore, a row of five
+// pixels to a byte. Lower case letters are shown in upper case.
+var font5x7 = [64][7]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // Space
+	{0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04}, // !
+	{0x0A, 0x0A, 0x0A, 0x00, 0x00, 0x00, 0x00}, // "
+	{0x0A, 0x0A, 0x1F, 0x0A, 0x1F, 0x0A, 0x0A}, // #
+	{0x04, 0x0F, 0x14, 0x0E, 0x05, 0x1E, 0x04}, // $
+	{0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03}, // %
+	{0x0C, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0D}, // &
+	{0x0C, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00}, // '
+	{0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02}, // (
+	{0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08}, // )
+	{0x00, 0x04, 0x15, 0x0E, 0x15, 0x04, 0x00}, // *
+	{0x00, 0x04, 0x04, 0x1F, 0x04, 0x04, 0x00}, // +
+	{0x00, 0x00, 0x00, 0x00, 0x0C, 0x04, 0x08}, // ,
+	{0x00, 0x00, 0x00, 0x1F, 0x00, 0x00, 0x00}, // -
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C}, // .
+	{0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00}, // /
+	{0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E}, // 0
+	{0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E}, // 1
+	{0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F}, // 2
+	{0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E}, // 3
+	{0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02}, // 4
+	{0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E}, // 5
+	{0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E}, // 6
+	{0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08}, // 7
+	{0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E}, // 8
+	{0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C}, // 9
+	{0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00}, // :
+	{0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x04, 0x08}, // ;
+	{0x02, 0x04, 0x08, 0x10, 0x08, 0x04, 0x02}, // <
+	{0x00, 0x00, 0x1F, 0x00, 0x1F, 0x00, 0x00}, // =
+	{0x08, 0x04, 0x02, 0x01, 0x02, 0x04, 0x08}, // >
+	{0x0E, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04}, // ?
+	{0x0E, 0x11, 0x01, 0x0D, 0x15, 0x15, 0x0E}, // @
+	{0x0E, 0x11, 0x11, 0x11, 0x1F, 0x11, 0x11}, // A
+	{0x1E, 0x11, 0x11, 0x1E, 0x11, 0x11, 0x1E}, // B
+	{0x0E, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0E}, // C
+	{0x1C, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1C}, // D
+	{0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F}, // E
+	{0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x10}, // F
+	{0x0E, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0F}, // G
+	{0x11, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11}, // H
+	{0x0E, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0E}, // I
+	{0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0C}, // J
+	{0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11}, // K
+	{0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1F}, // L
+	{0x11, 0x1B, 0x15, 0x15, 0x11, 0x11, 0x11}, // M
+	{0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11}, // N
+	{0x0E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E}, // O
+	{0x1E, 0x11, 0x11, 0x1E, 0x10, 0x10, 0x10}, // P
+	{0x0E, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0D}, // Q
+	{0x1E, 0x11, 0x11, 0x1E, 0x14, 0x12, 0x11}, // R
+	{0x0F, 0x10, 0x10, 0x0E, 0x01, 0x01, 0x1E}, // S
+	{0x1F, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04}, // T
+	{0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E}, // U
+	{0x11, 0x11, 0x11, 0x11, 0x11, 0x0A, 0x04}, // V
+	{0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0A}, // W
+	{0x11, 0x11, 0x0A, 0x04, 0x0A, 0x11, 0x11}, // X
+	{0x11, 0x11, 0x11, 0x0A, 0x04, 0x04, 0x04}, // Y
+	{0x1F, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1F}, // Z
+	{0x0E, 0x08, 0x08, 0x08, 0x08, 0x08, 0x0E}, // [
+	{0x00, 0x10, 0x08, 0x04, 0x02, 0x01, 0x00}, // \
+	{0x0E, 0x02, 0x02, 0x02, 0x02, 0x02, 0x0E}, // ]
+	{0x04, 0x0A, 0x11, 0x00, 0x00, 0x00, 0x00}, // ^
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1F}, // _
+}
+
+// Debugger colours
+var (
+	debugBackground = sdl.Color{R: 0x20, G: 0x20, B: 0x28, A: 0xFF}
+	debugText       = sdl.Color{R: 0xE0, G: 0xE0, B: 0xE0, A: 0xFF}
+	debugLabel      = sdl.Color{R: 0x80, G: 0x80, B: 0x90, A: 0xFF}
+	debugHighlight  = sdl.Color{R: 0xFF, G: 0xE0, B: 0x40, A: 0xFF}
+	debugBreakpoint = sdl.Color{R: 0xFF, G: 0x50, B: 0x50, A: 0xFF}
+	debugSelected   = sdl.Color{R: 0x40, G: 0xE0, B: 0xFF, A: 0xFF}
+	debugBeam       = sdl.Color{R: 0xFF, G: 0x30, B: 0x30, A: 0xA0}
+)
+
+// debugButtons are the buttons along the top of the panel, by the columns
+// they cover
+var debugButtons = []struct {
+	label      string
+	start, end int
+}{
+	{"RUN", 0, 5},
+	{"STEP", 6, 12},
+	{"FRAME", 13, 20},
+}
+
+// Debugger is the state of the debugger panel
+type Debugger struct {
+	visible  bool
+	paused   bool
+	memory   uint16   // First address in the hex view
+	listing  []uint16 // Address of each line of disassembly shown
+	selected int      // Byte being edited in the hex view, or -1
+	address  bool     // Editing the hex view's address instead
+	typed    int      // Hex digits typed so far
+	value    uint16
+}
+
+// toggleDebugger shows or hides the debugger panel
+func (s *System) toggleDebugger() {
+	d := &s.debugger
+	d.visible = !d.visible
+	d.selected = -1
+	d.address = false
+	if d.visible {
+		s.crt.SetPanel(DebugPanelWidth, CRTLines)
+	} else {
+		s.crt.SetPanel(0, 0)
+	}
+}
+
+// pause stops the machine between two instructions, or lets it go again
+func (s *System) pause(paused bool) {
+	if paused && !s.debugger.paused {
+		s.Step()
+	}
+	s.debugger.paused = paused
+}
+
+// step runs the paused machine for an instruction, or a frame. A running
+// machine just pauses, at the next instruction.
+func (s *System) step(frame bool) {
+	if !s.debugger.paused {
+		s.pause(true)
+		return
+	}
+	if frame {
+		s.StepFrame()
+	} else {
+		s.Step()
+	}
+}
+
+// handleDebugKey takes the keys that control the debugger, and the hex
+// digits typed into its memory view. It returns whether it used the key.
+func (s *System) handleDebugKey(sym sdl.Keycode) bool {
+	d := &s.debugger
+	switch sym {
+	case sdl.K_F10:
+		s.toggleDebugger()
+		return true
+	case sdl.K_F11:
+		s.step(false)
+		return true
+	case sdl.K_F12:
+		s.step(true)
+		return true
+	}
+	if !d.visible || (d.selected < 0 && !d.address) {
+		return false
+	}
+
+	var digit uint16
+	switch {
+	case sym >= sdl.K_0 && sym <= sdl.K_9:
+		digit = uint16(sym - sdl.K_0)
+	case sym >= sdl.K_a && sym <= sdl.K_f:
+		digit = uint16(sym-sdl.K_a) + 10
+	case sym == sdl.K_ESCAPE, sym == sdl.K_RETURN:
+		d.selected = -1
+		d.address = false
+		return true
+	default:
+		return false
+	}
+	d.value = d.value<<4 | digit
+	d.typed++
+	switch {
+	case d.address && d.typed == 4:
+		d.memory = d.value
+		d.address = false
+	case !d.address && d.typed == 2:
+		s.Memory().Write(d.memory+uint16(d.selected), byte(d.value))
+		d.selected = (d.selected + 1) % (debugMemoryRows * debugMemoryColumns)
+		d.typed, d.value = 0, 0
+	}
+	return true
+}
+
+// handleMouseEvent works the debugger panel's buttons, sets breakpoints
+// on the disassembly and picks bytes in the memory view to edit
+func (s *System) handleMouseEvent(event sdl.Event) {
+	d := &s.debugger
+	if !d.visible {
+		return
+	}
+	switch event := event.(type) {
+	case *sdl.MouseWheelEvent:
+		d.memory -= uint16(event.Y * debugMemoryColumns)
+	case *sdl.MouseButtonEvent:
+		if event.Type != sdl.MOUSEBUTTONDOWN || event.Button != sdl.BUTTON_LEFT {
+			return
+		}
+		x := int(event.X - s.crt.PanelLeft())
+		if x < 0 {
+			return
+		}
+		column, row := x/charWidth, int(event.Y)/charHeight
+		d.selected = -1
+		d.address = false
+		d.typed, d.value = 0, 0
+		switch {
+		case row == 0:
+			for _, button := range debugButtons {
+				if column >= button.start && column < button.end {
+					switch button.label {
+					case "RUN":
+						s.pause(!d.paused)
+					case "STEP":
+						s.step(false)
+					case "FRAME":
+						s.step(true)
+					}
+				}
+			}
+		case row >= debugDisassemblyRow && row-debugDisassemblyRow < len(d.listing):
+			addr := d.listing[row-debugDisassemblyRow]
+			s.SetBreakpoint(addr, !s.Breakpoint(addr))
+		case row >= debugMemoryRow && row < debugMemoryRow+debugMemoryRows:
+			if column < 4 {
+				d.address = true
+			} else if byteColumn := (column - 5) / 3; column >= 5 && byteColumn < debugMemoryColumns {
+				d.selected = (row-debugMemoryRow)*debugMemoryColumns + byteColumn
+			}
+		}
+	}
+}
+
+// drawDebugger draws the debugger panel, and the raster beam over the
+// screen while paused
+func (s *System) drawDebugger(r *sdl.Renderer) {
+	d := &s.debugger
+	if !d.visible {
+		return
+	}
+	left := s.crt.PanelLeft()
+	_, height, _ := r.GetOutputSize()
+	setColor(r, debugBackground)
+	r.FillRect(&sdl.Rect{X: left, Y: 0, W: DebugPanelWidth, H: height})
+	text := func(column, row int, color sdl.Color, format string, args ...any) {
+		drawText(r, left+int32(column*charWidth), int32(row*charHeight), color, fmt.Sprintf(format, args...))
+	}
+
+	// Buttons
+	for _, button := range debugButtons {
+		label := button.label
+		if label == "RUN" && !d.paused {
+			label = "STOP"
+		}
+		text(button.start, 0, debugHighlight, "[%s]", label)
+	}
+
+	// Registers
+	c := s.CPU()
+	pairs := [][4]any{
+		{"AF", c.AF(), "AF'", c.AF2()},
+		{"BC", c.BC(), "BC'", c.BC2()},
+		{"DE", c.DE(), "DE'", c.DE2()},
+		{"HL", c.HL(), "HL'", c.HL2()},
+		{"IX", c.IX(), "IY", c.IY()},
+		{"SP", c.SP(), "PC", c.NextPC()},
+	}
+	for i, p := range pairs {
+		row := debugRegisterRow + i
+		text(0, row, debugLabel, "%s", p[0])
+		text(4, row, debugText, "%04X", p[1])
+		text(10, row, debugLabel, "%s", p[2])
+		text(14, row, debugText, "%04X", p[3])
+	}
+	flags := []byte("SZ5H3PNC")
+	for i := range flags {
+		if c.F()&(0x80>>i) == 0 {
+			flags[i] = '-'
+		}
+	}
+	iff := func(on bool) int {
+		if on {
+			return 1
+		}
+		return 0
+	}
+	row := debugRegisterRow + len(pairs)
+	text(0, row, debugText, "I %02X  R %02X  IM %d  IFF %d%d", c.I(), c.R(), c.IM(), iff(c.IFF1()), iff(c.IFF2()))
+	text(0, row+1, debugText, "F %s", flags)
+	line, cycle := s.Raster()
+	text(0, debugRasterRow, debugText, "LINE %03d  T %03d  FRAME %d", line, cycle, s.Frames())
+
+	// Disassembly, starting a few instructions before PC
+	read := s.Memory().Read
+	pc := c.NextPC()
+	addr := disasm.Back(read, pc, 3)
+	d.listing = d.listing[:0]
+	for i := range debugDisassembly {
+		instruction, length := disasm.Instruction(read, addr)
+		color := debugText
+		if addr == pc {
+			color = debugHighlight
+			text(1, debugDisassemblyRow+i, color, ">")
+		}
+		if s.Breakpoint(addr) {
+			color = debugBreakpoint
+			text(0, debugDisassemblyRow+i, color, "*")
+		}
+		text(2, debugDisassemblyRow+i, color, "%04X %s", addr, instruction)
+		d.listing = append(d.listing, addr)
+		addr += uint16(length)
+	}
+
+	// Memory
+	for row := range debugMemoryRows {
+		base := d.memory + uint16(row*debugMemoryColumns)
+		color := debugLabel
+		if d.address && row == 0 {
+			color = debugSelected
+		}
+		text(0, debugMemoryRow+row, color, "%04X", base)
+		for column := range debugMemoryColumns {
+			color := debugText
+			if d.selected == row*debugMemoryColumns+column {
+				color = debugSelected
+			}
+			text(5+column*3, debugMemoryRow+row, color, "%02X", read(base+uint16(column)))
+		}
+	}
+
+	// The beam, on the picture, where the next pixels will be drawn, two
+	// to a T-state
+	if d.paused && line >= spectrum.TopBlanking && line < spectrum.TopBlanking+spectrum.VisibleLines {
+		picture := s.crt.pictureRect()
+		y := picture.Y + int32(line-spectrum.TopBlanking)*picture.H/spectrum.VisibleLines
+		h := max(picture.H/spectrum.VisibleLines, 1)
+		r.SetDrawBlendMode(sdl.BLENDMODE_BLEND)
+		setColor(r, debugBeam)
+		r.FillRect(&sdl.Rect{X: picture.X, Y: y, W: picture.W, H: h})
+		if cycle < spectrum.Columns*4 {
+			x := picture.X + int32(cycle*2)*picture.W/spectrum.TotalWidth
+			w := max(2*picture.W/spectrum.TotalWidth, 1)
+			r.FillRect(&sdl.Rect{X: x, Y: y - 3*h, W: w, H: 7 * h})
+		}
+		r.SetDrawBlendMode(sdl.BLENDMODE_NONE)
+	}
+}
+
+func setColor(r *sdl.Renderer, c sdl.Color) {
+	r.SetDrawColor(c.R, c.G, c.B, c.A)
+}
 
-	sp, err2 := readWord()
-	if err2 != nil {
-		return err2
+// drawText draws a line of text in the 5x7 font with its top left corner
+// at x, y
+func drawText(r *sdl.Renderer, x, y int32, color sdl.Color, text string) {
+	var rects []sdl.Rect
+	for i, ch := range strings.ToUpper(text) {
+		if ch < ' ' || ch > '_' {
+			ch = '?'
+		}
+		for row, bits := range font5x7[ch-' '] {
+			for column := range 5 {
+				if bits&(0x10>>column) != 0 {
+					rects = append(rects, sdl.Rect{
+						X: x + int32(i*charWidth+column*fontScale),
+						Y: y + int32(row*fontScale),
+						W: fontScale,
+						H: fontScale,
+					})
+				}
+			}
+		}
+	}
+	if len(rects) > 0 {
+		setColor(r, color)
+		r.FillRects(rects)
 	}
-	s.cpu.SetSP(sp)
+}
 
-	// Interrupt mode
-	im, err := readByte()
+// SlotCount is the number of save-state slots the keys and the slot
+// browser use
+const SlotCount = 8
+
+// UseSlotsFor keeps the save-state slots for the program in the files
+// loaded: the first that isn't a ROM, or the model when there is none.
+// The slots go in the user's data directory.
+func (s *System) UseSlotsFor(files []string) error {
+	s.media = nil
+	for _, file := range files {
+		if strings.EqualFold(filepath.Ext(file), ".rom") {
+			continue
+		}
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		s.media = append(s.media, file)
+	}
+	var dir string
+	var err error
+	if len(s.media) > 0 {
+		dir, err = savestate.FileDir("omse", s.media[0])
+	} else {
+		dir, err = savestate.Dir("omse", strings.ToLower(s.Model().Name))
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("could not find a directory for save states: %v", err)
 	}
-	s.cpu.SetIM(im)
+	s.slots = savestate.New(dir)
+	return nil
+}
 
-	// Border color
-	borderColor, err := readByte()
+// SaveSlot saves the machine in a slot, with a thumbnail of the screen
+func (s *System) SaveSlot(slot int) error {
+	if s.slots == nil {
+		return fmt.Errorf("no directory for save states")
+	}
+	info := savestate.Info{Model: s.Model().Name, Media: s.media}
+	return s.slots.Save(slot, s.Snapshot(), s.framebuffer.Image(), info)
+}
+
+// LoadSlot puts the machine back as it was saved in a slot
+func (s *System) LoadSlot(slot int) error {
+	if s.slots == nil {
+		return fmt.Errorf("no directory for save states")
+	}
+	if s.PlayingRZX() || s.RZXRecording() != "" {
+		return fmt.Errorf("can't load a slot while recording or replaying input")
+	}
+	snap, _, err := s.slots.Load(slot)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("slot %d is empty", slot)
+	}
 	if err != nil {
 		return err
 	}
-	s.ula.SetBorderColor(borderColor)
+	return s.Restore(snap)
+}
 
-	// Load RAM
-	return s.memory.LoadFromReader(file, 0x4000, 49152)
+// quickSave saves the machine in the current slot
+func (s *System) quickSave() {
+	if err := s.SaveSlot(s.slot); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved slot %d\n", s.slot)
+	if s.browser.visible {
+		s.loadSlotBrowser()
+	}
 }
 
-func main() {
-	// Parse command line arguments
-	romLoaded := false
+// quickLoad loads the machine from the current slot
+func (s *System) quickLoad() {
+	if err := s.LoadSlot(s.slot); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Loaded slot %d\n", s.slot)
+}
 
-	system, err := NewSystem()
+// SlotBrowser shows the save-state slots over the picture, with their
+// thumbnails. The machine is paused while it is open.
+type SlotBrowser struct {
+	visible  bool
+	infos    [SlotCount]*savestate.Info // nil for an empty slot
+	textures [SlotCount]*sdl.Texture    // nil without a thumbnail
+}
+
+// Slot browser layout
+const (
+	browserColumns = 4
+	browserRows    = SlotCount / browserColumns
+)
+
+// clear forgets the slots, freeing their thumbnails
+func (b *SlotBrowser) clear() {
+	for i, texture := range b.textures {
+		if texture != nil {
+			texture.Destroy()
+		}
+		b.textures[i] = nil
+		b.infos[i] = nil
+	}
+}
+
+// toggleSlotBrowser shows or hides the slot browser
+func (s *System) toggleSlotBrowser() {
+	b := &s.browser
+	b.visible = !b.visible
+	if b.visible {
+		s.loadSlotBrowser()
+	} else {
+		b.clear()
+	}
+}
+
+// loadSlotBrowser reads the slots' info and thumbnails
+func (s *System) loadSlotBrowser() {
+	b := &s.browser
+	b.clear()
+	if s.slots == nil {
+		return
+	}
+	for i := range SlotCount {
+		info, err := s.slots.Info(i + 1)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		b.infos[i] = &info
+		thumbnail, err := s.slots.Thumbnail(i + 1)
+		if err == nil {
+			b.textures[i], err = thumbnailTexture(s.crt.renderer, thumbnail)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+}
+
+// thumbnailTexture makes a texture of a thumbnail image
+func thumbnailTexture(r *sdl.Renderer, img image.Image) (*sdl.Texture, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("empty thumbnail")
+	}
+	pixels := make([]uint32, width*height)
+	for y := range height {
+		for x := range width {
+			c := color.RGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA)
+			pixels[y*width+x] = rgba(c)
+		}
+	}
+	texture, err := r.CreateTexture(sdl.PIXELFORMAT_RGBA8888, sdl.TEXTUREACCESS_STATIC,
+		int32(width), int32(height))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("texture creation failed: %v", err)
 	}
-	defer system.Close()
+	texture.Update(nil, unsafe.Pointer(&pixels[0]), width*4)
+	return texture, nil
+}
 
-	if len(os.Args) > 1 {
-		for i := 1; i < len(os.Args); i++ {
-			arg := os.Args[i]
+// handleBrowserKey takes the keys while the slot browser is open: the
+// arrows and digits choose a slot, Enter loads it, S saves to it, Delete
+// empties it and Escape or F1 closes the browser
+func (s *System) handleBrowserKey(sym sdl.Keycode) {
+	switch {
+	case sym == sdl.K_ESCAPE, sym == sdl.K_F1:
+		s.toggleSlotBrowser()
+	case sym == sdl.K_LEFT:
+		s.slot = (s.slot+SlotCount-2)%SlotCount + 1
+	case sym == sdl.K_RIGHT:
+		s.slot = s.slot%SlotCount + 1
+	case sym == sdl.K_UP, sym == sdl.K_DOWN:
+		s.slot = (s.slot-1+browserColumns)%SlotCount + 1
+	case sym >= sdl.K_1 && sym < sdl.K_1+SlotCount:
+		s.slot = int(sym-sdl.K_1) + 1
+	case sym == sdl.K_RETURN, sym == sdl.K_KP_ENTER, sym == sdl.K_F3:
+		s.quickLoad()
+		s.toggleSlotBrowser()
+	case sym == sdl.K_s, sym == sdl.K_F2:
+		s.quickSave()
+	case sym == sdl.K_DELETE, sym == sdl.K_BACKSPACE:
+		if s.slots == nil {
+			return
+		}
+		if err := s.slots.Delete(s.slot); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		s.loadSlotBrowser()
+	}
+}
 
-			if arg == "-h" || arg == "--help" {
-				fmt.Printf("Usage: %s [options] [filename...]\n"+
-					"Options:\n"+
-					"  -h, --help           Show this help message\n"+
-					"If no filename is provided, boot into 48.rom.\n\n"+
-					"(.scr, .rom and .sna files are supported)\n", os.Args[0])
-				return
-			} else if filepath.Ext(arg) == ".rom" {
-				// Load the ROM file into memory
-				err := system.memory.LoadFromFile(arg, 0x0000, 16384)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-					os.Exit(1)
-				}
-				romLoaded = true
-			} else if filepath.Ext(arg) == ".sna" {
-				// Load the SNA file into memory
-				err := system.LoadSNA(arg)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-					os.Exit(1)
+// drawSlotBrowser draws the slots over the picture, in a grid of
+// thumbnails with the time each was saved
+func (s *System) drawSlotBrowser(r *sdl.Renderer) {
+	b := &s.browser
+	if !b.visible {
+		return
+	}
+	picture := s.crt.pictureRect()
+	setColor(r, debugBackground)
+	r.FillRect(&picture)
+
+	const margin = charWidth
+	title := "NO SAVE STATES"
+	if s.slots != nil {
+		title = "SAVE STATES: " + filepath.Base(s.slots.Dir())
+	}
+	title = title[:min(len(title), int(picture.W-2*margin)/charWidth)]
+	drawText(r, picture.X+margin, picture.Y+margin, debugHighlight, title)
+	drawText(r, picture.X+margin, picture.Y+picture.H-margin-charHeight, debugLabel,
+		"ENTER LOAD  S SAVE  DEL DELETE  ESC CLOSE")
+
+	cellWidth := (picture.W - margin) / browserColumns
+	thumbWidth := cellWidth - margin
+	thumbHeight := thumbWidth * picture.H / picture.W
+	cellHeight := thumbHeight + 2*charHeight + margin
+	top := picture.Y + (picture.H-cellHeight*browserRows)/2
+	for i := range SlotCount {
+		x := picture.X + margin + int32(i%browserColumns)*cellWidth
+		y := top + int32(i/browserColumns)*cellHeight
+		thumb := sdl.Rect{X: x, Y: y, W: thumbWidth, H: thumbHeight}
+		if b.textures[i] != nil {
+			r.Copy(b.textures[i], nil, &thumb)
+		}
+		color := debugLabel
+		if i+1 == s.slot {
+			color = debugSelected
+		}
+		setColor(r, color)
+		r.DrawRect(&thumb)
+
+		label := "EMPTY"
+		if info := b.infos[i]; info != nil {
+			label = info.Model
+			drawText(r, x, y+thumbHeight+charHeight+fontScale, debugText, info.Time.Format("02 Jan 15:04"))
+		}
+		drawText(r, x, y+thumbHeight+fontScale, color, fmt.Sprintf("%d %s", i+1, label))
+	}
+}
+
+// Speed returns how fast the machine runs, as a multiple of the real
+// speed, or zero for as fast as it can
+func (s *System) Speed() float64 {
+	if s.warp || s.autoWarp && s.TapePlaying() {
+		return 0
+	}
+	return s.speed
+}
+
+// SetSpeed sets how fast the machine runs, as a multiple of the real
+// speed, when it isn't warping
+func (s *System) SetSpeed(speed float64) {
+	s.speed = speed
+	fmt.Printf("Speed %.0f%%\n", speed*100)
+}
+
+// stepSpeed moves the speed to the next of SpeedSteps up, or down for a
+// negative direction
+func (s *System) stepSpeed(direction int) {
+	speed := s.speed
+	if direction > 0 {
+		for _, step := range SpeedSteps {
+			if step > s.speed {
+				speed = step
+				break
+			}
+		}
+	} else {
+		for _, step := range SpeedSteps {
+			if step < s.speed {
+				speed = step
+			}
+		}
+	}
+	s.SetSpeed(speed)
+}
+
+// handleSpeedKey takes the Alt keys that control the speed. It returns
+// whether it used the key.
+func (s *System) handleSpeedKey(sym sdl.Keycode) bool {
+	switch sym {
+	case sdl.K_EQUALS, sdl.K_PLUS, sdl.K_KP_PLUS:
+		s.stepSpeed(1)
+	case sdl.K_MINUS, sdl.K_KP_MINUS:
+		s.stepSpeed(-1)
+	case sdl.K_0:
+		s.SetSpeed(1)
+	case sdl.K_w:
+		s.warp = !s.warp
+		fmt.Printf("Warp %s\n", onOff(s.warp))
+	case sdl.K_a:
+		s.autoWarp = !s.autoWarp
+		fmt.Printf("Warp while loading %s\n", onOff(s.autoWarp))
+	case sdl.K_f:
+		s.speedometer.visible = !s.speedometer.visible
+	default:
+		return false
+	}
+	return true
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// Speedometer measures how fast the machine runs, for the readout over
+// the picture
+type Speedometer struct {
+	visible bool
+	start   time.Time // When the measurement began
+	tstates uint64    // T-states run by then
+	frames  uint64    // Frames finished by then
+	shown   int       // Pictures shown since
+	reading string
+}
+
+// SpeedometerPeriod is how often the readout changes
+const SpeedometerPeriod = 500 * time.Millisecond
+
+// reset starts a new measurement
+func (m *Speedometer) reset(s *System) {
+	m.start = time.Now()
+	m.tstates = s.TStates()
+	m.frames = s.Frames()
+	m.shown = 0
+}
+
+// measure takes a reading once a period has passed: the frames the
+// machine finishes a second, the pictures shown of them, and its clock
+// speed, in MHz and against the real one
+func (m *Speedometer) measure(s *System) {
+	elapsed := time.Since(m.start)
+	if elapsed < SpeedometerPeriod {
+		return
+	}
+	seconds := elapsed.Seconds()
+	hz := float64(s.TStates()-m.tstates) / seconds
+	m.reading = fmt.Sprintf("%.1f FPS (%.0f SHOWN) %.2f MHZ %.0f%%",
+		float64(s.Frames()-m.frames)/seconds, float64(m.shown)/seconds,
+		hz/1e6, hz*100/float64(s.Model().ClockRate))
+	m.reset(s)
+}
+
+// drawOverlay draws the debugger, the slot browser and the speed readout
+// over the picture
+func (s *System) drawOverlay(r *sdl.Renderer) {
+	s.drawDebugger(r)
+	s.drawSlotBrowser(r)
+	m := &s.speedometer
+	if !m.visible || m.reading == "" {
+		return
+	}
+	text := m.reading
+	if s.Speed() == 0 {
+		text += " WARP"
+	}
+	picture := s.crt.pictureRect()
+	setColor(r, debugBackground)
+	r.FillRect(&sdl.Rect{
+		X: picture.X,
+		Y: picture.Y,
+		W: int32(len(text)*charWidth + charWidth),
+		H: charHeight + fontScale,
+	})
+	drawText(r, picture.X+charWidth/2, picture.Y+fontScale, debugText, text)
+}
+
+// Run runs the machine in its window until the window is closed, at the
+// speed chosen, kept by the sync chosen. Frames are skipped when they
+// come faster than the display can show them.
+func (s *System) Run() error {
+	quit := false
+	frameTime := time.Duration(float64(s.Model().Timing.FrameLength()) * float64(time.Second) / float64(s.Model().ClockRate))
+
+	// Where the timer's pacing started, or when the machine last ran when
+	// syncing to vsync. Both start afresh when the speed changes.
+	var startTime time.Time
+	var startTState uint64
+	var owed time.Duration // Machine time owed when syncing to vsync
+	lastSpeed := -1.0
+
+	lastFrame := s.Frames()
+	var lastRefresh time.Time
+	s.speedometer.reset(s)
+
+	for !quit {
+		// Handle SDL events
+		for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+			switch event := event.(type) {
+			case *sdl.QuitEvent:
+				quit = true
+			case *sdl.KeyboardEvent:
+				s.handleKeyEvent(event)
+			case *sdl.ControllerDeviceEvent, *sdl.ControllerButtonEvent, *sdl.ControllerAxisEvent:
+				s.handleControllerEvent(event)
+			case *sdl.MouseButtonEvent, *sdl.MouseWheelEvent:
+				s.handleMouseEvent(event)
+			}
+		}
+
+		// While paused, only the debugger runs the machine
+		if s.debugger.paused || s.browser.visible {
+			if err := s.crt.Refresh(); err != nil {
+				return err
+			}
+			time.Sleep(20 * time.Millisecond)
+			lastSpeed = -1
+			s.speedometer.reset(s)
+			continue
+		}
+
+		speed := s.Speed()
+		sync := s.sync
+		if sync == SyncAudio && (s.audio == nil || speed != 1) {
+			sync = SyncTimer
+		}
+		if speed != lastSpeed {
+			startTime = time.Now()
+			startTState = s.TStates()
+			owed = 0
+			lastSpeed = speed
+		}
+
+		// Process a chunk of cycles, or when syncing to vsync the whole
+		// frames due since the last picture, so each one shown is finished
+		vsync := sync == SyncVsync && speed != 0
+		if vsync {
+			now := time.Now()
+			owed = min(owed+time.Duration(float64(now.Sub(startTime))*speed), time.Duration(float64(MaxLag)*speed))
+			startTime = now
+			for ; owed >= frameTime; owed -= frameTime {
+				s.RunFrame()
+				if s.AtBreakpoint() {
+					break
 				}
-			} else if filepath.Ext(arg) == ".scr" {
-				// Load the SCR file into memory
-				err := system.memory.LoadFromFile(arg, 0x4000, 6912)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-					os.Exit(1)
+			}
+		} else {
+			s.Machine.Run(ChunkSize)
+		}
+		s.reportReplay()
+		if s.AtBreakpoint() {
+			s.debugger.paused = true
+			if !s.debugger.visible {
+				s.toggleDebugger()
+			}
+		}
+
+		// Show each finished frame, but no more often than the display
+		// refreshes. Syncing to vsync shows a picture every refresh, and
+		// waits for it.
+		if vsync || s.Frames() != lastFrame && time.Since(lastRefresh) >= s.crt.refresh {
+			if err := s.crt.Refresh(); err != nil {
+				return err
+			}
+			lastFrame = s.Frames()
+			lastRefresh = time.Now()
+			s.speedometer.shown++
+		}
+
+		samples, err := s.Audio()
+		if err != nil {
+			return err
+		}
+
+		// Sound only plays at the real speed
+		if s.audio != nil && speed == 1 {
+			if err := s.audio.Queue(samples); err != nil {
+				return fmt.Errorf("could not queue audio: %v", err)
+			}
+			switch {
+			case sync == SyncAudio:
+				// The sound card plays samples at exactly the output rate,
+				// so keeping its queue short keeps us running at the right
+				// speed
+				s.audio.WaitForQueue(AudioLatency)
+			case s.audio.Queued() > MaxAudioQueue:
+				// The sound card's clock drifts from the one keeping time
+				s.audio.Clear()
+			}
+		}
+
+		// Sleep if we're ahead
+		if sync == SyncTimer && speed != 0 {
+			elapsedTime := time.Since(startTime)
+			expectedTime := time.Duration(float64(s.TStates()-startTState)/speed*1e6/float64(s.Model().ClockRate)) * time.Microsecond
+			if expectedTime > elapsedTime {
+				aheadBy := expectedTime - elapsedTime
+				if aheadBy.Milliseconds() > 1 {
+					time.Sleep(aheadBy - time.Millisecond)
 				}
-			} else {
-				fmt.Fprintf(os.Stderr, "Unknown file type: %s\n", arg)
-				os.Exit(1)
+			} else if elapsedTime-expectedTime > MaxLag {
+				// Too far behind to catch up
+				startTime = time.Now()
+				startTState = s.TStates()
 			}
 		}
+		s.speedometer.measure(s)
 	}
 
-	// Load the ROM (48.rom) into memory if not already loaded
-	if !romLoaded {
-		err := system.memory.LoadFromFile("48.rom", 0x0000, 16384)
+	return nil
+}
+
+// RunHeadless runs a headless system for a number of frames as fast as it
+// can
+func (s *System) RunHeadless(frames int) error {
+	if err := s.RunFrames(frames); err != nil {
+		return err
+	}
+	s.reportReplay()
+	return nil
+}
+
+// Options are the settings for a run of OMSE, from the config file and
+// then the command line
+type Options struct {
+	Model        *spectrum.Model
+	ROMs         []string // ROM images loaded in order in place of the model's own
+	ROMDir       string   // Where the model's own ROM image is found
+	Speed        float64  // 1 for the real speed, 0 for as fast as possible
+	AutoWarp     bool     // Run as fast as possible while the tape plays
+	Sync         Sync
+	ShowSpeed    bool
+	Display      DisplayOptions
+	Sound        bool
+	ULAplus      bool
+	Joysticks    string // Interfaces for one or two players, split by a comma
+	JoystickKeys string // Host keys for the first joystick
+	FastLoad     bool
+	Headless     bool
+	Frames       int    // Frames to run headless
+	Screenshot   string // PNG saved of the last frame on exit
+	WAV          string
+	Record       string // Video file
+	Save         string // Tape file to save to
+	Snapshot     string // Snapshot saved on exit
+	RZXRecord    string
+	Files        []string // Files to load, chosen by extension
+}
+
+// flagAliases maps the short flags to the long ones they stand for
+var flagAliases = map[string]string{
+	"h": "help",
+	"m": "model",
+	"j": "joystick",
+	"w": "wav",
+	"v": "record",
+	"s": "save",
+	"o": "snapshot",
+	"x": "rzx-record",
+	"f": "frames",
+	"r": "real-time",
+}
+
+const usage = `Usage: %s [options] [filename...]
+Options:
+  -h, --help           Show this help message
+      --config FILE    Read settings from FILE (default: omse.conf in the
+                       user's config directory, such as ~/.config/omse)
+  -m, --model MODEL    Emulate a 48K (the default), 128K, +2, +2A or +3
+      --rom FILE       Load a ROM image, in place of the model's own; give
+                       it more than once for a model with several ROMs
+      --rom-dir DIR    Find the model's own ROM image in DIR (default: .)
+      --speed N        Run at N times the real speed, or at N%%, or
+                       unlimited (default: 1)
+      --sync NAME      Keep time by the sound card (audio, the default),
+                       the display's refresh (vsync) or the clock (timer)
+      --no-auto-warp   Don't run as fast as possible while loading a tape
+      --show-speed     Show the frame rate and clock speed over the picture
+      --no-sound       Run without sound
+      --ulaplus        Add a ULAplus palette extension
+  -j, --joystick TYPE  Plug in a Kempston, Sinclair1, Sinclair2 or Cursor
+                       joystick; give two, split by a comma, for a second
+                       player
+      --joystick-keys UP,DOWN,LEFT,RIGHT,FIRE
+                       Keys for the first joystick (default: the keypad)
+  -w, --wav FILE       Record the sound output to a WAV file
+  -v, --record FILE    Record video to a .gif, .png (APNG) or .y4m file,
+                       and the sound to a .wav file beside it
+  -r, --real-time      Load tapes in real time rather than instantly
+  -s, --save FILE      Save to a .tap, .tzx or .csw file
+  -o, --snapshot FILE  Save a .z80, .sna or .szx snapshot on exit
+  -x, --rzx-record FILE
+                       Record input to an RZX file for exact replay
+      --headless       Run without a window or sound, as fast as possible
+  -f, --frames N       Frames to run headless (default: 250)
+      --screenshot FILE
+                       Save the last frame as a PNG image on exit
+      --scale N        Start the window at N times the size of the
+                       picture, which may be fractional (default: 2)
+      --integer-scale  Only scale by whole numbers to fit the window
+      --square-pixels  Show square pixels rather than a 4:3 picture
+      --no-interlace   Turn off the interlace and phosphor simulation
+      --palette NAME   Colours: measured (the default) or pure
+      --filter NAME    Filter the picture: none (the default),
+                       scanlines, mask (a shadow mask) or tv (both)
+      --fullscreen     Fill the screen; Alt+Enter switches
+Flags may be written with one dash or two, and everything after -- is a
+file. The config file takes the long names of the flags, one to a line,
+as name = value, where the value may be in double quotes as in Go. Lines
+starting with # or ; are comments, and [section] lines are skipped; the
+command line overrides the file.
+
+Without a ROM, boot into 48.rom, 128.rom, plus2.rom, plus2a.rom or
+plus3.rom. A .dsk file goes in the +3's drive A:. Game controllers work
+the joysticks; F5 and F6 change their interfaces. F7 starts and stops
+recording a GIF, and F8 recording input to an RZX file. F9 rewinds a
+second, as far back as thirty seconds. F10 shows the debugger, where
+clicking an instruction sets a breakpoint and clicking a byte edits it;
+F11 steps an instruction and F12 a frame. Alt+Plus and Alt+Minus change
+the speed, and Alt+0 sets it back; Alt+W runs as fast as possible, Alt+A
+switches warping while loading and Alt+F shows the speed. Sound only
+plays at the real speed.
+
+F2 saves the machine to a slot and F3 loads it back; F4 chooses among
+eight slots, and F1 shows them all. Slots are kept for each program, in
+omse/states under the user's data directory (~/.local/share). They keep
+the tape, where it had got to and the disk; a disk that has changed since
+is saved and replaced by the slot's, which isn't written back to a file.
+
+(.scr, .rom, .sna, .z80, .szx, .rzx, .tap, .tzx, .csw and .dsk files are
+supported)
+`
+
+// newFlagSet makes the command line flags, setting o
+func newFlagSet(o *Options, config *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("omse", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() { fmt.Printf(usage, os.Args[0]) }
+
+	fs.StringVar(config, "config", "", "")
+	fs.Func("model", "", func(name string) error {
+		var err error
+		o.Model, err = spectrum.ModelByName(name)
+		return err
+	})
+	fs.Func("rom", "", func(filename string) error {
+		o.ROMs = append(o.ROMs, filename)
+		return nil
+	})
+	fs.StringVar(&o.ROMDir, "rom-dir", ".", "")
+	fs.Func("speed", "", func(value string) error {
+		if value == "unlimited" {
+			o.Speed = 0
+			return nil
+		}
+		percent, isPercent := strings.CutSuffix(value, "%")
+		speed, err := strconv.ParseFloat(percent, 64)
+		if isPercent {
+			speed /= 100
+		}
+		if err != nil || speed <= 0 {
+			return fmt.Errorf("bad speed %q", value)
+		}
+		o.Speed = speed
+		return nil
+	})
+	fs.Func("sync", "", func(name string) error {
+		sync, ok := Syncs[name]
+		if !ok {
+			return fmt.Errorf("unknown sync %q", name)
+		}
+		o.Sync = sync
+		o.Display.VSync = sync == SyncVsync
+		return nil
+	})
+	fs.BoolFunc("no-auto-warp", "", func(value string) error {
+		off, err := strconv.ParseBool(value)
+		o.AutoWarp = !off
+		return err
+	})
+	fs.BoolVar(&o.ShowSpeed, "show-speed", false, "")
+	fs.BoolFunc("no-sound", "", func(value string) error {
+		sound, err := strconv.ParseBool(value)
+		o.Sound = !sound
+		return err
+	})
+	fs.BoolVar(&o.ULAplus, "ulaplus", false, "")
+	fs.StringVar(&o.Joysticks, "joystick", "", "")
+	fs.StringVar(&o.JoystickKeys, "joystick-keys", "", "")
+	fs.StringVar(&o.WAV, "wav", "", "")
+	fs.StringVar(&o.Record, "record", "", "")
+	fs.BoolFunc("real-time", "", func(value string) error {
+		realTime, err := strconv.ParseBool(value)
+		o.FastLoad = !realTime
+		return err
+	})
+	fs.StringVar(&o.Save, "save", "", "")
+	fs.StringVar(&o.Snapshot, "snapshot", "", "")
+	fs.StringVar(&o.RZXRecord, "rzx-record", "", "")
+	fs.BoolVar(&o.Headless, "headless", false, "")
+	fs.Func("frames", "", func(value string) error {
+		frames, err := strconv.Atoi(value)
+		if err != nil || frames < 0 {
+			return fmt.Errorf("bad frame count %q", value)
+		}
+		o.Frames = frames
+		return nil
+	})
+	fs.StringVar(&o.Screenshot, "screenshot", "", "")
+	fs.Func("scale", "", func(value string) error {
+		scale, err := strconv.ParseFloat(value, 64)
+		if err != nil || scale <= 0 {
+			return fmt.Errorf("bad scale %q", value)
+		}
+		o.Display.Scale = scale
+		return nil
+	})
+	fs.BoolVar(&o.Display.Integer, "integer-scale", false, "")
+	fs.BoolFunc("square-pixels", "", func(value string) error {
+		square, err := strconv.ParseBool(value)
+		o.Display.Aspect = !square
+		return err
+	})
+	fs.BoolFunc("no-interlace", "", func(value string) error {
+		off, err := strconv.ParseBool(value)
+		o.Display.Interlace = !off
+		return err
+	})
+	fs.Func("palette", "", func(name string) error {
+		if _, ok := Palettes[name]; !ok {
+			return fmt.Errorf("unknown palette %q", name)
+		}
+		o.Display.Palette = name
+		return nil
+	})
+	fs.Func("filter", "", func(name string) error {
+		if _, ok := Filters[name]; !ok {
+			return fmt.Errorf("unknown filter %q", name)
+		}
+		o.Display.Filter = name
+		return nil
+	})
+	fs.BoolVar(&o.Display.Fullscreen, "fullscreen", false, "")
+
+	for short, long := range flagAliases {
+		if f := fs.Lookup(long); f != nil {
+			fs.Var(f.Value, short, "")
+		}
+	}
+	return fs
+}
+
+// ParseOptions reads the config file and then the command line, which may
+// mix flags and files. It returns flag.ErrHelp if the user asked for help,
+// which has been shown.
+func ParseOptions(args []string) (*Options, error) {
+	o := &Options{
+		Model:    spectrum.Model48K,
+		Speed:    1,
+		AutoWarp: true,
+		Display:  DefaultDisplayOptions(),
+		Sound:    true,
+		FastLoad: true,
+		Frames:   DefaultHeadlessFrames,
+	}
+	var config string
+	fs := newFlagSet(o, &config)
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%v (see --help)", err)
+		}
+		rest := fs.Args()
+		if parsed := args[:len(args)-len(rest)]; len(parsed) > 0 && parsed[len(parsed)-1] == "--" {
+			// Everything after -- is a file, even if it starts with a dash
+			o.Files = append(o.Files, rest...)
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		o.Files = append(o.Files, rest[0])
+		args = rest[1:]
+	}
+
+	// The config file only sets what the command line didn't
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		if long, ok := flagAliases[f.Name]; ok {
+			set[long] = true
+		} else {
+			set[f.Name] = true
+		}
+	})
+	if config == "" {
+		dir, err := os.UserConfigDir()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			// Continue without ROM, we'll just use the pattern
+			return o, nil
+		}
+		config = filepath.Join(dir, "omse", "omse.conf")
+		if _, err := os.Stat(config); errors.Is(err, os.ErrNotExist) {
+			return o, nil
+		}
+	}
+	if err := loadConfig(fs, config, set); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// loadConfig sets the flags that the command line didn't from a config
+// file of name = value lines. Values may be quoted; lines starting with #
+// or ; are comments, and [section] headers are ignored.
+func loadConfig(fs *flag.FlagSet, filename string, set map[string]bool) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", filename, n+1)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: bad quoted value", filename, n+1)
+			}
+		}
+		if fs.Lookup(name) == nil || name == "config" || name == "help" || len(name) == 1 {
+			return fmt.Errorf("%s:%d: unknown setting %q", filename, n+1, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", filename, n+1, name, err)
 		}
 	}
+	return nil
+}
 
-	err = system.Run()
+func main() {
+	options, err := ParseOptions(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err == nil {
+		err = run(options)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// run runs OMSE with the given options
+func run(o *Options) error {
+	system, err := NewSystem(o)
+	if err != nil {
+		return err
+	}
+	defer system.Close()
+
+	if o.Joysticks != "" {
+		for player, name := range strings.SplitN(o.Joysticks, ",", 2) {
+			iface, err := joystick.ParseInterface(name)
+			if err != nil {
+				return err
+			}
+			system.SetJoystick(player, iface)
+		}
+	}
+	if o.JoystickKeys != "" {
+		keys, err := ParseJoystickKeys(o.JoystickKeys)
+		if err != nil {
+			return err
+		}
+		system.SetJoystickKeys(keys)
+	}
+	system.SetFastLoad(o.FastLoad)
+	if o.WAV != "" {
+		if err := system.StartWAVCapture(o.WAV); err != nil {
+			return err
+		}
+	}
+	if o.Record != "" {
+		if err := system.StartRecording(o.Record); err != nil {
+			return err
+		}
+	}
+	if o.Save != "" {
+		if err := system.StartTapeSave(o.Save); err != nil {
+			return err
+		}
+	}
+
+	roms := o.ROMs
+	rzxFile := ""
+	for _, file := range o.Files {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".rom":
+			roms = append(roms, file)
+		case ".sna":
+			err = system.LoadSNA(file)
+		case ".z80":
+			err = system.LoadZ80(file)
+		case ".szx":
+			err = system.LoadSZX(file)
+		case ".rzx":
+			// Replay it once the ROMs are in
+			rzxFile = file
+		case ".tap", ".tzx", ".csw":
+			// Insert the tape, ready for LOAD ""
+			err = system.InsertTape(file)
+		case ".dsk":
+			// Put the disk in drive A:
+			err = system.InsertDisk(file)
+		case ".scr":
+			err = system.Memory().LoadFromFile(file, 0x4000, 6912)
+		default:
+			err = fmt.Errorf("unknown file type: %s", file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Load the ROMs given, one after another, or else the model's own
+	loaded := 0
+	for _, rom := range roms {
+		n, err := system.Memory().LoadROMFile(rom, loaded)
+		if err != nil {
+			return err
+		}
+		loaded += n
+	}
+	if loaded == 0 {
+		rom := filepath.Join(o.ROMDir, o.Model.ROMFile)
+		if _, err := system.Memory().LoadROMFile(rom, 0); err != nil {
+			// Carry on with the test pattern on the screen
+			fmt.Fprintf(os.Stderr, "Warning: %v, running without a ROM (try --rom-dir)\n", err)
+		}
+	}
+
+	// Save states are kept for the program loaded
+	if err := system.UseSlotsFor(o.Files); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+
+	// Input recordings run from snapshots that rely on the ROMs
+	if rzxFile != "" {
+		if err := system.PlayRZX(rzxFile); err != nil {
+			return err
+		}
+	}
+	if o.RZXRecord != "" {
+		if err := system.StartRZXRecording(o.RZXRecord); err != nil {
+			return err
+		}
+	}
+
+	if o.Headless {
+		err = system.RunHeadless(o.Frames)
+	} else {
+		err = system.Run()
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.Screenshot != "" {
+		if err := system.framebuffer.SavePNG(o.Screenshot); err != nil {
+			return err
+		}
+	}
+	if o.Snapshot != "" {
+		if err := system.SaveSnapshot(o.Snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
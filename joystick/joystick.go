@@ -0,0 +1,147 @@
+// Package joystick emulates the Spectrum's joystick interfaces.
+//
+// A Kempston interface has a port of its own that reads the stick's
+// switches. The Sinclair (Interface 2) and Cursor joysticks
+// instead press keys: the Sinclair ports share the number keys 1-5 and
+// 6-0, and a Cursor joystick presses the keys with the cursor arrows
+// on them, so their switches appear in the keyboard matrix.
+package joystick
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Button is a set of joystick switches, in the bit order of the Kempston
+// interface
+type Button byte
+
+const (
+	Right Button = 1 << iota
+	Left
+	Down
+	Up
+	Fire
+
+	AllButtons = Right | Left | Down | Up | Fire
+)
+
+// Interface is a type of joystick interface
+type Interface int
+
+const (
+	None Interface = iota
+	Kempston
+	Sinclair1 // Interface 2's first port, on keys 6-0
+	Sinclair2 // Interface 2's second port, on keys 1-5
+	Cursor
+)
+
+// Interfaces lists every interface, in the order to cycle through them
+var Interfaces = []Interface{None, Kempston, Sinclair1, Sinclair2, Cursor}
+
+func (i Interface) String() string {
+	switch i {
+	case None:
+		return "none"
+	case Kempston:
+		return "Kempston"
+	case Sinclair1:
+		return "Sinclair 1"
+	case Sinclair2:
+		return "Sinclair 2"
+	case Cursor:
+		return "Cursor"
+	}
+	return fmt.Sprintf("Interface(%d)", int(i))
+}
+
+// ParseInterface finds an interface by a name such as "kempston",
+// "sinclair1" or "none"
+func ParseInterface(name string) (Interface, error) {
+	switch strings.ReplaceAll(strings.ToLower(name), " ", "") {
+	case "none", "":
+		return None, nil
+	case "kempston":
+		return Kempston, nil
+	case "sinclair1", "sinclair", "if2":
+		return Sinclair1, nil
+	case "sinclair2":
+		return Sinclair2, nil
+	case "cursor", "protek", "agf":
+		return Cursor, nil
+	}
+	return None, fmt.Errorf("unknown joystick interface: %s", name)
+}
+
+// Port address of the Kempston interface. It only looks at A5, so it
+// answers to 0x1F among others.
+const (
+	KempstonMask  = 0x0020
+	KempstonMatch = 0x0000
+)
+
+// matrixKey is a key position in the Spectrum's keyboard matrix
+type matrixKey struct {
+	halfRow int // Address line A8+halfRow selects it
+	bit     int
+}
+
+// Keys the matrix interfaces press for Right, Left, Down, Up and Fire
+var matrixKeys = map[Interface][5]matrixKey{
+	Sinclair1: {{4, 3}, {4, 4}, {4, 2}, {4, 1}, {4, 0}}, // 7, 6, 8, 9, 0
+	Sinclair2: {{3, 1}, {3, 0}, {3, 2}, {3, 3}, {3, 4}}, // 2, 1, 3, 4, 5
+	Cursor:    {{4, 2}, {3, 4}, {4, 4}, {4, 3}, {4, 0}}, // 8, 5, 6, 7, 0
+}
+
+// Joystick is a joystick plugged into an interface
+type Joystick struct {
+	Interface Interface
+	state     Button
+}
+
+// Press closes the given switches
+func (j *Joystick) Press(b Button) {
+	j.state |= b & AllButtons
+}
+
+// Release opens the given switches
+func (j *Joystick) Release(b Button) {
+	j.state &^= b
+}
+
+// Set sets the state of every switch at once
+func (j *Joystick) Set(b Button) {
+	j.state = b & AllButtons
+}
+
+// State returns the switches that are closed
+func (j *Joystick) State() Button {
+	return j.state
+}
+
+// Kempston returns what the Kempston port reads: the closed switches, or
+// nothing if the joystick isn't on a Kempston interface
+func (j *Joystick) Kempston() byte {
+	if j.Interface != Kempston {
+		return 0
+	}
+	return byte(j.state)
+}
+
+// ScanLines returns the keyboard lines the joystick holds down when the
+// half-rows whose bits are set in halfRows are scanned, in the same form
+// as a kbd.Matrix
+func (j *Joystick) ScanLines(halfRows uint16) uint16 {
+	keys, ok := matrixKeys[j.Interface]
+	if !ok {
+		return 0
+	}
+	var lines uint16
+	for i, key := range keys {
+		if j.state&(1<<i) != 0 && halfRows&(1<<key.halfRow) != 0 {
+			lines |= 1 << key.bit
+		}
+	}
+	return lines
+}
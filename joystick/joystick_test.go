@@ -0,0 +1,69 @@
+package joystick
+
+import "testing"
+
+func TestKempston(t *testing.T) {
+	j := &Joystick{Interface: Kempston}
+	j.Press(Up | Fire)
+	if got := j.Kempston(); got != 0x18 {
+		t.Errorf("Kempston port reads 0x%02X, want 0x18", got)
+	}
+	j.Release(Fire)
+	if got := j.Kempston(); got != 0x08 {
+		t.Errorf("Kempston port reads 0x%02X after releasing fire", got)
+	}
+	if j.ScanLines(0xFF) != 0 {
+		t.Error("Kempston joystick shows up elsewhere")
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	const (
+		row1to5 = 1 << 3
+		row6to0 = 1 << 4
+	)
+	tests := []struct {
+		iface   Interface
+		button  Button
+		halfRow uint16
+		lines   uint16
+	}{
+		{Sinclair1, Left, row6to0, 0x10},  // 6
+		{Sinclair1, Right, row6to0, 0x08}, // 7
+		{Sinclair1, Down, row6to0, 0x04},  // 8
+		{Sinclair1, Up, row6to0, 0x02},    // 9
+		{Sinclair1, Fire, row6to0, 0x01},  // 0
+		{Sinclair2, Left, row1to5, 0x01},  // 1
+		{Sinclair2, Fire, row1to5, 0x10},  // 5
+		{Cursor, Left, row1to5, 0x10},     // 5
+		{Cursor, Down, row6to0, 0x10},     // 6
+		{Cursor, Up, row6to0, 0x08},       // 7
+		{Cursor, Right, row6to0, 0x04},    // 8
+		{Cursor, Fire, row6to0, 0x01},     // 0
+	}
+	for _, test := range tests {
+		j := &Joystick{Interface: test.iface}
+		j.Press(test.button)
+		if got := j.ScanLines(test.halfRow); got != test.lines {
+			t.Errorf("%v %05b gives lines 0x%02X, want 0x%02X", test.iface, test.button, got, test.lines)
+		}
+		if got := j.ScanLines(^test.halfRow); got != 0 {
+			t.Errorf("%v %05b shows in other half-rows: 0x%02X", test.iface, test.button, got)
+		}
+		if j.Kempston() != 0 {
+			t.Errorf("%v shows on the Kempston port", test.iface)
+		}
+	}
+}
+
+func TestParseInterface(t *testing.T) {
+	for _, iface := range Interfaces {
+		got, err := ParseInterface(iface.String())
+		if err != nil || got != iface {
+			t.Errorf("ParseInterface(%q) = %v, %v", iface.String(), got, err)
+		}
+	}
+	if _, err := ParseInterface("atari"); err == nil {
+		t.Error("parsed an unknown interface")
+	}
+}
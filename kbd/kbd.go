@@ -0,0 +1,201 @@
+// Package kbd emulates a keyboard matrix of the kind found in most 8-bit
+// computers.
+//
+// Keys sit at the crossing of a column and a line. The host registers the
+// keys it wants to use, each identified by an arbitrary Key code, and
+// presses and releases them. The emulated system scans the matrix by
+// activating columns and reading back which lines are active, or the
+// other way around.
+//
+// A key may be registered together with modifier keys (such as a shift
+// key), which are pressed along with it. Key releases can be made sticky
+// so that keys pressed and released faster than the emulated system scans
+// the keyboard are still seen.
+package kbd
+
+import "fmt"
+
+// Matrix limits
+const (
+	MaxColumns   = 16
+	MaxLines     = 16
+	MaxModifiers = 4
+)
+
+// Key is a host-chosen code that identifies a registered key, for example
+// an ASCII character
+type Key int
+
+// position of a key in the matrix
+type position struct {
+	column, line int
+}
+
+// keyDef describes what a registered key presses in the matrix
+type keyDef struct {
+	pos       position
+	modifiers uint8 // bit n set: modifier n is pressed along with the key
+}
+
+// pressedKey tracks a key that is held down or waiting for its sticky
+// period to run out
+type pressedKey struct {
+	key      Key
+	frame    uint64 // frame the key was pressed in
+	released bool
+}
+
+// Matrix is a keyboard matrix with registered keys
+type Matrix struct {
+	keys      map[Key]keyDef
+	modifiers [MaxModifiers]position
+	pressed   []pressedKey
+	frame     uint64
+
+	// StickyFrames is the minimum number of frames a key stays pressed
+	StickyFrames uint64
+
+	// lines[c] has bit n set if the key at column c, line n is pressed
+	lines [MaxColumns]uint16
+}
+
+// New creates an empty keyboard matrix. Key releases are delayed until
+// the key has been held for at least stickyFrames calls to Update.
+func New(stickyFrames uint64) *Matrix {
+	return &Matrix{
+		keys:         make(map[Key]keyDef),
+		StickyFrames: stickyFrames,
+	}
+}
+
+func checkPosition(column, line int) {
+	if column < 0 || column >= MaxColumns || line < 0 || line >= MaxLines {
+		panic(fmt.Sprintf("kbd: invalid matrix position (%d, %d)", column, line))
+	}
+}
+
+// RegisterModifier places modifier mod (0 to MaxModifiers-1) in the matrix
+func (m *Matrix) RegisterModifier(mod int, column, line int) {
+	if mod < 0 || mod >= MaxModifiers {
+		panic(fmt.Sprintf("kbd: invalid modifier %d", mod))
+	}
+	checkPosition(column, line)
+	m.modifiers[mod] = position{column, line}
+}
+
+// RegisterKey places key in the matrix. Every modifier whose bit is set
+// in modifiers is pressed whenever the key is pressed.
+func (m *Matrix) RegisterKey(key Key, column, line int, modifiers uint8) {
+	checkPosition(column, line)
+	m.keys[key] = keyDef{pos: position{column, line}, modifiers: modifiers}
+}
+
+// Registered reports whether key has been registered
+func (m *Matrix) Registered(key Key) bool {
+	_, ok := m.keys[key]
+	return ok
+}
+
+// KeyDown presses a key. Unregistered keys are ignored.
+func (m *Matrix) KeyDown(key Key) {
+	if _, ok := m.keys[key]; !ok {
+		return
+	}
+	for i := range m.pressed {
+		if m.pressed[i].key == key {
+			// Pressed again before the sticky release expired
+			m.pressed[i].frame = m.frame
+			m.pressed[i].released = false
+			return
+		}
+	}
+	m.pressed = append(m.pressed, pressedKey{key: key, frame: m.frame})
+	m.updateLines()
+}
+
+// KeyUp releases a key. If the key has been held for less than
+// StickyFrames, it is released by a later Update instead.
+func (m *Matrix) KeyUp(key Key) {
+	for i := range m.pressed {
+		if m.pressed[i].key == key {
+			m.pressed[i].released = true
+		}
+	}
+	m.expire()
+}
+
+// IsPressed reports whether key currently counts as pressed
+func (m *Matrix) IsPressed(key Key) bool {
+	for _, p := range m.pressed {
+		if p.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseAll releases every key immediately, ignoring stickiness
+func (m *Matrix) ReleaseAll() {
+	m.pressed = m.pressed[:0]
+	m.updateLines()
+}
+
+// Update advances the sticky key timer by one frame. Call it once per
+// emulated video frame.
+func (m *Matrix) Update() {
+	m.frame++
+	m.expire()
+}
+
+// expire drops released keys that have been held long enough
+func (m *Matrix) expire() {
+	kept := m.pressed[:0]
+	for _, p := range m.pressed {
+		if !p.released || m.frame-p.frame < m.StickyFrames {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) != len(m.pressed) {
+		m.pressed = kept
+		m.updateLines()
+	}
+}
+
+// updateLines recomputes the matrix state from the pressed keys
+func (m *Matrix) updateLines() {
+	m.lines = [MaxColumns]uint16{}
+	for _, p := range m.pressed {
+		def := m.keys[p.key]
+		m.lines[def.pos.column] |= 1 << def.pos.line
+		for mod := 0; mod < MaxModifiers; mod++ {
+			if def.modifiers&(1<<mod) != 0 {
+				pos := m.modifiers[mod]
+				m.lines[pos.column] |= 1 << pos.line
+			}
+		}
+	}
+}
+
+// ScanLines returns the active lines when the columns whose bits are set
+// in columns are activated
+func (m *Matrix) ScanLines(columns uint16) uint16 {
+	var lines uint16
+	for c := 0; c < MaxColumns; c++ {
+		if columns&(1<<c) != 0 {
+			lines |= m.lines[c]
+		}
+	}
+	return lines
+}
+
+// ScanColumns returns the active columns when the lines whose bits are
+// set in lines are activated
+func (m *Matrix) ScanColumns(lines uint16) uint16 {
+	var columns uint16
+	for c := 0; c < MaxColumns; c++ {
+		if m.lines[c]&lines != 0 {
+			columns |= 1 << c
+		}
+	}
+	return columns
+}
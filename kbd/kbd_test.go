@@ -0,0 +1,100 @@
+package kbd
+
+import "testing"
+
+// spectrum lays out a few keys the way the Spectrum does: eight half rows,
+// the columns, of five keys, the lines, with CAPS SHIFT as modifier 0
+func spectrum(sticky uint64) *Matrix {
+	m := New(sticky)
+	m.RegisterModifier(0, 0, 0) // CAPS SHIFT
+	m.RegisterKey('a', 1, 0, 0)
+	m.RegisterKey('s', 1, 1, 0)
+	m.RegisterKey('0', 4, 0, 0)
+	m.RegisterKey('\b', 4, 0, 1) // DELETE is CAPS SHIFT+0
+	m.RegisterKey(' ', 7, 0, 0)
+	return m
+}
+
+func TestScanLines(t *testing.T) {
+	m := spectrum(0)
+	m.KeyDown('s')
+	m.KeyDown(' ')
+	tests := []struct {
+		columns uint16
+		want    uint16
+	}{
+		{0x01, 0x00}, // CAPS SHIFT..V
+		{0x02, 0x02}, // A..G: S
+		{0x80, 0x01}, // SPACE..B
+		{0x82, 0x03}, // Both half rows at once
+		{0xFF, 0x03},
+		{0x00, 0x00},
+	}
+	for _, test := range tests {
+		if got := m.ScanLines(test.columns); got != test.want {
+			t.Errorf("ScanLines(%02X) = %02X; want %02X", test.columns, got, test.want)
+		}
+	}
+	if got := m.ScanColumns(0x01); got != 0x80 {
+		t.Errorf("ScanColumns(01) = %02X; want 80", got)
+	}
+
+	m.KeyUp('s')
+	if got := m.ScanLines(0x02); got != 0 {
+		t.Errorf("ScanLines(02) after release = %02X; want 00", got)
+	}
+}
+
+func TestModifiers(t *testing.T) {
+	m := spectrum(0)
+	m.KeyDown('\b')
+	if m.ScanLines(0x01) != 0x01 || m.ScanLines(0x10) != 0x01 {
+		t.Errorf("DELETE pressed CAPS SHIFT %02X, 0 %02X; want both", m.ScanLines(0x01), m.ScanLines(0x10))
+	}
+	m.KeyUp('\b')
+	if m.ScanLines(0xFF) != 0 {
+		t.Error("DELETE released but keys still down")
+	}
+}
+
+func TestUnregistered(t *testing.T) {
+	m := spectrum(0)
+	if m.Registered('z') {
+		t.Error("'z' registered")
+	}
+	m.KeyDown('z')
+	if m.IsPressed('z') || m.ScanLines(0xFF) != 0 {
+		t.Error("unregistered key pressed")
+	}
+}
+
+func TestStickyKeys(t *testing.T) {
+	m := spectrum(2)
+	m.KeyDown('a')
+	m.KeyUp('a')
+	for frame := range 2 {
+		if m.ScanLines(0x02) != 0x01 {
+			t.Fatalf("frame %d: key released before its sticky frames", frame)
+		}
+		m.Update()
+	}
+	if m.IsPressed('a') || m.ScanLines(0x02) != 0 {
+		t.Error("key still down after its sticky frames")
+	}
+
+	// A key held longer than the sticky frames goes at once
+	m.KeyDown('a')
+	m.Update()
+	m.Update()
+	m.KeyUp('a')
+	if m.IsPressed('a') {
+		t.Error("key held past its sticky frames still down after release")
+	}
+
+	m.KeyDown('a')
+	m.KeyDown(' ')
+	m.ReleaseAll()
+	if m.ScanLines(0xFF) != 0 {
+		t.Error("keys down after ReleaseAll")
+	}
+}
@@ -0,0 +1,212 @@
+// Package mem provides a banked memory system for 8-bit computers with a
+// 16-bit address space.
+//
+// The address space is divided into equally sized pages. Each page has a
+// read mapping and a write mapping, which are set independently, so a page
+// can, for example, read from ROM while writes go to the RAM underneath.
+// Mapping only updates page pointers, so bank switching is cheap.
+package mem
+
+import "fmt"
+
+// PageType describes what a page is mapped to
+type PageType uint8
+
+const (
+	Unmapped PageType = iota // reads return the open bus value, writes are ignored
+	RAM                      // reads and writes go to a byte slice
+	ROM                      // reads come from a byte slice, writes are ignored
+	Callback                 // accesses are forwarded to a Device
+)
+
+func (t PageType) String() string {
+	switch t {
+	case Unmapped:
+		return "unmapped"
+	case RAM:
+		return "RAM"
+	case ROM:
+		return "ROM"
+	case Callback:
+		return "callback"
+	}
+	return fmt.Sprintf("PageType(%d)", uint8(t))
+}
+
+// Device is implemented by memory-mapped devices. The address passed to
+// the device is the full CPU address, not an offset into the page.
+type Device interface {
+	Read(addr uint16) byte
+	Write(addr uint16, value byte)
+}
+
+// page is one page of either the read or write mapping
+type page struct {
+	kind PageType
+	data []byte // page-sized slice for RAM and ROM pages
+	dev  Device // device for Callback pages
+}
+
+// Memory is a paged 64K address space
+type Memory struct {
+	pageSize  int
+	pageShift uint
+	pageMask  uint16
+	read      []page
+	write     []page
+
+	// OpenBus is the value returned when reading from an unmapped page
+	OpenBus byte
+}
+
+// AddressSpace is the size of the Z80 address space
+const AddressSpace = 0x10000
+
+// New creates a memory system with everything unmapped. The page size must
+// be a power of two between 256 bytes and 64K.
+func New(pageSize int) (*Memory, error) {
+	if pageSize < 0x100 || pageSize > AddressSpace || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	shift := uint(0)
+	for (1 << shift) < pageSize {
+		shift++
+	}
+	numPages := AddressSpace / pageSize
+	return &Memory{
+		pageSize:  pageSize,
+		pageShift: shift,
+		pageMask:  uint16(pageSize - 1),
+		read:      make([]page, numPages),
+		write:     make([]page, numPages),
+		OpenBus:   0xff,
+	}, nil
+}
+
+// PageSize returns the size of a page in bytes
+func (m *Memory) PageSize() int {
+	return m.pageSize
+}
+
+// NumPages returns the number of pages in the address space
+func (m *Memory) NumPages() int {
+	return len(m.read)
+}
+
+// pageRange checks that a mapping is page aligned and returns the first
+// page index and the number of pages. Misaligned mappings are programming
+// errors, so they panic.
+func (m *Memory) pageRange(addr uint16, size int) (int, int) {
+	if int(addr)&(m.pageSize-1) != 0 || size&(m.pageSize-1) != 0 {
+		panic(fmt.Sprintf("mem: mapping at 0x%04X of size 0x%X is not aligned to page size 0x%X",
+			addr, size, m.pageSize))
+	}
+	if int(addr)+size > AddressSpace {
+		panic(fmt.Sprintf("mem: mapping at 0x%04X of size 0x%X extends past end of address space",
+			addr, size))
+	}
+	return int(addr) >> m.pageShift, size >> m.pageShift
+}
+
+// mapPages points count pages starting at first to consecutive chunks of data
+func (m *Memory) mapPages(pages []page, addr uint16, kind PageType, data []byte) {
+	first, count := m.pageRange(addr, len(data))
+	for i := 0; i < count; i++ {
+		offset := i * m.pageSize
+		pages[first+i] = page{kind: kind, data: data[offset : offset+m.pageSize]}
+	}
+}
+
+// MapRAM maps data for reading and writing at addr. The slice is used
+// directly, not copied, so several mappings may share the same RAM bank.
+func (m *Memory) MapRAM(addr uint16, data []byte) {
+	m.mapPages(m.read, addr, RAM, data)
+	m.mapPages(m.write, addr, RAM, data)
+}
+
+// MapROM maps data for reading at addr. Writes to the region are ignored.
+func (m *Memory) MapROM(addr uint16, data []byte) {
+	m.mapPages(m.read, addr, ROM, data)
+	m.mapPages(m.write, addr, ROM, data)
+}
+
+// MapRead changes only the read mapping of the region at addr, leaving
+// the write mapping untouched.
+func (m *Memory) MapRead(addr uint16, data []byte) {
+	m.mapPages(m.read, addr, RAM, data)
+}
+
+// MapWrite changes only the write mapping of the region at addr, leaving
+// the read mapping untouched.
+func (m *Memory) MapWrite(addr uint16, data []byte) {
+	m.mapPages(m.write, addr, RAM, data)
+}
+
+// MapDevice forwards reads and writes in the region at addr to dev
+func (m *Memory) MapDevice(addr uint16, size int, dev Device) {
+	first, count := m.pageRange(addr, size)
+	for i := first; i < first+count; i++ {
+		m.read[i] = page{kind: Callback, dev: dev}
+		m.write[i] = page{kind: Callback, dev: dev}
+	}
+}
+
+// Unmap removes both mappings of the region at addr
+func (m *Memory) Unmap(addr uint16, size int) {
+	first, count := m.pageRange(addr, size)
+	for i := first; i < first+count; i++ {
+		m.read[i] = page{}
+		m.write[i] = page{}
+	}
+}
+
+// Read reads a byte as the CPU would see it
+func (m *Memory) Read(addr uint16) byte {
+	p := &m.read[addr>>m.pageShift]
+	if p.data != nil {
+		return p.data[addr&m.pageMask]
+	}
+	if p.dev != nil {
+		return p.dev.Read(addr)
+	}
+	return m.OpenBus
+}
+
+// Write writes a byte as the CPU would, honouring ROM protection
+func (m *Memory) Write(addr uint16, value byte) {
+	p := &m.write[addr>>m.pageShift]
+	switch p.kind {
+	case RAM:
+		p.data[addr&m.pageMask] = value
+	case Callback:
+		p.dev.Write(addr, value)
+	}
+}
+
+// Poke writes a byte into whatever is currently mapped for reading at
+// addr, even if it is ROM. It is meant for loaders and debuggers. Pokes
+// to unmapped or callback pages are ignored.
+func (m *Memory) Poke(addr uint16, value byte) {
+	p := &m.read[addr>>m.pageShift]
+	if p.data != nil {
+		p.data[addr&m.pageMask] = value
+	}
+}
+
+// Load pokes a block of bytes starting at addr, wrapping at the end of
+// the address space.
+func (m *Memory) Load(addr uint16, data []byte) {
+	for i, b := range data {
+		m.Poke(addr+uint16(i), b)
+	}
+}
+
+// ReadType returns what the page containing addr is mapped to for reading
+func (m *Memory) ReadType(addr uint16) PageType {
+	return m.read[addr>>m.pageShift].kind
+}
+
+// WriteType returns what the page containing addr is mapped to for writing
+func (m *Memory) WriteType(addr uint16) PageType {
+	return m.write[addr>>m.pageShift].kind
+}
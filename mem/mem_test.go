@@ -0,0 +1,139 @@
+package mem
+
+import "testing"
+
+func TestNewPageSize(t *testing.T) {
+	for _, size := range []int{0, 0x80, 0x300, 0x20000} {
+		if _, err := New(size); err == nil {
+			t.Errorf("New(%#x) succeeded; want an error", size)
+		}
+	}
+	m, err := New(0x4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.PageSize() != 0x4000 || m.NumPages() != 4 {
+		t.Errorf("16K pages: size %#x, %d pages; want 0x4000, 4", m.PageSize(), m.NumPages())
+	}
+}
+
+func TestUnmapped(t *testing.T) {
+	m, _ := New(0x4000)
+	if got := m.Read(0x1234); got != 0xFF {
+		t.Errorf("unmapped read = %02X; want FF", got)
+	}
+	m.OpenBus = 0x38
+	m.Write(0x1234, 0x55) // Ignored
+	if got := m.Read(0x1234); got != 0x38 {
+		t.Errorf("unmapped read = %02X; want the open bus, 38", got)
+	}
+	if m.ReadType(0) != Unmapped || m.WriteType(0) != Unmapped {
+		t.Errorf("page 0 is %v/%v; want unmapped", m.ReadType(0), m.WriteType(0))
+	}
+}
+
+func TestROMProtection(t *testing.T) {
+	m, _ := New(0x4000)
+	rom := make([]byte, 0x4000)
+	rom[0x10] = 0xC3
+	m.MapROM(0x0000, rom)
+	m.Write(0x0010, 0x00)
+	if got := m.Read(0x0010); got != 0xC3 {
+		t.Errorf("ROM read after write = %02X; want C3", got)
+	}
+	m.Poke(0x0010, 0x76)
+	if got := m.Read(0x0010); got != 0x76 {
+		t.Errorf("ROM read after poke = %02X; want 76", got)
+	}
+}
+
+// TestBankSwitching pages banks in and out of the top 16K the way a 128K
+// Spectrum does, checking each bank keeps its own contents and that a
+// bank mapped twice is shared
+func TestBankSwitching(t *testing.T) {
+	m, _ := New(0x4000)
+	var banks [8][]byte
+	for i := range banks {
+		banks[i] = make([]byte, 0x4000)
+	}
+	m.MapRAM(0x4000, banks[5])
+	m.MapRAM(0x8000, banks[2])
+	for i := range banks {
+		m.MapRAM(0xC000, banks[i])
+		m.Write(0xC000, byte(i))
+		m.Write(0xFFFF, byte(0x80|i))
+	}
+	for i := range banks {
+		m.MapRAM(0xC000, banks[i])
+		if got := m.Read(0xC000); got != byte(i) {
+			t.Errorf("bank %d: read %02X; want %02X", i, got, i)
+		}
+		if got := m.Read(0xFFFF); got != byte(0x80|i) {
+			t.Errorf("bank %d: top byte %02X; want %02X", i, got, 0x80|i)
+		}
+	}
+
+	// Bank 5 at 0xC000 is also the screen at 0x4000
+	m.MapRAM(0xC000, banks[5])
+	m.Write(0x4000, 0xAA)
+	if got := m.Read(0xC000); got != 0xAA {
+		t.Errorf("bank 5 through 0xC000 = %02X; want AA, written through 0x4000", got)
+	}
+}
+
+func TestSplitReadWrite(t *testing.T) {
+	m, _ := New(0x2000)
+	rom := make([]byte, 0x2000)
+	ram := make([]byte, 0x2000)
+	rom[0] = 0x11
+	m.MapRead(0x0000, rom)
+	m.MapWrite(0x0000, ram)
+	m.Write(0x0000, 0x22)
+	if m.Read(0x0000) != 0x11 || ram[0] != 0x22 {
+		t.Errorf("read %02X, RAM %02X; want reads from ROM (11), writes to RAM (22)", m.Read(0), ram[0])
+	}
+}
+
+type recorder struct {
+	reads  []uint16
+	writes map[uint16]byte
+}
+
+func (r *recorder) Read(addr uint16) byte {
+	r.reads = append(r.reads, addr)
+	return byte(addr >> 8)
+}
+
+func (r *recorder) Write(addr uint16, value byte) {
+	r.writes[addr] = value
+}
+
+func TestDevice(t *testing.T) {
+	m, _ := New(0x100)
+	dev := &recorder{writes: make(map[uint16]byte)}
+	m.MapDevice(0xFE00, 0x200, dev)
+	if got := m.Read(0xFF10); got != 0xFF {
+		t.Errorf("device read = %02X; want FF", got)
+	}
+	m.Write(0xFE01, 0x42)
+	if len(dev.reads) != 1 || dev.reads[0] != 0xFF10 || dev.writes[0xFE01] != 0x42 {
+		t.Errorf("device saw reads %04X, writes %v; want the full CPU addresses", dev.reads, dev.writes)
+	}
+	if m.ReadType(0xFE00) != Callback {
+		t.Errorf("device page is %v; want callback", m.ReadType(0xFE00))
+	}
+	m.Unmap(0xFE00, 0x200)
+	if got := m.Read(0xFF10); got != 0xFF || len(dev.reads) != 1 {
+		t.Error("device still mapped after Unmap")
+	}
+}
+
+func TestMisalignedMapping(t *testing.T) {
+	m, _ := New(0x4000)
+	defer func() {
+		if recover() == nil {
+			t.Error("misaligned mapping didn't panic")
+		}
+	}()
+	m.MapRAM(0x2000, make([]byte, 0x4000))
+}
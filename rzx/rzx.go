@@ -0,0 +1,291 @@
+// Package rzx reads and writes RZX input recordings.
+//
+// An RZX file holds a snapshot and everything the program read from its
+// I/O ports afterwards, frame by frame, so that another run from the same
+// snapshot can be made to do exactly the same thing. Each frame ends with
+// an interrupt and records how many opcodes were fetched since the last
+// one; a player raises the interrupt after that many fetches, rather than
+// when its own clock says, and answers every IN from the recording.
+package rzx
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Signature starts every RZX file
+const Signature = "RZX!"
+
+// The version of the format Write writes
+const (
+	majorVersion = 0
+	minorVersion = 13
+)
+
+// Block IDs
+const (
+	blockCreator  = 0x10
+	blockSnapshot = 0x30
+	blockInput    = 0x80
+)
+
+// Lengths, including a block's ID and length
+const (
+	headerLength       = 10
+	blockHeaderLength  = 5
+	creatorLength      = 29
+	creatorNameLength  = 20
+	snapshotHeaderLen  = 17
+	snapshotTypeLength = 4
+	inputHeaderLength  = 18
+)
+
+// Flags in the blocks
+const (
+	snapshotExternal   = 0x01 // Only the name of a snapshot file
+	snapshotCompressed = 0x02
+	inputProtected     = 0x01 // Encrypted
+	inputCompressed    = 0x02
+)
+
+// repeatInputs is a frame's input count when it has the same inputs as
+// the frame before
+const repeatInputs = 0xFFFF
+
+// maxInputSize limits how much an input block may decompress to
+const maxInputSize = 64 << 20
+
+// Frame is the input for one frame: the number of opcodes fetched before
+// the interrupt that ends it, and the value of every IN in order
+type Frame struct {
+	Fetches uint16
+	Inputs  []byte
+}
+
+// Session is a run of frames, starting from a snapshot or else carrying
+// on from the end of the previous session
+type Session struct {
+	SnapshotType string // File extension of the snapshot, such as "szx"
+	Snapshot     []byte // nil to carry on from the previous session
+	TStates      uint32 // T-states into the frame at the start
+	Frames       []Frame
+}
+
+// Recording is the content of an RZX file
+type Recording struct {
+	Creator      string // The program that made it
+	CreatorMajor uint16
+	CreatorMinor uint16
+	Sessions     []*Session
+}
+
+// Read reads an RZX file. Digital signatures are ignored, and encrypted
+// input blocks can't be read.
+func Read(r io.Reader) (*Recording, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerLength || string(data[:4]) != Signature {
+		return nil, fmt.Errorf("not an RZX file")
+	}
+	if data[4] > majorVersion {
+		return nil, fmt.Errorf("unsupported RZX version %d.%d", data[4], data[5])
+	}
+
+	rec := &Recording{}
+	var pending *Session // Snapshot waiting for its input
+	for pos := headerLength; pos < len(data); {
+		if len(data)-pos < blockHeaderLength {
+			return nil, fmt.Errorf("truncated RZX block")
+		}
+		id := data[pos]
+		length := binary.LittleEndian.Uint32(data[pos+1:])
+		if length < blockHeaderLength || uint64(length) > uint64(len(data)-pos) {
+			return nil, fmt.Errorf("bad RZX block length %d", length)
+		}
+		block := data[pos+blockHeaderLength : pos+int(length)]
+		pos += int(length)
+
+		switch id {
+		case blockCreator:
+			if len(block) < creatorLength-blockHeaderLength {
+				return nil, fmt.Errorf("truncated RZX creator block")
+			}
+			name, _, _ := strings.Cut(string(block[:creatorNameLength]), "\x00")
+			rec.Creator = name
+			rec.CreatorMajor = binary.LittleEndian.Uint16(block[20:])
+			rec.CreatorMinor = binary.LittleEndian.Uint16(block[22:])
+
+		case blockSnapshot:
+			if len(block) < snapshotHeaderLen-blockHeaderLength {
+				return nil, fmt.Errorf("truncated RZX snapshot block")
+			}
+			flags := binary.LittleEndian.Uint32(block)
+			if flags&snapshotExternal != 0 {
+				return nil, fmt.Errorf("RZX refers to a snapshot in another file")
+			}
+			kind, _, _ := strings.Cut(string(block[4:8]), "\x00")
+			size := binary.LittleEndian.Uint32(block[8:])
+			snap := block[12:]
+			if flags&snapshotCompressed != 0 {
+				if snap, err = inflate(snap, size); err != nil {
+					return nil, fmt.Errorf("RZX snapshot: %v", err)
+				}
+			}
+			if uint32(len(snap)) != size {
+				return nil, fmt.Errorf("RZX snapshot is %d bytes, not %d", len(snap), size)
+			}
+			pending = &Session{SnapshotType: strings.ToLower(kind), Snapshot: snap}
+
+		case blockInput:
+			if len(block) < inputHeaderLength-blockHeaderLength {
+				return nil, fmt.Errorf("truncated RZX input block")
+			}
+			count := binary.LittleEndian.Uint32(block)
+			tstates := binary.LittleEndian.Uint32(block[5:])
+			flags := binary.LittleEndian.Uint32(block[9:])
+			if flags&inputProtected != 0 {
+				return nil, fmt.Errorf("RZX input is encrypted")
+			}
+			frames := block[13:]
+			if flags&inputCompressed != 0 {
+				if frames, err = inflate(frames, maxInputSize); err != nil {
+					return nil, fmt.Errorf("RZX input: %v", err)
+				}
+			}
+			session := pending
+			if session == nil {
+				session = &Session{}
+			}
+			pending = nil
+			session.TStates = tstates
+			if session.Frames, err = readFrames(frames, count); err != nil {
+				return nil, err
+			}
+			rec.Sessions = append(rec.Sessions, session)
+
+		default:
+			// Security information and anything newer
+		}
+	}
+	if len(rec.Sessions) == 0 {
+		return nil, fmt.Errorf("RZX file has no input")
+	}
+	return rec, nil
+}
+
+// readFrames decodes count frames of an input block
+func readFrames(data []byte, count uint32) ([]Frame, error) {
+	frames := make([]Frame, 0, min(count, uint32(len(data)/4)))
+	var previous []byte
+	for range count {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated RZX input frame")
+		}
+		fetches := binary.LittleEndian.Uint16(data)
+		n := binary.LittleEndian.Uint16(data[2:])
+		data = data[4:]
+		inputs := previous
+		if n != repeatInputs {
+			if int(n) > len(data) {
+				return nil, fmt.Errorf("truncated RZX input frame")
+			}
+			inputs = data[:n:n]
+			data = data[n:]
+		}
+		frames = append(frames, Frame{Fetches: fetches, Inputs: inputs})
+		previous = inputs
+	}
+	return frames, nil
+}
+
+// inflate decompresses zlib data of up to limit bytes
+func inflate(data []byte, limit uint32) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > limit {
+		return nil, fmt.Errorf("more than %d bytes of data", limit)
+	}
+	return out, nil
+}
+
+// deflate compresses data with zlib
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// Write writes a recording as an RZX file, compressing the snapshots and
+// input
+func Write(w io.Writer, rec *Recording) error {
+	out := []byte(Signature)
+	out = append(out, majorVersion, minorVersion)
+	out = binary.LittleEndian.AppendUint32(out, 0)
+
+	var creator [creatorLength - blockHeaderLength]byte
+	copy(creator[:creatorNameLength-1], rec.Creator)
+	binary.LittleEndian.PutUint16(creator[20:], rec.CreatorMajor)
+	binary.LittleEndian.PutUint16(creator[22:], rec.CreatorMinor)
+	out = appendBlock(out, blockCreator, creator[:])
+
+	for _, session := range rec.Sessions {
+		if session.Snapshot != nil {
+			if len(session.SnapshotType) > snapshotTypeLength-1 {
+				return fmt.Errorf("bad snapshot type %q", session.SnapshotType)
+			}
+			block := binary.LittleEndian.AppendUint32(nil, snapshotCompressed)
+			var kind [snapshotTypeLength]byte
+			copy(kind[:], session.SnapshotType)
+			block = append(block, kind[:]...)
+			block = binary.LittleEndian.AppendUint32(block, uint32(len(session.Snapshot)))
+			block = append(block, deflate(session.Snapshot)...)
+			out = appendBlock(out, blockSnapshot, block)
+		}
+
+		var frames []byte
+		var previous []byte
+		for i, f := range session.Frames {
+			frames = binary.LittleEndian.AppendUint16(frames, f.Fetches)
+			if i > 0 && len(f.Inputs) > 0 && bytes.Equal(f.Inputs, previous) {
+				frames = binary.LittleEndian.AppendUint16(frames, repeatInputs)
+				continue
+			}
+			if len(f.Inputs) >= repeatInputs {
+				return fmt.Errorf("frame %d has too many inputs: %d", i, len(f.Inputs))
+			}
+			frames = binary.LittleEndian.AppendUint16(frames, uint16(len(f.Inputs)))
+			frames = append(frames, f.Inputs...)
+			previous = f.Inputs
+		}
+		block := binary.LittleEndian.AppendUint32(nil, uint32(len(session.Frames)))
+		block = append(block, 0)
+		block = binary.LittleEndian.AppendUint32(block, session.TStates)
+		block = binary.LittleEndian.AppendUint32(block, inputCompressed)
+		block = append(block, deflate(frames)...)
+		out = appendBlock(out, blockInput, block)
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// appendBlock appends a block with its ID and length
+func appendBlock(out []byte, id byte, data []byte) []byte {
+	out = append(out, id)
+	out = binary.LittleEndian.AppendUint32(out, uint32(blockHeaderLength+len(data)))
+	return append(out, data...)
+}
@@ -0,0 +1,108 @@
+package rzx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	want := &Recording{
+		Creator:      "test",
+		CreatorMajor: 1,
+		CreatorMinor: 2,
+		Sessions: []*Session{
+			{
+				SnapshotType: "szx",
+				Snapshot:     bytes.Repeat([]byte("ZXST"), 1000),
+				TStates:      1234,
+				Frames: []Frame{
+					{Fetches: 100, Inputs: []byte{0xBF, 0xFF}},
+					{Fetches: 200, Inputs: []byte{0xBF, 0xFF}},
+					{Fetches: 300, Inputs: []byte{}},
+					{Fetches: 400, Inputs: []byte{0x1F}},
+				},
+			},
+			{
+				TStates: 99,
+				Frames:  []Frame{{Fetches: 5, Inputs: []byte{1, 2, 3}}},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 1000 {
+		t.Errorf("RZX file is %d bytes; not compressed?", buf.Len())
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recording changed:\ngot  %+v\nwant %+v", got, want)
+		for i := range got.Sessions {
+			t.Logf("session %d: %+v", i, got.Sessions[i])
+		}
+	}
+}
+
+func TestReadUncompressed(t *testing.T) {
+	file := []byte("RZX!\x00\x0D\x00\x00\x00\x00")
+
+	snapshot := []byte{0, 0, 0, 0, 'Z', '8', '0', 0, 3, 0, 0, 0, 'a', 'b', 'c'}
+	file = append(file, 0x30)
+	file = binary.LittleEndian.AppendUint32(file, uint32(5+len(snapshot)))
+	file = append(file, snapshot...)
+
+	// A security block to be skipped
+	file = append(file, 0x20, 9, 0, 0, 0, 1, 2, 3, 4)
+
+	input := []byte{2, 0, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0}
+	input = append(input, 7, 0, 2, 0, 0xAA, 0xBB) // 7 fetches, 2 INs
+	input = append(input, 8, 0, 0xFF, 0xFF)       // The same INs again
+	file = append(file, 0x80)
+	file = binary.LittleEndian.AppendUint32(file, uint32(5+len(input)))
+	file = append(file, input...)
+
+	got, err := Read(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Recording{Sessions: []*Session{{
+		SnapshotType: "z80",
+		Snapshot:     []byte("abc"),
+		TStates:      10,
+		Frames: []Frame{
+			{Fetches: 7, Inputs: []byte{0xAA, 0xBB}},
+			{Fetches: 8, Inputs: []byte{0xAA, 0xBB}},
+		},
+	}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got.Sessions[0], want.Sessions[0])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var good bytes.Buffer
+	err := Write(&good, &Recording{Sessions: []*Session{{Frames: []Frame{{Fetches: 1}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]byte{
+		"empty":     nil,
+		"signature": []byte("RZY!\x00\x0D\x00\x00\x00\x00"),
+		"no input":  []byte("RZX!\x00\x0D\x00\x00\x00\x00"),
+		"truncated": good.Bytes()[:good.Len()-1],
+		"encrypted": append([]byte("RZX!\x00\x0D\x00\x00\x00\x00\x80\x12\x00\x00\x00"),
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0),
+	}
+	for name, data := range tests {
+		if _, err := Read(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
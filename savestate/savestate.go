@@ -0,0 +1,251 @@
+// Package savestate keeps numbered slots of saved machine states in a
+// directory. A slot is an SZX snapshot, the most complete of the snapshot
+// formats, with a PNG thumbnail of the screen and a JSON file saying when
+// it was saved and what was loaded.
+//
+// The snapshot holds the tape, how far it has played and the disk in
+// drive A:, but not a command the disk controller is part way through.
+package savestate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/imneme/chips-to-go/snapshot"
+)
+
+// ThumbnailScale is how many times smaller than the screen a thumbnail is
+const ThumbnailScale = 2
+
+// Info describes a saved state
+type Info struct {
+	Slot  int       `json:"-"`
+	Time  time.Time `json:"time"`
+	Model string    `json:"model"`
+	Media []string  `json:"media,omitempty"` // Files loaded into the machine
+}
+
+// Store is a directory of slots
+type Store struct {
+	dir string
+}
+
+// New returns the store of slots in dir, which is made when the first
+// slot is saved
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Dir returns the directory the slots of a program with the given name
+// are kept in, following the XDG base directory spec: app/states/program
+// under $XDG_DATA_HOME, or under ~/.local/share when that isn't set
+func Dir(app, program string) (string, error) {
+	data := os.Getenv("XDG_DATA_HOME")
+	if !filepath.IsAbs(data) {
+		// The spec says to ignore a relative path
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		data = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(data, app, "states", filepath.Base(program)), nil
+}
+
+// FileDir returns the directory the slots of a program loaded from a file
+// are kept in, as Dir does. The name is the file's without its extension
+// and with a hash of its absolute path, so files of the same name in
+// different directories have slots of their own.
+func FileDir(app, file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	base := filepath.Base(abs)
+	name := strings.TrimSuffix(base, filepath.Ext(base)) + "-" + hex.EncodeToString(sum[:6])
+	return Dir(app, name)
+}
+
+// Dir returns the store's directory
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// path returns the name of one of a slot's files
+func (s *Store) path(slot int, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("slot%d%s", slot, ext))
+}
+
+// Save saves a snapshot in a slot, replacing what was there, with a
+// thumbnail of the screen. The time and slot of info are filled in.
+func (s *Store) Save(slot int, snap *snapshot.Snapshot, screen image.Image, info Info) error {
+	if slot < 0 {
+		return fmt.Errorf("bad slot %d", slot)
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("could not make directory: %v", err)
+	}
+	info.Slot = slot
+	info.Time = time.Now()
+	if err := writeFile(s.path(slot, ".szx"), func(w io.Writer) error {
+		return snapshot.WriteSZX(w, snap)
+	}); err != nil {
+		return err
+	}
+	if err := writeFile(s.path(slot, ".png"), func(w io.Writer) error {
+		return png.Encode(w, thumbnail(screen))
+	}); err != nil {
+		return err
+	}
+	// The slot is only used once it has its info
+	return writeFile(s.path(slot, ".json"), func(w io.Writer) error {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(info)
+	})
+}
+
+// Load returns the snapshot saved in a slot and its info
+func (s *Store) Load(slot int) (*snapshot.Snapshot, Info, error) {
+	info, err := s.Info(slot)
+	if err != nil {
+		return nil, info, err
+	}
+	filename := s.path(slot, ".szx")
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, info, fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+	snap, err := snapshot.ReadSZX(file)
+	if err != nil {
+		return nil, info, fmt.Errorf("%s: %v", filename, err)
+	}
+	return snap, info, nil
+}
+
+// Info returns the info of a slot. For an empty slot the error is
+// fs.ErrNotExist.
+func (s *Store) Info(slot int) (Info, error) {
+	info := Info{Slot: slot}
+	data, err := os.ReadFile(s.path(slot, ".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return info, fs.ErrNotExist
+	}
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("%s: %v", s.path(slot, ".json"), err)
+	}
+	return info, nil
+}
+
+// Thumbnail returns the thumbnail of a slot
+func (s *Store) Thumbnail(slot int) (image.Image, error) {
+	filename := s.path(slot, ".png")
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return img, nil
+}
+
+// List returns the info of the used slots, in order
+func (s *Store) List() ([]Info, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "slot*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var slots []int
+	for _, name := range names {
+		var slot int
+		if _, err := fmt.Sscanf(filepath.Base(name), "slot%d.json", &slot); err == nil && slot >= 0 {
+			slots = append(slots, slot)
+		}
+	}
+	// Glob sorts by name, which puts slot10 before slot2
+	slices.Sort(slots)
+	infos := make([]Info, 0, len(slots))
+	for _, slot := range slots {
+		info, err := s.Info(slot)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Delete empties a slot
+func (s *Store) Delete(slot int) error {
+	var errs []error
+	for _, ext := range []string{".json", ".szx", ".png"} {
+		if err := os.Remove(s.path(slot, ext)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeFile writes a file through a temporary one, so a slot is never
+// left half written
+func writeFile(filename string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create file: %s: %v", filename, err)
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("could not write file: %s: %v", filename, err)
+	}
+	return nil
+}
+
+// thumbnail shrinks an image by ThumbnailScale, averaging the pixels
+func thumbnail(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	thumb := image.NewRGBA(image.Rect(0, 0, b.Dx()/ThumbnailScale, b.Dy()/ThumbnailScale))
+	const n = ThumbnailScale * ThumbnailScale
+	for y := range thumb.Rect.Dy() {
+		for x := range thumb.Rect.Dx() {
+			var r, g, bl, a uint32
+			for dy := range ThumbnailScale {
+				for dx := range ThumbnailScale {
+					pr, pg, pb, pa := img.At(b.Min.X+x*ThumbnailScale+dx, b.Min.Y+y*ThumbnailScale+dy).RGBA()
+					r, g, bl, a = r+pr, g+pg, bl+pb, a+pa
+				}
+			}
+			thumb.SetRGBA(x, y, color.RGBA{
+				uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8),
+			})
+		}
+	}
+	return thumb
+}
@@ -0,0 +1,126 @@
+package savestate
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/imneme/chips-to-go/snapshot"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	store := New(filepath.Join(t.TempDir(), "game"))
+	if infos, err := store.List(); err != nil || len(infos) != 0 {
+		t.Fatalf("List of a new store = %v, %v; want nothing", infos, err)
+	}
+
+	snap := snapshot.New(snapshot.Model128K)
+	snap.PC = 0x8000
+	snap.Port7FFD = 0x13
+	snap.Write(0xC000, 0xAA)
+	screen := image.NewPaletted(image.Rect(0, 0, 8, 4), color.Palette{
+		color.RGBA{0, 0, 0, 0xFF}, color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+	})
+	for i := range screen.Pix {
+		screen.Pix[i] = byte(i % 2) // Alternate columns, grey when shrunk
+	}
+	media := []string{"/games/game.tap"}
+	for _, slot := range []int{10, 2} {
+		if err := store.Save(slot, snap, screen, Info{Model: "128K", Media: media}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, info, err := store.Load(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PC != 0x8000 || got.Port7FFD != 0x13 || got.Read(0xC000) != 0xAA {
+		t.Errorf("loaded PC %04X, 7FFD %02X, (C000) %02X; want 8000, 13, AA", got.PC, got.Port7FFD, got.Read(0xC000))
+	}
+	if info.Slot != 2 || info.Model != "128K" || !reflect.DeepEqual(info.Media, media) || info.Time.IsZero() {
+		t.Errorf("info = %+v", info)
+	}
+
+	thumb, err := store.Thumbnail(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := thumb.Bounds().Size(); size != image.Pt(4, 2) {
+		t.Errorf("thumbnail is %v; want 4x2", size)
+	}
+	if r, _, _, _ := thumb.At(0, 0).RGBA(); r>>8 != 0x7F {
+		t.Errorf("thumbnail pixel red = %02X; want 7F, the average", r>>8)
+	}
+
+	infos, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Slot != 2 || infos[1].Slot != 10 {
+		t.Errorf("List = %+v; want slots 2 and 10", infos)
+	}
+
+	if err := store.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Info(2); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Info of a deleted slot: %v; want fs.ErrNotExist", err)
+	}
+	if _, _, err := store.Load(3); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of an empty slot: %v; want fs.ErrNotExist", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", "/data")
+	dir, err := Dir("omse", "game")
+	if err != nil || dir != "/data/omse/states/game" {
+		t.Errorf("Dir = %q, %v", dir, err)
+	}
+
+	// A relative XDG_DATA_HOME is ignored
+	t.Setenv("XDG_DATA_HOME", "data")
+	t.Setenv("HOME", "/home/user")
+	dir, err = Dir("omse", "game")
+	if err != nil || dir != "/home/user/.local/share/omse/states/game" {
+		t.Errorf("Dir = %q, %v", dir, err)
+	}
+}
+
+func TestFileDir(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", "/data")
+	seen := map[string]bool{}
+	for _, file := range []string{"/games/one/game.tap", "/games/two/game.tap", "/games/one/game.tzx"} {
+		dir, err := FileDir("omse", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(dir, "/data/omse/states/game-") {
+			t.Errorf("FileDir(%q) = %q, want a directory named for the game", file, dir)
+		}
+		if seen[dir] {
+			t.Errorf("FileDir(%q) = %q, shared with another file", file, dir)
+		}
+		seen[dir] = true
+	}
+
+	// A relative path is the same file as its absolute path
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := FileDir("omse", "game.tap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if absolute, _ := FileDir("omse", filepath.Join(wd, "game.tap")); relative != absolute {
+		t.Errorf("FileDir of a relative path = %q, want %q", relative, absolute)
+	}
+}
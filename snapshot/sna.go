@@ -0,0 +1,159 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Sizes of the parts of an .sna file
+const (
+	snaHeaderLength = 27
+	sna48KLength    = snaHeaderLength + 3*BankSize
+	sna128KExtra    = 4 // PC, port 0x7FFD and the TR-DOS flag
+)
+
+// ReadSNA reads an .sna snapshot, either the 48K format or the 128K one,
+// which adds PC, the paging state and the other RAM banks. The format
+// has no way to tell a +2A or +3 from a 128K.
+func ReadSNA(r io.Reader) (*Snapshot, error) {
+	header := make([]byte, snaHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("truncated .sna header")
+	}
+	ram := make([]byte, 3*BankSize)
+	if n, err := io.ReadFull(r, ram); err != nil {
+		return nil, fmt.Errorf("truncated .sna memory: %d of %d bytes", n, len(ram))
+	}
+
+	var extra [sna128KExtra]byte
+	n, err := io.ReadFull(r, extra[:])
+	switch {
+	case err == io.EOF:
+		// Just the 48K format
+	case err != nil:
+		return nil, fmt.Errorf("truncated 128K .sna header: %d of %d bytes", n, len(extra))
+	}
+
+	word := func(offset int) uint16 { return binary.LittleEndian.Uint16(header[offset:]) }
+	regs := Registers{
+		I:    header[0],
+		HL2:  word(1),
+		DE2:  word(3),
+		BC2:  word(5),
+		AF2:  word(7),
+		HL:   word(9),
+		DE:   word(11),
+		BC:   word(13),
+		IY:   word(15),
+		IX:   word(17),
+		IFF2: header[19]&0x04 != 0,
+		R:    header[20],
+		AF:   word(21),
+		SP:   word(23),
+		IM:   header[25] & 0x03,
+	}
+	regs.IFF1 = regs.IFF2
+
+	if err == io.EOF {
+		s := New(Model48K)
+		s.Registers = regs
+		s.Border = header[26] & 0x07
+		for i, bank := range Banks48K {
+			copy(s.RAM[bank], ram[i*BankSize:])
+		}
+
+		// PC is on the stack, as if an interrupt had just happened
+		s.PC = uint16(s.Read(s.SP)) | uint16(s.Read(s.SP+1))<<8
+		s.SP += 2
+		return s, nil
+	}
+
+	s := New(Model128K)
+	s.Registers = regs
+	s.Border = header[26] & 0x07
+	s.PC = binary.LittleEndian.Uint16(extra[0:])
+	s.Port7FFD = extra[2]
+	s.TRDOSPaged = extra[3] != 0
+
+	paged := int(s.Port7FFD & 0x07)
+	copy(s.RAM[5], ram[0:])
+	copy(s.RAM[2], ram[BankSize:])
+	copy(s.RAM[paged], ram[2*BankSize:])
+	for bank := range s.RAM {
+		if bank == 5 || bank == 2 || bank == paged {
+			continue
+		}
+		if n, err := io.ReadFull(r, s.RAM[bank]); err != nil {
+			return nil, fmt.Errorf("truncated .sna RAM bank %d: %d of %d bytes", bank, n, BankSize)
+		}
+	}
+	return s, nil
+}
+
+// WriteSNA writes an .sna snapshot. For a 48K snapshot PC is pushed onto
+// the stack, which must be in RAM, as the format has nowhere else for it.
+func WriteSNA(w io.Writer, s *Snapshot) error {
+	regs := s.Registers
+	var ram []byte
+	switch s.Model {
+	case Model48K:
+		if regs.SP-2 < 0x4000 || regs.SP-1 < 0x4000 {
+			return fmt.Errorf("can't push PC for .sna: stack at 0x%04X is in ROM", regs.SP)
+		}
+		for _, bank := range Banks48K {
+			ram = append(ram, s.bank(bank)...)
+		}
+		regs.SP -= 2
+		ram[regs.SP-0x4000] = byte(regs.PC)
+		ram[regs.SP+1-0x4000] = byte(regs.PC >> 8)
+	case Model128K:
+		ram = append(ram, s.bank(5)...)
+		ram = append(ram, s.bank(2)...)
+		ram = append(ram, s.bank(int(s.Port7FFD&0x07))...)
+	default:
+		return fmt.Errorf(".sna files can't hold a %v snapshot", s.Model)
+	}
+
+	header := make([]byte, snaHeaderLength)
+	put := func(offset int, v uint16) { binary.LittleEndian.PutUint16(header[offset:], v) }
+	header[0] = regs.I
+	put(1, regs.HL2)
+	put(3, regs.DE2)
+	put(5, regs.BC2)
+	put(7, regs.AF2)
+	put(9, regs.HL)
+	put(11, regs.DE)
+	put(13, regs.BC)
+	put(15, regs.IY)
+	put(17, regs.IX)
+	if regs.IFF2 {
+		header[19] = 0x04
+	}
+	header[20] = regs.R
+	put(21, regs.AF)
+	put(23, regs.SP)
+	header[25] = regs.IM & 0x03
+	header[26] = s.Border & 0x07
+
+	out := bytes.NewBuffer(header)
+	out.Write(ram)
+	if s.Model == Model128K {
+		binary.Write(out, binary.LittleEndian, regs.PC)
+		out.WriteByte(s.Port7FFD)
+		if s.TRDOSPaged {
+			out.WriteByte(1)
+		} else {
+			out.WriteByte(0)
+		}
+		paged := int(s.Port7FFD & 0x07)
+		for bank := range s.RAM {
+			if bank != 5 && bank != 2 && bank != paged {
+				out.Write(s.bank(bank))
+			}
+		}
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,94 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSNARoundTrip48K(t *testing.T) {
+	want := testSnapshot(Model48K)
+	want.TStates = 0 // Not kept by the format
+	want.SP = 0x8000
+	saved := append([]byte(nil), want.RAM[2]...)
+
+	var buf bytes.Buffer
+	if err := WriteSNA(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != sna48KLength {
+		t.Errorf("48K .sna is %d bytes, want %d", buf.Len(), sna48KLength)
+	}
+	if !bytes.Equal(want.RAM[2], saved) {
+		t.Error("WriteSNA changed the snapshot's RAM")
+	}
+
+	got, err := ReadSNA(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PC went onto the stack below SP
+	want.Write(want.SP-2, byte(want.PC))
+	want.Write(want.SP-1, byte(want.PC>>8))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot changed:\ngot  %+v\nwant %+v", got.Registers, want.Registers)
+	}
+}
+
+func TestSNARoundTrip128K(t *testing.T) {
+	for paged := byte(0); paged < 8; paged++ {
+		t.Run(fmt.Sprintf("bank %d", paged), func(t *testing.T) {
+			want := testSnapshot(Model128K)
+			want.TStates = 0
+			want.AYRegister = 0
+			want.AYRegisters = [16]byte{}
+			want.Port7FFD = 0x10 | paged
+			want.TRDOSPaged = paged == 3
+
+			var buf bytes.Buffer
+			if err := WriteSNA(&buf, want); err != nil {
+				t.Fatal(err)
+			}
+			size := sna48KLength + sna128KExtra + 5*BankSize
+			if paged == 2 || paged == 5 {
+				size += BankSize
+			}
+			if buf.Len() != size {
+				t.Errorf("128K .sna is %d bytes, want %d", buf.Len(), size)
+			}
+
+			got, err := ReadSNA(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("snapshot changed:\ngot  %+v\nwant %+v", got.Registers, want.Registers)
+			}
+		})
+	}
+}
+
+func TestSNAErrors(t *testing.T) {
+	s := testSnapshot(Model48K)
+	s.SP = 0x4001
+	if err := WriteSNA(&bytes.Buffer{}, s); err == nil {
+		t.Error("pushed PC into ROM")
+	}
+
+	for _, model := range []Model{Model48K, Model128K} {
+		var buf bytes.Buffer
+		if err := WriteSNA(&buf, testSnapshot(model)); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		for _, n := range []int{0, 10, snaHeaderLength, sna48KLength - 1, sna48KLength + 2, len(data) - 1} {
+			if n >= len(data) {
+				continue
+			}
+			if _, err := ReadSNA(bytes.NewReader(data[:n])); err == nil {
+				t.Errorf("%v: read an .sna file cut to %d bytes", model, n)
+			}
+		}
+	}
+}
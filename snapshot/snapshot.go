@@ -0,0 +1,253 @@
+// Package snapshot reads and writes Spectrum snapshot files. A Snapshot
+// holds the state of the machine in a form that doesn't depend on the
+// emulator, so each file format only has to deal with its own layout.
+package snapshot
+
+import "fmt"
+
+// Model is the Spectrum model a snapshot was taken from
+type Model int
+
+const (
+	Model48K Model = iota
+	Model128K
+	ModelPlus2A
+	ModelPlus3
+)
+
+func (m Model) String() string {
+	switch m {
+	case Model48K:
+		return "48K"
+	case Model128K:
+		return "128K"
+	case ModelPlus2A:
+		return "+2A"
+	case ModelPlus3:
+		return "+3"
+	}
+	return fmt.Sprintf("Model(%d)", int(m))
+}
+
+// TStatesPerFrame returns the length of the model's frame
+func (m Model) TStatesPerFrame() uint32 {
+	if m == Model48K {
+		return 69888
+	}
+	return 70908
+}
+
+// Paged reports whether the model has eight RAM banks paged through port
+// 0x7FFD
+func (m Model) Paged() bool {
+	return m != Model48K
+}
+
+// SpecialPaging reports whether the model has the +2A/+3's port 0x1FFD,
+// which selects from four ROMs and can fill the memory map with RAM
+func (m Model) SpecialPaging() bool {
+	return m == ModelPlus2A || m == ModelPlus3
+}
+
+// BankSize is the size of a RAM bank
+const BankSize = 0x4000
+
+// SpecialPagingBanks lists the banks at 0x0000, 0x4000, 0x8000 and
+// 0xC000 in each of the +2A/+3's all-RAM configurations, chosen by bits
+// 1 and 2 of port 0x1FFD
+var SpecialPagingBanks = [4][4]int{
+	{0, 1, 2, 3},
+	{4, 5, 6, 7},
+	{4, 5, 6, 3},
+	{4, 7, 6, 3},
+}
+
+// Banks48K lists the banks that hold the 48K's RAM at 0x4000, 0x8000 and
+// 0xC000. Banks are numbered as on the 128K, where the same banks are
+// paged in at those addresses after a reset.
+var Banks48K = [3]int{5, 2, 0}
+
+// Registers holds the state of the Z80
+type Registers struct {
+	AF, BC, DE, HL     uint16
+	AF2, BC2, DE2, HL2 uint16
+	IX, IY, SP, PC     uint16
+	I, R               uint8
+	IFF1, IFF2         bool
+	IM                 uint8
+	MemPtr             uint16 // The internal WZ register
+}
+
+// Joystick is a type of joystick interface
+type Joystick int
+
+const (
+	JoystickNone Joystick = iota
+	JoystickKempston
+	JoystickSinclair1
+	JoystickSinclair2
+	JoystickCursor
+	JoystickFuller
+)
+
+func (j Joystick) String() string {
+	switch j {
+	case JoystickNone:
+		return "none"
+	case JoystickKempston:
+		return "Kempston"
+	case JoystickSinclair1:
+		return "Sinclair 1"
+	case JoystickSinclair2:
+		return "Sinclair 2"
+	case JoystickCursor:
+		return "Cursor"
+	case JoystickFuller:
+		return "Fuller"
+	}
+	return fmt.Sprintf("Joystick(%d)", int(j))
+}
+
+// SZXBlock is a block of an SZX file, kept as it was read
+type SZXBlock struct {
+	ID   [4]byte
+	Data []byte
+}
+
+// ULAplus is the state of the ULAplus palette extension
+type ULAplus struct {
+	Enabled  bool     // Attributes choose colours from the palette
+	Register byte     // Last value written to the register port
+	Palette  [64]byte // Colours as GRB332
+}
+
+// Tape is a tape image in the tape player and how far it has played
+type Tape struct {
+	Block  int    // Block the player is at
+	Format string // Extension of the image's file, without the dot
+	Image  []byte
+}
+
+// Snapshot is the state of a Spectrum between two instructions
+type Snapshot struct {
+	Model Model
+	Registers
+
+	Border   byte   // Border colour, 0-7
+	TStates  uint32 // T-states since the frame interrupt
+	Port7FFD byte   // Last write to the 128K paging port
+	Port1FFD byte   // Last write to the +2A/+3 paging port
+
+	// Halted is set when the CPU is executing a HALT, with PC pointing at
+	// the HALT instruction
+	Halted bool
+
+	// TRDOSPaged records that a Beta disk interface had its ROM paged in
+	TRDOSPaged bool
+
+	// RAM holds the 16K banks; a 48K only uses those in Banks48K. Banks
+	// a snapshot doesn't include are nil.
+	RAM [8][]byte
+
+	// The AY sound chip of the 128K
+	AYRegister  byte // Selected register
+	AYRegisters [16]byte
+
+	// Issue2 selects the keyboard of an issue 2 board, where bit 6 of the
+	// ULA port follows the MIC output as well as EAR
+	Issue2 bool
+
+	// Joysticks connected for the first and second player, and the one
+	// the keyboard's cursor keys stand in for
+	Joysticks        [2]Joystick
+	KeyboardJoystick Joystick
+
+	// ULAplus is the state of the ULAplus palette, nil for a machine
+	// without one
+	ULAplus *ULAplus
+
+	// Tape is the tape in the player, nil when there is none or the
+	// format doesn't keep it (only SZX does)
+	Tape *Tape
+
+	// Disk is the .dsk image in drive A: of a +3, nil as for Tape
+	Disk []byte
+
+	// SZXBlocks holds blocks of an SZX file that describe hardware this
+	// package doesn't know about, so that writing the snapshot back out as
+	// SZX keeps them
+	SZXBlocks []SZXBlock
+}
+
+// New creates a snapshot of the given model with all its RAM cleared
+func New(model Model) *Snapshot {
+	s := &Snapshot{Model: model}
+	if model == Model48K {
+		for _, bank := range Banks48K {
+			s.RAM[bank] = make([]byte, BankSize)
+		}
+	} else {
+		for bank := range s.RAM {
+			s.RAM[bank] = make([]byte, BankSize)
+		}
+	}
+	return s
+}
+
+// Read returns a byte from the 48K memory map, with banks paged as set
+// by Port7FFD and Port1FFD. The ROM isn't part of a snapshot and reads as
+// 0.
+func (s *Snapshot) Read(addr uint16) byte {
+	bank := s.bankAt(addr)
+	if bank < 0 || s.RAM[bank] == nil {
+		return 0
+	}
+	return s.RAM[bank][addr%BankSize]
+}
+
+// Write stores a byte in the memory map, as for Read. Writes to the ROM
+// are ignored.
+func (s *Snapshot) Write(addr uint16, value byte) {
+	bank := s.bankAt(addr)
+	if bank < 0 || s.RAM[bank] == nil {
+		return
+	}
+	s.RAM[bank][addr%BankSize] = value
+}
+
+// bankAt returns the RAM bank paged in at addr, or -1 for ROM
+func (s *Snapshot) bankAt(addr uint16) int {
+	if s.Model.SpecialPaging() && s.Port1FFD&0x01 != 0 {
+		return SpecialPagingBanks[(s.Port1FFD>>1)&0x03][addr/BankSize]
+	}
+	switch addr / BankSize {
+	case 1:
+		return 5
+	case 2:
+		return 2
+	case 3:
+		if s.Model.Paged() {
+			return int(s.Port7FFD & 0x07)
+		}
+		return 0
+	}
+	return -1
+}
+
+// loadBank stores a bank read from a file, checking its size
+func (s *Snapshot) loadBank(bank int, data []byte) error {
+	if len(data) != BankSize {
+		return fmt.Errorf("RAM bank %d is %d bytes, expected %d", bank, len(data), BankSize)
+	}
+	s.RAM[bank] = data
+	return nil
+}
+
+// bank returns a RAM bank for writing to a file, which is all zeros if
+// the snapshot doesn't have it
+func (s *Snapshot) bank(bank int) []byte {
+	if s.RAM[bank] == nil {
+		return make([]byte, BankSize)
+	}
+	return s.RAM[bank]
+}
@@ -0,0 +1,536 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SZXSignature starts every SZX (zx-state) file
+const SZXSignature = "ZXST"
+
+// The version of the format WriteSZX writes
+const (
+	szxMajorVersion = 1
+	szxMinorVersion = 4
+)
+
+// Machine IDs in the SZX header
+const (
+	szxMachine16K    = 0
+	szxMachine48K    = 1
+	szxMachine128K   = 2
+	szxMachinePlus2  = 3
+	szxMachinePlus2A = 4
+	szxMachinePlus3  = 5
+	szxMachinePlus3E = 6
+)
+
+// Block IDs
+var (
+	szxCreator   = [4]byte{'C', 'R', 'T', 'R'}
+	szxZ80Regs   = [4]byte{'Z', '8', '0', 'R'}
+	szxSpecRegs  = [4]byte{'S', 'P', 'C', 'R'}
+	szxRAMPage   = [4]byte{'R', 'A', 'M', 'P'}
+	szxAY        = [4]byte{'A', 'Y', 0, 0}
+	szxKeyboard  = [4]byte{'K', 'E', 'Y', 'B'}
+	szxJoysticks = [4]byte{'J', 'O', 'Y', 0}
+	szxPalette   = [4]byte{'P', 'L', 'T', 'T'}
+	szxTape      = [4]byte{'T', 'A', 'P', 'E'}
+	szxDisk      = [4]byte{'D', 'S', 'K', 0}
+	szxPlus3     = [4]byte{'+', '3', 0, 0}
+)
+
+// Block sizes, not counting the data of a RAM page
+const (
+	szxHeaderLength     = 8
+	szxBlockHeader      = 8
+	szxZ80RegsLength    = 37
+	szxZ80RegsMinLength = 33 // Up to the T-state counter
+	szxSpecRegsLength   = 8
+	szxRAMPageHeader    = 3
+	szxAYLength         = 18
+	szxKeyboardLength   = 5
+	szxJoysticksLength  = 6
+	szxPaletteLength    = 66
+	szxTapeHeader       = 28
+	szxTapeExtension    = 16 // Bytes for the file extension in a TAPE block
+	szxDiskHeader       = 7
+	szxPlus3Length      = 2
+)
+
+// Flags in the blocks
+const (
+	szxZ80Halted      = 0x02
+	szxRAMCompressed  = 0x01
+	szxAY128          = 0x02 // The AY of a 128K, as opposed to a Fuller Box
+	szxKeyboardIssue2 = 0x01
+	szxPaletteEnabled = 0x01
+	szxTapeEmbedded   = 0x01
+	szxTapeCompressed = 0x02
+	szxDiskCompressed = 0x01
+	szxDiskEmbedded   = 0x02
+)
+
+// szxJoystickTypes lists the joysticks by their number in the KEYB and
+// JOY blocks, which use the same numbering; the rest aren't supported
+var szxJoystickTypes = []Joystick{
+	0: JoystickKempston,
+	1: JoystickFuller,
+	2: JoystickCursor,
+	3: JoystickSinclair1,
+	4: JoystickSinclair2,
+}
+
+// szxJoystickNone is the SZX number for no joystick
+const szxJoystickNone = 8
+
+func szxJoystick(n byte) Joystick {
+	if int(n) < len(szxJoystickTypes) {
+		return szxJoystickTypes[n]
+	}
+	return JoystickNone
+}
+
+func szxJoystickNumber(j Joystick) byte {
+	for n, joystick := range szxJoystickTypes {
+		if joystick == j {
+			return byte(n)
+		}
+	}
+	return szxJoystickNone
+}
+
+// ReadSZX reads an SZX snapshot. Blocks for hardware other than the CPU,
+// ULA, memory, AY, keyboard, joysticks and ULAplus palette, and for media
+// other than a tape or a disk in drive A: held in the file, are kept in
+// SZXBlocks, except for the creator block, which only describes the
+// program that wrote the file.
+func ReadSZX(r io.Reader) (*Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < szxHeaderLength || string(data[:4]) != SZXSignature {
+		return nil, fmt.Errorf("not an SZX file")
+	}
+	var s *Snapshot
+	switch machine := data[6]; machine {
+	case szxMachine16K, szxMachine48K:
+		s = &Snapshot{Model: Model48K}
+	case szxMachine128K, szxMachinePlus2:
+		s = &Snapshot{Model: Model128K}
+	case szxMachinePlus2A:
+		s = &Snapshot{Model: ModelPlus2A}
+	case szxMachinePlus3, szxMachinePlus3E:
+		s = &Snapshot{Model: ModelPlus3}
+	default:
+		return nil, fmt.Errorf("unsupported SZX machine %d", machine)
+	}
+
+	haveRegisters := false
+	for rest := data[szxHeaderLength:]; len(rest) > 0; {
+		if len(rest) < szxBlockHeader {
+			return nil, fmt.Errorf("truncated SZX block header")
+		}
+		var id [4]byte
+		copy(id[:], rest)
+		size := binary.LittleEndian.Uint32(rest[4:])
+		rest = rest[szxBlockHeader:]
+		if uint32(len(rest)) < size {
+			return nil, fmt.Errorf("truncated SZX %q block: %d of %d bytes", id[:], len(rest), size)
+		}
+		block := rest[:size]
+		rest = rest[size:]
+
+		switch id {
+		case szxCreator:
+			// Nothing to keep
+		case szxZ80Regs:
+			if len(block) < szxZ80RegsMinLength {
+				return nil, fmt.Errorf("SZX Z80R block is %d bytes, expected %d", len(block), szxZ80RegsLength)
+			}
+			s.readZ80Regs(block)
+			haveRegisters = true
+		case szxSpecRegs:
+			if len(block) < szxSpecRegsLength {
+				return nil, fmt.Errorf("SZX SPCR block is %d bytes, expected %d", len(block), szxSpecRegsLength)
+			}
+			s.Border = block[0] & 0x07
+			if s.Model.Paged() {
+				s.Port7FFD = block[1]
+			}
+			if s.Model.SpecialPaging() {
+				s.Port1FFD = block[2]
+			}
+		case szxRAMPage:
+			if err := s.readRAMPage(block); err != nil {
+				return nil, err
+			}
+		case szxAY:
+			if len(block) < szxAYLength {
+				return nil, fmt.Errorf("SZX AY block is %d bytes, expected %d", len(block), szxAYLength)
+			}
+			if !s.Model.Paged() {
+				// An add-on sound interface on a 48K
+				s.SZXBlocks = append(s.SZXBlocks, SZXBlock{id, append([]byte(nil), block...)})
+				continue
+			}
+			s.AYRegister = block[1]
+			copy(s.AYRegisters[:], block[2:])
+		case szxKeyboard:
+			if len(block) < szxKeyboardLength {
+				return nil, fmt.Errorf("SZX KEYB block is %d bytes, expected %d", len(block), szxKeyboardLength)
+			}
+			s.Issue2 = binary.LittleEndian.Uint32(block)&szxKeyboardIssue2 != 0
+			s.KeyboardJoystick = szxJoystick(block[4])
+		case szxJoysticks:
+			if len(block) < szxJoysticksLength {
+				return nil, fmt.Errorf("SZX JOY block is %d bytes, expected %d", len(block), szxJoysticksLength)
+			}
+			s.Joysticks[0] = szxJoystick(block[4])
+			s.Joysticks[1] = szxJoystick(block[5])
+		case szxPalette:
+			if len(block) < szxPaletteLength {
+				return nil, fmt.Errorf("SZX PLTT block is %d bytes, expected %d", len(block), szxPaletteLength)
+			}
+			s.ULAplus = &ULAplus{
+				Enabled:  block[0]&szxPaletteEnabled != 0,
+				Register: block[1],
+			}
+			copy(s.ULAplus.Palette[:], block[2:])
+		case szxTape:
+			ok, err := s.readTape(block)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				// A tape in a file of its own
+				s.SZXBlocks = append(s.SZXBlocks, SZXBlock{id, append([]byte(nil), block...)})
+			}
+		case szxDisk:
+			ok, err := s.readDisk(block)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				s.SZXBlocks = append(s.SZXBlocks, SZXBlock{id, append([]byte(nil), block...)})
+			}
+		case szxPlus3:
+			// The motor is in the SPCR block too; WriteSZX writes this
+			// again
+		default:
+			s.SZXBlocks = append(s.SZXBlocks, SZXBlock{id, append([]byte(nil), block...)})
+		}
+	}
+	if !haveRegisters {
+		return nil, fmt.Errorf("SZX file has no Z80R block")
+	}
+
+	// Pages the file left out are cleared
+	for bank := range s.RAM {
+		if s.RAM[bank] == nil && (s.Model.Paged() || bank == 0 || bank == 2 || bank == 5) {
+			s.RAM[bank] = make([]byte, BankSize)
+		}
+	}
+	return s, nil
+}
+
+// readZ80Regs reads the CPU state from a Z80R block
+func (s *Snapshot) readZ80Regs(block []byte) {
+	word := func(offset int) uint16 { return binary.LittleEndian.Uint16(block[offset:]) }
+	s.Registers = Registers{
+		AF: word(0), BC: word(2), DE: word(4), HL: word(6),
+		AF2: word(8), BC2: word(10), DE2: word(12), HL2: word(14),
+		IX: word(16), IY: word(18), SP: word(20), PC: word(22),
+		I:    block[24],
+		R:    block[25],
+		IFF1: block[26] != 0,
+		IFF2: block[27] != 0,
+		IM:   block[28] & 0x03,
+	}
+	s.TStates = binary.LittleEndian.Uint32(block[29:]) % s.Model.TStatesPerFrame()
+	if len(block) >= szxZ80RegsLength {
+		s.Halted = block[34]&szxZ80Halted != 0
+		s.MemPtr = word(35)
+	}
+}
+
+// readTape stores the tape held by a TAPE block, returning false if the
+// block names a file rather than holding the image
+func (s *Snapshot) readTape(block []byte) (bool, error) {
+	if len(block) < szxTapeHeader {
+		return false, fmt.Errorf("SZX TAPE block is %d bytes, expected at least %d", len(block), szxTapeHeader)
+	}
+	flags := binary.LittleEndian.Uint16(block[2:])
+	if flags&szxTapeEmbedded == 0 {
+		return false, nil
+	}
+	size := binary.LittleEndian.Uint32(block[4:])
+	data := block[szxTapeHeader:]
+	if stored := binary.LittleEndian.Uint32(block[8:]); uint64(stored) < uint64(len(data)) {
+		data = data[:stored]
+	}
+	data, err := szxData(data, flags&szxTapeCompressed != 0, size)
+	if err != nil {
+		return false, fmt.Errorf("SZX TAPE block: %v", err)
+	}
+	extension := block[12 : 12+szxTapeExtension]
+	if n := bytes.IndexByte(extension, 0); n >= 0 {
+		extension = extension[:n]
+	}
+	s.Tape = &Tape{
+		Block:  int(binary.LittleEndian.Uint16(block)),
+		Format: strings.TrimPrefix(strings.ToLower(string(extension)), "."),
+		Image:  data,
+	}
+	return true, nil
+}
+
+// readDisk stores the disk held by a DSK block for drive A:, returning
+// false for other drives and blocks that name a file
+func (s *Snapshot) readDisk(block []byte) (bool, error) {
+	if len(block) < szxDiskHeader {
+		return false, fmt.Errorf("SZX DSK block is %d bytes, expected at least %d", len(block), szxDiskHeader)
+	}
+	flags := binary.LittleEndian.Uint16(block)
+	if flags&szxDiskEmbedded == 0 || block[2] != 0 {
+		return false, nil
+	}
+	data, err := szxData(block[szxDiskHeader:], flags&szxDiskCompressed != 0, binary.LittleEndian.Uint32(block[3:]))
+	if err != nil {
+		return false, fmt.Errorf("SZX DSK block: %v", err)
+	}
+	s.Disk = data
+	return true, nil
+}
+
+// szxData returns the data of a media block, expanding it if compressed
+func szxData(data []byte, compressed bool, size uint32) ([]byte, error) {
+	if !compressed {
+		return append([]byte(nil), data...), nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	data, err = io.ReadAll(io.LimitReader(zr, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(size) {
+		return nil, fmt.Errorf("%d bytes, expected %d", len(data), size)
+	}
+	return data, nil
+}
+
+// readRAMPage stores the bank held by a RAMP block
+func (s *Snapshot) readRAMPage(block []byte) error {
+	if len(block) < szxRAMPageHeader {
+		return fmt.Errorf("truncated SZX RAMP block")
+	}
+	flags := binary.LittleEndian.Uint16(block)
+	bank := int(block[2])
+	data := block[szxRAMPageHeader:]
+	if bank >= len(s.RAM) {
+		return fmt.Errorf("SZX RAM page %d doesn't exist", bank)
+	}
+	if s.Model == Model48K && bank != 0 && bank != 2 && bank != 5 {
+		return fmt.Errorf("SZX RAM page %d doesn't exist on a 48K", bank)
+	}
+	if flags&szxRAMCompressed != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("SZX RAM page %d: %v", bank, err)
+		}
+		// Read one byte more than a bank to catch pages that are too long
+		data, err = io.ReadAll(io.LimitReader(zr, BankSize+1))
+		if err != nil {
+			return fmt.Errorf("SZX RAM page %d: %v", bank, err)
+		}
+	} else {
+		data = append([]byte(nil), data...)
+	}
+	return s.loadBank(bank, data)
+}
+
+// WriteSZX writes an SZX snapshot, with its RAM pages compressed. Blocks
+// kept from a file that ReadSZX read are written after the others.
+func WriteSZX(w io.Writer, s *Snapshot) error {
+	out := new(bytes.Buffer)
+	out.WriteString(SZXSignature)
+	out.WriteByte(szxMajorVersion)
+	out.WriteByte(szxMinorVersion)
+	switch s.Model {
+	case Model48K:
+		out.WriteByte(szxMachine48K)
+	case Model128K:
+		out.WriteByte(szxMachine128K)
+	case ModelPlus2A:
+		out.WriteByte(szxMachinePlus2A)
+	case ModelPlus3:
+		out.WriteByte(szxMachinePlus3)
+	default:
+		return fmt.Errorf("SZX files can't hold a %v snapshot", s.Model)
+	}
+	out.WriteByte(0) // Flags
+
+	writeBlock := func(id [4]byte, data []byte) {
+		out.Write(id[:])
+		binary.Write(out, binary.LittleEndian, uint32(len(data)))
+		out.Write(data)
+	}
+
+	regs := make([]byte, szxZ80RegsLength)
+	put := func(offset int, v uint16) { binary.LittleEndian.PutUint16(regs[offset:], v) }
+	for i, v := range []uint16{
+		s.AF, s.BC, s.DE, s.HL, s.AF2, s.BC2, s.DE2, s.HL2,
+		s.IX, s.IY, s.SP, s.PC,
+	} {
+		put(2*i, v)
+	}
+	regs[24] = s.I
+	regs[25] = s.R
+	if s.IFF1 {
+		regs[26] = 1
+	}
+	if s.IFF2 {
+		regs[27] = 1
+	}
+	regs[28] = s.IM & 0x03
+	binary.LittleEndian.PutUint32(regs[29:], s.TStates)
+	regs[33] = 32 // T-states the interrupt is held for
+	if s.Model == Model128K {
+		regs[33] = 36
+	}
+	if s.Halted {
+		regs[34] |= szxZ80Halted
+	}
+	put(35, s.MemPtr)
+	writeBlock(szxZ80Regs, regs)
+
+	spec := make([]byte, szxSpecRegsLength)
+	spec[0] = s.Border & 0x07
+	spec[1] = s.Port7FFD
+	spec[2] = s.Port1FFD
+	spec[3] = s.Border & 0x07 // Last write to port 0xFE
+	writeBlock(szxSpecRegs, spec)
+
+	banks := Banks48K[:]
+	if s.Model.Paged() {
+		banks = []int{0, 1, 2, 3, 4, 5, 6, 7}
+	}
+	for _, bank := range banks {
+		page, err := szxRAMPageBlock(bank, s.bank(bank))
+		if err != nil {
+			return err
+		}
+		writeBlock(szxRAMPage, page)
+	}
+
+	if s.Model.Paged() {
+		ay := make([]byte, szxAYLength)
+		ay[0] = szxAY128
+		ay[1] = s.AYRegister
+		copy(ay[2:], s.AYRegisters[:])
+		writeBlock(szxAY, ay)
+	}
+
+	keyboard := make([]byte, szxKeyboardLength)
+	if s.Issue2 {
+		keyboard[0] = szxKeyboardIssue2
+	}
+	keyboard[4] = szxJoystickNumber(s.KeyboardJoystick)
+	writeBlock(szxKeyboard, keyboard)
+
+	joysticks := make([]byte, szxJoysticksLength)
+	joysticks[4] = szxJoystickNumber(s.Joysticks[0])
+	joysticks[5] = szxJoystickNumber(s.Joysticks[1])
+	writeBlock(szxJoysticks, joysticks)
+
+	if s.ULAplus != nil {
+		palette := make([]byte, szxPaletteLength)
+		if s.ULAplus.Enabled {
+			palette[0] = szxPaletteEnabled
+		}
+		palette[1] = s.ULAplus.Register
+		copy(palette[2:], s.ULAplus.Palette[:])
+		writeBlock(szxPalette, palette)
+	}
+
+	if s.Tape != nil {
+		data, err := szxCompress(s.Tape.Image)
+		if err != nil {
+			return err
+		}
+		tape := make([]byte, szxTapeHeader, szxTapeHeader+len(data))
+		binary.LittleEndian.PutUint16(tape, uint16(s.Tape.Block))
+		binary.LittleEndian.PutUint16(tape[2:], szxTapeEmbedded|szxTapeCompressed)
+		binary.LittleEndian.PutUint32(tape[4:], uint32(len(s.Tape.Image)))
+		binary.LittleEndian.PutUint32(tape[8:], uint32(len(data)))
+		copy(tape[12:12+szxTapeExtension-1], s.Tape.Format)
+		writeBlock(szxTape, append(tape, data...))
+	}
+
+	if s.Model == ModelPlus3 {
+		plus3 := make([]byte, szxPlus3Length)
+		plus3[0] = 1 // Drives
+		if s.Port1FFD&0x08 != 0 {
+			plus3[1] = 1 // Motor on
+		}
+		writeBlock(szxPlus3, plus3)
+		if s.Disk != nil {
+			data, err := szxCompress(s.Disk)
+			if err != nil {
+				return err
+			}
+			disk := make([]byte, szxDiskHeader, szxDiskHeader+len(data))
+			binary.LittleEndian.PutUint16(disk, szxDiskEmbedded|szxDiskCompressed)
+			binary.LittleEndian.PutUint32(disk[3:], uint32(len(s.Disk)))
+			writeBlock(szxDisk, append(disk, data...))
+		}
+	}
+
+	for _, block := range s.SZXBlocks {
+		writeBlock(block.ID, block.Data)
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// szxCompress compresses the data of a block with zlib
+func szxCompress(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// szxRAMPageBlock builds a RAMP block, compressed unless that would make
+// it larger
+func szxRAMPageBlock(bank int, data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	compressed.Write([]byte{szxRAMCompressed, 0, byte(bank)})
+	zw, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if compressed.Len() < szxRAMPageHeader+len(data) {
+		return compressed.Bytes(), nil
+	}
+	return append([]byte{0, 0, byte(bank)}, data...), nil
+}
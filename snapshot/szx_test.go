@@ -0,0 +1,131 @@
+package snapshot
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSZXRoundTrip(t *testing.T) {
+	for _, model := range []Model{Model48K, Model128K, ModelPlus2A, ModelPlus3} {
+		t.Run(model.String(), func(t *testing.T) {
+			want := testSnapshot(model)
+			want.MemPtr = 0x5A5A
+			want.Halted = true
+			want.Issue2 = true
+			want.Joysticks = [2]Joystick{JoystickKempston, JoystickSinclair2}
+			want.KeyboardJoystick = JoystickCursor
+			want.ULAplus = &ULAplus{Enabled: true, Register: 0x40}
+			for i := range want.ULAplus.Palette {
+				want.ULAplus.Palette[i] = byte(i * 3)
+			}
+			want.SZXBlocks = []SZXBlock{
+				{[4]byte{'M', 'F', 'C', 'E'}, []byte{1, 2, 3, 4, 5}},
+				{[4]byte{'I', 'F', '1', 0}, nil},
+			}
+			want.Tape = &Tape{Block: 3, Format: "tzx", Image: bytes.Repeat([]byte("tape"), 1000)}
+			if model == ModelPlus3 {
+				want.Disk = bytes.Repeat([]byte{0xE5}, 2000)
+			}
+
+			var buf bytes.Buffer
+			if err := WriteSZX(&buf, want); err != nil {
+				t.Fatalf("WriteSZX: %v", err)
+			}
+			if buf.Len() > 3*BankSize {
+				t.Errorf("RAM wasn't compressed: file is %d bytes", buf.Len())
+			}
+			got, err := ReadSZX(&buf)
+			if err != nil {
+				t.Fatalf("ReadSZX: %v", err)
+			}
+			if !reflect.DeepEqual(got.Registers, want.Registers) {
+				t.Errorf("registers changed:\ngot  %+v\nwant %+v", got.Registers, want.Registers)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("snapshot changed:\ngot  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestSZXUncompressedPage(t *testing.T) {
+	file := []byte("ZXST\x01\x04\x01\x00")
+	block := func(id string, data []byte) {
+		file = append(file, id...)
+		file = append(file, byte(len(data)), byte(len(data)>>8), byte(len(data)>>16), 0)
+		file = append(file, data...)
+	}
+	regs := make([]byte, szxZ80RegsLength)
+	regs[22], regs[23] = 0x00, 0x80 // PC
+	block("Z80R", regs)
+	page := append([]byte{0, 0, 5}, bytes.Repeat([]byte{0xAA}, BankSize)...)
+	block("RAMP", page)
+
+	s, err := ReadSZX(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Model != Model48K || s.PC != 0x8000 {
+		t.Errorf("read %v snapshot with PC 0x%04X", s.Model, s.PC)
+	}
+	if s.Read(0x4000) != 0xAA || s.Read(0x7FFF) != 0xAA || s.Read(0x8000) != 0 {
+		t.Error("RAM page 5 wasn't loaded at 0x4000")
+	}
+}
+
+func TestSZXMedia(t *testing.T) {
+	file := []byte("ZXST\x01\x04\x01\x00")
+	block := func(id string, data []byte) {
+		file = append(file, id...)
+		file = append(file, byte(len(data)), byte(len(data)>>8), byte(len(data)>>16), 0)
+		file = append(file, data...)
+	}
+	block("Z80R", make([]byte, szxZ80RegsLength))
+	// A tape held uncompressed, then one named by a file
+	embedded := make([]byte, szxTapeHeader)
+	embedded[0] = 2                 // Block
+	embedded[2] = szxTapeEmbedded   // Flags
+	embedded[4], embedded[8] = 3, 3 // Sizes
+	copy(embedded[12:], ".TAP")
+	block("TAPE", append(embedded, 7, 8, 9))
+	named := make([]byte, szxTapeHeader)
+	named[4] = 9
+	block("TAPE", append(named, "game.tzx\x00"...))
+	// A disk for drive B:
+	block("DSK\x00", []byte{szxDiskEmbedded, 0, 1, 1, 0, 0, 0, 0xE5})
+
+	s, err := ReadSZX(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Tape{Block: 2, Format: "tap", Image: []byte{7, 8, 9}}
+	if !reflect.DeepEqual(s.Tape, want) {
+		t.Errorf("read tape %+v, want %+v", s.Tape, want)
+	}
+	if s.Disk != nil {
+		t.Error("read drive B:'s disk as drive A:'s")
+	}
+	if len(s.SZXBlocks) != 2 || s.SZXBlocks[0].ID != szxTape || s.SZXBlocks[1].ID != szxDisk {
+		t.Errorf("kept blocks %v, want the named tape and drive B:'s disk", s.SZXBlocks)
+	}
+}
+
+func TestSZXErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSZX(&buf, testSnapshot(Model128K)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, n := range []int{0, 4, 12, 20, 100, len(data) - 1} {
+		if _, err := ReadSZX(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("read an SZX file cut to %d bytes", n)
+		}
+	}
+	if _, err := ReadSZX(bytes.NewReader([]byte("ZXST\x01\x04\x01\x00"))); err == nil {
+		t.Error("read an SZX file without registers")
+	}
+	if _, err := ReadSZX(bytes.NewReader([]byte("ZXST\x01\x04\x07\x00"))); err == nil {
+		t.Error("read an SZX file for a Pentagon")
+	}
+}
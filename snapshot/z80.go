@@ -0,0 +1,383 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Header lengths of the .z80 format versions
+const (
+	z80HeaderLength = 30
+	z80V2Extra      = 23
+	z80V3Extra      = 54
+	z80V3ExtraPlus3 = 55 // Version 3 with the last write to port 0x1FFD
+)
+
+// z80v1End marks the end of the compressed memory in a version 1 file
+var z80v1End = []byte{0x00, 0xED, 0xED, 0x00}
+
+// ReadZ80 reads a .z80 snapshot, any of versions 1, 2 and 3
+func ReadZ80(r io.Reader) (*Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < z80HeaderLength {
+		return nil, fmt.Errorf("truncated .z80 header")
+	}
+	header := data[:z80HeaderLength]
+	word := func(b []byte, offset int) uint16 { return binary.LittleEndian.Uint16(b[offset:]) }
+
+	flags := header[12]
+	if flags == 0xFF {
+		flags = 0x01 // Some old programs write 0xFF, which means 1
+	}
+	regs := Registers{
+		AF:   uint16(header[0])<<8 | uint16(header[1]),
+		BC:   word(header, 2),
+		HL:   word(header, 4),
+		PC:   word(header, 6),
+		SP:   word(header, 8),
+		I:    header[10],
+		R:    header[11]&0x7F | flags<<7,
+		DE:   word(header, 13),
+		BC2:  word(header, 15),
+		DE2:  word(header, 17),
+		HL2:  word(header, 19),
+		AF2:  uint16(header[21])<<8 | uint16(header[22]),
+		IY:   word(header, 23),
+		IX:   word(header, 25),
+		IFF1: header[27] != 0,
+		IFF2: header[28] != 0,
+		IM:   header[29] & 0x03,
+	}
+	border := (flags >> 1) & 0x07
+	issue2 := header[29]&0x04 != 0
+
+	if regs.PC != 0 {
+		// Version 1: a 48K snapshot with the RAM following the header
+		s := New(Model48K)
+		s.Registers = regs
+		s.Border = border
+		s.Issue2 = issue2
+		ram := data[z80HeaderLength:]
+		if flags&0x20 != 0 {
+			end := bytes.LastIndex(ram, z80v1End)
+			if end >= 0 && end+len(z80v1End) == len(ram) {
+				ram = ram[:end]
+			}
+			if ram, err = decompressZ80(ram, 3*BankSize); err != nil {
+				return nil, err
+			}
+		} else if len(ram) < 3*BankSize {
+			return nil, fmt.Errorf("truncated .z80 memory: %d bytes", len(ram))
+		}
+		for i, bank := range Banks48K {
+			copy(s.RAM[bank], ram[i*BankSize:])
+		}
+		return s, nil
+	}
+
+	// Versions 2 and 3 have an additional header, then memory blocks
+	if len(data) < z80HeaderLength+2 {
+		return nil, fmt.Errorf("truncated .z80 header")
+	}
+	extraLength := int(word(data, z80HeaderLength))
+	rest := data[z80HeaderLength+2:]
+	if len(rest) < extraLength {
+		return nil, fmt.Errorf("truncated .z80 header")
+	}
+	extra := rest[:extraLength]
+	rest = rest[extraLength:]
+
+	var version int
+	switch extraLength {
+	case z80V2Extra:
+		version = 2
+	case z80V3Extra, z80V3ExtraPlus3:
+		version = 3
+	default:
+		return nil, fmt.Errorf("unknown .z80 version, additional header is %d bytes", extraLength)
+	}
+
+	model, err := z80Model(version, extra[2])
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{Model: model, Registers: regs, Border: border, Issue2: issue2}
+	s.PC = word(extra, 0)
+	if model.Paged() {
+		s.Port7FFD = extra[3]
+		s.AYRegister = extra[6]
+		copy(s.AYRegisters[:], extra[7:23])
+	}
+	if version == 3 {
+		frame := model.TStatesPerFrame()
+		quarter := frame / 4
+		low := uint32(word(extra, 23))
+		high := uint32(extra[25])
+		s.TStates = (((high+1)%4+1)*quarter - (low + 1)) % frame
+	}
+	if extraLength == z80V3ExtraPlus3 && model.SpecialPaging() {
+		s.Port1FFD = extra[54]
+	}
+
+	for len(rest) > 0 {
+		if len(rest) < 3 {
+			return nil, fmt.Errorf("truncated .z80 memory block header")
+		}
+		length := int(word(rest, 0))
+		page := rest[2]
+		rest = rest[3:]
+
+		var block []byte
+		if length == 0xFFFF {
+			if len(rest) < BankSize {
+				return nil, fmt.Errorf("truncated .z80 page %d", page)
+			}
+			block = append([]byte(nil), rest[:BankSize]...)
+			rest = rest[BankSize:]
+		} else {
+			if len(rest) < length {
+				return nil, fmt.Errorf("truncated .z80 page %d", page)
+			}
+			if block, err = decompressZ80(rest[:length], BankSize); err != nil {
+				return nil, fmt.Errorf(".z80 page %d: %v", page, err)
+			}
+			rest = rest[length:]
+		}
+
+		bank, ok := z80PageBank(model, page)
+		if !ok {
+			// ROM pages and the like aren't part of the machine state
+			continue
+		}
+		if err := s.loadBank(bank, block); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fill in any banks the file left out
+	for bank := range s.RAM {
+		if s.RAM[bank] == nil && (model.Paged() || bank == 0 || bank == 2 || bank == 5) {
+			s.RAM[bank] = make([]byte, BankSize)
+		}
+	}
+	return s, nil
+}
+
+// z80Model returns the model for a hardware mode in a .z80 header
+func z80Model(version int, mode byte) (Model, error) {
+	switch {
+	case mode == 0 || mode == 1:
+		return Model48K, nil // With or without Interface 1
+	case version == 3 && mode == 3:
+		return Model48K, nil // With an M.G.T.
+	case version == 2 && (mode == 3 || mode == 4):
+		return Model128K, nil
+	case version == 3 && (mode == 4 || mode == 5 || mode == 6 || mode == 12):
+		return Model128K, nil // With Interface 1, M.G.T. or as a +2
+	case mode == 7 || mode == 8:
+		return ModelPlus3, nil // 8 is written by some versions of XZX-Pro
+	case version == 3 && mode == 13:
+		return ModelPlus2A, nil
+	}
+	return 0, fmt.Errorf("unsupported .z80 hardware mode %d", mode)
+}
+
+// z80PageBank maps a .z80 memory page number to a RAM bank
+func z80PageBank(model Model, page byte) (int, bool) {
+	if model.Paged() {
+		if page >= 3 && page <= 10 {
+			return int(page) - 3, true
+		}
+		return 0, false
+	}
+	switch page {
+	case 8:
+		return 5, true
+	case 4:
+		return 2, true
+	case 5:
+		return 0, true
+	}
+	return 0, false
+}
+
+// decompressZ80 expands a block compressed with the .z80 run-length
+// encoding, where ED ED nn bb stands for nn copies of bb
+func decompressZ80(data []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(data); {
+		if i+3 < len(data) && data[i] == 0xED && data[i+1] == 0xED {
+			for range data[i+2] {
+				out = append(out, data[i+3])
+			}
+			i += 4
+		} else {
+			out = append(out, data[i])
+			i++
+		}
+		if len(out) > size {
+			break
+		}
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("compressed memory expands to %d bytes, expected %d", len(out), size)
+	}
+	return out, nil
+}
+
+// compressZ80 run-length encodes a block for a .z80 file. Runs of five or
+// more identical bytes, or two or more EDs, are encoded; a byte following
+// a single ED is never part of a run.
+func compressZ80(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		b := data[i]
+		run := 1
+		for i+run < len(data) && data[i+run] == b && run < 0xFF {
+			run++
+		}
+		if run >= 5 || (b == 0xED && run >= 2) {
+			out = append(out, 0xED, 0xED, byte(run), b)
+			i += run
+			continue
+		}
+		out = append(out, b)
+		i++
+		if b == 0xED && i < len(data) {
+			out = append(out, data[i])
+			i++
+		}
+	}
+	return out
+}
+
+// WriteZ80 writes a .z80 snapshot of the given version (1, 2 or 3), with
+// compressed memory. Version 1 files can only hold a 48K snapshot, only
+// version 3 files keep the T-state counter and can hold a +2A, and only
+// their longer header for the +2A/+3 keeps port 0x1FFD.
+func WriteZ80(w io.Writer, s *Snapshot, version int) error {
+	if version < 1 || version > 3 {
+		return fmt.Errorf("unknown .z80 version %d", version)
+	}
+	if (version == 1 && s.Model != Model48K) || (version == 2 && s.Model == ModelPlus2A) {
+		return fmt.Errorf("version %d .z80 files can't hold a %v snapshot", version, s.Model)
+	}
+
+	header := make([]byte, z80HeaderLength)
+	put := func(offset int, v uint16) { binary.LittleEndian.PutUint16(header[offset:], v) }
+	header[0] = byte(s.AF >> 8)
+	header[1] = byte(s.AF)
+	put(2, s.BC)
+	put(4, s.HL)
+	if version == 1 {
+		put(6, s.PC)
+	}
+	put(8, s.SP)
+	header[10] = s.I
+	header[11] = s.R & 0x7F
+	header[12] = s.R>>7 | (s.Border&0x07)<<1
+	if version == 1 {
+		header[12] |= 0x20 // Compressed
+	}
+	put(13, s.DE)
+	put(15, s.BC2)
+	put(17, s.DE2)
+	put(19, s.HL2)
+	header[21] = byte(s.AF2 >> 8)
+	header[22] = byte(s.AF2)
+	put(23, s.IY)
+	put(25, s.IX)
+	if s.IFF1 {
+		header[27] = 1
+	}
+	if s.IFF2 {
+		header[28] = 1
+	}
+	header[29] = s.IM & 0x03
+	if s.Issue2 {
+		header[29] |= 0x04
+	}
+
+	out := bytes.NewBuffer(header)
+	if version == 1 {
+		ram := make([]byte, 0, 3*BankSize)
+		for _, bank := range Banks48K {
+			ram = append(ram, s.bank(bank)...)
+		}
+		out.Write(compressZ80(ram))
+		out.Write(z80v1End)
+		_, err := w.Write(out.Bytes())
+		return err
+	}
+
+	extraLength := z80V2Extra
+	if version == 3 {
+		extraLength = z80V3Extra
+		if s.Model.SpecialPaging() {
+			extraLength = z80V3ExtraPlus3
+		}
+	}
+	extra := make([]byte, extraLength)
+	binary.LittleEndian.PutUint16(extra, s.PC)
+	switch {
+	case s.Model == Model48K:
+		extra[2] = 0
+	case s.Model == ModelPlus3:
+		extra[2] = 7
+	case s.Model == ModelPlus2A:
+		extra[2] = 13
+	case version == 2:
+		extra[2] = 3
+	default:
+		extra[2] = 4
+	}
+	if s.Model.Paged() {
+		extra[3] = s.Port7FFD
+		extra[5] = 0x04 // AY in use
+		extra[6] = s.AYRegister
+		copy(extra[7:23], s.AYRegisters[:])
+	}
+	if version == 3 {
+		frame := s.Model.TStatesPerFrame()
+		quarter := frame / 4
+		tstates := s.TStates % frame
+		binary.LittleEndian.PutUint16(extra[23:], uint16(quarter-tstates%quarter-1))
+		extra[25] = byte((tstates/quarter + 3) % 4)
+	}
+	if extraLength == z80V3ExtraPlus3 {
+		extra[54] = s.Port1FFD
+	}
+	binary.Write(out, binary.LittleEndian, uint16(extraLength))
+	out.Write(extra)
+
+	writePage := func(page byte, data []byte) {
+		block := compressZ80(data)
+		if len(block) >= BankSize {
+			// Not worth compressing
+			binary.Write(out, binary.LittleEndian, uint16(0xFFFF))
+			out.WriteByte(page)
+			out.Write(data)
+			return
+		}
+		binary.Write(out, binary.LittleEndian, uint16(len(block)))
+		out.WriteByte(page)
+		out.Write(block)
+	}
+	if s.Model.Paged() {
+		for bank := range s.RAM {
+			writePage(byte(bank+3), s.bank(bank))
+		}
+	} else {
+		writePage(8, s.bank(5))
+		writePage(4, s.bank(2))
+		writePage(5, s.bank(0))
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
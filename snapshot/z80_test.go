@@ -0,0 +1,171 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// testSnapshot builds a snapshot with every register different and RAM
+// that has runs to compress, runs of EDs and noise
+func testSnapshot(model Model) *Snapshot {
+	s := New(model)
+	s.Registers = Registers{
+		AF: 0x1234, BC: 0x2345, DE: 0x3456, HL: 0x4567,
+		AF2: 0x5678, BC2: 0x6789, DE2: 0x789A, HL2: 0x89AB,
+		IX: 0x9ABC, IY: 0xABCD, SP: 0xBCDE, PC: 0xCDEF,
+		I: 0x3F, R: 0xA5,
+		IFF1: true, IFF2: true, IM: 1,
+	}
+	s.Border = 5
+	s.TStates = 12345
+	if model.SpecialPaging() {
+		s.Port1FFD = 0x04
+	}
+	if model.Paged() {
+		s.Port7FFD = 0x13
+		s.AYRegister = 7
+		for i := range s.AYRegisters {
+			s.AYRegisters[i] = byte(i * 11)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for bank, ram := range s.RAM {
+		if ram == nil {
+			continue
+		}
+		for i := range ram {
+			switch {
+			case i < 0x1000:
+				ram[i] = byte(bank) // A long run
+			case i < 0x1100:
+				ram[i] = 0xED
+			case i < 0x2000:
+				ram[i] = byte(rng.Intn(256))
+			case i < 0x2100:
+				// A single ED followed by runs
+				ram[i] = []byte{0xED, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}[i%8]
+			}
+		}
+	}
+	return s
+}
+
+func TestZ80RoundTrip(t *testing.T) {
+	tests := []struct {
+		model   Model
+		version int
+	}{
+		{Model48K, 1},
+		{Model48K, 2},
+		{Model48K, 3},
+		{Model128K, 2},
+		{Model128K, 3},
+		{ModelPlus2A, 3},
+		{ModelPlus3, 3},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v v%d", test.model, test.version), func(t *testing.T) {
+			want := testSnapshot(test.model)
+			want.Issue2 = test.model == Model48K
+			var buf bytes.Buffer
+			if err := WriteZ80(&buf, want, test.version); err != nil {
+				t.Fatalf("WriteZ80 version %d: %v", test.version, err)
+			}
+			got, err := ReadZ80(&buf)
+			if err != nil {
+				t.Fatalf("ReadZ80 version %d: %v", test.version, err)
+			}
+			if test.version < 3 {
+				// Only version 3 keeps the T-state counter
+				want.TStates = 0
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("version %d snapshot changed:\ngot  %+v\nwant %+v",
+					test.version, got.Registers, want.Registers)
+			}
+		})
+	}
+}
+
+func TestZ80TStates(t *testing.T) {
+	for _, model := range []Model{Model48K, Model128K} {
+		for _, tstates := range []uint32{0, 1, 17471, 17472, 34943, 52416, model.TStatesPerFrame() - 1} {
+			want := New(model)
+			want.TStates = tstates
+			var buf bytes.Buffer
+			if err := WriteZ80(&buf, want, 3); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadZ80(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.TStates != tstates {
+				t.Errorf("%v: T-states %d read back as %d", model, tstates, got.TStates)
+			}
+		}
+	}
+}
+
+func TestZ80Compression(t *testing.T) {
+	tests := []struct {
+		data, want []byte
+	}{
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0, 0, 0, 0}, []byte{0, 0, 0, 0}},
+		{[]byte{0, 0, 0, 0, 0}, []byte{0xED, 0xED, 5, 0}},
+		{[]byte{0xED, 0xED}, []byte{0xED, 0xED, 2, 0xED}},
+		{[]byte{0xED, 0, 0, 0, 0, 0, 0}, []byte{0xED, 0, 0xED, 0xED, 5, 0}},
+		{bytes.Repeat([]byte{7}, 300), []byte{0xED, 0xED, 255, 7, 0xED, 0xED, 45, 7}},
+	}
+	for _, test := range tests {
+		got := compressZ80(test.data)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("compressZ80(% X) = % X, want % X", test.data, got, test.want)
+		}
+		back, err := decompressZ80(got, len(test.data))
+		if err != nil || !bytes.Equal(back, test.data) {
+			t.Errorf("decompressZ80(% X) = % X, %v", got, back, err)
+		}
+	}
+}
+
+func TestZ80Errors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteZ80(&buf, testSnapshot(Model128K), 1); err == nil {
+		t.Error("wrote a 128K snapshot as version 1")
+	}
+	if err := WriteZ80(&buf, testSnapshot(ModelPlus2A), 2); err == nil {
+		t.Error("wrote a +2A snapshot as version 2")
+	}
+	buf.Reset()
+	if err := WriteZ80(&buf, testSnapshot(Model128K), 3); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, n := range []int{10, 31, 40, 100, len(data) - 1} {
+		if _, err := ReadZ80(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("read a .z80 file cut to %d bytes", n)
+		}
+	}
+}
+
+func TestSpecialPaging(t *testing.T) {
+	s := testSnapshot(ModelPlus3)
+	s.Port1FFD = 0x07 // Banks 4, 7, 6 and 3
+	for i, bank := range []int{4, 7, 6, 3} {
+		addr := uint16(i*BankSize + 0x1000)
+		s.RAM[bank][0x1000] = 0x99
+		if got := s.Read(addr); got != 0x99 {
+			t.Errorf("Read(0x%04X) = 0x%02X, expected bank %d", addr, got, bank)
+		}
+		s.Write(addr, byte(bank))
+		if s.RAM[bank][0x1000] != byte(bank) {
+			t.Errorf("Write(0x%04X) didn't reach bank %d", addr, bank)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package spectrum
+
+// IODevice interface for devices that support read and write
+type IODevice interface {
+	Read(addr uint16) byte
+	Write(addr uint16, value byte)
+}
+
+// IODeviceBus for I/O devices
+type IODeviceBus struct {
+	ports       []ioPort
+	floatingBus func() byte // Value read from unattached ports, or nil
+
+	// Sees, and may replace, every value read, for input recordings
+	input func(addr uint16, value byte) byte
+}
+
+// ioPort is a device and the addresses it answers to, those where the
+// bits in mask equal match. Output-only ports have no device, only write.
+type ioPort struct {
+	mask, match uint16
+	device      IODevice
+	write       func(addr uint16, value byte)
+}
+
+func NewIODeviceBus() *IODeviceBus {
+	return &IODeviceBus{}
+}
+
+// AddDevice connects a device selected by zeros in all the address bits
+// in mask
+func (b *IODeviceBus) AddDevice(mask uint16, device IODevice) {
+	b.AddPort(mask, 0, device)
+}
+
+// AddPort connects a device to the addresses where the bits in mask
+// equal match
+func (b *IODeviceBus) AddPort(mask, match uint16, device IODevice) {
+	b.ports = append(b.ports, ioPort{mask: mask, match: match, device: device, write: device.Write})
+}
+
+// AddOutputPort connects a port that can only be written, so reading it
+// gives the floating bus
+func (b *IODeviceBus) AddOutputPort(mask, match uint16, write func(addr uint16, value byte)) {
+	b.ports = append(b.ports, ioPort{mask: mask, match: match, write: write})
+}
+
+// SetFloatingBus sets what ports no device answers to read as. Without
+// it they read as all bits set.
+func (b *IODeviceBus) SetFloatingBus(floating func() byte) {
+	b.floatingBus = floating
+}
+
+// Read reads from the first device connected to addr
+func (b *IODeviceBus) Read(addr uint16) byte {
+	value := b.read(addr)
+	if b.input != nil {
+		value = b.input(addr, value)
+	}
+	return value
+}
+
+func (b *IODeviceBus) read(addr uint16) byte {
+	for _, port := range b.ports {
+		if port.device != nil && addr&port.mask == port.match {
+			return port.device.Read(addr)
+		}
+	}
+	return b.Floating()
+}
+
+// SetInput sets a function that sees every value read from the bus and
+// returns the value to use instead, or nil for none
+func (b *IODeviceBus) SetInput(input func(addr uint16, value byte) byte) {
+	b.input = input
+}
+
+// Floating returns what a port nothing answers to reads as
+func (b *IODeviceBus) Floating() byte {
+	if b.floatingBus != nil {
+		return b.floatingBus()
+	}
+	return 0xff // Default to all bits set
+}
+
+// Write writes to every device connected to addr, as partially decoded
+// ports can overlap
+func (b *IODeviceBus) Write(addr uint16, value byte) {
+	for _, port := range b.ports {
+		if addr&port.mask == port.match {
+			port.write(addr, value)
+		}
+	}
+}
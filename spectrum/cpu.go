@@ -0,0 +1,132 @@
+package spectrum
+
+import (
+	"github.com/imneme/chips-to-go/ula"
+	"github.com/imneme/chips-to-go/z80"
+)
+
+// CPU implementation using our Z80 wrapper
+type CPU struct {
+	*z80.CPU      // Embed our Z80 CPU implementation
+	memory        *Memory
+	bus           *IODeviceBus
+	interruptFlag bool
+	pins          uint64
+	traps         map[uint16]func() bool // opcode fetch address -> trap
+	contention    *ula.Contention
+	stall         uint32 // T-states the ULA is holding up the CPU for
+	fetchTState   uint32 // When the last opcode fetch started
+	fetches       uint32 // Opcode fetches, for input recordings
+	fetched       bool   // An opcode fetch began this T-state
+	acknowledged  bool   // An interrupt acknowledge began this T-state
+}
+
+func NewCPU(memory *Memory, bus *IODeviceBus) *CPU {
+	z80cpu, pins := z80.New()
+	contention := ula.NewContention(memory.model.Timing)
+	contention.Contended = memory.Contended
+	return &CPU{
+		CPU:        z80cpu,
+		memory:     memory,
+		bus:        bus,
+		pins:       pins, // Store initial pin state
+		contention: contention,
+	}
+}
+
+// Tick runs the CPU for one T-state, tstate being the ULA's position in
+// the frame. While the ULA is contending an access the CPU waits, and the
+// access happens when the wait is over.
+func (c *CPU) Tick(tstate uint32) {
+	c.fetched, c.acknowledged = false, false
+	if c.stall > 0 {
+		c.stall--
+		if c.stall == 0 {
+			c.transact()
+		}
+		return
+	}
+
+	// Update pin state with any pending interrupt
+	if c.interruptFlag {
+		c.pins |= z80.INT
+	} else {
+		c.pins &= ^z80.INT
+	}
+
+	// Perform one Z80 tick
+	c.pins = c.CPU.Tick(c.pins)
+
+	if c.pins&(z80.M1|z80.MREQ) == z80.M1|z80.MREQ {
+		c.fetchTState = tstate
+		c.fetches++
+		c.fetched = true
+	} else if c.pins&(z80.M1|z80.IORQ) == z80.M1|z80.IORQ {
+		c.acknowledged = true
+	}
+
+	// Process memory and I/O transactions, unless contended
+	c.stall = c.contention.Tick(c.pins, tstate)
+	if c.stall == 0 {
+		c.transact()
+	}
+}
+
+func (c *CPU) transact() {
+	// Handle memory access
+	if c.pins&z80.MREQ != 0 {
+		addr := z80.GetAddr(c.pins)
+		if c.pins&z80.M1 != 0 && c.traps != nil {
+			// Opcode fetch, which a trap may take over
+			if trap, ok := c.traps[addr]; ok && trap() {
+				return
+			}
+		}
+		if c.pins&z80.RD != 0 {
+			// Memory read
+			data := c.memory.Read(addr)
+			z80.SetData(&c.pins, data)
+		} else if c.pins&z80.WR != 0 {
+			// Memory write
+			data := z80.GetData(c.pins)
+			c.memory.Write(addr, data)
+		}
+	} else if c.pins&z80.IORQ != 0 {
+		// I/O access
+		if c.pins&z80.M1 != 0 {
+			// Interrupt acknowledge
+			z80.SetData(&c.pins, 0xFF)
+		} else {
+			addr := z80.GetAddr(c.pins)
+			if c.pins&z80.RD != 0 {
+				// IO read
+				data := c.bus.Read(addr)
+				z80.SetData(&c.pins, data)
+			} else if c.pins&z80.WR != 0 {
+				// IO write
+				data := z80.GetData(c.pins)
+				c.bus.Write(addr, data)
+			}
+		}
+	}
+}
+
+func (c *CPU) SetInterrupt(status bool) {
+	c.interruptFlag = status
+}
+
+func (c *CPU) SetPC(addr uint16) {
+	c.pins = c.CPU.Prefetch(addr)
+	c.stall = 0
+	c.contention.Reset()
+}
+
+// AddTrap calls trap whenever an instruction is fetched from addr. If the
+// trap returns true it has taken over, typically by calling SetPC, and
+// the fetch is abandoned; otherwise the instruction runs as normal.
+func (c *CPU) AddTrap(addr uint16, trap func() bool) {
+	if c.traps == nil {
+		c.traps = make(map[uint16]func() bool)
+	}
+	c.traps[addr] = trap
+}
@@ -0,0 +1,79 @@
+package spectrum
+
+import "github.com/imneme/chips-to-go/z80"
+
+// CPU returns the machine's CPU, whose registers a debugger can show
+func (m *Machine) CPU() *CPU {
+	return m.cpu
+}
+
+// NextPC returns the address of the instruction the CPU is starting, when
+// it is between instructions. The core's own PC has already moved past
+// the opcode being fetched.
+func (c *CPU) NextPC() uint16 {
+	return z80.GetAddr(c.pins)
+}
+
+// Raster returns where the ULA's beam is: the line of the frame, counting
+// from the top of the vertical blanking, and the T-state within the line
+func (m *Machine) Raster() (line, lineCycle uint32) {
+	return m.ula.line, m.ula.lineCycle
+}
+
+// SetBreakpoint sets or clears a breakpoint. Running stops as soon as the
+// CPU starts to fetch an instruction at a breakpoint.
+func (m *Machine) SetBreakpoint(addr uint16, on bool) {
+	if on {
+		if m.breakpoints == nil {
+			m.breakpoints = make(map[uint16]bool)
+		}
+		m.breakpoints[addr] = true
+	} else {
+		delete(m.breakpoints, addr)
+	}
+}
+
+// Breakpoint returns whether there is a breakpoint at addr
+func (m *Machine) Breakpoint(addr uint16) bool {
+	return m.breakpoints[addr]
+}
+
+// AtBreakpoint returns whether running last stopped at a breakpoint
+func (m *Machine) AtBreakpoint() bool {
+	return m.atBreakpoint
+}
+
+// Step runs the machine until the CPU starts the next instruction, or
+// goes to an interrupt. Breakpoints are ignored.
+func (m *Machine) Step() {
+	for {
+		m.tick()
+		if m.cpu.fetched || m.cpu.acknowledged {
+			break
+		}
+	}
+	if m.cpu.acknowledged {
+		// Into the interrupt routine
+		for !m.cpu.fetched {
+			m.tick()
+		}
+	}
+	m.atBreakpoint = false
+}
+
+// StepFrame runs the machine to the end of the frame and on to the start
+// of the next instruction, stopping early at a breakpoint
+func (m *Machine) StepFrame() {
+	m.RunFrame()
+	for !m.atBreakpoint && !m.cpu.fetched {
+		m.tick()
+	}
+}
+
+// checkBreakpoint notes when the CPU has started fetching an instruction
+// at a breakpoint
+func (m *Machine) checkBreakpoint() {
+	if m.cpu.fetched && m.breakpoints[z80.GetAddr(m.cpu.pins)] {
+		m.atBreakpoint = true
+	}
+}
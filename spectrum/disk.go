@@ -0,0 +1,70 @@
+package spectrum
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/imneme/chips-to-go/dsk"
+)
+
+// InsertDisk puts a .dsk image in drive A:. Anything written to the disk
+// is saved back to the file when it is ejected.
+func (m *Machine) InsertDisk(filename string) error {
+	if m.fdc == nil {
+		return fmt.Errorf("the %s has no disk drive", m.model.Name)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open disk: %v", err)
+	}
+	defer file.Close()
+	disk, err := dsk.Read(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := m.EjectDisk(); err != nil {
+		return err
+	}
+	m.fdc.Drives[0].Insert(disk, false)
+	m.diskFile = filename
+	return nil
+}
+
+// EjectDisk takes the disk out of drive A:, saving it if it was written.
+// The image is written beside the file and renamed over it, so a disk that
+// can't be saved leaves the file as it was.
+func (m *Machine) EjectDisk() error {
+	if m.fdc == nil || m.fdc.Drives[0].Disk == nil {
+		return nil
+	}
+	modified := m.fdc.Drives[0].Modified
+	disk := m.fdc.Drives[0].Eject()
+	filename := m.diskFile
+	m.diskFile = ""
+	if !modified || filename == "" {
+		// A disk from a snapshot has no file to go back to
+		return nil
+	}
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("could not save disk: %v", err)
+	}
+	if info, statErr := os.Stat(filename); statErr == nil {
+		err = file.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = dsk.Write(file, disk)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("could not save disk: %s: %v", filename, err)
+	}
+	return nil
+}
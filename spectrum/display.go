@@ -0,0 +1,253 @@
+package spectrum
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+)
+
+// Display receives the picture the ULA generates, eight pixels at a time
+type Display interface {
+	// UpdatePixels draws 8 pixels at a column of a line of the frame, the
+	// set bits of displayByte in the ink of attrByte and the rest in its
+	// paper. Lines count from the top of the frame and include the
+	// blanking intervals.
+	UpdatePixels(line, column uint32, displayByte, attrByte byte)
+
+	// ToggleFlash swaps the ink and paper of flashing attributes
+	ToggleFlash()
+
+	// EndFrame is called when the ULA finishes a frame
+	EndFrame()
+}
+
+// Picture geometry
+const (
+	TotalWidth     = 352            // 352 pixels
+	Columns        = TotalWidth / 8 // 352/8 columns
+	FieldLines     = 312            // Total PAL lines per field
+	TopBlanking    = 16             // Lines before visible area
+	BottomBlanking = 4              // Lines after visible area
+	VisibleLines   = FieldLines - TopBlanking - BottomBlanking
+)
+
+// Palette holds the eight colours and then their bright versions
+var Palette = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	color.RGBA{0x00, 0x00, 0xD7, 0xFF},
+	color.RGBA{0xD7, 0x00, 0x00, 0xFF},
+	color.RGBA{0xD7, 0x00, 0xD7, 0xFF},
+	color.RGBA{0x00, 0xD7, 0x00, 0xFF},
+	color.RGBA{0x00, 0xD7, 0xD7, 0xFF},
+	color.RGBA{0xD7, 0xD7, 0x00, 0xFF},
+	color.RGBA{0xD7, 0xD7, 0xD7, 0xFF},
+	color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	color.RGBA{0x00, 0x00, 0xFF, 0xFF},
+	color.RGBA{0xFF, 0x00, 0x00, 0xFF},
+	color.RGBA{0xFF, 0x00, 0xFF, 0xFF},
+	color.RGBA{0x00, 0xFF, 0x00, 0xFF},
+	color.RGBA{0x00, 0xFF, 0xFF, 0xFF},
+	color.RGBA{0xFF, 0xFF, 0x00, 0xFF},
+	color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+}
+
+// Framebuffer is a Display that keeps the visible part of the picture in
+// memory, TotalWidth by VisibleLines pixels, as colours from Palette. It
+// needs no window, so the machine can run headless.
+//
+// Given a ULAplus, the palette grows to 256 colours, Palette followed by
+// the ULAplus colours as they are first drawn. Each new colour makes a new
+// palette, so images taken earlier keep theirs.
+type Framebuffer struct {
+	image         *image.Paletted // The frame being drawn
+	flashInverted bool
+	frames        int
+	ulaplus       *ULAplus   // nil without one
+	indices       [256]uint8 // Palette index of each ULAplus colour, 0 if it has none yet
+	free          int        // Next palette index for a ULAplus colour
+}
+
+// NewFramebuffer creates a framebuffer, initially black
+func NewFramebuffer() *Framebuffer {
+	return &Framebuffer{
+		image: image.NewPaletted(image.Rect(0, 0, TotalWidth, VisibleLines), Palette),
+	}
+}
+
+// SetULAplus draws with the colours of a ULAplus whenever its palette is
+// on
+func (f *Framebuffer) SetULAplus(p *ULAplus) {
+	f.ulaplus = p
+	if len(f.image.Palette) == len(Palette) {
+		palette := make(color.Palette, 256)
+		copy(palette, Palette)
+		for i := len(Palette); i < len(palette); i++ {
+			palette[i] = Palette[0]
+		}
+		f.image.Palette = palette
+		f.free = len(Palette)
+		// The bright colours and black are ULAplus colours too. Black
+		// uses index 8, leaving 0 to mean none.
+		for i := range 8 {
+			var grb byte
+			if i&4 != 0 {
+				grb |= 0xE0
+			}
+			if i&2 != 0 {
+				grb |= 0x1C
+			}
+			if i&1 != 0 {
+				grb |= 0x03
+			}
+			f.indices[grb] = uint8(8 + i)
+		}
+	}
+}
+
+// ulaplusIndex returns the palette index of a ULAplus palette entry,
+// adding its colour to the palette if it isn't there. Once the palette is
+// full, the nearest colour stands in.
+func (f *Framebuffer) ulaplusIndex(entry byte) uint8 {
+	grb := f.ulaplus.Palette[entry&0x3F]
+	if index := f.indices[grb]; index != 0 {
+		return index
+	}
+	c := f.ulaplus.Color(entry)
+	if f.free == len(f.image.Palette) {
+		f.indices[grb] = uint8(f.image.Palette.Index(c))
+	} else {
+		palette := append(color.Palette(nil), f.image.Palette...)
+		palette[f.free] = c
+		f.image.Palette = palette
+		f.indices[grb] = uint8(f.free)
+		f.free++
+	}
+	return f.indices[grb]
+}
+
+// UpdatePixels draws 8 pixels
+func (f *Framebuffer) UpdatePixels(line, column uint32, displayByte, attrByte byte) {
+	if line < TopBlanking || line >= TopBlanking+VisibleLines || column >= Columns {
+		return
+	}
+	var ink, paper byte
+	if f.ulaplus != nil && f.ulaplus.Enabled {
+		inkEntry, paperEntry := f.ulaplus.Entries(line, column, attrByte)
+		ink, paper = f.ulaplusIndex(inkEntry), f.ulaplusIndex(paperEntry)
+	} else {
+		paper = (attrByte >> 3) & 0x07
+		ink = attrByte & 0x07
+		if attrByte&0x80 != 0 && f.flashInverted {
+			paper, ink = ink, paper
+		}
+		if attrByte&0x40 != 0 {
+			paper += 8
+			ink += 8
+		}
+	}
+	row := f.image.Pix[int(line-TopBlanking)*f.image.Stride+int(column)*8:]
+	for bit := range 8 {
+		if displayByte&(0x80>>bit) != 0 {
+			row[bit] = ink
+		} else {
+			row[bit] = paper
+		}
+	}
+}
+
+// ToggleFlash swaps the ink and paper of flashing attributes
+func (f *Framebuffer) ToggleFlash() {
+	f.flashInverted = !f.flashInverted
+}
+
+// EndFrame counts a finished frame
+func (f *Framebuffer) EndFrame() {
+	f.frames++
+}
+
+// Frames returns the number of frames drawn
+func (f *Framebuffer) Frames() int {
+	return f.frames
+}
+
+// At returns the Palette index of the pixel at x, y
+func (f *Framebuffer) At(x, y int) uint8 {
+	return f.image.ColorIndexAt(x, y)
+}
+
+// Image returns a copy of the picture. Between frames, it is the frame
+// just finished.
+func (f *Framebuffer) Image() *image.Paletted {
+	img := *f.image
+	img.Pix = append([]byte(nil), f.image.Pix...)
+	return &img
+}
+
+// WritePNG writes the picture as a PNG image
+func (f *Framebuffer) WritePNG(w io.Writer) error {
+	return png.Encode(w, f.image)
+}
+
+// SavePNG saves the picture to a PNG file
+func (f *Framebuffer) SavePNG(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create file: %s: %v", filename, err)
+	}
+	err = f.WritePNG(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write screenshot: %s: %v", filename, err)
+	}
+	return nil
+}
+
+// MultiDisplay returns a Display that draws on every one of displays,
+// skipping any that are nil
+func MultiDisplay(displays ...Display) Display {
+	var all multiDisplay
+	for _, d := range displays {
+		if d != nil {
+			all = append(all, d)
+		}
+	}
+	return all
+}
+
+// ulaplusDisplay is a Display that can draw with a ULAplus palette
+type ulaplusDisplay interface {
+	SetULAplus(p *ULAplus)
+}
+
+type multiDisplay []Display
+
+func (m multiDisplay) SetULAplus(p *ULAplus) {
+	for _, d := range m {
+		if d, ok := d.(ulaplusDisplay); ok {
+			d.SetULAplus(p)
+		}
+	}
+}
+
+func (m multiDisplay) UpdatePixels(line, column uint32, displayByte, attrByte byte) {
+	for _, d := range m {
+		d.UpdatePixels(line, column, displayByte, attrByte)
+	}
+}
+
+func (m multiDisplay) ToggleFlash() {
+	for _, d := range m {
+		d.ToggleFlash()
+	}
+}
+
+func (m multiDisplay) EndFrame() {
+	for _, d := range m {
+		d.EndFrame()
+	}
+}
@@ -0,0 +1,95 @@
+package spectrum
+
+import "github.com/imneme/chips-to-go/kbd"
+
+// Keyboard - the Spectrum's 40 keys sit in eight half-rows of five keys.
+// Each half-row is selected by a zero in one bit of the high byte of the
+// port address (A8-A15) and its keys appear in bits 0-4 of the result.
+// Keys are identified by their ASCII character where there is one.
+const (
+	KeyBreak       = kbd.Key(0x03) // CAPS SHIFT + SPACE
+	KeyEdit        = kbd.Key(0x07) // CAPS SHIFT + 1
+	KeyLeft        = kbd.Key(0x08) // CAPS SHIFT + 5
+	KeyRight       = kbd.Key(0x09) // CAPS SHIFT + 8
+	KeyDown        = kbd.Key(0x0A) // CAPS SHIFT + 6
+	KeyUp          = kbd.Key(0x0B) // CAPS SHIFT + 7
+	KeyDelete      = kbd.Key(0x0C) // CAPS SHIFT + 0
+	KeyEnter       = kbd.Key(0x0D)
+	KeyCapsShift   = kbd.Key(0x0E)
+	KeySymbolShift = kbd.Key(0x0F)
+	KeySpace       = kbd.Key(' ')
+)
+
+const (
+	CapsShiftModifier   = 0
+	SymbolShiftModifier = 1
+	KeyStickyFrames     = 2 // Keep quick key presses down long enough to be scanned
+)
+
+// spectrumKeymap lists the characters on each key, by half-row (A8-A15)
+// and bit, unshifted and then with CAPS SHIFT and SYMBOL SHIFT.
+// Spaces are keys with nothing to register at that layer.
+var spectrumKeymap = [3]string{
+	// No shift
+	" zxcv" + // A8: CAPS SHIFT, Z, X, C, V
+		"asdfg" + // A9
+		"qwert" + // A10
+		"12345" + // A11
+		"09876" + // A12
+		"poiuy" + // A13
+		" lkjh" + // A14: ENTER, L, K, J, H
+		"  mnb", // A15: SPACE, SYMBOL SHIFT, M, N, B
+	// CAPS SHIFT
+	" ZXCV" +
+		"ASDFG" +
+		"QWERT" +
+		"     " +
+		"     " +
+		"POIUY" +
+		" LKJH" +
+		"  MNB",
+	// SYMBOL SHIFT
+	" : ?/" +
+		"     " +
+		"   <>" +
+		"!@#$%" +
+		"_)('&" +
+		"\";   " +
+		" =+-^" +
+		"  .,*",
+}
+
+// NewKeyboard creates the Spectrum keyboard matrix with every key and
+// shifted character registered
+func NewKeyboard() *kbd.Matrix {
+	k := kbd.New(KeyStickyFrames)
+	k.RegisterModifier(CapsShiftModifier, 0, 0)
+	k.RegisterModifier(SymbolShiftModifier, 7, 1)
+
+	for layer, keys := range spectrumKeymap {
+		var modifiers uint8
+		if layer > 0 {
+			modifiers = 1 << (layer - 1)
+		}
+		for i, ch := range keys {
+			if ch != ' ' {
+				k.RegisterKey(kbd.Key(ch), i/5, i%5, modifiers)
+			}
+		}
+	}
+
+	k.RegisterKey(KeySpace, 7, 0, 0)
+	k.RegisterKey(KeyEnter, 6, 0, 0)
+	k.RegisterKey(KeyCapsShift, 0, 0, 0)
+	k.RegisterKey(KeySymbolShift, 7, 1, 0)
+
+	caps := uint8(1 << CapsShiftModifier)
+	k.RegisterKey(KeyBreak, 7, 0, caps)
+	k.RegisterKey(KeyEdit, 3, 0, caps)
+	k.RegisterKey(KeyLeft, 3, 4, caps)
+	k.RegisterKey(KeyDown, 4, 4, caps)
+	k.RegisterKey(KeyUp, 4, 3, caps)
+	k.RegisterKey(KeyRight, 4, 2, caps)
+	k.RegisterKey(KeyDelete, 4, 0, caps)
+	return k
+}
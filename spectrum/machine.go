@@ -0,0 +1,325 @@
+// Package spectrum emulates the ZX Spectrum 48K, 128K, +2, +2A and +3.
+//
+// A Machine ties the Z80, the ULA, memory, the sound chips, the tape
+// player and the disk drive together. It draws its picture through a
+// Display, which can be a window or an in-memory Framebuffer, so the
+// machine can run headless, as fast as it will go, for tests and tools.
+package spectrum
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/imneme/chips-to-go/ay"
+	"github.com/imneme/chips-to-go/beeper"
+	"github.com/imneme/chips-to-go/joystick"
+	"github.com/imneme/chips-to-go/kbd"
+	"github.com/imneme/chips-to-go/snapshot"
+	"github.com/imneme/chips-to-go/tape"
+	"github.com/imneme/chips-to-go/upd765"
+	"github.com/imneme/chips-to-go/wav"
+)
+
+// Machine combines all components
+type Machine struct {
+	model         *Model
+	memory        *Memory
+	bus           *IODeviceBus
+	display       Display
+	cpu           *CPU
+	ula           *ULA
+	keyboard      *kbd.Matrix
+	joysticks     *[2]joystick.Joystick
+	beeper        *beeper.Beeper
+	ay            *ay.AY // nil on a 48K
+	ulaplus       *ULAplus
+	fdc           *upd765.FDC // nil without a disk drive
+	diskFile      string      // Image of the disk in drive A:, written back on eject
+	tape          *tape.Player
+	tapeImage     []byte // File of the tape in the player, kept for snapshots
+	tapeFormat    string // Its extension
+	fastLoad      bool   // Load tapes through the ROM trap rather than in real time
+	recorder      *tape.Recorder
+	saveName      string   // File being saved to, empty when not saving
+	saveFile      *os.File // Open TAP file when saving through the ROM trap
+	wavFile       *os.File
+	wavWriter     *wav.Writer
+	video         *videoRecorder // nil when not recording video
+	rzxRecorder   *rzxRecorder   // nil when not recording input
+	rzxPlayer     *rzxPlayer     // nil when not replaying input
+	rzxErr        error          // Why the last replay stopped early
+	rewind        *rewindBuffer  // nil when rewinding is off
+	breakpoints   map[uint16]bool
+	atBreakpoint  bool // Running stopped at a breakpoint
+	currentTState uint64
+
+	// SZX blocks for hardware we don't emulate, kept from the last
+	// snapshot loaded so that saving an SZX file doesn't lose them
+	szxBlocks []snapshot.SZXBlock
+}
+
+// NewMachine creates a Spectrum that draws on display, which may be nil,
+// and produces sound at sampleRate samples a second, or none for zero.
+// Its ROMs are empty until loaded through Memory.
+func NewMachine(model *Model, display Display, sampleRate int) *Machine {
+	memory := NewMemory(model)
+	bus := NewIODeviceBus()
+
+	keyboard := NewKeyboard()
+	speaker := beeper.New(model.ClockRate, sampleRate)
+	player := tape.NewPlayer(model.ClockRate)
+	player.Is48K = !model.Paging
+	recorder := tape.NewRecorder(model.ClockRate)
+	cpu := NewCPU(memory, bus)
+	joysticks := &[2]joystick.Joystick{}
+	ula := NewULA(memory, cpu, display, keyboard, joysticks, speaker, player, recorder)
+
+	// Initialize subsystems
+	bus.AddDevice(0x0001, ula)
+	if model.FloatingBus {
+		bus.SetFloatingBus(ula.FloatingBus)
+	}
+
+	var sound *ay.AY
+	var fdc *upd765.FDC
+	switch {
+	case model.SpecialPaging:
+		// The +2A and +3 decode more of the address than the 128K
+		bus.AddOutputPort(0xC002, 0x4000, memory.WritePaging)
+		bus.AddOutputPort(0xF002, 0x1000, func(addr uint16, value byte) {
+			memory.WriteSpecialPaging(addr, value)
+			if fdc != nil {
+				fdc.SetMotor(memory.SpecialPaging()&SpecialPagingMotor != 0)
+			}
+		})
+	case model.Paging:
+		bus.AddOutputPort(0x8002, 0x0000, memory.WritePaging)
+	}
+	if model.Disk {
+		fdc = upd765.New()
+		bus.AddPort(0xE002, 0x2000, FDCPorts{fdc})
+	}
+	bus.AddPort(joystick.KempstonMask, joystick.KempstonMatch, JoystickPorts{joysticks, bus})
+	if model.AY {
+		// The AY is clocked at half the CPU's speed
+		sound = ay.New(model.ClockRate, model.ClockRate/2, sampleRate)
+		bus.AddPort(0xC002, 0xC000, AYPorts{sound})
+		bus.AddOutputPort(0xC002, 0x8000, AYPorts{sound}.Write)
+	}
+
+	m := &Machine{
+		model:     model,
+		memory:    memory,
+		bus:       bus,
+		display:   display,
+		cpu:       cpu,
+		ula:       ula,
+		keyboard:  keyboard,
+		joysticks: joysticks,
+		beeper:    speaker,
+		ay:        sound,
+		fdc:       fdc,
+		tape:      player,
+		fastLoad:  true,
+		recorder:  recorder,
+	}
+	cpu.AddTrap(LDBytes, m.loadTrap)
+	cpu.AddTrap(SABytes, m.saveTrap)
+	return m
+}
+
+// Close ejects the disk, saving it if it was written to, and finishes
+// any WAV capture, recording and tape being saved
+func (m *Machine) Close() error {
+	return errors.Join(m.EjectDisk(), m.StopWAVCapture(), m.StopRecording(),
+		m.StopRZXRecording(), m.StopTapeSave())
+}
+
+// Model returns the model being emulated
+func (m *Machine) Model() *Model {
+	return m.model
+}
+
+// Memory returns the machine's memory, for loading ROMs and screens
+func (m *Machine) Memory() *Memory {
+	return m.memory
+}
+
+// Display returns what the machine draws on
+func (m *Machine) Display() Display {
+	return m.display
+}
+
+// TStates returns the number of T-states run since the machine was made
+func (m *Machine) TStates() uint64 {
+	return m.currentTState
+}
+
+// Frames returns the number of frames the ULA has finished
+func (m *Machine) Frames() uint64 {
+	return m.ula.frames
+}
+
+// Run runs the machine for a number of T-states, or until it reaches a
+// breakpoint
+func (m *Machine) Run(tstates uint64) {
+	target := m.currentTState + tstates
+	m.atBreakpoint = false
+	for m.currentTState < target && !m.atBreakpoint {
+		m.tick()
+	}
+}
+
+// RunFrame runs the machine until the ULA finishes the current frame, or
+// until it reaches a breakpoint
+func (m *Machine) RunFrame() {
+	frame := m.ula.frames
+	m.atBreakpoint = false
+	for m.ula.frames == frame && !m.atBreakpoint {
+		m.tick()
+	}
+}
+
+// RunFrames runs the machine for n frames as fast as it can, throwing
+// away the sound. It is for running headless.
+func (m *Machine) RunFrames(n int) error {
+	for range n {
+		m.RunFrame()
+		if _, err := m.Audio(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishInstruction runs the machine until the CPU is between two
+// instructions. The CPU core overlaps the next opcode fetch with the end
+// of an instruction, so that fetch will just have started.
+func (m *Machine) finishInstruction() {
+	for !m.cpu.OpDone() || m.cpu.stall > 0 {
+		m.tick()
+	}
+}
+
+// tick runs the machine for one T-state
+func (m *Machine) tick() {
+	interrupt, frames := m.cpu.interruptFlag, m.ula.frames
+	m.ula.Tick()
+	if m.ay != nil {
+		m.ay.Tick()
+	}
+	switch {
+	case m.rzxPlayer != nil:
+		// The recording decides when the interrupts come
+		m.replayTick()
+	case m.rzxRecorder != nil:
+		m.recordTick(interrupt)
+	}
+	m.currentTState++
+	if len(m.breakpoints) > 0 {
+		m.checkBreakpoint()
+	}
+	if m.rewind != nil && m.ula.frames != frames && m.ula.frames%uint64(m.rewind.interval) == 0 {
+		m.saveRewindPoint()
+	}
+}
+
+// StartWAVCapture records everything the speaker plays to a WAV file
+// until StopWAVCapture is called
+func (m *Machine) StartWAVCapture(filename string) error {
+	if err := m.StopWAVCapture(); err != nil {
+		return err
+	}
+	if m.beeper.SampleRate() == 0 {
+		return fmt.Errorf("can't record sound from a machine without any")
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create file: %s: %v", filename, err)
+	}
+	writer, err := wav.NewWriter(file, m.beeper.SampleRate(), 1)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not write WAV header: %s: %v", filename, err)
+	}
+	m.wavFile = file
+	m.wavWriter = writer
+	return nil
+}
+
+// StopWAVCapture finishes the WAV file started by StartWAVCapture, if any
+func (m *Machine) StopWAVCapture() error {
+	if m.wavFile == nil {
+		return nil
+	}
+	err := m.wavWriter.Close()
+	if closeErr := m.wavFile.Close(); err == nil {
+		err = closeErr
+	}
+	m.wavFile = nil
+	m.wavWriter = nil
+	return err
+}
+
+// Audio returns the sound produced since the last call, the beeper and
+// AY mixed together, and adds it to any WAV capture and video recording.
+// The samples are only valid until the machine runs again.
+func (m *Machine) Audio() ([]float32, error) {
+	samples := m.beeper.Samples()
+	if m.ay != nil {
+		// Both count samples from the same clock, so they produce the same
+		// number
+		for i, sample := range m.ay.Samples() {
+			if i < len(samples) {
+				samples[i] += sample
+			}
+		}
+	}
+	if m.video != nil {
+		m.video.writeSamples(samples)
+	}
+	if m.wavWriter != nil {
+		if err := m.wavWriter.WriteSamples(samples); err != nil {
+			return samples, fmt.Errorf("could not write WAV data: %v", err)
+		}
+	}
+	return samples, nil
+}
+
+// KeyDown presses a Spectrum key. Keys are identified by the ASCII
+// character they type (for example 'a', 'A' for CAPS SHIFT+A, or '"' for
+// SYMBOL SHIFT+P) or by one of the Key constants.
+func (m *Machine) KeyDown(key kbd.Key) {
+	m.keyboard.KeyDown(key)
+}
+
+// KeyUp releases a Spectrum key pressed with KeyDown. Keys stay down for
+// at least KeyStickyFrames frames, so a KeyDown immediately followed by
+// KeyUp still types the key.
+func (m *Machine) KeyUp(key kbd.Key) {
+	m.keyboard.KeyUp(key)
+}
+
+// Joystick returns the first (0) or second (1) player's joystick, for
+// pressing its switches directly
+func (m *Machine) Joystick(player int) *joystick.Joystick {
+	return &m.joysticks[player]
+}
+
+// SetIssue2 chooses between the EAR input of an issue 2 board, which
+// also follows MIC, and that of the later issue 3 (the default)
+func (m *Machine) SetIssue2(issue2 bool) {
+	m.ula.issue2 = issue2
+}
+
+// Issue2 reports whether the machine has an issue 2 board
+func (m *Machine) Issue2() bool {
+	return m.ula.issue2
+}
+
+// SetJoystick plugs a player's joystick into an interface
+func (m *Machine) SetJoystick(player int, iface joystick.Interface) {
+	m.joysticks[player].Interface = iface
+	m.joysticks[player].Set(0)
+}
@@ -0,0 +1,1040 @@
+package spectrum
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/imneme/chips-to-go/dsk"
+	"github.com/imneme/chips-to-go/kbd"
+	"github.com/imneme/chips-to-go/rzx"
+	"github.com/imneme/chips-to-go/tape"
+	"github.com/imneme/chips-to-go/ula"
+	"github.com/imneme/chips-to-go/upd765"
+)
+
+// newTestMachine makes a headless machine running program from address 0
+// of ROM 0, with a blank screen
+func newTestMachine(t *testing.T, model *Model, program ...byte) (*Machine, *Framebuffer) {
+	t.Helper()
+	fb := NewFramebuffer()
+	m := NewMachine(model, fb, 0)
+	m.Memory().Load(0x0000, program)
+	m.Memory().Load(0x4000, make([]byte, 6912))
+	return m, fb
+}
+
+// screenY is where the top of the screen is in a Framebuffer
+func screenY(model *Model) int {
+	return int(model.ScreenStartLine - TopBlanking)
+}
+
+const screenX = ScreenStartColumn * 8
+
+func TestBorderAndScreen(t *testing.T) {
+	m, fb := newTestMachine(t, Model48K,
+		0xF3,       // DI
+		0x3E, 0x02, // LD A,2
+		0xD3, 0xFE, // OUT (0xFE),A
+		0x76, // HALT
+	)
+	m.Memory().Write(0x4000, 0xF0)
+	m.Memory().Write(0x5800, 0x47) // Bright white ink on black
+	m.Memory().Write(0x5801, 0x10) // Black ink on red
+
+	if err := m.RunFrames(2); err != nil {
+		t.Fatal(err)
+	}
+	if m.Frames() != 2 || fb.Frames() != 2 {
+		t.Errorf("ran %d frames and drew %d, want 2", m.Frames(), fb.Frames())
+	}
+	y := screenY(Model48K)
+	tests := []struct {
+		x, y int
+		want uint8
+	}{
+		{0, 0, 2},                             // Border
+		{TotalWidth - 1, VisibleLines - 1, 2}, // Border
+		{screenX - 1, y, 2},                   // Border beside the screen
+		{screenX, y, 15},                      // Ink
+		{screenX + 4, y, 8},                   // Paper
+		{screenX + 8, y, 2},                   // Paper of the next cell
+		{screenX, y + 1, 8},                   // Next line is blank
+		{screenX + 16, y, 0},                  // Black on black
+	}
+	for _, test := range tests {
+		if got := fb.At(test.x, test.y); got != test.want {
+			t.Errorf("pixel at %d, %d is %d, want %d", test.x, test.y, got, test.want)
+		}
+	}
+}
+
+func TestFlash(t *testing.T) {
+	m, fb := newTestMachine(t, Model48K, 0xF3, 0x76) // DI; HALT
+	m.Memory().Write(0x4000, 0xFF)
+	m.Memory().Write(0x5800, 0x87) // Flashing white ink on black
+
+	x, y := screenX, screenY(Model48K)
+	m.RunFrames(1)
+	if got := fb.At(x, y); got != 7 {
+		t.Errorf("flashing pixel starts as %d, want 7", got)
+	}
+	m.RunFrames(FlashRate)
+	if got := fb.At(x, y); got != 0 {
+		t.Errorf("flashing pixel is %d after %d frames, want 0", got, FlashRate)
+	}
+}
+
+func TestPaging(t *testing.T) {
+	m := NewMachine(Model128K, nil, 0)
+	m.Memory().Write(0xC000, 0x12) // Bank 0
+	m.bus.Write(0x7FFD, 0x13)
+	if got := m.Memory().Paging(); got != 0x13 {
+		t.Errorf("paging is 0x%02X, want 0x13", got)
+	}
+	m.Memory().Write(0xC000, 0x34) // Bank 3
+
+	// The 128K only looks at A1 and A15
+	m.bus.Write(0x3FFD, 0x20)
+	if got := m.Memory().Read(0xC000); got != 0x12 {
+		t.Errorf("bank 0 reads 0x%02X, want 0x12", got)
+	}
+	m.bus.Write(0x7FFD, 0x03)
+	if got := m.Memory().Paging(); got != 0x20 {
+		t.Errorf("locked paging changed to 0x%02X", got)
+	}
+}
+
+func TestSpecialPaging(t *testing.T) {
+	m := NewMachine(ModelPlus3, nil, 0)
+	m.bus.Write(0x3FFD, 0x07) // The disk controller, not paging
+	if got := m.Memory().Paging(); got != 0 {
+		t.Errorf("0x3FFD paged memory: 0x%02X", got)
+	}
+	m.bus.Write(0x1FFD, SpecialPagingOn|SpecialPagingMotor)
+	if got := m.Memory().SpecialPaging(); got != SpecialPagingOn|SpecialPagingMotor {
+		t.Errorf("special paging is 0x%02X", got)
+	}
+	if !m.fdc.Motor() {
+		t.Error("disk motor is off")
+	}
+	m.Memory().Write(0x0000, 0x56) // Bank 0, in place of the ROM
+	if got := m.Memory().Read(0x0000); got != 0x56 {
+		t.Errorf("RAM at 0x0000 reads 0x%02X, want 0x56", got)
+	}
+
+	m.bus.Write(0x7FFD, PagingLock)
+	m.bus.Write(0x1FFD, 0x00)
+	if got := m.Memory().SpecialPaging(); got != SpecialPagingOn|SpecialPagingMotor {
+		t.Errorf("locked special paging changed to 0x%02X", got)
+	}
+}
+
+// writeDisk writes a disk image to a file in a temporary directory
+func writeDisk(t *testing.T, disk *dsk.Disk) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "disk.dsk")
+	var buf bytes.Buffer
+	if err := dsk.Write(&buf, disk); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// TestEjectDisk checks a disk written to is saved on ejecting, and that
+// one that can't be saved leaves the file alone
+func TestEjectDisk(t *testing.T) {
+	filename := writeDisk(t, dsk.Format(40, 1, 9, 1, 2, 0xE5))
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine(ModelPlus3, nil, 0)
+	if err := m.InsertDisk(filename); err != nil {
+		t.Fatal(err)
+	}
+	track := m.fdc.Drives[0].Disk.Track(0, 0)
+	for len(track.Sectors) < 30 {
+		track.Sectors = append(track.Sectors, &dsk.Sector{N: 2, Data: make([]byte, 512)})
+	}
+	m.fdc.Drives[0].Modified = true
+	if err := m.EjectDisk(); err == nil {
+		t.Error("saved a track of 30 sectors")
+	}
+	if data, err := os.ReadFile(filename); err != nil || !bytes.Equal(data, original) {
+		t.Errorf("disk that couldn't be saved changed the file: %v", err)
+	}
+	if files, _ := filepath.Glob(filename + ".*"); len(files) != 0 {
+		t.Errorf("left %v behind", files)
+	}
+
+	if err := m.InsertDisk(filename); err != nil {
+		t.Fatal(err)
+	}
+	m.fdc.Drives[0].Disk.Track(0, 0).Sectors[0].Data[0] = 0x42
+	m.fdc.Drives[0].Modified = true
+	if err := m.EjectDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.InsertDisk(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.fdc.Drives[0].Disk.Track(0, 0).Sectors[0].Data[0]; got != 0x42 {
+		t.Errorf("saved disk has 0x%02X; want 0x42", got)
+	}
+}
+
+// TestSnapshotMedia checks an SZX snapshot keeps the tape, how far it has
+// played and the disk in the drive
+func TestSnapshotMedia(t *testing.T) {
+	dir := t.TempDir()
+	tapeFile := filepath.Join(dir, "game.tap")
+	var image bytes.Buffer
+	for i := range 3 {
+		if err := tape.WriteTAPBlock(&image, []byte{0xFF, byte(i), byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(tapeFile, image.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine(ModelPlus3, nil, 0)
+	if err := m.InsertTape(tapeFile); err != nil {
+		t.Fatal(err)
+	}
+	m.SeekTape(2)
+	if err := m.InsertDisk(writeDisk(t, dsk.Format(40, 1, 9, 1, 2, 0xE5))); err != nil {
+		t.Fatal(err)
+	}
+	m.fdc.Drives[0].Disk.Track(0, 0).Sectors[0].Data[0] = 0x42
+	snapshotFile := filepath.Join(dir, "state.szx")
+	if err := m.SaveSZX(snapshotFile); err != nil {
+		t.Fatal(err)
+	}
+
+	m.SeekTape(0)
+	if err := m.LoadSZX(snapshotFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.tape.BlockIndex(); got != 2 {
+		t.Errorf("tape at block %d after loading; want 2", got)
+	}
+
+	m = NewMachine(ModelPlus3, nil, 0)
+	if err := m.LoadSZX(snapshotFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(m.tape.Blocks()); got != 3 {
+		t.Errorf("loaded a tape of %d blocks; want 3", got)
+	}
+	if got := m.tape.BlockIndex(); got != 2 {
+		t.Errorf("tape at block %d in a new machine; want 2", got)
+	}
+	if m.fdc.Drives[0].Disk == nil {
+		t.Fatal("no disk in the drive")
+	}
+	if got := m.fdc.Drives[0].Disk.Track(0, 0).Sectors[0].Data[0]; got != 0x42 {
+		t.Errorf("disk has 0x%02X; want 0x42", got)
+	}
+	m.fdc.Drives[0].Modified = true
+	if err := m.EjectDisk(); err != nil {
+		t.Errorf("ejecting the snapshot's disk: %v", err)
+	}
+}
+
+// TestDiskRead runs a program that reads two sectors through the +3's
+// disk controller ports, as +3DOS does, polling the status register
+func TestDiskRead(t *testing.T) {
+	disk := dsk.Format(40, 1, 9, 1, 2, 0xE5)
+	for _, s := range disk.Track(0, 0).Sectors {
+		for i := range s.Data {
+			s.Data[i] = byte(i) + s.R
+		}
+	}
+	m, _ := newTestMachine(t, ModelPlus3,
+		0xF3,             // DI
+		0x31, 0x00, 0x80, // LD SP,0x8000
+		0x01, 0xFD, 0x1F, // LD BC,0x1FFD
+		0x3E, 0x08, // LD A,8
+		0xED, 0x79, // OUT (C),A: motor on
+		0x21, 0x4C, 0x00, // LD HL,command
+		0x1E, 0x09, // LD E,9
+		0x06, 0x2F, // send: LD B,0x2F
+		0xED, 0x78, // IN A,(C)
+		0x87,       // ADD A,A
+		0x30, 0xFB, // JR NC,wait for the data register
+		0x06, 0x3F, // LD B,0x3F
+		0x7E,       // LD A,(HL)
+		0xED, 0x79, // OUT (C),A
+		0x23,       // INC HL
+		0x1D,       // DEC E
+		0x20, 0xF0, // JR NZ,send
+		0x21, 0x00, 0x80, // LD HL,0x8000
+		0x06, 0x2F, // read: LD B,0x2F
+		0xED, 0x78, // IN A,(C)
+		0x87,       // ADD A,A
+		0x30, 0xFB, // JR NC,wait for the data register
+		0x87,       // ADD A,A
+		0x87,       // ADD A,A
+		0x30, 0x08, // JR NC,result at the end of execution
+		0x06, 0x3F, // LD B,0x3F
+		0xED, 0x78, // IN A,(C)
+		0x77,       // LD (HL),A
+		0x23,       // INC HL
+		0x18, 0xED, // JR read
+		0x21, 0x00, 0x90, // result: LD HL,0x9000
+		0x06, 0x2F, // LD B,0x2F
+		0xED, 0x78, // IN A,(C)
+		0x87,       // ADD A,A
+		0x30, 0xFB, // JR NC,wait for the data register
+		0x87,       // ADD A,A
+		0x30, 0x08, // JR NC,done when there is nothing to read
+		0x06, 0x3F, // LD B,0x3F
+		0xED, 0x78, // IN A,(C)
+		0x77,       // LD (HL),A
+		0x23,       // INC HL
+		0x18, 0xEE, // JR result
+		0x76, // done: HALT
+		// command: Read Data, drive 0, C0 H0 R1 N2 to sector 2
+		0x46, 0x00, 0x00, 0x00, 0x01, 0x02, 0x02, 0x2A, 0xFF,
+	)
+	if err := m.InsertDisk(writeDisk(t, disk)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RunFrames(5); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 1024 {
+		if got, want := m.Memory().Read(uint16(0x8000+i)), byte(i%512)+byte(1+i/512); got != want {
+			t.Fatalf("byte %d read is 0x%02X; want 0x%02X", i, got, want)
+		}
+	}
+	// No terminal count, so the read ends at the end of the cylinder
+	want := []byte{upd765.ST0Abnormal, upd765.ST1EndOfCylinder, 0, 1, 0, 1, 2}
+	for i, b := range want {
+		if got := m.Memory().Read(uint16(0x9000 + i)); got != b {
+			t.Errorf("result byte %d is 0x%02X; want 0x%02X", i, got, b)
+		}
+	}
+}
+
+func TestULAplus(t *testing.T) {
+	m := NewMachine(Model48K, nil, 0)
+	if m.ULAplus() != nil || m.Snapshot().ULAplus != nil {
+		t.Error("machine has a ULAplus before one is added")
+	}
+	p := m.AddULAplus()
+	m.bus.Write(ULAplusRegisterPort, 0x05)
+	m.bus.Write(ULAplusDataPort, 0xE3) // Green and blue
+	if got := m.bus.Read(ULAplusDataPort); got != 0xE3 {
+		t.Errorf("palette entry 5 reads 0x%02X, want 0xE3", got)
+	}
+	if got, want := p.Color(5), (color.RGBA{0x00, 0xFF, 0xFF, 0xFF}); got != want {
+		t.Errorf("palette entry 5 is %v, want %v", got, want)
+	}
+	m.bus.Write(ULAplusRegisterPort, ULAplusModeGroup)
+	m.bus.Write(ULAplusDataPort, 0x01)
+	if !p.Enabled || m.bus.Read(ULAplusDataPort) != 0x01 {
+		t.Error("palette mode isn't on")
+	}
+
+	// FLASH and BRIGHT choose the CLUT on the screen; the border is paper
+	if ink, paper := p.Entries(Model48K.ScreenStartLine, ScreenStartColumn, 0xC5); ink != 53 || paper != 56 {
+		t.Errorf("screen attribute 0xC5 is entries %d on %d, want 53 on 56", ink, paper)
+	}
+	if ink, paper := p.Entries(0, 0, 0x13); ink != 11 || paper != 10 {
+		t.Errorf("border attribute 0x13 is entries %d on %d, want 11 on 10", ink, paper)
+	}
+
+	// Snapshots keep the palette
+	other := NewMachine(Model48K, nil, 0)
+	other.AddULAplus()
+	if err := other.Restore(m.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if *other.ULAplus() != *p {
+		t.Error("ULAplus changed in a snapshot")
+	}
+}
+
+// TestULAplusDrawing checks the framebuffer, screenshots and recordings
+// show the ULAplus colours
+func TestULAplusDrawing(t *testing.T) {
+	m, fb := newTestMachine(t, Model48K,
+		0xF3, // DI
+		0x76, // HALT
+	)
+	p := m.AddULAplus()
+	for entry, grb := range map[byte]byte{8: 0x4A, 53: 0xE3, 56: 0x1C} {
+		m.bus.Write(ULAplusRegisterPort, entry)
+		m.bus.Write(ULAplusDataPort, grb)
+	}
+	m.bus.Write(ULAplusRegisterPort, ULAplusModeGroup)
+	m.bus.Write(ULAplusDataPort, 0x01)
+	m.Memory().Write(0x4000, 0xF0)
+	m.Memory().Write(0x5800, 0xC5) // Entries 53 on 56
+
+	filename := filepath.Join(t.TempDir(), "ulaplus.gif")
+	if err := m.StartRecording(filename); err != nil {
+		t.Fatal(err)
+	}
+	m.RunFrames(2)
+	before := fb.Image()
+
+	// A new colour doesn't change the palette of images already taken
+	m.bus.Write(ULAplusRegisterPort, 53)
+	m.bus.Write(ULAplusDataPort, 0x93)
+	m.RunFrames(1)
+	if err := m.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	x, y := screenX, screenY(Model48K)
+	var screenshot bytes.Buffer
+	if err := fb.WritePNG(&screenshot); err != nil {
+		t.Fatal(err)
+	}
+	after, err := png.Decode(&screenshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compose the recording's frames to get the last one
+	last := image.NewRGBA(recording.Image[0].Bounds())
+	for _, frame := range recording.Image {
+		for fy := frame.Rect.Min.Y; fy < frame.Rect.Max.Y; fy++ {
+			for fx := frame.Rect.Min.X; fx < frame.Rect.Max.X; fx++ {
+				last.Set(fx, fy, frame.At(fx, fy))
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		img   image.Image
+		x, y  int
+		entry byte
+		grb   byte
+	}{
+		{"border", before, 0, 0, 8, 0x4A},
+		{"ink", before, x, y, 53, 0xE3},
+		{"paper", before, x + 4, y, 56, 0x1C},
+		{"new ink", after, x, y, 53, 0x93},
+		{"recorded border", recording.Image[0], 0, 0, 8, 0x4A},
+		{"recorded ink", recording.Image[0], x, y, 53, 0xE3},
+		{"recorded new ink", last, x, y, 53, 0x93},
+	}
+	for _, test := range tests {
+		var q ULAplus
+		q.Palette[test.entry] = test.grb
+		want := q.Color(test.entry)
+		if got := color.RGBAModel.Convert(test.img.At(test.x, test.y)); got != want {
+			t.Errorf("%s is %v, want %v", test.name, got, want)
+		}
+	}
+
+	// Turning the palette off goes back to the normal colours
+	m.bus.Write(ULAplusRegisterPort, ULAplusModeGroup)
+	m.bus.Write(ULAplusDataPort, 0x00)
+	m.RunFrames(1)
+	if got := fb.At(x, y); p.Enabled || got >= uint8(len(Palette)) {
+		t.Errorf("ink is palette index %d with the ULAplus off", got)
+	}
+}
+
+func TestScreenshot(t *testing.T) {
+	m, fb := newTestMachine(t, Model48K,
+		0xF3,       // DI
+		0x3E, 0x05, // LD A,5
+		0xD3, 0xFE, // OUT (0xFE),A
+		0x76, // HALT
+	)
+	m.RunFrames(2)
+
+	filename := filepath.Join(t.TempDir(), "screen.png")
+	if err := fb.SavePNG(filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != TotalWidth || size.Y != VisibleLines {
+		t.Errorf("screenshot is %v, want %dx%d", size, TotalWidth, VisibleLines)
+	}
+	if got, want := img.At(0, 0), Palette[5]; got != want {
+		t.Errorf("border is %v, want %v", got, want)
+	}
+
+	// A copy doesn't change as the machine runs
+	before := fb.Image()
+	m.Memory().Write(0x4000, 0xFF)
+	m.Memory().Write(0x5800, 0x07)
+	m.RunFrames(1)
+	x, y := screenX, screenY(Model48K)
+	if before.ColorIndexAt(x, y) != 0 || fb.At(x, y) != 7 {
+		t.Error("image copy shares pixels with the framebuffer")
+	}
+}
+
+// TestROMBoot boots each model from its real ROMs, which must be in the
+// directory named by OMSE_ROMS, and checks for the white start-up screen
+func TestROMBoot(t *testing.T) {
+	dir := os.Getenv("OMSE_ROMS")
+	if dir == "" {
+		t.Skip("set OMSE_ROMS to a directory of ROM images to boot them")
+	}
+	for _, model := range []*Model{Model48K, Model128K, ModelPlus2, ModelPlus2A, ModelPlus3} {
+		t.Run(model.Name, func(t *testing.T) {
+			fb := NewFramebuffer()
+			m := NewMachine(model, fb, 0)
+			if _, err := m.Memory().LoadROMFile(filepath.Join(dir, model.ROMFile), 0); err != nil {
+				t.Skip(err)
+			}
+			if err := m.RunFrames(200); err != nil {
+				t.Fatal(err)
+			}
+			if got := fb.At(0, 0); got != 7 {
+				t.Errorf("border is %d, want white", got)
+			}
+			ink := false
+			for y := screenY(model); y < screenY(model)+ScreenHeight; y++ {
+				for x := screenX; x < screenX+ScreenWidthBytes*8; x++ {
+					ink = ink || fb.At(x, y) == 0
+				}
+			}
+			if !ink {
+				t.Error("nothing written on the screen")
+			}
+		})
+	}
+}
+
+// borderProgram changes the border colour every frame
+var borderProgram = map[uint16][]byte{
+	0x0000: {
+		0x31, 0x00, 0x80, // LD SP,0x8000
+		0xFB,       // EI
+		0x76,       // HALT
+		0x3C,       // INC A
+		0xD3, 0xFE, // OUT (0xFE),A
+		0x18, 0xFA, // JR to the HALT
+	},
+	0x0038: {0xFB, 0xC9}, // EI; RET
+}
+
+func TestRecording(t *testing.T) {
+	m := NewMachine(Model48K, nil, 8000)
+	for addr, code := range borderProgram {
+		m.Memory().Load(addr, code)
+	}
+	dir := t.TempDir()
+	if err := m.StartRecording(filepath.Join(dir, "test.txt")); err == nil {
+		t.Error("recorded to an unknown format")
+	}
+
+	filename := filepath.Join(dir, "test.y4m")
+	if err := m.StartRecording(filename); err != nil {
+		t.Fatal(err)
+	}
+	if m.Recording() != filename {
+		t.Errorf("recording to %q, want %q", m.Recording(), filename)
+	}
+	const frames = 10
+	if err := m.RunFrames(frames); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Recording() != "" {
+		t.Error("still recording")
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, data, _ := bytes.Cut(data, []byte("\n"))
+	if want := "YUV4MPEG2 W352 H292 F3500000:69888"; !bytes.HasPrefix(header, []byte(want)) {
+		t.Errorf("header is %q, want it to start %q", header, want)
+	}
+	frameSize := len("FRAME\n") + TotalWidth*VisibleLines*3/2
+	if len(data) != frames*frameSize {
+		t.Errorf("recorded %d bytes, want %d frames of %d", len(data), frames, frameSize)
+	}
+	// The border starts black and is red by the fourth frame
+	if data[len("FRAME\n")] == data[3*frameSize+len("FRAME\n")] {
+		t.Error("the border didn't change")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "test.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each frame lasts just under 1/50s
+	if want := int64(44 + frames*8000/50*2); info.Size() < want*99/100 || info.Size() > want {
+		t.Errorf("sound is %d bytes, want about %d", info.Size(), want)
+	}
+}
+
+func TestFetchCount(t *testing.T) {
+	m, _ := newTestMachine(t, Model48K, make([]byte, 100)...) // NOPs
+	m.Run(1)
+	m.cpu.fetches = 0
+	m.Run(10 * 4) // NOPs take 4 T-states in uncontended ROM
+	if m.cpu.fetches != 10 {
+		t.Errorf("counted %d fetches over 10 NOPs", m.cpu.fetches)
+	}
+}
+
+// inputProgram stores the keys pressed on the bottom row, once a frame
+var inputProgram = map[uint16][]byte{
+	0x0000: {
+		0x31, 0x00, 0x80, // LD SP,0x8000
+		0x21, 0x00, 0x90, // LD HL,0x9000
+		0xFB,       // EI
+		0xAF,       // XOR A
+		0xDB, 0xFE, // IN A,(0xFE)
+		0xE6, 0x1F, // AND 0x1F
+		0xFE, 0x1F, // CP 0x1F
+		0x28, 0xF7, // JR Z,0x0007 until a key is pressed
+		0x77,       // LD (HL),A
+		0x23,       // INC HL
+		0x76,       // HALT
+		0x18, 0xF2, // JR 0x0007
+	},
+	0x0038: {0xFB, 0xC9}, // EI; RET
+}
+
+// recordInputProgram records inputProgram with some keys pressed, returning the
+// machine as it was when the recording stopped
+func recordInputProgram(t *testing.T, filename string) *Machine {
+	t.Helper()
+	m := NewMachine(Model48K, nil, 0)
+	for addr, code := range inputProgram {
+		m.Memory().Load(addr, code)
+	}
+	m.RunFrames(3)
+	if err := m.StartRZXRecording(filename); err != nil {
+		t.Fatal(err)
+	}
+	if m.RZXRecording() != filename {
+		t.Errorf("recording to %q, want %q", m.RZXRecording(), filename)
+	}
+	m.Run(12345) // Start and stop partway through frames
+	for _, key := range []kbd.Key{KeySpace, 'm', KeySymbolShift} {
+		m.KeyDown(key)
+		m.RunFrames(2)
+		m.KeyUp(key)
+		m.RunFrames(3)
+	}
+	m.Run(5000)
+	if err := m.StopRZXRecording(); err != nil {
+		t.Fatal(err)
+	}
+	if m.RZXRecording() != "" {
+		t.Error("still recording")
+	}
+	return m
+}
+
+// replayInputProgram replays a recording of inputProgram until it ends
+func replayInputProgram(t *testing.T, filename string) *Machine {
+	t.Helper()
+	m := NewMachine(Model48K, nil, 0)
+	for addr, code := range inputProgram {
+		m.Memory().Load(addr, code)
+	}
+	if err := m.PlayRZX(filename); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; m.PlayingRZX(); i++ {
+		if i == 100 {
+			t.Fatal("replay didn't end")
+		}
+		m.RunFrame()
+	}
+	return m
+}
+
+func TestRZX(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.rzx")
+	recorded := recordInputProgram(t, filename)
+
+	played := replayInputProgram(t, filename)
+	if err := played.RZXError(); err != nil {
+		t.Fatal(err)
+	}
+	for addr := 0x4000; addr < 0x10000; addr++ {
+		want, got := recorded.Memory().Read(uint16(addr)), played.Memory().Read(uint16(addr))
+		if got != want {
+			t.Fatalf("memory at 0x%04X is 0x%02X after replay, want 0x%02X", addr, got, want)
+		}
+	}
+	if played.Memory().Read(0x9002) == 0 {
+		t.Error("the keys weren't replayed")
+	}
+}
+
+func TestRZXDivergence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.rzx")
+	recordInputProgram(t, filename)
+
+	// Drop the INs of a frame
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := rzx.Read(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Creator != RZXCreator {
+		t.Errorf("creator is %q, want %q", rec.Creator, RZXCreator)
+	}
+	rec.Sessions[0].Frames[4].Inputs = nil
+	var buf bytes.Buffer
+	if err := rzx.Write(&buf, rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := replayInputProgram(t, filename)
+	var d *Divergence
+	if !errors.As(m.RZXError(), &d) {
+		t.Fatalf("replay ended with %v, want a divergence", m.RZXError())
+	}
+	if d.Frame != 4 {
+		t.Errorf("diverged at frame %d, want 4", d.Frame)
+	}
+}
+
+func TestRewind(t *testing.T) {
+	m, fb := newTestMachine(t, Model48K,
+		0x31, 0x00, 0x80, // LD SP,0x8000
+		0x21, 0x00, 0x58, // LD HL,0x5800
+		0xFB,       // EI
+		0x76,       // HALT
+		0x3C,       // INC A
+		0xD3, 0xFE, // OUT (0xFE),A
+		0x77,       // LD (HL),A
+		0x23,       // INC HL
+		0x18, 0xF8, // JR to the HALT
+	)
+	m.Memory().Load(0x0038, []byte{0xFB, 0xC9}) // EI; RET
+	if _, err := m.Rewind(1); err == nil {
+		t.Error("rewound with rewinding off")
+	}
+	m.EnableRewind(2, 4)
+	m.RunFrames(7)
+
+	// Keep the frames drawn after frame 8 starts
+	const first = 8
+	var pictures [][]byte
+	var tstates []uint64
+	for m.Frames() < first+5 {
+		m.RunFrame()
+		pictures = append(pictures, append([]byte(nil), fb.image.Pix...))
+		tstates = append(tstates, m.TStates())
+	}
+
+	n, err := m.Rewind(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || m.Frames() != first {
+		t.Fatalf("rewound %d frames to frame %d, want 5 to frame %d", n, m.Frames(), first)
+	}
+	for i := 1; i < len(pictures); i++ {
+		m.RunFrame()
+		if m.TStates() != tstates[i] {
+			t.Errorf("frame %d ended at T-state %d, not %d", first+i, m.TStates(), tstates[i])
+		}
+		if !bytes.Equal(fb.image.Pix, pictures[i]) {
+			t.Errorf("frame %d is different after rewinding", first+i)
+		}
+	}
+
+	// Only four snapshots are kept
+	n, err = m.Rewind(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 || m.Frames() != 6 {
+		t.Errorf("rewound %d frames to frame %d, want 7 to frame 6", n, m.Frames())
+	}
+
+	// A recording doesn't get the frames run again to reach the target
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "rewind.y4m")
+	if err := m.StartRecording(filename); err != nil {
+		t.Fatal(err)
+	}
+	m.RunFrames(5)
+	if _, err := m.Rewind(2); err != nil { // Back to between two points
+		t.Fatal(err)
+	}
+	m.RunFrames(1)
+	if err := m.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := bytes.Count(data, []byte("FRAME\n")); frames != 6 {
+		t.Errorf("recorded %d frames, want the 6 run", frames)
+	}
+
+	// Nor can what has been saved to tape be taken back
+	if err := m.StartTapeSave(filepath.Join(dir, "rewind.tzx")); err != nil {
+		t.Fatal(err)
+	}
+	m.RunFrames(1)
+	if _, err := m.Rewind(1); err == nil {
+		t.Error("rewound while saving to tape")
+	}
+	if err := m.StopTapeSave(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRewindDisk checks rewinding takes the disk controller back too
+func TestRewindDisk(t *testing.T) {
+	m, _ := newTestMachine(t, ModelPlus3, 0xF3, 0x76) // DI; HALT
+	if err := m.InsertDisk(writeDisk(t, dsk.Format(40, 1, 9, 1, 2, 0xE5))); err != nil {
+		t.Fatal(err)
+	}
+	m.EnableRewind(1, 4)
+	m.RunFrames(2)
+	m.bus.Write(0x1FFD, SpecialPagingMotor)
+	for _, b := range []byte{0x46, 0x00, 0x00, 0x00, 0x01, 0x02, 0x01, 0x2A, 0xFF} {
+		m.bus.Write(0x3FFD, b) // Read Data of sector 1
+	}
+	m.RunFrames(1)
+	if m.bus.Read(0x2FFD)&upd765.StatusExecution == 0 {
+		t.Fatal("read didn't start")
+	}
+	if _, err := m.Rewind(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.bus.Read(0x2FFD); got != upd765.StatusReady {
+		t.Errorf("status 0x%02X after rewinding to before the read; want 0x%02X", got, upd765.StatusReady)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	m, _ := newTestMachine(t, Model48K,
+		0xF3,       // DI
+		0x3E, 0x01, // LD A,1
+		0x06, 0x02, // LD B,2
+		0x76, // HALT
+	)
+	m.SetBreakpoint(0x0003, true)
+	if !m.Breakpoint(0x0003) || m.Breakpoint(0x0001) {
+		t.Error("wrong breakpoints set")
+	}
+	m.Run(1000)
+	if !m.AtBreakpoint() {
+		t.Fatal("didn't stop at the breakpoint")
+	}
+	if pc, a := m.CPU().NextPC(), m.CPU().A(); pc != 0x0003 || a != 1 {
+		t.Errorf("stopped at 0x%04X with A=%d, want 0x0003 with A=1", pc, a)
+	}
+
+	m.Step()
+	if pc, b := m.CPU().NextPC(), m.CPU().B(); pc != 0x0005 || b != 2 {
+		t.Errorf("stepped to 0x%04X with B=%d, want 0x0005 with B=2", pc, b)
+	}
+
+	m.SetBreakpoint(0x0003, false)
+	if m.Breakpoint(0x0003) {
+		t.Error("breakpoint wasn't cleared")
+	}
+	m.StepFrame()
+	if m.AtBreakpoint() || m.Frames() != 1 {
+		t.Errorf("frame step stopped in frame %d", m.Frames())
+	}
+	if line, _ := m.Raster(); line != 0 {
+		t.Errorf("frame step stopped on line %d, want 0", line)
+	}
+}
+
+// TestBorderStripes changes the border every 27 T-states, which is
+// part way through a column more often than not, and compares the second
+// frame with one drawn from when the OUTs happened
+func TestBorderStripes(t *testing.T) {
+	for _, model := range []*Model{Model48K, Model128K, ModelPlus3} {
+		t.Run(model.Name, func(t *testing.T) {
+			m, fb := newTestMachine(t, model,
+				0xF3,       // DI
+				0xD3, 0xFE, // OUT (0xFE),A
+				0x3C,       // INC A
+				0x18, 0xFB, // JR to the OUT
+			)
+			type change struct {
+				tstate uint64
+				color  byte
+			}
+			var changes []change
+			m.bus.AddOutputPort(0x0001, 0x0000, func(addr uint16, value byte) {
+				changes = append(changes, change{m.TStates(), value & 0x07})
+			})
+			m.RunFrames(2)
+
+			// The machine starts with the beam at the interrupt, BorderTStates
+			// into the first line
+			timing := model.Timing
+			frame := uint64(timing.FrameLength())
+			mismatches := 0
+			for y := range VisibleLines {
+				line := uint64(y + TopBlanking)
+				for x := range TotalWidth {
+					tstate := frame + line*uint64(timing.TStatesPerLine) + uint64(x/2) - BorderTStates
+					var want uint8
+					for _, c := range changes {
+						if c.tstate <= tstate {
+							want = c.color
+						}
+					}
+					screenLine := uint32(line) - model.ScreenStartLine
+					if screenLine < ScreenHeight && x >= screenX && x < screenX+ScreenWidthBytes*8 {
+						want = 0 // The screen is black
+					}
+					if got := fb.At(x, y); got != want && mismatches < 10 {
+						mismatches++
+						t.Errorf("pixel at %d, %d is %d, want %d", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMulticolour changes the attribute of the top left cell as fast as it
+// can, and checks that each of its lines shows the attribute there when
+// the ULA fetched it
+func TestMulticolour(t *testing.T) {
+	for _, model := range []*Model{Model48K, Model128K, ModelPlus3} {
+		t.Run(model.Name, func(t *testing.T) {
+			m, fb := newTestMachine(t, model,
+				0xF3,             // DI
+				0x21, 0x00, 0x58, // LD HL,0x5800
+				0x77,       // LD (HL),A
+				0x3C,       // INC A
+				0x18, 0xFC, // JR to the LD
+			)
+			for line := range 8 {
+				m.Memory().Write(0x4000+uint16(line)<<8, 0xF0)
+			}
+
+			var want [8]byte
+			m.RunFrame()
+			for m.Frames() == 1 {
+				tstate := m.ula.FrameTState()
+				m.tick()
+				kind, line, column := model.Timing.Fetch(tstate)
+				if kind == ula.FetchAttribute && column == 0 && line < 8 {
+					want[line] = m.Memory().Read(0x5800)
+				}
+			}
+
+			changed := false
+			y := screenY(model)
+			for line, attr := range want {
+				changed = changed || attr != want[0]
+				bright := (attr >> 6 & 1) * 8
+				if ink, paper := fb.At(screenX, y+line), fb.At(screenX+4, y+line); ink != attr&7+bright || paper != attr>>3&7+bright {
+					t.Errorf("line %d is %d on %d, want attribute 0x%02X", line, ink, paper, attr)
+				}
+			}
+			if !changed {
+				t.Error("the attribute didn't change while the cell was drawn")
+			}
+		})
+	}
+}
+
+// TestStop48K checks a "stop the tape if in 48K mode" block stops the tape
+// on a 48K Spectrum and is passed over on a 128K one
+func TestStop48K(t *testing.T) {
+	for _, test := range []struct {
+		model *Model
+		stops bool
+	}{
+		{Model48K, true},
+		{Model128K, false},
+		{ModelPlus3, false},
+	} {
+		t.Run(test.model.Name, func(t *testing.T) {
+			m := NewMachine(test.model, nil, 0)
+			m.tape.Insert([]tape.Block{
+				&tape.PulseSequence{Lengths: []uint32{100}},
+				&tape.Stop48KBlock{},
+				&tape.PulseSequence{Lengths: []uint32{100000}},
+			})
+			m.PlayTape()
+			m.Run(1000)
+			if m.TapePlaying() == test.stops {
+				t.Errorf("tape playing is %v; want %v", m.TapePlaying(), !test.stops)
+			}
+		})
+	}
+}
+
+// TestIssue2 checks MIC shows on the EAR input of an issue 2 board only,
+// and that snapshots carry the choice
+func TestIssue2(t *testing.T) {
+	m := NewMachine(Model48K, nil, 0)
+	m.bus.Write(0x00FE, 0x08) // MIC
+	if got := m.ula.Read(0xFEFE) & 0x40; got != 0 {
+		t.Errorf("issue 3 EAR input with MIC set = %02X; want 00", got)
+	}
+	snap := m.Snapshot()
+	if snap.Issue2 {
+		t.Error("issue 3 machine saved as issue 2")
+	}
+	snap.Issue2 = true
+	if err := m.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Issue2() {
+		t.Fatal("issue 2 snapshot restored as issue 3")
+	}
+	m.bus.Write(0x00FE, 0x08)
+	if got := m.ula.Read(0xFEFE) & 0x40; got != 0x40 {
+		t.Errorf("issue 2 EAR input with MIC set = %02X; want 40", got)
+	}
+	m.bus.Write(0x00FE, 0x00)
+	if got := m.ula.Read(0xFEFE) & 0x40; got != 0 {
+		t.Errorf("issue 2 EAR input with EAR and MIC clear = %02X; want 00", got)
+	}
+	if !m.Snapshot().Issue2 {
+		t.Error("issue 2 machine saved as issue 3")
+	}
+}
@@ -0,0 +1,229 @@
+package spectrum
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/imneme/chips-to-go/mem"
+	"github.com/imneme/chips-to-go/snapshot"
+)
+
+// Memory system - 16K ROMs and 16K RAM banks, paged as the model says
+type Memory struct {
+	*mem.Memory
+	model    *Model
+	roms     [][]byte
+	ram      [8][]byte // Banks numbered as on the 128K; a 48K has 5, 2 and 0
+	port7FFD byte      // Last write to the paging port
+	port1FFD byte      // Last write to the +2A/+3's special paging port
+	banks    [4]int    // RAM bank in each 16K of the address space, -1 for ROM
+}
+
+const PageSize = 0x4000
+
+// Bits of the 128K paging port
+const (
+	PagingRAM    = 0x07 // RAM bank at 0xC000
+	PagingScreen = 0x08 // Display bank 7 rather than bank 5
+	PagingROM    = 0x10 // ROM 1 rather than ROM 0
+	PagingLock   = 0x20 // Ignore further writes to both ports until reset
+)
+
+// Bits of the +2A/+3's special paging port
+const (
+	SpecialPagingOn     = 0x01 // All RAM, in the layout bits 1-2 choose
+	SpecialPagingLayout = 0x06
+	SpecialPagingROM    = 0x04 // High bit of the ROM number when not all RAM
+	SpecialPagingMotor  = 0x08 // Disk motor
+)
+
+func NewMemory(model *Model) *Memory {
+	pages, err := mem.New(PageSize)
+	if err != nil {
+		panic(err) // PageSize is a valid constant
+	}
+	m := &Memory{
+		Memory: pages,
+		model:  model,
+	}
+	for range model.ROMs {
+		m.roms = append(m.roms, make([]byte, PageSize))
+	}
+	for bank := range m.ram {
+		if model.Paging || bank == 5 || bank == 2 || bank == 0 {
+			m.ram[bank] = make([]byte, PageSize)
+		}
+	}
+	m.SetPaging(0)
+
+	// Create a recognizable pattern in screen memory
+	for y := uint16(0); y < 192; y++ {
+		for x := uint16(0); x < 32; x++ {
+			addr := 0x4000 + (y * 32) + x
+			// Create diagonal stripes
+			if ((x + (y / 8)) & 0x07) != 0 {
+				m.Write(addr, 0xAA)
+			} else {
+				m.Write(addr, 0x55)
+			}
+		}
+	}
+
+	// Set attributes to alternate colors
+	for y := uint16(0); y < 24; y++ {
+		for x := uint16(0); x < 32; x++ {
+			attrAddr := 0x5800 + (y * 32) + x
+			// Alternate between cyan on black and yellow on blue
+			if ((x + y) & 1) != 0 {
+				m.Write(attrAddr, 0x45)
+			} else {
+				m.Write(attrAddr, 0x16)
+			}
+		}
+	}
+
+	return m
+}
+
+// SetPaging pages ROM and RAM as a write of value to port 0x7FFD would,
+// even if paging is locked. On a 48K only ROM 0 and bank 0 exist, so it
+// does nothing.
+func (m *Memory) SetPaging(value byte) {
+	if !m.model.Paging {
+		value = 0
+	}
+	m.port7FFD = value
+	m.page()
+}
+
+// SetSpecialPaging pages memory as a write of value to port 0x1FFD would,
+// even if paging is locked. Only the +2A and +3 have the port.
+func (m *Memory) SetSpecialPaging(value byte) {
+	if !m.model.SpecialPaging {
+		value = 0
+	}
+	m.port1FFD = value
+	m.page()
+}
+
+// page maps the ROM and RAM the paging ports select
+func (m *Memory) page() {
+	if m.port1FFD&SpecialPagingOn != 0 {
+		layout := snapshot.SpecialPagingBanks[(m.port1FFD&SpecialPagingLayout)>>1]
+		for i, bank := range layout {
+			m.banks[i] = bank
+			m.MapRAM(uint16(i*PageSize), m.ram[bank])
+		}
+		return
+	}
+
+	rom := 0
+	if m.port7FFD&PagingROM != 0 {
+		rom = 1
+	}
+	if m.port1FFD&SpecialPagingROM != 0 {
+		rom += 2
+	}
+	m.banks = [4]int{-1, 5, 2, int(m.port7FFD & PagingRAM)}
+	m.MapROM(0x0000, m.roms[rom])
+	for i := 1; i < 4; i++ {
+		m.MapRAM(uint16(i*PageSize), m.ram[m.banks[i]])
+	}
+}
+
+// Paging returns the last value written to port 0x7FFD
+func (m *Memory) Paging() byte {
+	return m.port7FFD
+}
+
+// WritePaging handles a write to port 0x7FFD, which the lock bit can
+// turn off until the next reset
+func (m *Memory) WritePaging(addr uint16, value byte) {
+	if m.port7FFD&PagingLock == 0 {
+		m.SetPaging(value)
+	}
+}
+
+// SpecialPaging returns the last value written to port 0x1FFD
+func (m *Memory) SpecialPaging() byte {
+	return m.port1FFD
+}
+
+// WriteSpecialPaging handles a write to port 0x1FFD, which is locked
+// along with port 0x7FFD
+func (m *Memory) WriteSpecialPaging(addr uint16, value byte) {
+	if m.port7FFD&PagingLock == 0 {
+		m.SetSpecialPaging(value)
+	}
+}
+
+// Screen returns the RAM bank the ULA displays
+func (m *Memory) Screen() []byte {
+	if m.port7FFD&PagingScreen != 0 {
+		return m.ram[7]
+	}
+	return m.ram[5]
+}
+
+// Contended reports whether the ULA contends an address: one in the odd
+// RAM banks (of which the 48K only has bank 5), or in banks 4-7 on the
+// +2A and +3
+func (m *Memory) Contended(addr uint16) bool {
+	bank := m.banks[addr/PageSize]
+	if m.model.SpecialPaging {
+		return bank >= 4
+	}
+	return bank >= 0 && bank&1 != 0
+}
+
+// LoadROMFile loads an image of one or more 16K ROMs, starting with ROM
+// number first, and returns how many ROMs it held
+func (m *Memory) LoadROMFile(filename string, first int) (int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, fmt.Errorf("could not read ROM: %v", err)
+	}
+	if len(data) == 0 || len(data)%PageSize != 0 {
+		return 0, fmt.Errorf("%s: ROM images must be a multiple of 16K, not %d bytes", filename, len(data))
+	}
+	n := len(data) / PageSize
+	if first+n > len(m.roms) {
+		return 0, fmt.Errorf("%s: too many ROMs, the %s has %d", filename, m.model.Name, len(m.roms))
+	}
+	for i := range n {
+		copy(m.roms[first+i], data[i*PageSize:])
+	}
+	return n, nil
+}
+
+func (m *Memory) LoadFromFile(filename string, addr uint16, size uint16) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	// Get file size
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not get file info: %v", err)
+	}
+
+	// Check if we have enough data
+	if fileInfo.Size() < int64(size) {
+		return fmt.Errorf("file too small: need at least %d bytes", size)
+	}
+
+	return m.LoadFromReader(file, addr, size)
+}
+
+// LoadFromReader loads size bytes at addr, bypassing ROM protection
+func (m *Memory) LoadFromReader(r io.Reader, addr uint16, size uint16) error {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	m.Load(addr, data)
+	return nil
+}
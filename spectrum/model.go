@@ -0,0 +1,116 @@
+package spectrum
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/imneme/chips-to-go/snapshot"
+	"github.com/imneme/chips-to-go/ula"
+)
+
+// Model describes the hardware of a Spectrum model
+type Model struct {
+	Name              string
+	Timing            *ula.Timing
+	ClockRate         int    // CPU clock in Hz
+	ScreenStartLine   uint32 // Line of the frame the screen starts on
+	InterruptDuration uint32 // T-states the frame interrupt is held for
+	ROMs              int    // Number of 16K ROMs
+	ROMFile           string // Default image holding all the ROMs
+	Paging            bool   // Eight RAM banks and two ROMs paged by port 0x7FFD
+	SpecialPaging     bool   // Port 0x1FFD pages ROMs 2-3 and all-RAM layouts
+	AY                bool   // AY-3-8910 sound on ports 0xFFFD and 0xBFFD
+	Disk              bool   // uPD765 disk controller on ports 0x2FFD and 0x3FFD
+	FloatingBus       bool   // Unattached ports read what the ULA is fetching
+	Snapshot          snapshot.Model
+}
+
+var Model48K = &Model{
+	Name:              "48K",
+	Timing:            &ula.Timing48K,
+	ClockRate:         3_500_000,
+	ScreenStartLine:   64,
+	InterruptDuration: 32,
+	ROMs:              1,
+	ROMFile:           "48.rom",
+	FloatingBus:       true,
+	Snapshot:          snapshot.Model48K,
+}
+
+var Model128K = &Model{
+	Name:              "128K",
+	Timing:            &ula.Timing128K,
+	ClockRate:         3_546_900,
+	ScreenStartLine:   63,
+	InterruptDuration: 36,
+	ROMs:              2,
+	ROMFile:           "128.rom",
+	Paging:            true,
+	AY:                true,
+	FloatingBus:       true,
+	Snapshot:          snapshot.Model128K,
+}
+
+// ModelPlus2 is the Amstrad +2, a 128K with a different ROM
+var ModelPlus2 = &Model{
+	Name:              "+2",
+	Timing:            &ula.Timing128K,
+	ClockRate:         3_546_900,
+	ScreenStartLine:   63,
+	InterruptDuration: 36,
+	ROMs:              2,
+	ROMFile:           "plus2.rom",
+	Paging:            true,
+	AY:                true,
+	FloatingBus:       true,
+	Snapshot:          snapshot.Model128K,
+}
+
+// ModelPlus2A is the Amstrad +2A, the +3's gate array without its disk
+// drive
+var ModelPlus2A = &Model{
+	Name:              "+2A",
+	Timing:            &ula.TimingPlus3,
+	ClockRate:         3_546_900,
+	ScreenStartLine:   63,
+	InterruptDuration: 32,
+	ROMs:              4,
+	ROMFile:           "plus2a.rom",
+	Paging:            true,
+	SpecialPaging:     true,
+	AY:                true,
+	Snapshot:          snapshot.ModelPlus2A,
+}
+
+// ModelPlus3 is the Amstrad +3, with a 3" disk drive
+var ModelPlus3 = &Model{
+	Name:              "+3",
+	Timing:            &ula.TimingPlus3,
+	ClockRate:         3_546_900,
+	ScreenStartLine:   63,
+	InterruptDuration: 32,
+	ROMs:              4,
+	ROMFile:           "plus3.rom",
+	Paging:            true,
+	SpecialPaging:     true,
+	AY:                true,
+	Disk:              true,
+	Snapshot:          snapshot.ModelPlus3,
+}
+
+// ModelByName finds a model by a name such as "48", "128k" or "+2"
+func ModelByName(name string) (*Model, error) {
+	switch strings.TrimSuffix(strings.ToLower(name), "k") {
+	case "48":
+		return Model48K, nil
+	case "128":
+		return Model128K, nil
+	case "+2", "plus2":
+		return ModelPlus2, nil
+	case "+2a", "plus2a":
+		return ModelPlus2A, nil
+	case "+3", "plus3":
+		return ModelPlus3, nil
+	}
+	return nil, fmt.Errorf("unknown model: %s", name)
+}
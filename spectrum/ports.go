@@ -0,0 +1,69 @@
+package spectrum
+
+import (
+	"github.com/imneme/chips-to-go/ay"
+	"github.com/imneme/chips-to-go/joystick"
+	"github.com/imneme/chips-to-go/upd765"
+)
+
+// AYPorts connects the AY to the 128K's ports: 0xFFFD selects a
+// register and reads it back, and 0xBFFD writes it
+type AYPorts struct {
+	*ay.AY
+}
+
+func (p AYPorts) Read(addr uint16) byte {
+	return p.AY.Read()
+}
+
+func (p AYPorts) Write(addr uint16, value byte) {
+	if addr&0x4000 != 0 {
+		p.Select(value)
+	} else {
+		p.AY.Write(value)
+	}
+}
+
+// JoystickPorts connects the Kempston interface. Its port reads as if
+// nothing were there unless a joystick is on the interface.
+type JoystickPorts struct {
+	joysticks *[2]joystick.Joystick
+	bus       *IODeviceBus
+}
+
+func (p JoystickPorts) Read(addr uint16) byte {
+	var value byte
+	attached := false
+	for i := range p.joysticks {
+		j := &p.joysticks[i]
+		if j.Interface == joystick.Kempston {
+			value |= j.Kempston()
+			attached = true
+		}
+	}
+	if !attached {
+		return p.bus.Floating()
+	}
+	return value
+}
+
+func (p JoystickPorts) Write(addr uint16, value byte) {}
+
+// FDCPorts connects the +3's disk controller: 0x2FFD reads its main
+// status register and 0x3FFD is its data register
+type FDCPorts struct {
+	*upd765.FDC
+}
+
+func (p FDCPorts) Read(addr uint16) byte {
+	if addr&0x1000 == 0 {
+		return p.Status()
+	}
+	return p.FDC.Read()
+}
+
+func (p FDCPorts) Write(addr uint16, value byte) {
+	if addr&0x1000 != 0 {
+		p.FDC.Write(value)
+	}
+}
@@ -0,0 +1,139 @@
+package spectrum
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/imneme/chips-to-go/video"
+	"github.com/imneme/chips-to-go/wav"
+)
+
+// videoRecorder is a Display that keeps its own copy of the picture and
+// writes every finished frame to a video file, with the sound going to a
+// WAV file beside it
+type videoRecorder struct {
+	*Framebuffer
+	filename  string
+	file      *os.File
+	writer    video.Writer
+	wavFile   *os.File // nil for a machine without sound
+	wavWriter *wav.Writer
+	started   bool  // A whole frame has been drawn since recording began
+	err       error // The first error writing, reported on stopping
+}
+
+// EndFrame writes the finished frame
+func (r *videoRecorder) EndFrame() {
+	r.Framebuffer.EndFrame()
+	if !r.started {
+		// Recording began partway through this frame
+		r.started = true
+		return
+	}
+	if r.err == nil {
+		r.err = r.writer.WriteFrame(r.image)
+	}
+}
+
+// writeSamples adds sound to the recording once the first whole frame has
+// started
+func (r *videoRecorder) writeSamples(samples []float32) {
+	if r.started && r.wavWriter != nil && r.err == nil {
+		r.err = r.wavWriter.WriteSamples(samples)
+	}
+}
+
+// StartRecording records every frame to a video file until StopRecording
+// is called. The extension chooses the format: .gif, or .png or .apng for
+// an animated PNG, or .y4m for raw video an encoder can take. The sound,
+// if the machine has any, goes to a WAV file of the same name.
+func (m *Machine) StartRecording(filename string) error {
+	if err := m.StopRecording(); err != nil {
+		return err
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".gif", ".png", ".apng", ".y4m":
+	default:
+		return fmt.Errorf("can't record video to %s: use .gif, .png, .apng or .y4m", filename)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create file: %s: %v", filename, err)
+	}
+
+	rate := video.FrameRate{Num: m.model.ClockRate, Den: int(m.model.Timing.FrameLength())}
+	r := &videoRecorder{
+		Framebuffer: NewFramebuffer(),
+		filename:    filename,
+		file:        file,
+		started:     m.ula.line < TopBlanking, // Nothing drawn yet this frame
+	}
+	r.flashInverted = m.ula.flash
+	if m.ulaplus != nil {
+		r.SetULAplus(m.ulaplus)
+	}
+	switch ext {
+	case ".gif":
+		r.writer = video.NewGIFWriter(file, rate)
+	case ".png", ".apng":
+		r.writer, err = video.NewAPNGWriter(file, rate)
+	case ".y4m":
+		r.writer = video.NewY4MWriter(file, rate)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if m.beeper.SampleRate() != 0 {
+		wavName := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".wav"
+		r.wavFile, err = os.Create(wavName)
+		if err == nil {
+			r.wavWriter, err = wav.NewWriter(r.wavFile, m.beeper.SampleRate(), 1)
+			if err != nil {
+				r.wavFile.Close()
+			}
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("could not record sound: %s: %v", wavName, err)
+		}
+	}
+
+	m.video = r
+	m.ula.display = MultiDisplay(m.display, r)
+	return nil
+}
+
+// StopRecording finishes the video started by StartRecording, if any
+func (m *Machine) StopRecording() error {
+	r := m.video
+	if r == nil {
+		return nil
+	}
+	m.video = nil
+	m.ula.display = m.display
+
+	err := errors.Join(r.err, r.writer.Close(), r.file.Close())
+	if err != nil {
+		err = fmt.Errorf("could not record video: %s: %v", r.filename, err)
+	}
+	if r.wavFile != nil {
+		if wavErr := errors.Join(r.wavWriter.Close(), r.wavFile.Close()); wavErr != nil {
+			err = errors.Join(err, fmt.Errorf("could not record sound: %v", wavErr))
+		}
+	}
+	return err
+}
+
+// Recording returns the file being recorded to, or "" when not recording
+func (m *Machine) Recording() string {
+	if m.video == nil {
+		return ""
+	}
+	return m.video.filename
+}
@@ -0,0 +1,298 @@
+package spectrum
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/imneme/chips-to-go/ay"
+	"github.com/imneme/chips-to-go/beeper"
+	"github.com/imneme/chips-to-go/tape"
+	"github.com/imneme/chips-to-go/ula"
+	"github.com/imneme/chips-to-go/upd765"
+	"github.com/imneme/chips-to-go/z80"
+)
+
+// Rewinding keeps a snapshot every DefaultRewindInterval frames, up to
+// DefaultRewindPoints of them, unless EnableRewind says otherwise
+const (
+	DefaultRewindInterval = 5   // A tenth of a second
+	DefaultRewindPoints   = 300 // Thirty seconds
+)
+
+// machineState is everything about the machine that changes as it runs,
+// apart from its RAM. Unlike a snapshot it is exact, down to where the
+// CPU is within an instruction, so a machine put back in it carries on
+// exactly as it did. The keyboard and joysticks are left as the user has
+// them, and the disk in the drive keeps what was written to it.
+type machineState struct {
+	tstates uint64
+
+	// CPU
+	cpu         z80.State
+	pins        uint64
+	interrupt   bool
+	stall       uint32
+	fetchTState uint32
+	fetches     uint32
+	contention  ula.ContentionState
+
+	// Memory
+	port7FFD byte
+	port1FFD byte
+
+	// ULA
+	borderColor  byte
+	portFE       byte
+	flashFlipper byte
+	flash        bool
+	frames       uint64
+	line         uint32
+	lineCycle    uint32
+	border       [4]byte
+	bitmap       [2]byte
+	attribute    [2]byte
+	ulaplus      *ULAplus // nil without one
+
+	// Sound, tape and disk
+	beeper beeper.State
+	ay     ay.State
+	tape   tape.State
+	fdc    upd765.State
+
+	tapeImage  []byte // The tape's file, which tape holds the blocks of
+	tapeFormat string
+}
+
+// rewindPoint is a saved state of the machine at the start of a frame
+type rewindPoint struct {
+	state machineState
+
+	// The newest point holds the RAM banks one after another. Each older
+	// one holds its RAM XORed with that of the point after it and
+	// compressed, which is small as little changes in a few frames.
+	ram []byte
+}
+
+// rewindBuffer is a ring of rewind points, oldest first
+type rewindBuffer struct {
+	interval int // Frames between points
+	points   []rewindPoint
+	first    int // Oldest point
+	count    int
+}
+
+// at returns the ith point, counting from the oldest
+func (b *rewindBuffer) at(i int) *rewindPoint {
+	return &b.points[(b.first+i)%len(b.points)]
+}
+
+// EnableRewind keeps a snapshot of the machine every interval frames, up
+// to points of them, for Rewind to go back to. Zero points turns rewinding
+// off. Changing either forgets the snapshots kept so far.
+func (m *Machine) EnableRewind(interval, points int) {
+	if points <= 0 || interval <= 0 {
+		m.rewind = nil
+		return
+	}
+	m.rewind = &rewindBuffer{interval: interval, points: make([]rewindPoint, points)}
+}
+
+// saveRewindPoint keeps the state of the machine as the newest rewind
+// point, forgetting the oldest if there are already as many as allowed
+func (m *Machine) saveRewindPoint() {
+	b := m.rewind
+	ram := m.ramBytes(nil)
+	if b.count > 0 {
+		newest := b.at(b.count - 1)
+		newest.ram = compressDelta(newest.ram, ram)
+	}
+	if b.count == len(b.points) {
+		b.first = (b.first + 1) % len(b.points)
+		b.count--
+	}
+	*b.at(b.count) = rewindPoint{state: m.saveState(), ram: ram}
+	b.count++
+}
+
+// Rewind takes the machine back to the start of the frame the given
+// number of frames before the current one, or as close to it as the
+// snapshots kept by EnableRewind go. It returns how many frames back that
+// was. Running on from there shows the same frames again, for as long as
+// the input is the same. A video being recorded goes on from the frame
+// rewound to, as it was shown; a tape being saved can't be rewound.
+func (m *Machine) Rewind(frames int) (int, error) {
+	b := m.rewind
+	if b == nil || b.count == 0 {
+		return 0, fmt.Errorf("nothing to rewind to")
+	}
+	if m.rzxActive() {
+		return 0, fmt.Errorf("can't rewind while recording or replaying input")
+	}
+	if m.saveName != "" {
+		// What was saved after the point rewound to can't be taken back
+		return 0, fmt.Errorf("can't rewind while saving to tape")
+	}
+	now := m.ula.frames
+	target := now - min(uint64(max(frames, 0)), now)
+
+	// Undo the deltas back from the newest point to the one wanted
+	i := b.count - 1
+	ram := append([]byte(nil), b.at(i).ram...)
+	for i > 0 && b.at(i).state.frames > target {
+		i--
+		if err := expandDelta(ram, b.at(i).ram); err != nil {
+			return 0, fmt.Errorf("rewind snapshot: %v", err)
+		}
+	}
+	point := b.at(i)
+	point.ram = ram
+	b.count = i + 1
+
+	m.loadState(&point.state)
+	m.setRAMBytes(ram)
+	// The frames run again to reach the target aren't recorded, as their
+	// sound is thrown away
+	m.ula.display = m.display
+	for m.ula.frames < target {
+		m.RunFrame()
+	}
+	if m.video != nil {
+		m.video.flashInverted = m.ula.flash
+		m.ula.display = MultiDisplay(m.display, m.video)
+	}
+
+	// The sound of the frames run again was heard the first time
+	m.beeper.Samples()
+	if m.ay != nil {
+		m.ay.Samples()
+	}
+	return int(now - m.ula.frames), nil
+}
+
+// saveState returns the state of the machine
+func (m *Machine) saveState() machineState {
+	c, u := m.cpu, m.ula
+	s := machineState{
+		tstates:      m.currentTState,
+		cpu:          c.State(),
+		pins:         c.pins,
+		interrupt:    c.interruptFlag,
+		stall:        c.stall,
+		fetchTState:  c.fetchTState,
+		fetches:      c.fetches,
+		contention:   c.contention.State(),
+		port7FFD:     m.memory.Paging(),
+		port1FFD:     m.memory.SpecialPaging(),
+		borderColor:  u.borderColor,
+		portFE:       u.portFE,
+		flashFlipper: u.flashFlipper,
+		flash:        u.flash,
+		frames:       u.frames,
+		line:         u.line,
+		lineCycle:    u.lineCycle,
+		border:       u.border,
+		bitmap:       u.bitmap,
+		attribute:    u.attribute,
+		beeper:       m.beeper.State(),
+		tape:         m.tape.State(),
+		tapeImage:    m.tapeImage,
+		tapeFormat:   m.tapeFormat,
+	}
+	if m.ay != nil {
+		s.ay = m.ay.State()
+	}
+	if m.fdc != nil {
+		s.fdc = m.fdc.State()
+	}
+	if m.ulaplus != nil {
+		ulaplus := *m.ulaplus
+		s.ulaplus = &ulaplus
+	}
+	return s
+}
+
+// loadState puts the machine back in a state returned by saveState
+func (m *Machine) loadState(s *machineState) {
+	c, u := m.cpu, m.ula
+	m.currentTState = s.tstates
+	c.SetState(s.cpu)
+	c.pins = s.pins
+	c.interruptFlag = s.interrupt
+	c.stall = s.stall
+	c.fetchTState = s.fetchTState
+	c.fetches = s.fetches
+	c.contention.SetState(s.contention)
+	m.memory.SetPaging(s.port7FFD)
+	m.memory.SetSpecialPaging(s.port1FFD)
+
+	if u.flash != s.flash && u.display != nil {
+		u.display.ToggleFlash()
+	}
+	u.borderColor = s.borderColor
+	u.portFE = s.portFE
+	u.flashFlipper = s.flashFlipper
+	u.flash = s.flash
+	u.frames = s.frames
+	u.line = s.line
+	u.lineCycle = s.lineCycle
+	u.border = s.border
+	u.bitmap = s.bitmap
+	u.attribute = s.attribute
+	if m.ulaplus != nil && s.ulaplus != nil {
+		*m.ulaplus = *s.ulaplus
+	}
+
+	m.beeper.SetState(s.beeper)
+	if m.ay != nil {
+		m.ay.SetState(s.ay)
+	}
+	m.tape.SetState(s.tape)
+	m.tapeImage, m.tapeFormat = s.tapeImage, s.tapeFormat
+	if m.fdc != nil {
+		m.fdc.SetState(s.fdc)
+	}
+}
+
+// ramBytes appends the machine's RAM banks to buf
+func (m *Machine) ramBytes(buf []byte) []byte {
+	for _, bank := range m.memory.ram {
+		buf = append(buf, bank...)
+	}
+	return buf
+}
+
+// setRAMBytes fills the machine's RAM banks from data made by ramBytes
+func (m *Machine) setRAMBytes(data []byte) {
+	for _, bank := range m.memory.ram {
+		data = data[copy(bank, data):]
+	}
+}
+
+// compressDelta returns old XORed with new, compressed
+func compressDelta(old, new []byte) []byte {
+	for i := range old {
+		old[i] ^= new[i]
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(old)
+	w.Close()
+	return buf.Bytes()
+}
+
+// expandDelta turns data back into what it was before compressDelta was
+// given it as new, with delta being what that returned
+func expandDelta(data, delta []byte) error {
+	r := flate.NewReader(bytes.NewReader(delta))
+	defer r.Close()
+	xor := make([]byte, len(data))
+	if _, err := io.ReadFull(r, xor); err != nil {
+		return err
+	}
+	for i := range data {
+		data[i] ^= xor[i]
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package spectrum
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/imneme/chips-to-go/rzx"
+	"github.com/imneme/chips-to-go/snapshot"
+)
+
+// RZXCreator names the emulator in the RZX files it records
+const RZXCreator = "chips-to-go"
+
+// Divergence is the error when a replay stops following its recording:
+// the program asked for input the recording doesn't have, so the
+// emulation no longer does what it did when it was recorded
+type Divergence struct {
+	Frame  int // Frame of the recording, counting from 0
+	Reason string
+}
+
+func (d *Divergence) Error() string {
+	return fmt.Sprintf("replay diverged at frame %d: %s", d.Frame, d.Reason)
+}
+
+// rzxRecorder collects the machine's input for an RZX file
+type rzxRecorder struct {
+	filename  string
+	file      *os.File
+	recording *rzx.Recording
+	session   *rzx.Session
+	inputs    []byte // Values read by INs so far this frame
+	pending   bool   // The interrupt is up and the frame ends at the next M1
+}
+
+// rzxPlayer feeds a recording's input back to the machine
+type rzxPlayer struct {
+	recording *rzx.Recording
+	session   int
+	frame     int    // Frame within the session
+	played    int    // Frames played in all sessions
+	input     int    // Next input of the frame
+	raised    bool   // The frame has had its fetches and ends at the next M1
+	interrupt uint32 // T-states left of the interrupt the player raised
+	held      bool   // The interrupt signal is up
+}
+
+// StartRZXRecording records the machine's input to an RZX file, starting
+// from a snapshot of it now, until StopRZXRecording is called. The tape
+// traps are off while recording, so a tape loads in real time and the
+// recording doesn't depend on them.
+func (m *Machine) StartRZXRecording(filename string) error {
+	if err := m.StopRZXRecording(); err != nil {
+		return err
+	}
+	if m.rzxPlayer != nil {
+		return fmt.Errorf("can't record input while replaying it")
+	}
+	var snap bytes.Buffer
+	if err := snapshot.WriteSZX(&snap, m.Snapshot()); err != nil {
+		return fmt.Errorf("could not make snapshot: %v", err)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create file: %s: %v", filename, err)
+	}
+	r := &rzxRecorder{
+		filename: filename,
+		file:     file,
+		session: &rzx.Session{
+			SnapshotType: "szx",
+			Snapshot:     snap.Bytes(),
+			TStates:      m.cpu.fetchTState,
+		},
+	}
+	r.recording = &rzx.Recording{Creator: RZXCreator, Sessions: []*rzx.Session{r.session}}
+
+	// The fetch under way when the snapshot was taken doesn't count, as it
+	// is made again when the snapshot is loaded
+	m.cpu.fetches = 0
+	r.pending = m.cpu.interruptFlag
+	m.bus.SetInput(m.recordInput)
+	m.rzxRecorder = r
+	return nil
+}
+
+// StopRZXRecording finishes the RZX file started by StartRZXRecording, if
+// any
+func (m *Machine) StopRZXRecording() error {
+	r := m.rzxRecorder
+	if r == nil {
+		return nil
+	}
+	// End the last frame between instructions, where a player can stop
+	m.finishInstruction()
+	m.rzxRecorder = nil
+	m.bus.SetInput(nil)
+	if m.cpu.fetches > 0 {
+		// Just after the fetch that starts the next instruction
+		m.recordFrame(r, m.cpu.fetches-1)
+	}
+	err := rzx.Write(r.file, r.recording)
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write RZX file: %s: %v", r.filename, err)
+	}
+	return nil
+}
+
+// RZXRecording returns the RZX file being recorded, or "" when not
+// recording input
+func (m *Machine) RZXRecording() string {
+	if m.rzxRecorder == nil {
+		return ""
+	}
+	return m.rzxRecorder.filename
+}
+
+// recordInput records the value read by an IN
+func (m *Machine) recordInput(addr uint16, value byte) byte {
+	r := m.rzxRecorder
+	r.inputs = append(r.inputs, value)
+	return value
+}
+
+// recordTick ends a frame of the recording where the CPU takes the
+// interrupt, given whether the interrupt was up before this T-state. A
+// player raises the interrupt once it has counted the frame's fetches, and
+// the CPU takes it at the end of that instruction, so the frame ends at
+// the first M1 cycle after the interrupt that the CPU would have taken it
+// at: an acknowledge, or a fetch with interrupts disabled. Should the CPU
+// let the interrupt go by, the frame ends there instead.
+func (m *Machine) recordTick(interrupt bool) {
+	r := m.rzxRecorder
+	switch {
+	case m.cpu.interruptFlag && !interrupt:
+		// The CPU has already made this T-state's M1, if any
+		r.pending = true
+	case !r.pending:
+	case m.cpu.acknowledged, !m.cpu.interruptFlag:
+		m.recordFrame(r, m.cpu.fetches)
+	case m.cpu.fetched && !m.cpu.IFF1():
+		m.recordFrame(r, m.cpu.fetches-1)
+	}
+}
+
+// recordFrame ends a frame of the recording after the given number of
+// fetches
+func (m *Machine) recordFrame(r *rzxRecorder, fetches uint32) {
+	r.session.Frames = append(r.session.Frames, rzx.Frame{
+		Fetches: uint16(fetches),
+		Inputs:  r.inputs,
+	})
+	r.inputs = nil
+	r.pending = false
+	m.cpu.fetches -= fetches
+}
+
+// PlayRZX replays an RZX file. The machine runs from the recording's
+// snapshot, with interrupts when the recording says and INs reading what
+// they read when it was made, until the recording ends or the replay
+// diverges from it; RZXError then says which.
+func (m *Machine) PlayRZX(filename string) error {
+	if err := m.StopRZXRecording(); err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+	recording, err := rzx.Read(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if recording.Sessions[0].Snapshot == nil {
+		return fmt.Errorf("%s: RZX file doesn't start with a snapshot", filename)
+	}
+	if err := m.startSession(recording.Sessions[0]); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	m.rzxPlayer = &rzxPlayer{recording: recording}
+	m.rzxErr = nil
+	m.bus.SetInput(m.replayInput)
+	return nil
+}
+
+// StopRZXPlayback stops replaying, leaving the machine running as it is
+func (m *Machine) StopRZXPlayback() {
+	m.stopReplay(nil)
+}
+
+// PlayingRZX returns whether an RZX file is being replayed
+func (m *Machine) PlayingRZX() bool {
+	return m.rzxPlayer != nil
+}
+
+// RZXError returns why the last replay stopped early: a Divergence, or a
+// snapshot in the recording that couldn't be loaded. It is nil while
+// replaying and if the replay reached the end of the recording.
+func (m *Machine) RZXError() error {
+	return m.rzxErr
+}
+
+// startSession loads the snapshot a session of a recording starts from
+func (m *Machine) startSession(session *rzx.Session) error {
+	if session.Snapshot != nil {
+		var snap *snapshot.Snapshot
+		var err error
+		r := bytes.NewReader(session.Snapshot)
+		switch session.SnapshotType {
+		case "z80":
+			snap, err = snapshot.ReadZ80(r)
+		case "sna":
+			snap, err = snapshot.ReadSNA(r)
+		case "szx":
+			snap, err = snapshot.ReadSZX(r)
+		default:
+			return fmt.Errorf("can't load %q snapshots", session.SnapshotType)
+		}
+		if err != nil {
+			return fmt.Errorf("RZX snapshot: %v", err)
+		}
+		if err := m.Restore(snap); err != nil {
+			return err
+		}
+		m.ula.SetFrameTState(session.TStates)
+	}
+	m.cpu.fetches = 0
+	return nil
+}
+
+// stopReplay ends a replay, with err saying why if it ended early
+func (m *Machine) stopReplay(err error) {
+	if m.rzxPlayer == nil {
+		return
+	}
+	m.rzxPlayer = nil
+	m.rzxErr = err
+	m.bus.SetInput(nil)
+	m.cpu.SetInterrupt(m.ula.FrameTState() < m.model.InterruptDuration)
+}
+
+// replayInput answers an IN from the recording
+func (m *Machine) replayInput(addr uint16, value byte) byte {
+	p := m.rzxPlayer
+	frame := &p.recording.Sessions[p.session].Frames[p.frame]
+	if p.input >= len(frame.Inputs) {
+		m.stopReplay(&Divergence{
+			Frame:  p.played,
+			Reason: fmt.Sprintf("IN from 0x%04X after the %d recorded", addr, len(frame.Inputs)),
+		})
+		return value
+	}
+	value = frame.Inputs[p.input]
+	p.input++
+	return value
+}
+
+// replayTick raises the interrupt when the current frame has had as many
+// fetches as the recording says, and moves on to the next frame at the
+// next M1 cycle, when the CPU takes the interrupt or carries on without it
+func (m *Machine) replayTick() {
+	p := m.rzxPlayer
+	frame := &p.recording.Sessions[p.session].Frames[p.frame]
+	if p.raised && (m.cpu.acknowledged || m.cpu.fetched) {
+		if p.input != len(frame.Inputs) {
+			m.stopReplay(&Divergence{
+				Frame:  p.played,
+				Reason: fmt.Sprintf("%d INs, not the %d recorded", p.input, len(frame.Inputs)),
+			})
+			return
+		}
+		m.cpu.fetches -= uint32(frame.Fetches)
+		p.raised = false
+		p.input = 0
+		p.played++
+		p.frame++
+		for p.frame == len(p.recording.Sessions[p.session].Frames) {
+			p.frame = 0
+			p.session++
+			if p.session == len(p.recording.Sessions) {
+				m.stopReplay(nil)
+				return
+			}
+			if err := m.startSession(p.recording.Sessions[p.session]); err != nil {
+				m.stopReplay(err)
+				return
+			}
+		}
+		frame = &p.recording.Sessions[p.session].Frames[p.frame]
+	}
+	if !p.raised && m.cpu.fetches >= uint32(frame.Fetches) {
+		p.raised = true
+		p.interrupt = m.model.InterruptDuration
+	}
+
+	// The interrupt lasts at least as long as the ULA's own, which stays
+	// in step when replaying one of our own recordings, so that a handler
+	// quick enough to see it twice does so again
+	p.held = p.interrupt > 0 || p.held && m.ula.FrameTState() < m.model.InterruptDuration
+	if p.interrupt > 0 {
+		p.interrupt--
+	}
+	m.cpu.SetInterrupt(p.held)
+}
+
+// rzxActive returns whether input is being recorded or replayed, when
+// the tape traps must leave the ROM to load and save by itself
+func (m *Machine) rzxActive() bool {
+	return m.rzxRecorder != nil || m.rzxPlayer != nil
+}
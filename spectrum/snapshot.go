@@ -0,0 +1,282 @@
+package spectrum
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/imneme/chips-to-go/dsk"
+	"github.com/imneme/chips-to-go/joystick"
+	"github.com/imneme/chips-to-go/snapshot"
+	"github.com/imneme/chips-to-go/tape"
+	"github.com/imneme/chips-to-go/z80"
+)
+
+// snapshotJoysticks gives the snapshot package's name for each joystick
+// interface
+var snapshotJoysticks = map[joystick.Interface]snapshot.Joystick{
+	joystick.None:      snapshot.JoystickNone,
+	joystick.Kempston:  snapshot.JoystickKempston,
+	joystick.Sinclair1: snapshot.JoystickSinclair1,
+	joystick.Sinclair2: snapshot.JoystickSinclair2,
+	joystick.Cursor:    snapshot.JoystickCursor,
+}
+
+// Snapshot captures the state of the machine, first finishing the current
+// instruction
+func (m *Machine) Snapshot() *snapshot.Snapshot {
+	m.finishInstruction()
+	c := m.cpu
+	snap := snapshot.New(m.model.Snapshot)
+	snap.Registers = snapshot.Registers{
+		AF: c.AF(), BC: c.BC(), DE: c.DE(), HL: c.HL(),
+		AF2: c.AF2(), BC2: c.BC2(), DE2: c.DE2(), HL2: c.HL2(),
+		IX: c.IX(), IY: c.IY(), SP: c.SP(),
+		PC:     z80.GetAddr(c.pins), // The opcode being fetched
+		I:      c.I(),
+		R:      c.R(),
+		IFF1:   c.IFF1(),
+		IFF2:   c.IFF2(),
+		IM:     c.IM(),
+		MemPtr: c.WZ(),
+	}
+	snap.Halted = c.pins&z80.HALT != 0
+	snap.Border = m.ula.GetBorderColor()
+	snap.TStates = c.fetchTState
+	snap.SZXBlocks = m.szxBlocks
+	for bank, ram := range snap.RAM {
+		copy(ram, m.memory.ram[bank])
+	}
+	for i := range m.joysticks {
+		snap.Joysticks[i] = snapshotJoysticks[m.joysticks[i].Interface]
+	}
+	snap.KeyboardJoystick = snap.Joysticks[0]
+	snap.Port7FFD = m.memory.Paging()
+	snap.Port1FFD = m.memory.SpecialPaging()
+	snap.Issue2 = m.ula.issue2
+	if m.ulaplus != nil {
+		snap.ULAplus = m.ulaplus.snapshot()
+	}
+	if m.ay != nil {
+		snap.AYRegister = m.ay.Selected()
+		snap.AYRegisters = m.ay.Registers()
+	}
+	if m.tapeImage != nil {
+		snap.Tape = &snapshot.Tape{
+			Block:  m.tape.BlockIndex(),
+			Format: m.tapeFormat,
+			Image:  m.tapeImage,
+		}
+	}
+	snap.Disk = m.diskImage()
+	return snap
+}
+
+// diskImage returns the disk in drive A: as a .dsk image, or nil if there
+// is none or it won't fit in one
+func (m *Machine) diskImage() []byte {
+	if m.fdc == nil || m.fdc.Drives[0].Disk == nil {
+		return nil
+	}
+	var image bytes.Buffer
+	if err := dsk.Write(&image, m.fdc.Drives[0].Disk); err != nil {
+		return nil
+	}
+	return image.Bytes()
+}
+
+// Restore puts the machine in the state held by a snapshot. A tape or disk
+// in the snapshot replaces the one in the machine unless they're the same.
+// The disk that was in the drive is saved, as when ejected, and the one
+// from the snapshot isn't written back to any file.
+func (m *Machine) Restore(snap *snapshot.Snapshot) error {
+	if snap.Model != m.model.Snapshot {
+		return fmt.Errorf("can't load a %v snapshot into a %s Spectrum", snap.Model, m.model.Name)
+	}
+	for bank, ram := range m.memory.ram {
+		if ram != nil && len(snap.RAM[bank]) != snapshot.BankSize {
+			return fmt.Errorf("snapshot is missing RAM bank %d", bank)
+		}
+	}
+	var blocks []tape.Block
+	if snap.Tape != nil && !bytes.Equal(snap.Tape.Image, m.tapeImage) {
+		var err error
+		blocks, err = tape.Read(bytes.NewReader(snap.Tape.Image), snap.Tape.Format)
+		if err != nil {
+			return fmt.Errorf("snapshot's tape: %v", err)
+		}
+	}
+	var disk *dsk.Disk
+	if snap.Disk != nil && m.fdc != nil && !bytes.Equal(snap.Disk, m.diskImage()) {
+		var err error
+		disk, err = dsk.Read(bytes.NewReader(snap.Disk))
+		if err != nil {
+			return fmt.Errorf("snapshot's disk: %v", err)
+		}
+		if err := m.EjectDisk(); err != nil {
+			return err
+		}
+	}
+
+	c := m.cpu
+	c.SetAF(snap.AF)
+	c.SetBC(snap.BC)
+	c.SetDE(snap.DE)
+	c.SetHL(snap.HL)
+	c.SetAF2(snap.AF2)
+	c.SetBC2(snap.BC2)
+	c.SetDE2(snap.DE2)
+	c.SetHL2(snap.HL2)
+	c.SetIX(snap.IX)
+	c.SetIY(snap.IY)
+	c.SetSP(snap.SP)
+	c.SetI(snap.I)
+	c.SetR(snap.R)
+	c.SetIFF1(snap.IFF1)
+	c.SetIFF2(snap.IFF2)
+	c.SetIM(snap.IM)
+	c.SetWZ(snap.MemPtr)
+	c.SetPC(snap.PC) // Fetching a HALT halts the CPU again
+
+	for bank, ram := range m.memory.ram {
+		copy(ram, snap.RAM[bank])
+	}
+	m.memory.SetPaging(snap.Port7FFD)
+	m.memory.SetSpecialPaging(snap.Port1FFD)
+	if m.fdc != nil {
+		// Snapshots don't keep a command the controller is part way through
+		m.fdc.Reset()
+		m.fdc.SetMotor(snap.Port1FFD&SpecialPagingMotor != 0)
+	}
+	if m.ay != nil {
+		m.ay.SetRegisters(snap.AYRegisters, snap.AYRegister)
+	}
+	m.ula.issue2 = snap.Issue2
+	if m.ulaplus != nil {
+		m.ulaplus.restore(snap.ULAplus)
+	}
+	if snap.Joysticks != [2]snapshot.Joystick{} {
+		// Only some formats say which joysticks are plugged in
+		for i, j := range snap.Joysticks {
+			for iface, sj := range snapshotJoysticks {
+				if sj == j {
+					m.SetJoystick(i, iface)
+				}
+			}
+		}
+	}
+	m.ula.SetBorderColor(snap.Border)
+	m.ula.SetFrameTState(snap.TStates)
+	m.szxBlocks = snap.SZXBlocks
+
+	if blocks != nil {
+		m.insertTape(snap.Tape.Image, snap.Tape.Format, blocks)
+	}
+	if snap.Tape != nil {
+		m.tape.Seek(snap.Tape.Block)
+	}
+	if disk != nil {
+		m.fdc.Drives[0].Insert(disk, false)
+	}
+	return nil
+}
+
+// LoadZ80 loads a .z80 snapshot
+func (m *Machine) LoadZ80(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	snap, err := snapshot.ReadZ80(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return m.Restore(snap)
+}
+
+// SaveZ80 saves the machine as a version 3 .z80 snapshot
+func (m *Machine) SaveZ80(filename string) error {
+	return m.saveSnapshot(filename, func(w io.Writer, snap *snapshot.Snapshot) error {
+		return snapshot.WriteZ80(w, snap, 3)
+	})
+}
+
+// LoadSZX loads an .szx snapshot
+func (m *Machine) LoadSZX(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	snap, err := snapshot.ReadSZX(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return m.Restore(snap)
+}
+
+// SaveSZX saves the machine as an .szx snapshot
+func (m *Machine) SaveSZX(filename string) error {
+	return m.saveSnapshot(filename, snapshot.WriteSZX)
+}
+
+// SaveSnapshot saves the machine as a .z80, .sna or .szx snapshot, by
+// the file's extension
+func (m *Machine) SaveSnapshot(filename string) error {
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".z80":
+		return m.SaveZ80(filename)
+	case ".sna":
+		return m.SaveSNA(filename)
+	case ".szx":
+		return m.SaveSZX(filename)
+	default:
+		return fmt.Errorf("can't save snapshots as %s files", ext)
+	}
+}
+
+// saveSnapshot writes a snapshot of the machine to a file in the format
+// write produces
+func (m *Machine) saveSnapshot(filename string, write func(io.Writer, *snapshot.Snapshot) error) error {
+	snap := m.Snapshot()
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create file: %s: %v", filename, err)
+	}
+	err = write(file, snap)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %s: %v", filename, err)
+	}
+	return nil
+}
+
+// LoadSNA loads an .sna snapshot
+func (m *Machine) LoadSNA(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	snap, err := snapshot.ReadSNA(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return m.Restore(snap)
+}
+
+// SaveSNA saves the machine as an .sna snapshot
+func (m *Machine) SaveSNA(filename string) error {
+	return m.saveSnapshot(filename, func(w io.Writer, snap *snapshot.Snapshot) error {
+		return snapshot.WriteSNA(w, snap)
+	})
+}
@@ -0,0 +1,241 @@
+package spectrum
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/imneme/chips-to-go/tape"
+	"github.com/imneme/chips-to-go/z80"
+)
+
+// ROM routines used by the tape traps
+const (
+	SABytes = 0x04C2 // SA-BYTES, saves a block
+	LDBytes = 0x0556 // LD-BYTES, loads a block
+	SALDRet = 0x053F // SA/LD-RET, the common exit of the tape routines
+)
+
+// The first instructions of LD-BYTES, used to check the 48K ROM is paged in
+var ldBytesSignature = []byte{
+	0x14, // INC D
+	0x08, // EX AF,AF'
+	0x15, // DEC D
+	0xF3, // DI
+}
+
+// The first instructions of SA-BYTES
+var saBytesSignature = []byte{
+	0x21, 0x3F, 0x05, // LD HL,SA/LD-RET
+	0xE5,             // PUSH HL
+	0x21, 0x80, 0x1F, // LD HL,$1F80
+	0xCB, 0x7F, // BIT 7,A
+}
+
+// InsertTape puts a tape image in the tape player. It will start playing
+// when the ROM begins to load from tape.
+func (m *Machine) InsertTape(filename string) error {
+	image, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	blocks, err := tape.Read(bytes.NewReader(image), format)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	m.insertTape(image, format, blocks)
+	return nil
+}
+
+// insertTape puts a tape in the player, keeping its file for snapshots
+func (m *Machine) insertTape(image []byte, format string, blocks []tape.Block) {
+	m.tape.Insert(blocks)
+	m.tapeImage, m.tapeFormat = image, format
+}
+
+// SetFastLoad chooses between loading standard blocks instantly through
+// the ROM trap (the default) and playing the tape in real time
+func (m *Machine) SetFastLoad(fast bool) {
+	m.fastLoad = fast
+}
+
+// TapeBlocks lists the blocks on the tape for a tape browser
+func (m *Machine) TapeBlocks() []tape.BlockInfo {
+	return m.tape.Browse()
+}
+
+// SeekTape moves the tape to the start of a block
+func (m *Machine) SeekTape(block int) {
+	m.tape.Seek(block)
+}
+
+// TapePlaying reports whether the tape is running, as it does while a
+// loader reads it in real time
+func (m *Machine) TapePlaying() bool {
+	return m.tape.Playing()
+}
+
+func (m *Machine) PlayTape()   { m.tape.Play() }
+func (m *Machine) StopTape()   { m.tape.Stop() }
+func (m *Machine) RewindTape() { m.tape.Rewind() }
+func (m *Machine) EjectTape()  { m.insertTape(nil, "", nil) }
+
+// romMatches checks the bytes at addr, to be sure a trap is looking at
+// the ROM routine it expects
+func (m *Machine) romMatches(addr uint16, signature []byte) bool {
+	for i, b := range signature {
+		if m.memory.Read(addr+uint16(i)) != b {
+			return false
+		}
+	}
+	return true
+}
+
+// loadTrap runs when LD-BYTES is called. In fast mode it loads the next
+// block straight into memory and returns through SA/LD-RET; otherwise it
+// starts the tape so the ROM can load it from the EAR input.
+func (m *Machine) loadTrap() bool {
+	if !m.tape.Loaded() || !m.romMatches(LDBytes, ldBytesSignature) || m.rzxActive() {
+		return false
+	}
+	if !m.fastLoad {
+		m.tape.Play()
+		return false
+	}
+	data, ok := m.tape.NextStandardBlock()
+	if !ok {
+		// The ROM can't load this block quickly, so play it in real time
+		m.tape.Play()
+		return false
+	}
+
+	flags := m.cpu.F() &^ z80.FlagC
+	if m.loadBlock(data) {
+		flags |= z80.FlagC
+	}
+	m.cpu.SetF(flags)
+	m.cpu.SetPC(SALDRet)
+	return true
+}
+
+// loadBlock does the work of LD-BYTES: A holds the expected flag byte,
+// IX the destination, DE the length and the carry flag is set to load or
+// reset to verify. It returns whether the block was loaded without error.
+func (m *Machine) loadBlock(data []byte) bool {
+	if len(data) == 0 || data[0] != m.cpu.A() {
+		return false
+	}
+	load := m.cpu.F()&z80.FlagC != 0
+	parity := data[0]
+	ix, de := m.cpu.IX(), m.cpu.DE()
+
+	payload := data[1:]
+	n := 0
+	verified := true
+	for ; de > 0 && n < len(payload); n++ {
+		b := payload[n]
+		if load {
+			m.memory.Write(ix, b)
+		} else if m.memory.Read(ix) != b {
+			verified = false
+		}
+		parity ^= b
+		ix++
+		de--
+	}
+	m.cpu.SetIX(ix)
+	m.cpu.SetDE(de)
+
+	// The checksum byte must follow the requested bytes
+	if de > 0 || n >= len(payload) {
+		return false
+	}
+	parity ^= payload[n]
+	return parity == 0 && verified
+}
+
+// StartTapeSave saves everything the Spectrum saves from now on to a
+// tape image. Blocks saved by the ROM go straight to a .tap file through
+// a trap; for .tzx and .csw files the MIC output is recorded, so custom
+// savers work too.
+func (m *Machine) StartTapeSave(filename string) error {
+	if err := m.StopTapeSave(); err != nil {
+		return err
+	}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".tap":
+		file, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("could not create file: %s: %v", filename, err)
+		}
+		m.saveFile = file
+	case ".tzx", ".csw":
+		m.recorder.Start(m.ula.portFE&0x08 != 0)
+	default:
+		return fmt.Errorf("can't save tapes as %s files", ext)
+	}
+	m.saveName = filename
+	return nil
+}
+
+// StopTapeSave finishes the tape image started by StartTapeSave, if any.
+// A MIC recording is decoded into blocks and written out.
+func (m *Machine) StopTapeSave() error {
+	filename := m.saveName
+	if filename == "" {
+		return nil
+	}
+	m.saveName = ""
+	if m.saveFile != nil {
+		err := m.saveFile.Close()
+		m.saveFile = nil
+		return err
+	}
+
+	m.recorder.Stop()
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create file: %s: %v", filename, err)
+	}
+	if strings.ToLower(filepath.Ext(filename)) == ".csw" {
+		_, high := m.recorder.Pulses()
+		err = tape.WriteCSW(file, m.recorder.CSW(tape.CSWSampleRate), high)
+	} else {
+		err = tape.WriteTZX(file, m.recorder.Blocks())
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write tape: %s: %v", filename, err)
+	}
+	return nil
+}
+
+// saveTrap runs when SA-BYTES is called while saving to a .tap file. It
+// writes the block A holds the flag for, DE bytes from IX and the
+// checksum, then returns through SA/LD-RET as the ROM would.
+func (m *Machine) saveTrap() bool {
+	if m.saveFile == nil || !m.romMatches(SABytes, saBytesSignature) || m.rzxActive() {
+		return false
+	}
+	ix, de := m.cpu.IX(), m.cpu.DE()
+	data := make([]byte, 0, int(de)+2)
+	data = append(data, m.cpu.A())
+	for ; de > 0; de-- {
+		data = append(data, m.memory.Read(ix))
+		ix++
+	}
+	data = append(data, tape.Checksum(data))
+
+	if err := tape.WriteTAPBlock(m.saveFile, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not save block: %v\n", err)
+	}
+	m.cpu.SetIX(ix)
+	m.cpu.SetDE(0)
+	m.cpu.SetPC(SALDRet)
+	return true
+}
@@ -0,0 +1,278 @@
+package spectrum
+
+import (
+	"github.com/imneme/chips-to-go/beeper"
+	"github.com/imneme/chips-to-go/joystick"
+	"github.com/imneme/chips-to-go/kbd"
+	"github.com/imneme/chips-to-go/tape"
+	"github.com/imneme/chips-to-go/ula"
+)
+
+// ULA (Uncommitted Logic Array) - the Spectrum's custom chip
+type ULA struct {
+	model        *Model
+	timing       *ula.Timing
+	memory       *Memory
+	display      Display // nil to draw nothing
+	cpu          *CPU
+	keyboard     *kbd.Matrix
+	joysticks    *[2]joystick.Joystick // Sinclair and Cursor joysticks press keys
+	beeper       *beeper.Beeper
+	tape         *tape.Player
+	recorder     *tape.Recorder
+	borderColor  byte
+	portFE       byte // Last value written to the ULA port
+	issue2       bool // An issue 2 board, where MIC also shows on EAR
+	flashFlipper byte
+	flash        bool   // Flashing attributes show ink and paper swapped
+	frames       uint64 // Frames finished
+
+	// Current position tracking
+	line      uint32 // Current scanline (0-311)
+	lineCycle uint32 // Current cycle within line (0-223)
+
+	// The beam draws two pixels a T-state. The border colour is latched
+	// every T-state, and the screen bytes when the ULA fetches them.
+	border    [4]byte // Border colour at each T-state of the current column
+	bitmap    [2]byte // Bitmap bytes fetched for an even and an odd column
+	attribute [2]byte // Attributes fetched for an even and an odd column
+}
+
+const (
+	ScreenStartColumn  = 6 // 48 pixels / 8
+	ScreenWidthBytes   = 32
+	ScreenHeight       = 192
+	BorderTStates      = ScreenStartColumn * 4
+	ScreenWidthTStates = ScreenWidthBytes * 4
+	FlashRate          = 16
+)
+
+func NewULA(memory *Memory, cpu *CPU, display Display, keyboard *kbd.Matrix, joysticks *[2]joystick.Joystick, speaker *beeper.Beeper, player *tape.Player, recorder *tape.Recorder) *ULA {
+	return &ULA{
+		model:        memory.model,
+		timing:       memory.model.Timing,
+		memory:       memory,
+		display:      display,
+		cpu:          cpu,
+		keyboard:     keyboard,
+		joysticks:    joysticks,
+		beeper:       speaker,
+		tape:         player,
+		recorder:     recorder,
+		borderColor:  0,
+		flashFlipper: FlashRate,
+		line:         0,
+		lineCycle:    BorderTStates,
+	}
+}
+
+// Read and write to I/O ports
+func (u *ULA) Read(addr uint16) byte {
+	// A zero in the high byte of the address selects a half-row, and
+	// pressed keys read as zero bits
+	halfRows := uint16(^(addr >> 8) & 0xff)
+	lines := u.keyboard.ScanLines(halfRows)
+	for i := range u.joysticks {
+		lines |= u.joysticks[i].ScanLines(halfRows)
+	}
+	keys := byte(lines)
+	value := 0xa0 | (^keys & 0x1f)
+
+	// Bit 6 is the EAR input. With no tape playing, an issue 3 board
+	// reads back what was last written to EAR (bit 4), and an issue 2
+	// board what was written to either EAR or MIC (bit 3).
+	output := byte(0x10)
+	if u.issue2 {
+		output |= 0x08
+	}
+	if u.tape.Playing() {
+		if u.tape.Level() {
+			value |= 0x40
+		}
+	} else if u.portFE&output != 0 {
+		value |= 0x40
+	}
+	return value
+}
+
+// Speaker levels for the four combinations of EAR (bit 1) and MIC (bit 0),
+// relative to the voltages measured on an issue 3 board
+var speakerLevels = [4]float32{0.0, 0.1, 0.96, 1.0}
+
+// TapeVolume is how loud a playing tape is through the speaker, which
+// shares the EAR pin of the ULA
+const TapeVolume = 0.1
+
+func (u *ULA) Write(addr uint16, value byte) {
+	u.SetBorderColor(value)
+	u.portFE = value
+	u.updateSpeaker()
+	u.recorder.SetLevel(value&0x08 != 0)
+}
+
+// updateSpeaker sets the speaker from bit 4 (EAR) and bit 3 (MIC, which
+// also leaks into the speaker a little) of the ULA port and the tape
+func (u *ULA) updateSpeaker() {
+	level := speakerLevels[(u.portFE>>3)&0x03]
+	if u.tape.Playing() && u.tape.Level() {
+		level += TapeVolume
+	}
+	u.beeper.SetLevel(level)
+}
+
+// FrameTState returns the position in the frame, counting from the
+// T-state in which the CPU sees the interrupt
+func (u *ULA) FrameTState() uint32 {
+	frame := u.timing.FrameLength()
+	tstate := u.line*u.timing.TStatesPerLine + u.lineCycle
+	return (tstate + frame - BorderTStates) % frame
+}
+
+// SetFrameTState moves the ULA to a position in the frame, as counted by
+// FrameTState
+func (u *ULA) SetFrameTState(tstate uint32) {
+	frame := u.timing.FrameLength()
+	tstate = (tstate%frame + BorderTStates) % frame
+	u.line = tstate / u.timing.TStatesPerLine
+	u.lineCycle = tstate % u.timing.TStatesPerLine
+	u.cpu.SetInterrupt(u.line == 0 && u.lineCycle >= BorderTStates &&
+		u.lineCycle < BorderTStates+u.model.InterruptDuration)
+}
+
+// FloatingBus returns what the CPU reads from a port nothing answers to,
+// which is whatever the ULA is fetching for the display at the time
+func (u *ULA) FloatingBus() byte {
+	// The CPU core shows port reads one T-state after the real Z80 samples
+	// the bus
+	frame := u.timing.FrameLength()
+	tstate := (u.FrameTState() + frame - 1) % frame
+	switch kind, line, column := u.timing.Fetch(tstate); kind {
+	case ula.FetchBitmap:
+		return u.screenByte(u.calculateDisplayAddress(line, column))
+	case ula.FetchAttribute:
+		return u.screenByte(u.calculateAttrAddress(line, column))
+	}
+	return 0xff
+}
+
+func (u *ULA) Tick() {
+	tstate := u.FrameTState()
+	u.cpu.Tick(tstate)
+
+	tapeLevel := u.tape.Level()
+	u.tape.Tick()
+	if u.tape.Level() != tapeLevel {
+		u.updateSpeaker()
+	}
+	u.beeper.Tick()
+	u.recorder.Tick()
+
+	if u.display != nil && u.line >= TopBlanking && u.line < FieldLines-BottomBlanking &&
+		u.lineCycle < Columns*4 {
+		u.scan(tstate)
+	}
+
+	// Update position counters
+	u.lineCycle++
+	if u.line == 0 && u.lineCycle == BorderTStates {
+		u.cpu.SetInterrupt(true)
+	} else if u.line == 0 && u.lineCycle == BorderTStates+u.model.InterruptDuration {
+		u.cpu.SetInterrupt(false)
+	}
+
+	if u.lineCycle >= u.timing.TStatesPerLine {
+		u.lineCycle = 0
+		u.line++
+		if u.line >= u.timing.LinesPerFrame {
+			u.line = 0
+			u.frames++
+			u.keyboard.Update()
+			u.flashFlipper--
+			if u.flashFlipper == 0 {
+				u.flashFlipper = FlashRate
+				u.flash = !u.flash
+				if u.display != nil {
+					u.display.ToggleFlash()
+				}
+			}
+			if u.display != nil {
+				u.display.EndFrame()
+			}
+		}
+	}
+}
+
+// scan moves the beam on by a T-state, at tstate of the frame. The ULA
+// reads the bitmap and attribute bytes of a column at the T-states that
+// Timing.Fetch says, so a program writing to the screen as the beam passes
+// sees each byte change take effect exactly when it would; the pixels are
+// drawn once both are in. Around the screen, the border is drawn four
+// T-states at a time with the colour of each pair of pixels as it was when
+// the beam reached them.
+func (u *ULA) scan(tstate uint32) {
+	switch kind, line, column := u.timing.Fetch(tstate); kind {
+	case ula.FetchBitmap:
+		u.bitmap[column&1] = u.screenByte(u.calculateDisplayAddress(line, column))
+	case ula.FetchAttribute:
+		u.attribute[column&1] = u.screenByte(u.calculateAttrAddress(line, column))
+		u.display.UpdatePixels(u.model.ScreenStartLine+line, ScreenStartColumn+column,
+			u.bitmap[column&1], u.attribute[column&1])
+	}
+
+	phase := u.lineCycle % 4
+	u.border[phase] = u.borderColor
+	if phase < 3 {
+		return
+	}
+	column := u.lineCycle / 4
+	screenLine := u.line - u.model.ScreenStartLine
+	if screenLine < ScreenHeight && column >= ScreenStartColumn &&
+		column < ScreenStartColumn+ScreenWidthBytes {
+		return
+	}
+
+	// A change of colour part way through shows as ink on paper. OUTs are
+	// at least 11 T-states apart, so there are never more than two colours.
+	var pixels byte
+	ink := u.border[0]
+	for pair := range u.border[1:] {
+		if u.border[pair+1] != u.border[0] {
+			pixels |= 0x30 >> (2 * pair)
+			ink = u.border[pair+1]
+		}
+	}
+	u.display.UpdatePixels(u.line, column, pixels, u.border[0]<<3|ink)
+}
+
+func (u *ULA) SetBorderColor(color byte) {
+	u.borderColor = color & 0x07
+}
+
+func (u *ULA) GetBorderColor() byte {
+	return u.borderColor
+}
+
+// screenByte reads the display from the screen bank, which on a 128K
+// needn't be paged in. Addresses are as if bank 5 were at 0x4000.
+func (u *ULA) screenByte(addr uint16) byte {
+	return u.memory.Screen()[addr-0x4000]
+}
+
+func (u *ULA) calculateDisplayAddress(line, col uint32) uint16 {
+	// Start of screen memory
+	addr := uint16(0x4000)
+
+	// Add Y portion
+	addr |= uint16((line & 0xC0) << 5) // Which third of the screen
+	addr |= uint16((line & 0x07) << 8) // Which character cell row
+	addr |= uint16((line & 0x38) << 2) // Remaining bits wherever
+
+	// Add X portion
+	addr |= uint16(col & 0b00011111) // 5 bits of X go to bits 0-4
+
+	return addr
+}
+
+func (u *ULA) calculateAttrAddress(line, col uint32) uint16 {
+	return 0x5800 + uint16((line>>3)*32) + uint16(col)
+}
@@ -0,0 +1,118 @@
+package spectrum
+
+import (
+	"image/color"
+
+	"github.com/imneme/chips-to-go/snapshot"
+)
+
+// ULAplus ports: a write to the register port selects a palette entry or
+// the mode register, which the data port then reads and writes
+const (
+	ULAplusRegisterPort = 0xBF3B
+	ULAplusDataPort     = 0xFF3B
+)
+
+// Groups of registers, in the top two bits of the register port
+const (
+	ULAplusPaletteGroup = 0x00 // Bits 0-5 choose a palette entry
+	ULAplusModeGroup    = 0x40
+	ULAplusGroupMask    = 0xC0
+)
+
+// ULAplus is the ULAplus palette extension. With its palette on, FLASH and
+// BRIGHT of an attribute choose one of four CLUTs of sixteen colours, the
+// first eight for ink and the rest for paper, so the screen can show 64
+// colours chosen from 256. The border takes the paper colours of the
+// first CLUT.
+type ULAplus struct {
+	Enabled     bool     // Attributes choose colours from the palette
+	Palette     [64]byte // Colours as GRB332
+	register    byte     // Last value written to the register port
+	screenStart uint32   // Line of the frame the screen starts on
+}
+
+func (p *ULAplus) Read(addr uint16) byte {
+	if p.register&ULAplusGroupMask == ULAplusModeGroup {
+		if p.Enabled {
+			return 1
+		}
+		return 0
+	}
+	return p.Palette[p.register&0x3F]
+}
+
+func (p *ULAplus) Write(addr uint16, value byte) {
+	if addr == ULAplusRegisterPort {
+		p.register = value
+		return
+	}
+	switch p.register & ULAplusGroupMask {
+	case ULAplusPaletteGroup:
+		p.Palette[p.register&0x3F] = value
+	case ULAplusModeGroup:
+		p.Enabled = value&0x01 != 0
+	}
+}
+
+// Entries returns the palette entries for the ink and paper of an
+// attribute the ULA drew at a column of a line of the frame
+func (p *ULAplus) Entries(line, column uint32, attr byte) (ink, paper byte) {
+	screenLine := line - p.screenStart
+	if screenLine >= ScreenHeight || column < ScreenStartColumn ||
+		column >= ScreenStartColumn+ScreenWidthBytes {
+		// The border, which may change colour part way through
+		return 8 + attr&0x07, 8 + attr>>3&0x07
+	}
+	clut := (attr >> 6) * 16
+	return clut + attr&0x07, clut + 8 + attr>>3&0x07
+}
+
+// Color returns a palette entry as RGB. Blue has only two bits, and gets
+// a third that is set if either is.
+func (p *ULAplus) Color(entry byte) color.RGBA {
+	c := p.Palette[entry&0x3F]
+	blue := c & 0x03
+	blue = blue<<1 | (blue>>1|blue)&1
+	expand := func(v byte) byte { return v<<5 | v<<2 | v>>1 }
+	return color.RGBA{expand(c >> 2 & 0x07), expand(c >> 5), expand(blue), 0xFF}
+}
+
+// AddULAplus plugs a ULAplus into the machine, which has none until then,
+// and returns it. A display with a SetULAplus(*ULAplus) method, such as a
+// Framebuffer, is given it to draw with; recordings started afterwards
+// draw with it too.
+func (m *Machine) AddULAplus() *ULAplus {
+	if m.ulaplus == nil {
+		m.ulaplus = &ULAplus{screenStart: m.model.ScreenStartLine}
+		m.bus.AddPort(0xFFFF, ULAplusDataPort, m.ulaplus)
+		m.bus.AddOutputPort(0xFFFF, ULAplusRegisterPort, m.ulaplus.Write)
+		if d, ok := m.display.(ulaplusDisplay); ok {
+			d.SetULAplus(m.ulaplus)
+		}
+	}
+	return m.ulaplus
+}
+
+// ULAplus returns the machine's ULAplus palette, or nil if it has none
+func (m *Machine) ULAplus() *ULAplus {
+	return m.ulaplus
+}
+
+// snapshot returns the state of the ULAplus for a snapshot
+func (p *ULAplus) snapshot() *snapshot.ULAplus {
+	return &snapshot.ULAplus{Enabled: p.Enabled, Register: p.register, Palette: p.Palette}
+}
+
+// restore sets the ULAplus from a snapshot, turning it off if the snapshot
+// doesn't have one
+func (p *ULAplus) restore(s *snapshot.ULAplus) {
+	if s == nil {
+		p.Enabled = false
+		p.register = 0
+		return
+	}
+	p.Enabled = s.Enabled
+	p.register = s.Register
+	p.Palette = s.Palette
+}
@@ -0,0 +1,112 @@
+package tape
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CSWSignature starts every CSW file
+const CSWSignature = "Compressed Square Wave\x1a"
+
+// CSWSampleRate is the sample rate used for CSW files we write
+const CSWSampleRate = 44100
+
+// ReadCSW reads a .csw file, version 1 or 2, as a single recording block
+func ReadCSW(r io.Reader) ([]Block, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 0x20 || string(data[:len(CSWSignature)]) != CSWSignature {
+		return nil, fmt.Errorf("not a CSW file")
+	}
+
+	major := data[0x17]
+	var rate, compression uint32
+	var start int
+	switch major {
+	case 1:
+		rate = uint32(binary.LittleEndian.Uint16(data[0x19:]))
+		compression = uint32(data[0x1B])
+		start = 0x20
+	case 2:
+		if len(data) < 0x34 {
+			return nil, fmt.Errorf("truncated CSW header")
+		}
+		rate = binary.LittleEndian.Uint32(data[0x19:])
+		compression = uint32(data[0x21])
+		start = 0x34 + int(data[0x23])
+		if start > len(data) {
+			return nil, fmt.Errorf("truncated CSW header")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported CSW version %d.%02d", major, data[0x18])
+	}
+	if rate == 0 {
+		return nil, fmt.Errorf("CSW sample rate is zero")
+	}
+
+	lengths, err := decodeCSW(data[start:], compression, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []Block{&CSWRecording{SampleRate: rate, Lengths: lengths}}, nil
+}
+
+// encodeCSW run-length encodes pulse lengths, zlib compressing the
+// result if compress is set
+func encodeCSW(lengths []uint32, compress bool) ([]byte, error) {
+	var rle []byte
+	for _, length := range lengths {
+		if length > 0 && length < 0x100 {
+			rle = append(rle, byte(length))
+		} else {
+			rle = append(rle, 0)
+			rle = binary.LittleEndian.AppendUint32(rle, length)
+		}
+	}
+	if !compress {
+		return rle, nil
+	}
+
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	if _, err := zw.Write(rle); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return z.Bytes(), nil
+}
+
+// WriteCSW writes a recording as a version 2 CSW file with Z-RLE
+// compression. high gives the level of the first pulse.
+func WriteCSW(w io.Writer, rec *CSWRecording, high bool) error {
+	data, err := encodeCSW(rec.Lengths, true)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0x34)
+	copy(header, CSWSignature)
+	header[0x17] = 2 // Version 2.0
+	header[0x18] = 0
+	binary.LittleEndian.PutUint32(header[0x19:], rec.SampleRate)
+	binary.LittleEndian.PutUint32(header[0x1D:], uint32(len(rec.Lengths)))
+	header[0x21] = 2 // Z-RLE
+	if high {
+		header[0x22] = 1
+	}
+	header[0x23] = 0 // No header extension
+	copy(header[0x24:0x34], "OMSE")
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
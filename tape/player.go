@@ -0,0 +1,293 @@
+package tape
+
+// Player plays a tape back as a signal, one T-state at a time
+type Player struct {
+	blocks    []Block
+	index     int     // Block being played
+	pulses    []Pulse // Signal for the current block, nil until it starts
+	pos       int     // Next pulse in pulses
+	remaining uint32  // T-states left in the current pulse
+	level     bool
+	playing   bool
+
+	// Loop and call state for TZX control blocks, which don't nest
+	loopStart int // First block of the loop
+	loopCount int // Times left to play the loop
+	callBlock int // Index of the CallSequence being run, or -1
+	callNext  int // Next entry of the CallSequence
+
+	// Is48K makes "stop the tape if in 48K mode" blocks stop the tape
+	Is48K bool
+
+	clockRate int64 // Rate Tick is called at
+	clock     int64 // ClockRate for each Tick less clockRate for each T-state of signal
+}
+
+// NewPlayer creates a player with no tape inserted, to be ticked
+// clockRate times a second
+func NewPlayer(clockRate int) *Player {
+	return &Player{callBlock: -1, Is48K: true, clockRate: int64(clockRate)}
+}
+
+// Insert puts a tape in the player, stopped and rewound
+func (p *Player) Insert(blocks []Block) {
+	p.blocks = blocks
+	p.playing = false
+	p.Rewind()
+}
+
+// Eject removes the tape
+func (p *Player) Eject() {
+	p.Insert(nil)
+}
+
+// Blocks returns the blocks on the tape
+func (p *Player) Blocks() []Block {
+	return p.blocks
+}
+
+// Loaded reports whether a tape is inserted
+func (p *Player) Loaded() bool {
+	return len(p.blocks) > 0
+}
+
+// Play starts the tape, if there is anything left to play
+func (p *Player) Play() {
+	p.playing = p.index < len(p.blocks)
+}
+
+// Stop stops the tape, keeping its position
+func (p *Player) Stop() {
+	p.playing = false
+}
+
+// Playing reports whether the tape is running
+func (p *Player) Playing() bool {
+	return p.playing
+}
+
+// Rewind moves back to the first block
+func (p *Player) Rewind() {
+	p.Seek(0)
+}
+
+// Seek moves to the start of block index, leaving any loop or call
+func (p *Player) Seek(index int) {
+	p.index = max(0, min(index, len(p.blocks)))
+	p.pulses = nil
+	p.pos = 0
+	p.remaining = 0
+	p.loopCount = 0
+	p.callBlock = -1
+	if p.index >= len(p.blocks) {
+		p.playing = false
+	}
+}
+
+// BlockIndex returns the index of the block being played, or the number
+// of blocks at the end of the tape
+func (p *Player) BlockIndex() int {
+	return p.index
+}
+
+// Level returns the current level of the signal
+func (p *Player) Level() bool {
+	return p.level
+}
+
+// BlockInfo describes a block for a tape browser
+type BlockInfo struct {
+	Index       int
+	Description string
+	Current     bool // The player is at this block
+	Depth       int  // Nesting within groups
+}
+
+// Browse lists the blocks on the tape
+func (p *Player) Browse() []BlockInfo {
+	infos := make([]BlockInfo, len(p.blocks))
+	depth := 0
+	for i, block := range p.blocks {
+		if _, ok := block.(*GroupEnd); ok && depth > 0 {
+			depth--
+		}
+		infos[i] = BlockInfo{
+			Index:       i,
+			Description: block.String(),
+			Current:     i == p.index,
+			Depth:       depth,
+		}
+		if _, ok := block.(*GroupStart); ok {
+			depth++
+		}
+	}
+	return infos
+}
+
+// Tick advances the tape by one T-state of the machine's clock when it is
+// playing
+func (p *Player) Tick() {
+	if !p.playing {
+		return
+	}
+	p.clock += ClockRate
+	for p.playing && p.clock > 0 {
+		p.clock -= p.clockRate
+		if p.remaining > 1 {
+			p.remaining--
+		} else {
+			p.nextPulse()
+		}
+	}
+}
+
+// nextPulse moves on to the next pulse, starting blocks as needed
+func (p *Player) nextPulse() {
+	for {
+		if p.pulses == nil {
+			if !p.settle() {
+				break
+			}
+			p.pulses = p.blocks[p.index].Pulses(p.level)
+			p.pos = 0
+		}
+		if p.pos < len(p.pulses) {
+			pulse := p.pulses[p.pos]
+			p.pos++
+			p.level = pulse.Level
+			p.remaining = pulse.Length
+			return
+		}
+		p.index++
+		p.pulses = nil
+	}
+	p.remaining = 0
+	p.playing = false
+}
+
+// settle carries out control blocks from the current position until it
+// reaches a block with a signal. It returns false if the tape ended or a
+// block stopped it.
+func (p *Player) settle() bool {
+	// Bound the work, so a tape that jumps in circles can't hang us
+	for steps := 0; steps <= 4*len(p.blocks)+4; steps++ {
+		if p.index < 0 || p.index >= len(p.blocks) {
+			p.index = len(p.blocks)
+			return false
+		}
+		switch b := p.blocks[p.index].(type) {
+		case *JumpBlock:
+			p.jump(p.index + b.Offset)
+		case *LoopStart:
+			p.loopStart = p.index + 1
+			p.loopCount = b.Count
+			p.index++
+		case *LoopEnd:
+			p.loopCount--
+			if p.loopCount > 0 {
+				p.index = p.loopStart
+			} else {
+				p.index++
+			}
+		case *CallSequence:
+			if len(b.Offsets) == 0 {
+				p.index++
+			} else {
+				p.callBlock = p.index
+				p.callNext = 1
+				p.jump(p.index + b.Offsets[0])
+			}
+		case *ReturnBlock:
+			p.returnFromCall()
+		case *Stop48KBlock:
+			p.index++
+			if p.Is48K {
+				p.playing = false
+				return false
+			}
+		case *SetLevelBlock:
+			p.level = b.Level
+			p.index++
+		case *PauseBlock:
+			if b.Pause > 0 {
+				return true
+			}
+			p.index++
+			p.playing = false
+			return false
+		case *GroupStart, *GroupEnd, *SelectBlock, *InfoBlock:
+			p.index++
+		default:
+			return true
+		}
+	}
+	p.index = len(p.blocks)
+	return false
+}
+
+// jump moves to block index, where a jump to the block itself counts as
+// a move to the next one
+func (p *Player) jump(index int) {
+	if index == p.index {
+		index++
+	}
+	p.index = index
+}
+
+// returnFromCall continues with the next call of the current call
+// sequence, or after it once all have been made
+func (p *Player) returnFromCall() {
+	if p.callBlock < 0 {
+		p.index++
+		return
+	}
+	call := p.blocks[p.callBlock].(*CallSequence)
+	if p.callNext < len(call.Offsets) {
+		p.index = p.callBlock + call.Offsets[p.callNext]
+		p.callNext++
+		return
+	}
+	p.index = p.callBlock + 1
+	p.callBlock = -1
+}
+
+// NextStandardBlock returns the data of the next block and skips past it,
+// if it is a block the ROM loader could read. Control and information
+// blocks before it are carried out first. It lets ROM traps load blocks
+// without playing them.
+func (p *Player) NextStandardBlock() ([]byte, bool) {
+	if p.pulses != nil {
+		return nil, false
+	}
+	// Blocks that stop the tape don't matter when blocks are only taken
+	// on demand, so carry on past them
+	for !p.settle() {
+		if p.index >= len(p.blocks) {
+			return nil, false
+		}
+	}
+	block, ok := p.blocks[p.index].(*DataBlock)
+	if !ok || !block.IsStandard() {
+		return nil, false
+	}
+	p.index++
+	return block.Data, true
+}
+
+// State is the tape in a player and where it has got to
+type State struct {
+	p Player
+}
+
+// State returns the player's state, to be put back with SetState
+func (p *Player) State() State {
+	return State{*p}
+}
+
+// SetState puts the player back in a state returned by State, with the
+// tape it had in then
+func (p *Player) SetState(s State) {
+	is48K := p.Is48K
+	*p = s.p
+	p.Is48K = is48K
+}
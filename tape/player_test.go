@@ -0,0 +1,125 @@
+package tape
+
+import (
+	"reflect"
+	"testing"
+)
+
+// merge joins neighbouring pulses of the same level
+func merge(pulses []Pulse) []Pulse {
+	var merged []Pulse
+	for _, p := range pulses {
+		if n := len(merged); n > 0 && merged[n-1].Level == p.Level {
+			merged[n-1].Length += p.Length
+		} else {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+// play plays the tape until it stops, giving up after limit T-states, and
+// returns the signal it made
+func play(t *testing.T, p *Player, limit int) []Pulse {
+	t.Helper()
+	var pulses []Pulse
+	p.Play()
+	for ticks := 0; p.Playing(); ticks++ {
+		if ticks == limit {
+			t.Fatalf("tape still playing after %d T-states", limit)
+		}
+		p.Tick()
+		if !p.Playing() {
+			break
+		}
+		if n := len(pulses); n > 0 && pulses[n-1].Level == p.Level() {
+			pulses[n-1].Length++
+		} else {
+			pulses = append(pulses, Pulse{Length: 1, Level: p.Level()})
+		}
+	}
+	return pulses
+}
+
+// TestPlayer plays a two block tape, checking the signal runs on from one
+// block to the next and the tape stops at its end
+func TestPlayer(t *testing.T) {
+	blocks := []Block{
+		NewStandardBlock([]byte{0xFF, 0x00}, 1),
+		NewStandardBlock([]byte{0xFF, 0xFF}, 3),
+	}
+	p := NewPlayer(ClockRate)
+	p.Insert(blocks)
+	if p.Playing() || !p.Loaded() || p.BlockIndex() != 0 {
+		t.Fatal("inserted tape isn't stopped at the start")
+	}
+
+	var want []Pulse
+	level := false
+	for _, block := range blocks {
+		pulses := block.Pulses(level)
+		want = append(want, pulses...)
+		level = pulses[len(pulses)-1].Level
+	}
+	got := play(t, p, 20_000_000)
+	if !reflect.DeepEqual(got, merge(want)) {
+		t.Errorf("played %d pulses; want %d", len(got), len(merge(want)))
+	}
+	if p.BlockIndex() != len(blocks) {
+		t.Errorf("stopped at block %d; want the end, %d", p.BlockIndex(), len(blocks))
+	}
+
+	// Stopping keeps the position
+	p.Rewind()
+	p.Play()
+	for range 1000 {
+		p.Tick()
+	}
+	p.Stop()
+	level = p.Level()
+	for range 5000 {
+		p.Tick()
+	}
+	if p.Level() != level || p.Playing() {
+		t.Error("a stopped tape kept playing")
+	}
+}
+
+// TestPause checks a pause block on its own stops the tape, and one with
+// a length is a silence
+func TestPause(t *testing.T) {
+	p := NewPlayer(ClockRate)
+	p.Insert([]Block{
+		&PulseSequence{Lengths: []uint32{100}},
+		&PauseBlock{Pause: 0},
+		&PulseSequence{Lengths: []uint32{200}},
+		&PauseBlock{Pause: 2},
+	})
+	got := play(t, p, 100_000)
+	if want := []Pulse{{100, true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("before the stop: %v; want %v", got, want)
+	}
+	if p.BlockIndex() != 2 {
+		t.Fatalf("stopped at block %d; want 2", p.BlockIndex())
+	}
+	got = play(t, p, 100_000)
+	want := []Pulse{{200, false}, {TStatesPerMS, true}, {TStatesPerMS, false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after the stop: %v; want %v", got, want)
+	}
+}
+
+// TestClockRate plays a tape to a faster machine, which takes more of its
+// T-states to play it
+func TestClockRate(t *testing.T) {
+	p := NewPlayer(3_546_900)
+	p.Insert([]Block{&PulseSequence{Lengths: []uint32{TStatesPerMS, 10 * TStatesPerMS}}})
+	got := play(t, p, 100_000)
+	want := []Pulse{{3547, true}, {35469, false}}
+	for i, pulse := range got {
+		if i >= len(want) || pulse.Level != want[i].Level ||
+			pulse.Length+1 < want[i].Length || pulse.Length > want[i].Length+1 {
+			t.Fatalf("played %v; want %v, give or take a T-state", got, want)
+		}
+	}
+}
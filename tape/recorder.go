@@ -0,0 +1,252 @@
+package tape
+
+// Recorder captures a signal, such as the Spectrum's MIC output, as the
+// times of its edges, and decodes it back into tape blocks
+type Recorder struct {
+	clockRate  int64  // Rate Tick is called at
+	clock      int64  // ClockRate for each Tick less clockRate for each T-state of signal
+	now        uint64 // T-states since recording started
+	lastEdge   uint64
+	level      bool
+	startLevel bool     // Level at the start of the first pulse
+	pulses     []uint32 // Time between edges, in T-states
+	recording  bool
+}
+
+// Decoding limits
+const (
+	// SilenceLength is the shortest gap between edges taken as a pause
+	// between blocks, in T-states (100ms)
+	SilenceLength = 100 * TStatesPerMS
+
+	minPilotPulses = 256  // Fewer pulses than this aren't a pilot tone
+	tolerance      = 0.15 // Allowed variation of pulses that should match
+)
+
+// NewRecorder creates a recorder that isn't recording yet, to be ticked
+// clockRate times a second
+func NewRecorder(clockRate int) *Recorder {
+	return &Recorder{clockRate: int64(clockRate)}
+}
+
+// Start clears the recording and starts capturing from the given level
+func (r *Recorder) Start(level bool) {
+	*r = Recorder{clockRate: r.clockRate, level: level, startLevel: level, recording: true}
+}
+
+// Stop ends the recording
+func (r *Recorder) Stop() {
+	if r.recording && r.now > r.lastEdge {
+		r.pulses = append(r.pulses, uint32(min(r.now-r.lastEdge, 0xFFFFFFFF)))
+		r.lastEdge = r.now
+	}
+	r.recording = false
+}
+
+// Recording reports whether the recorder is capturing
+func (r *Recorder) Recording() bool {
+	return r.recording
+}
+
+// Tick advances the recording by one T-state of the machine's clock
+func (r *Recorder) Tick() {
+	if !r.recording {
+		return
+	}
+	r.clock += ClockRate
+	for r.clock > 0 {
+		r.clock -= r.clockRate
+		r.now++
+	}
+}
+
+// SetLevel records the level of the signal at the current T-state
+func (r *Recorder) SetLevel(level bool) {
+	if !r.recording || level == r.level {
+		return
+	}
+	r.level = level
+	if r.now == 0 {
+		// An edge as recording starts just sets the starting level
+		r.startLevel = level
+		return
+	}
+	r.pulses = append(r.pulses, uint32(min(r.now-r.lastEdge, 0xFFFFFFFF)))
+	r.lastEdge = r.now
+}
+
+// Pulses returns the recorded time between edges and the level of the
+// signal before the first edge
+func (r *Recorder) Pulses() ([]uint32, bool) {
+	return r.pulses, r.startLevel
+}
+
+// CSW returns the whole recording resampled at sampleRate
+func (r *Recorder) CSW(sampleRate uint32) *CSWRecording {
+	lengths := make([]uint32, 0, len(r.pulses))
+	var tstates, done uint64
+	for _, p := range r.pulses {
+		tstates += uint64(p)
+		end := (tstates*uint64(sampleRate) + ClockRate/2) / ClockRate
+		if end > done {
+			lengths = append(lengths, uint32(end-done))
+			done = end
+		} else if len(lengths) > 0 {
+			// Too short for the sample rate; merge it and the previous
+			// pulse into the next one, to keep the polarity of the rest of
+			// the signal without losing time
+			done -= uint64(lengths[len(lengths)-1])
+			lengths = lengths[:len(lengths)-1]
+		}
+	}
+	if end := (tstates*uint64(sampleRate) + ClockRate/2) / ClockRate; end > done {
+		// The pulses merged at the end
+		lengths = append(lengths, uint32(end-done))
+	}
+	return &CSWRecording{SampleRate: sampleRate, Lengths: lengths}
+}
+
+// Blocks decodes the recording into tape blocks. Stretches of signal
+// between silences that decode as data, with the ROM timings or others,
+// become data blocks; anything else is kept as a CSW recording.
+func (r *Recorder) Blocks() []Block {
+	var blocks []Block
+	pulses := r.pulses
+
+	// Skip the silence before the first edge
+	if len(pulses) > 0 && pulses[0] >= SilenceLength {
+		pulses = pulses[1:]
+	}
+
+	for len(pulses) > 0 {
+		end := 0
+		for end < len(pulses) && pulses[end] < SilenceLength {
+			end++
+		}
+		segment := pulses[:end]
+		var pause uint32
+		if end < len(pulses) {
+			pause = min(pulses[end]/TStatesPerMS, 0xFFFF)
+			end++
+		}
+		pulses = pulses[end:]
+
+		if len(segment) == 0 {
+			blocks = append(blocks, &PauseBlock{Pause: max(pause, 1)})
+			continue
+		}
+		if block := decodeData(segment, pause); block != nil {
+			blocks = append(blocks, block)
+		} else {
+			blocks = append(blocks, &CSWRecording{
+				SampleRate: ClockRate,
+				Pause:      pause,
+				Lengths:    append([]uint32(nil), segment...),
+			})
+		}
+	}
+	return blocks
+}
+
+// near reports whether length is within tolerance of want
+func near(length uint32, want float64) bool {
+	return float64(length) >= want*(1-tolerance) && float64(length) <= want*(1+tolerance)
+}
+
+// decodeData tries to read a pilot tone, two sync pulses and data bits
+// from a stretch of signal
+func decodeData(pulses []uint32, pause uint32) *DataBlock {
+	// Pilot tone: a long run of pulses of about the same length
+	var sum float64
+	n := 0
+	for n < len(pulses) && (n == 0 || near(pulses[n], sum/float64(n))) {
+		sum += float64(pulses[n])
+		n++
+	}
+	if n < minPilotPulses || n+2 > len(pulses) {
+		return nil
+	}
+	pilot := sum / float64(n)
+
+	// Two sync pulses, both shorter than the pilot pulses
+	sync1, sync2 := pulses[n], pulses[n+1]
+	if float64(sync1) > pilot*0.75 || float64(sync2) > pilot*0.75 {
+		return nil
+	}
+	bits := pulses[n+2:]
+	if len(bits)%2 == 1 {
+		// The saver's final edge
+		bits = bits[:len(bits)-1]
+	}
+	if len(bits) == 0 {
+		return nil
+	}
+
+	// Zeros and ones are two short or two long pulses. Split them halfway
+	// between the shortest and longest pulse, or, when every bit is the
+	// same, by comparing with the pilot as the ROM timings do.
+	shortest, longest := bits[0], bits[0]
+	for _, b := range bits {
+		shortest = min(shortest, b)
+		longest = max(longest, b)
+	}
+	threshold := float64(shortest+longest) / 2
+	if float64(longest) < float64(shortest)*1.4 {
+		threshold = pilot * (ZeroPulse + OnePulse) / 2 / PilotPulse
+	}
+
+	data := make([]byte, 0, len(bits)/16+1)
+	var zeroSum, oneSum float64
+	var zeros, ones int
+	for i := 0; i < len(bits); i += 2 {
+		first, second := float64(bits[i]), float64(bits[i+1])
+		one := first > threshold
+		if one != (second > threshold) {
+			return nil
+		}
+		bit := (i / 2) % 8
+		if bit == 0 {
+			data = append(data, 0)
+		}
+		if one {
+			data[len(data)-1] |= 0x80 >> bit
+			oneSum += first + second
+			ones += 2
+		} else {
+			zeroSum += first + second
+			zeros += 2
+		}
+	}
+	lastBits := (len(bits) / 2) % 8
+	if lastBits == 0 {
+		lastBits = 8
+	}
+
+	zero := uint32(ZeroPulse * pilot / PilotPulse)
+	one := uint32(OnePulse * pilot / PilotPulse)
+	if zeros > 0 {
+		zero = uint32(zeroSum/float64(zeros) + 0.5)
+	}
+	if ones > 0 {
+		one = uint32(oneSum/float64(ones) + 0.5)
+	}
+
+	// Snap to the ROM timings if everything is close to them, so blocks
+	// saved by the ROM become standard blocks
+	if near(uint32(pilot), PilotPulse) && near(sync1, Sync1Pulse) && near(sync2, Sync2Pulse) &&
+		(zeros == 0 || near(zero, ZeroPulse)) && (ones == 0 || near(one, OnePulse)) &&
+		lastBits == 8 && n >= DataPilotPulses/2 {
+		return NewStandardBlock(data, pause)
+	}
+	return &DataBlock{
+		PilotPulse:  uint32(pilot + 0.5),
+		PilotLength: uint32(n),
+		Sync1Pulse:  sync1,
+		Sync2Pulse:  sync2,
+		ZeroPulse:   zero,
+		OnePulse:    one,
+		LastBits:    lastBits,
+		Pause:       pause,
+		Data:        data,
+	}
+}
@@ -0,0 +1,70 @@
+package tape
+
+import (
+	"bytes"
+	"testing"
+)
+
+// record records a signal of pulses of lengths, starting low
+func record(lengths []uint32) *Recorder {
+	r := NewRecorder(ClockRate)
+	r.Start(false)
+	level := false
+	for _, length := range lengths {
+		for range length {
+			r.Tick()
+		}
+		level = !level
+		r.SetLevel(level)
+	}
+	r.Stop()
+	return r
+}
+
+// TestCSWRoundTrip records a signal with pulses too short for the sample
+// rate, saves it as a CSW file and plays it back, checking no time is
+// lost on the way
+func TestCSWRoundTrip(t *testing.T) {
+	var lengths []uint32
+	var total int
+	for i := range 300 {
+		length := []uint32{855, 30, 1710, 10, 10, 667, 2168, 25}[i%8]
+		lengths = append(lengths, length)
+		total += int(length)
+	}
+	rec := record(lengths).CSW(CSWSampleRate)
+
+	var buf bytes.Buffer
+	if err := WriteCSW(&buf, rec, false); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := ReadCSW(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlayer(ClockRate)
+	p.Insert(blocks)
+	played := 0
+	for _, pulse := range play(t, p, 2*total) {
+		played += int(pulse.Length)
+	}
+	// Within a sample
+	if diff := played - total; diff < -80 || diff > 80 {
+		t.Errorf("played %d T-states; want %d", played, total)
+	}
+}
+
+// TestRecorderClockRate records a faster machine, whose T-states are
+// shorter than those of the tape timings
+func TestRecorderClockRate(t *testing.T) {
+	r := NewRecorder(3_546_900)
+	r.Start(false)
+	for range 35469 {
+		r.Tick()
+	}
+	r.SetLevel(true)
+	r.Stop()
+	if pulses, _ := r.Pulses(); len(pulses) != 1 || pulses[0] != 10*TStatesPerMS {
+		t.Errorf("recorded %v; want [%d]", pulses, 10*TStatesPerMS)
+	}
+}
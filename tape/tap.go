@@ -0,0 +1,62 @@
+package tape
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadTAP reads a .tap image. A TAP file is a sequence of blocks, each a
+// little-endian 16-bit length followed by the bytes the ROM saved: the
+// flag byte, the data and the checksum.
+func ReadTAP(r io.Reader) ([]Block, error) {
+	var blocks []Block
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err == io.EOF {
+			return blocks, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("TAP block %d: truncated length", len(blocks))
+		}
+
+		data := make([]byte, binary.LittleEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("TAP block %d: truncated data, expected %d bytes",
+				len(blocks), len(data))
+		}
+		blocks = append(blocks, NewStandardBlock(data, StandardPause))
+	}
+}
+
+// Open reads a tape image, choosing the format by file extension
+func Open(filename string) ([]Block, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	blocks, err := Read(file, filepath.Ext(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return blocks, nil
+}
+
+// Read reads a tape image in the format named by a file extension, such
+// as ".tzx". The dot may be left out.
+func Read(r io.Reader, ext string) ([]Block, error) {
+	switch strings.ToLower(strings.TrimPrefix(ext, ".")) {
+	case "tap":
+		return ReadTAP(r)
+	case "tzx":
+		return ReadTZX(r)
+	case "csw":
+		return ReadCSW(r)
+	default:
+		return nil, fmt.Errorf("unknown tape format: %s", ext)
+	}
+}
@@ -0,0 +1,118 @@
+package tape
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tapImage builds a TAP image of blocks
+func tapImage(blocks ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		WriteTAPBlock(&buf, block)
+	}
+	return buf.Bytes()
+}
+
+func TestReadTAP(t *testing.T) {
+	header := append([]byte{0x00, 0x03}, []byte("test      \x02\x00\x00\x80\x00\x00")...)
+	header = append(header, Checksum(header))
+	data := []byte{0xFF, 0xAA, 0x55, 0xFF}
+	blocks, err := ReadTAP(bytes.NewReader(tapImage(header, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("read %d blocks; want 2", len(blocks))
+	}
+	for i, want := range []struct {
+		data  []byte
+		pilot uint32
+	}{
+		{header, HeaderPilotPulses},
+		{data, DataPilotPulses},
+	} {
+		block, ok := blocks[i].(*DataBlock)
+		if !ok {
+			t.Fatalf("block %d is %T; want *DataBlock", i, blocks[i])
+		}
+		if !bytes.Equal(block.Data, want.data) || !block.IsStandard() ||
+			block.PilotLength != want.pilot || block.Pause != StandardPause {
+			t.Errorf("block %d = %+v", i, block)
+		}
+	}
+	if got := blocks[0].String(); got != `Standard data: Bytes: "test      "` {
+		t.Errorf("header block is %q", got)
+	}
+
+	// And back again
+	var buf bytes.Buffer
+	if err := WriteTAP(&buf, blocks); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), tapImage(header, data)) {
+		t.Error("WriteTAP didn't give back the image read")
+	}
+}
+
+func TestReadTAPErrors(t *testing.T) {
+	image := tapImage([]byte{0xFF, 1, 2, 3})
+	tests := []struct {
+		name  string
+		image []byte
+		err   string
+	}{
+		{"empty", nil, ""},
+		{"truncated length", append(append([]byte(nil), image...), 0x05), "truncated length"},
+		{"truncated data", image[:len(image)-1], "truncated data"},
+		{"truncated final block", append(append([]byte(nil), image...), 0x05, 0x00, 0xFF), "block 1: truncated data"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadTAP(bytes.NewReader(test.image))
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("error %v; want none", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v; want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestStandardBlockTiming(t *testing.T) {
+	block := NewStandardBlock([]byte{0x80, 0x01}, 2)
+	var want []Pulse
+	level := false
+	edge := func(length uint32) {
+		level = !level
+		want = append(want, Pulse{Length: length, Level: level})
+	}
+	for range DataPilotPulses {
+		edge(PilotPulse)
+	}
+	edge(Sync1Pulse)
+	edge(Sync2Pulse)
+	for _, one := range []bool{true, false, false, false, false, false, false, false,
+		false, false, false, false, false, false, false, true} {
+		length := uint32(ZeroPulse)
+		if one {
+			length = OnePulse
+		}
+		edge(length)
+		edge(length)
+	}
+	// A millisecond after the last edge, then low
+	edge(TStatesPerMS)
+	want = append(want, Pulse{Length: TStatesPerMS, Level: false})
+
+	if got := block.Pulses(false); !reflect.DeepEqual(merge(got), merge(want)) {
+		t.Errorf("pulses differ: got %d, want %d", len(got), len(want))
+	}
+	if pulses := NewStandardBlock([]byte{0x00}, 0).Pulses(false); len(pulses) != HeaderPilotPulses+2+16 {
+		t.Errorf("header block has %d pulses; want %d", len(pulses), HeaderPilotPulses+2+16)
+	}
+}
@@ -0,0 +1,194 @@
+// Package tape models ZX Spectrum cassette tapes.
+//
+// A tape is a list of blocks. Each block turns into a signal, a series of
+// pulses of constant level measured in T-states of the 48K's 3.5MHz clock,
+// as TZX files give them. The Player plays the signal back one T-state of
+// the emulated machine at a time, for it to read on its EAR input, and
+// the Recorder captures one; both scale the signal to the machine's clock,
+// which is faster on the 128K and later models.
+package tape
+
+import "fmt"
+
+// ClockRate is the rate of the clock tape timings count T-states of, the
+// 48K's, in T-states a second
+const ClockRate = 3_500_000
+
+// Timing of the standard ROM loader and saver, in T-states
+const (
+	PilotPulse        = 2168
+	Sync1Pulse        = 667
+	Sync2Pulse        = 735
+	ZeroPulse         = 855
+	OnePulse          = 1710
+	HeaderPilotPulses = 8063             // Pilot length for header blocks (flag < 128)
+	DataPilotPulses   = 3223             // Pilot length for data blocks
+	StandardPause     = 1000             // Pause after a standard block, in milliseconds
+	TStatesPerMS      = ClockRate / 1000 // T-states per millisecond
+)
+
+// Pulse is a stretch of the signal held at one level
+type Pulse struct {
+	Length uint32 // Duration in T-states
+	Level  bool
+}
+
+// Block is one block of a tape image
+type Block interface {
+	// Pulses returns the signal for the block, given the level the signal
+	// is at when the block starts
+	Pulses(level bool) []Pulse
+	String() string
+}
+
+// signal accumulates pulses for a block
+type signal struct {
+	pulses []Pulse
+	level  bool
+}
+
+// edge flips the level and holds it for length T-states
+func (s *signal) edge(length uint32) {
+	s.level = !s.level
+	s.hold(length)
+}
+
+// hold keeps the current level for length T-states
+func (s *signal) hold(length uint32) {
+	if length > 0 {
+		s.pulses = append(s.pulses, Pulse{Length: length, Level: s.level})
+	}
+}
+
+// pause ends the previous pulse and then holds the signal for ms
+// milliseconds. As the TZX specification asks, the signal goes low after
+// the first millisecond.
+func (s *signal) pause(ms uint32) {
+	if ms == 0 {
+		return
+	}
+	s.edge(TStatesPerMS)
+	if ms > 1 {
+		s.level = false
+		s.hold((ms - 1) * TStatesPerMS)
+	}
+}
+
+// DataBlock is a block of bytes with a pilot tone and sync pulses, using
+// either the ROM timings or custom (turbo) ones
+type DataBlock struct {
+	PilotPulse  uint32
+	PilotLength uint32 // Number of pilot pulses
+	Sync1Pulse  uint32
+	Sync2Pulse  uint32
+	ZeroPulse   uint32
+	OnePulse    uint32
+	LastBits    int    // Bits used in the last byte, 1 to 8
+	Pause       uint32 // Milliseconds of silence after the block
+	Data        []byte // Flag byte, payload and checksum for ROM blocks
+}
+
+// NewStandardBlock creates a block with the ROM timings. The pilot is
+// longer for header blocks, whose flag byte is below 128.
+func NewStandardBlock(data []byte, pause uint32) *DataBlock {
+	pilotLength := uint32(DataPilotPulses)
+	if len(data) > 0 && data[0] < 0x80 {
+		pilotLength = HeaderPilotPulses
+	}
+	return &DataBlock{
+		PilotPulse:  PilotPulse,
+		PilotLength: pilotLength,
+		Sync1Pulse:  Sync1Pulse,
+		Sync2Pulse:  Sync2Pulse,
+		ZeroPulse:   ZeroPulse,
+		OnePulse:    OnePulse,
+		LastBits:    8,
+		Pause:       pause,
+		Data:        data,
+	}
+}
+
+// IsStandard reports whether the block uses the ROM timings, so the ROM
+// loader can read it
+func (b *DataBlock) IsStandard() bool {
+	return b.PilotPulse == PilotPulse && b.Sync1Pulse == Sync1Pulse &&
+		b.Sync2Pulse == Sync2Pulse && b.ZeroPulse == ZeroPulse &&
+		b.OnePulse == OnePulse && b.LastBits == 8
+}
+
+func (b *DataBlock) Pulses(level bool) []Pulse {
+	s := signal{level: level}
+	for i := uint32(0); i < b.PilotLength; i++ {
+		s.edge(b.PilotPulse)
+	}
+	if b.Sync1Pulse > 0 {
+		s.edge(b.Sync1Pulse)
+	}
+	if b.Sync2Pulse > 0 {
+		s.edge(b.Sync2Pulse)
+	}
+	dataBits(&s, b.Data, b.LastBits, b.ZeroPulse, b.OnePulse)
+	s.pause(b.Pause)
+	return s.pulses
+}
+
+// dataBits adds two equal pulses for each bit of data, most significant
+// bit first
+func dataBits(s *signal, data []byte, lastBits int, zero, one uint32) {
+	for i, b := range data {
+		bits := 8
+		if i == len(data)-1 {
+			bits = lastBits
+		}
+		for bit := 0; bit < bits; bit++ {
+			length := zero
+			if b&(0x80>>bit) != 0 {
+				length = one
+			}
+			s.edge(length)
+			s.edge(length)
+		}
+	}
+}
+
+func (b *DataBlock) String() string {
+	kind := "Turbo data"
+	if b.IsStandard() {
+		kind = "Standard data"
+	} else if b.PilotLength == 0 && b.Sync1Pulse == 0 && b.Sync2Pulse == 0 {
+		kind = "Pure data"
+	}
+	return fmt.Sprintf("%s: %s", kind, DescribeData(b.Data))
+}
+
+// Header types in ROM header blocks
+var headerTypes = []string{"Program", "Number array", "Character array", "Bytes"}
+
+// DescribeData summarizes the contents of a ROM block, decoding the file
+// name and type for headers
+func DescribeData(data []byte) string {
+	if len(data) == 19 && data[0] == 0x00 && int(data[1]) < len(headerTypes) {
+		name := make([]byte, 10)
+		for i, c := range data[2:12] {
+			if c < 0x20 || c > 0x7e {
+				c = '?'
+			}
+			name[i] = c
+		}
+		return fmt.Sprintf("%s: \"%s\"", headerTypes[data[1]], name)
+	}
+	if len(data) > 0 {
+		return fmt.Sprintf("%d bytes, flag 0x%02X", len(data), data[0])
+	}
+	return "empty"
+}
+
+// Checksum returns the XOR of all bytes, which is zero for a ROM block
+// with a correct checksum byte
+func Checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum ^= b
+	}
+	return sum
+}
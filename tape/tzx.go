@@ -0,0 +1,697 @@
+package tape
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// TZXSignature starts every TZX file, followed by the major and minor
+// version of the format
+const TZXSignature = "ZXTape!\x1a"
+
+// ToneBlock is a pure tone: a number of pulses of the same length (0x12)
+type ToneBlock struct {
+	PulseLength uint32
+	Count       uint32
+}
+
+func (b *ToneBlock) Pulses(level bool) []Pulse {
+	s := signal{level: level}
+	for i := uint32(0); i < b.Count; i++ {
+		s.edge(b.PulseLength)
+	}
+	return s.pulses
+}
+
+func (b *ToneBlock) String() string {
+	return fmt.Sprintf("Pure tone: %d pulses of %d T-states", b.Count, b.PulseLength)
+}
+
+// PulseSequence is a list of pulses of arbitrary lengths (0x13)
+type PulseSequence struct {
+	Lengths []uint32
+}
+
+func (b *PulseSequence) Pulses(level bool) []Pulse {
+	s := signal{level: level}
+	for _, length := range b.Lengths {
+		s.edge(length)
+	}
+	return s.pulses
+}
+
+func (b *PulseSequence) String() string {
+	return fmt.Sprintf("Pulse sequence: %d pulses", len(b.Lengths))
+}
+
+// DirectRecording is a sampled signal, one bit per sample (0x15)
+type DirectRecording struct {
+	TStatesPerSample uint32
+	Pause            uint32 // Milliseconds
+	LastBits         int    // Samples used in the last byte
+	Data             []byte // Samples, most significant bit first; 1 is high
+}
+
+func (b *DirectRecording) Pulses(level bool) []Pulse {
+	s := signal{level: level}
+	var run uint32
+	for i, d := range b.Data {
+		bits := 8
+		if i == len(b.Data)-1 {
+			bits = b.LastBits
+		}
+		for bit := 0; bit < bits; bit++ {
+			sample := d&(0x80>>bit) != 0
+			if sample != s.level {
+				s.hold(run)
+				s.level = sample
+				run = 0
+			}
+			run += b.TStatesPerSample
+		}
+	}
+	s.hold(run)
+	s.pause(b.Pause)
+	return s.pulses
+}
+
+func (b *DirectRecording) String() string {
+	return fmt.Sprintf("Direct recording: %d samples", recordingSamples(b.Data, b.LastBits))
+}
+
+func recordingSamples(data []byte, lastBits int) int {
+	if len(data) == 0 {
+		return 0
+	}
+	return (len(data)-1)*8 + lastBits
+}
+
+// CSWRecording is a signal stored as the lengths of its pulses, in
+// samples at SampleRate (0x18 and CSW files)
+type CSWRecording struct {
+	SampleRate uint32
+	Pause      uint32   // Milliseconds
+	Lengths    []uint32 // Pulse lengths in samples
+}
+
+func (b *CSWRecording) Pulses(level bool) []Pulse {
+	s := signal{level: level}
+	// Keep the fractional T-states, so long recordings don't drift
+	var samples uint64
+	var done uint64
+	for _, length := range b.Lengths {
+		samples += uint64(length)
+		end := samples * ClockRate / uint64(b.SampleRate)
+		s.edge(uint32(end - done))
+		done = end
+	}
+	s.pause(b.Pause)
+	return s.pulses
+}
+
+func (b *CSWRecording) String() string {
+	return fmt.Sprintf("CSW recording: %d pulses at %d Hz", len(b.Lengths), b.SampleRate)
+}
+
+// Symbol is an entry of a GeneralizedData alphabet
+type Symbol struct {
+	// Polarity decides the level of the first pulse: 0 flips the level,
+	// 1 keeps it, 2 forces it low and 3 forces it high
+	Polarity byte
+	Lengths  []uint32 // A zero length ends the symbol early
+}
+
+// SymbolRun is a symbol repeated a number of times in a pilot stream
+type SymbolRun struct {
+	Symbol  byte
+	Repeats uint32
+}
+
+// GeneralizedData describes the signal through alphabets of symbols, for
+// a pilot and sync part and for the data (0x19)
+type GeneralizedData struct {
+	Pause        uint32 // Milliseconds
+	PilotSymbols []Symbol
+	Pilot        []SymbolRun
+	DataSymbols  []Symbol
+	DataCount    uint32 // Number of symbols in Data
+	Data         []byte // Symbols packed most significant bit first
+}
+
+// symbolBits returns the number of bits needed for a symbol of an
+// alphabet with n entries
+func symbolBits(n int) int {
+	bits := 0
+	for (1 << bits) < n {
+		bits++
+	}
+	return bits
+}
+
+func (s *signal) symbol(sym Symbol) {
+	for i, length := range sym.Lengths {
+		if length == 0 {
+			break
+		}
+		if i == 0 {
+			switch sym.Polarity & 0x03 {
+			case 0:
+				s.level = !s.level
+			case 2:
+				s.level = false
+			case 3:
+				s.level = true
+			}
+		} else {
+			s.level = !s.level
+		}
+		s.hold(length)
+	}
+}
+
+func (b *GeneralizedData) Pulses(level bool) []Pulse {
+	s := signal{level: level}
+	for _, run := range b.Pilot {
+		if int(run.Symbol) < len(b.PilotSymbols) {
+			for i := uint32(0); i < run.Repeats; i++ {
+				s.symbol(b.PilotSymbols[run.Symbol])
+			}
+		}
+	}
+	bits := symbolBits(len(b.DataSymbols))
+	bitPos := 0
+	for i := uint32(0); i < b.DataCount; i++ {
+		sym := 0
+		for j := 0; j < bits; j++ {
+			byteIndex := bitPos / 8
+			if byteIndex < len(b.Data) && b.Data[byteIndex]&(0x80>>(bitPos%8)) != 0 {
+				sym |= 1 << (bits - 1 - j)
+			}
+			bitPos++
+		}
+		if sym < len(b.DataSymbols) {
+			s.symbol(b.DataSymbols[sym])
+		}
+	}
+	s.pause(b.Pause)
+	return s.pulses
+}
+
+func (b *GeneralizedData) String() string {
+	return fmt.Sprintf("Generalized data: %d symbols", b.DataCount)
+}
+
+// PauseBlock is silence; a pause of zero stops the tape (0x20)
+type PauseBlock struct {
+	Pause uint32 // Milliseconds
+}
+
+func (b *PauseBlock) Pulses(level bool) []Pulse {
+	s := signal{level: level}
+	s.pause(b.Pause)
+	return s.pulses
+}
+
+func (b *PauseBlock) String() string {
+	if b.Pause == 0 {
+		return "Stop the tape"
+	}
+	return fmt.Sprintf("Pause: %d ms", b.Pause)
+}
+
+// The remaining blocks produce no signal. Some steer the player through
+// the tape, the others only carry information.
+
+// GroupStart starts a named group of blocks (0x21)
+type GroupStart struct {
+	Name string
+}
+
+// GroupEnd ends a group of blocks (0x22)
+type GroupEnd struct{}
+
+// JumpBlock continues playback Offset blocks away (0x23)
+type JumpBlock struct {
+	Offset int
+}
+
+// LoopStart repeats the blocks up to the next LoopEnd Count times (0x24)
+type LoopStart struct {
+	Count int
+}
+
+// LoopEnd marks the end of a loop (0x25)
+type LoopEnd struct{}
+
+// CallSequence plays the sequences starting at each of the Offsets in
+// turn, each ending with a ReturnBlock (0x26)
+type CallSequence struct {
+	Offsets []int
+}
+
+// ReturnBlock returns from a sequence started by a CallSequence (0x27)
+type ReturnBlock struct{}
+
+// SelectOption is one entry of a SelectBlock
+type SelectOption struct {
+	Offset      int
+	Description string
+}
+
+// SelectBlock is a menu of places to jump to, for tape browsers (0x28)
+type SelectBlock struct {
+	Options []SelectOption
+}
+
+// Stop48KBlock stops the tape when the machine is a 48K Spectrum (0x2A)
+type Stop48KBlock struct{}
+
+// SetLevelBlock sets the signal to a given level (0x2B)
+type SetLevelBlock struct {
+	Level bool
+}
+
+// InfoBlock holds descriptive text: text descriptions, messages, archive
+// info and other blocks playback can skip
+type InfoBlock struct {
+	ID   byte
+	Text string
+}
+
+func (*GroupStart) Pulses(bool) []Pulse    { return nil }
+func (*GroupEnd) Pulses(bool) []Pulse      { return nil }
+func (*JumpBlock) Pulses(bool) []Pulse     { return nil }
+func (*LoopStart) Pulses(bool) []Pulse     { return nil }
+func (*LoopEnd) Pulses(bool) []Pulse       { return nil }
+func (*CallSequence) Pulses(bool) []Pulse  { return nil }
+func (*ReturnBlock) Pulses(bool) []Pulse   { return nil }
+func (*SelectBlock) Pulses(bool) []Pulse   { return nil }
+func (*Stop48KBlock) Pulses(bool) []Pulse  { return nil }
+func (*SetLevelBlock) Pulses(bool) []Pulse { return nil }
+func (*InfoBlock) Pulses(bool) []Pulse     { return nil }
+
+func (b *GroupStart) String() string { return fmt.Sprintf("Group: %s", b.Name) }
+func (*GroupEnd) String() string     { return "Group end" }
+func (b *JumpBlock) String() string  { return fmt.Sprintf("Jump: %+d blocks", b.Offset) }
+func (b *LoopStart) String() string  { return fmt.Sprintf("Loop: %d times", b.Count) }
+func (*LoopEnd) String() string      { return "Loop end" }
+func (b *CallSequence) String() string {
+	return fmt.Sprintf("Call sequence: %d calls", len(b.Offsets))
+}
+func (*ReturnBlock) String() string { return "Return from sequence" }
+func (b *SelectBlock) String() string {
+	names := make([]string, len(b.Options))
+	for i, o := range b.Options {
+		names[i] = o.Description
+	}
+	return fmt.Sprintf("Select: %s", strings.Join(names, ", "))
+}
+func (*Stop48KBlock) String() string { return "Stop the tape if in 48K mode" }
+func (b *SetLevelBlock) String() string {
+	if b.Level {
+		return "Set signal level: high"
+	}
+	return "Set signal level: low"
+}
+
+// Names of the information blocks
+var infoNames = map[byte]string{
+	0x16: "C64 ROM type data (unsupported)",
+	0x17: "C64 turbo tape data (unsupported)",
+	0x30: "Text",
+	0x31: "Message",
+	0x32: "Archive info",
+	0x33: "Hardware type",
+	0x34: "Emulation info",
+	0x35: "Custom info",
+	0x40: "Snapshot (unsupported)",
+	0x5A: "Glue",
+}
+
+func (b *InfoBlock) String() string {
+	name, ok := infoNames[b.ID]
+	if !ok {
+		name = fmt.Sprintf("Block 0x%02X", b.ID)
+	}
+	if b.Text == "" {
+		return name
+	}
+	return fmt.Sprintf("%s: %s", name, b.Text)
+}
+
+// Archive info text fields, by ID
+var archiveFields = map[byte]string{
+	0x00: "Title", 0x01: "Publisher", 0x02: "Author", 0x03: "Year",
+	0x04: "Language", 0x05: "Type", 0x06: "Price", 0x07: "Protection",
+	0x08: "Origin", 0xFF: "Comment",
+}
+
+// tzxReader reads the fields of TZX blocks from the file contents
+type tzxReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *tzxReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		r.pos = len(r.data)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *tzxReader) byte() uint32 {
+	if b := r.bytes(1); b != nil {
+		return uint32(b[0])
+	}
+	return 0
+}
+
+func (r *tzxReader) word() uint32 {
+	if b := r.bytes(2); b != nil {
+		return uint32(binary.LittleEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *tzxReader) triple() uint32 {
+	if b := r.bytes(3); b != nil {
+		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	}
+	return 0
+}
+
+func (r *tzxReader) dword() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// offset reads a signed 16-bit block offset
+func (r *tzxReader) offset() int {
+	return int(int16(r.word()))
+}
+
+func (r *tzxReader) text(n int) string {
+	return string(r.bytes(n))
+}
+
+// ReadTZX reads a .tzx image, version 1.20 or earlier
+func ReadTZX(r io.Reader) ([]Block, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 10 || string(data[:8]) != TZXSignature {
+		return nil, fmt.Errorf("not a TZX file")
+	}
+	if data[8] != 1 {
+		return nil, fmt.Errorf("unsupported TZX version %d.%02d", data[8], data[9])
+	}
+
+	tr := &tzxReader{data: data, pos: 10}
+	var blocks []Block
+	for tr.pos < len(data) {
+		id := byte(tr.byte())
+		block, err := readTZXBlock(tr, id)
+		if err == nil {
+			err = tr.err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("TZX block %d (ID 0x%02X): %v", len(blocks), id, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func readTZXBlock(r *tzxReader, id byte) (Block, error) {
+	switch id {
+	case 0x10: // Standard speed data
+		pause := r.word()
+		data := r.bytes(int(r.word()))
+		return NewStandardBlock(data, pause), nil
+
+	case 0x11: // Turbo speed data
+		b := &DataBlock{}
+		b.PilotPulse = r.word()
+		b.Sync1Pulse = r.word()
+		b.Sync2Pulse = r.word()
+		b.ZeroPulse = r.word()
+		b.OnePulse = r.word()
+		b.PilotLength = r.word()
+		b.LastBits = int(r.byte())
+		b.Pause = r.word()
+		b.Data = r.bytes(int(r.triple()))
+		return b, checkLastBits(b.LastBits)
+
+	case 0x12: // Pure tone
+		length := r.word()
+		return &ToneBlock{PulseLength: length, Count: r.word()}, nil
+
+	case 0x13: // Pulse sequence
+		lengths := make([]uint32, r.byte())
+		for i := range lengths {
+			lengths[i] = r.word()
+		}
+		return &PulseSequence{Lengths: lengths}, nil
+
+	case 0x14: // Pure data
+		b := &DataBlock{}
+		b.ZeroPulse = r.word()
+		b.OnePulse = r.word()
+		b.LastBits = int(r.byte())
+		b.Pause = r.word()
+		b.Data = r.bytes(int(r.triple()))
+		return b, checkLastBits(b.LastBits)
+
+	case 0x15: // Direct recording
+		b := &DirectRecording{}
+		b.TStatesPerSample = r.word()
+		b.Pause = r.word()
+		b.LastBits = int(r.byte())
+		b.Data = r.bytes(int(r.triple()))
+		return b, checkLastBits(b.LastBits)
+
+	case 0x18: // CSW recording
+		length := int(r.dword())
+		body := &tzxReader{data: r.bytes(length)}
+		b := &CSWRecording{}
+		b.Pause = body.word()
+		b.SampleRate = body.triple()
+		compression := body.byte()
+		count := body.dword()
+		if body.err != nil {
+			return nil, body.err
+		}
+		lengths, err := decodeCSW(body.data[body.pos:], compression, count)
+		b.Lengths = lengths
+		if err == nil && b.SampleRate == 0 {
+			err = fmt.Errorf("CSW sample rate is zero")
+		}
+		return b, err
+
+	case 0x19: // Generalized data
+		length := int(r.dword())
+		return readGeneralizedData(&tzxReader{data: r.bytes(length)})
+
+	case 0x20: // Pause or stop the tape
+		return &PauseBlock{Pause: r.word()}, nil
+
+	case 0x21: // Group start
+		return &GroupStart{Name: r.text(int(r.byte()))}, nil
+
+	case 0x22:
+		return &GroupEnd{}, nil
+
+	case 0x23:
+		return &JumpBlock{Offset: r.offset()}, nil
+
+	case 0x24:
+		return &LoopStart{Count: int(r.word())}, nil
+
+	case 0x25:
+		return &LoopEnd{}, nil
+
+	case 0x26: // Call sequence
+		offsets := make([]int, r.word())
+		for i := range offsets {
+			offsets[i] = r.offset()
+		}
+		return &CallSequence{Offsets: offsets}, nil
+
+	case 0x27:
+		return &ReturnBlock{}, nil
+
+	case 0x28: // Select block
+		body := &tzxReader{data: r.bytes(int(r.word()))}
+		options := make([]SelectOption, body.byte())
+		for i := range options {
+			options[i].Offset = body.offset()
+			options[i].Description = body.text(int(body.byte()))
+		}
+		return &SelectBlock{Options: options}, body.err
+
+	case 0x2A: // Stop the tape if in 48K mode
+		r.bytes(int(r.dword()))
+		return &Stop48KBlock{}, nil
+
+	case 0x2B: // Set signal level
+		body := &tzxReader{data: r.bytes(int(r.dword()))}
+		return &SetLevelBlock{Level: body.byte() != 0}, body.err
+
+	case 0x30: // Text description
+		return &InfoBlock{ID: id, Text: r.text(int(r.byte()))}, nil
+
+	case 0x31: // Message block
+		r.byte() // Seconds to display the message
+		return &InfoBlock{ID: id, Text: r.text(int(r.byte()))}, nil
+
+	case 0x32: // Archive info
+		body := &tzxReader{data: r.bytes(int(r.word()))}
+		var fields []string
+		for n := body.byte(); n > 0; n-- {
+			fieldID := byte(body.byte())
+			text := body.text(int(body.byte()))
+			name, ok := archiveFields[fieldID]
+			if !ok {
+				name = fmt.Sprintf("Field 0x%02X", fieldID)
+			}
+			fields = append(fields, fmt.Sprintf("%s: %s", name, text))
+		}
+		return &InfoBlock{ID: id, Text: strings.Join(fields, "; ")}, body.err
+
+	case 0x33: // Hardware type
+		r.bytes(int(r.byte()) * 3)
+		return &InfoBlock{ID: id}, nil
+
+	case 0x34: // Emulation info (deprecated)
+		r.bytes(8)
+		return &InfoBlock{ID: id}, nil
+
+	case 0x35: // Custom info
+		name := strings.TrimRight(r.text(10), " \x00")
+		r.bytes(int(r.dword()))
+		return &InfoBlock{ID: id, Text: name}, nil
+
+	case 0x40: // Snapshot (deprecated)
+		r.byte()
+		r.bytes(int(r.triple()))
+		return &InfoBlock{ID: id}, nil
+
+	case 0x5A: // Glue block from merged files
+		r.bytes(9)
+		return &InfoBlock{ID: id}, nil
+
+	case 0x16, 0x17: // Deprecated C64 blocks
+		r.bytes(int(r.dword()) - 4)
+		return &InfoBlock{ID: id}, nil
+	}
+
+	// Blocks from later versions of the format all start with their
+	// length, so they can be skipped
+	r.bytes(int(r.dword()))
+	return &InfoBlock{ID: id}, nil
+}
+
+func checkLastBits(bits int) error {
+	if bits < 1 || bits > 8 {
+		return fmt.Errorf("invalid number of bits in last byte: %d", bits)
+	}
+	return nil
+}
+
+// readSymbols reads an alphabet of count symbols of up to maxPulses pulses
+func readSymbols(r *tzxReader, count, maxPulses int) []Symbol {
+	symbols := make([]Symbol, count)
+	for i := range symbols {
+		symbols[i].Polarity = byte(r.byte())
+		symbols[i].Lengths = make([]uint32, maxPulses)
+		for j := range symbols[i].Lengths {
+			symbols[i].Lengths[j] = r.word()
+		}
+	}
+	return symbols
+}
+
+func readGeneralizedData(r *tzxReader) (Block, error) {
+	b := &GeneralizedData{}
+	b.Pause = r.word()
+	totalPilot := r.dword()
+	pilotPulses := int(r.byte())
+	pilotAlphabet := int(r.byte())
+	b.DataCount = r.dword()
+	dataPulses := int(r.byte())
+	dataAlphabet := int(r.byte())
+	if pilotAlphabet == 0 {
+		pilotAlphabet = 256
+	}
+	if dataAlphabet == 0 {
+		dataAlphabet = 256
+	}
+
+	if totalPilot > 0 {
+		b.PilotSymbols = readSymbols(r, pilotAlphabet, pilotPulses)
+		if r.err == nil && int(totalPilot)*3 > len(r.data)-r.pos {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b.Pilot = make([]SymbolRun, totalPilot)
+		for i := range b.Pilot {
+			b.Pilot[i].Symbol = byte(r.byte())
+			b.Pilot[i].Repeats = r.word()
+		}
+	}
+	if b.DataCount > 0 {
+		b.DataSymbols = readSymbols(r, dataAlphabet, dataPulses)
+		bits := uint64(symbolBits(dataAlphabet)) * uint64(b.DataCount)
+		b.Data = r.bytes(int((bits + 7) / 8))
+	}
+	return b, r.err
+}
+
+// decodeCSW expands CSW pulse data: compression 1 is run-length encoded,
+// 2 is run-length encoded and then zlib compressed. In the RLE data each
+// byte is a pulse length in samples, with a zero byte introducing a
+// 32-bit length.
+func decodeCSW(data []byte, compression uint32, count uint32) ([]uint32, error) {
+	switch compression {
+	case 1:
+	case 2:
+		z, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("CSW data: %v", err)
+		}
+		defer z.Close()
+		if data, err = io.ReadAll(z); err != nil {
+			return nil, fmt.Errorf("CSW data: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown CSW compression %d", compression)
+	}
+
+	lengths := make([]uint32, 0, min(int(count), len(data)))
+	for i := 0; i < len(data); i++ {
+		length := uint32(data[i])
+		if length == 0 {
+			if i+4 >= len(data) {
+				return nil, fmt.Errorf("CSW data: truncated pulse length")
+			}
+			length = binary.LittleEndian.Uint32(data[i+1:])
+			i += 4
+		}
+		lengths = append(lengths, length)
+	}
+	return lengths, nil
+}
@@ -0,0 +1,302 @@
+package tape
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tzxImage builds a version 1.20 TZX image of blocks
+func tzxImage(blocks ...[]byte) []byte {
+	image := []byte(TZXSignature + "\x01\x14")
+	for _, block := range blocks {
+		image = append(image, block...)
+	}
+	return image
+}
+
+// le encodes v in n little-endian bytes
+func le(n int, v uint32) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(v >> (8 * i))
+	}
+	return b
+}
+
+// tzxBlock joins the ID and fields of a block
+func tzxBlock(id byte, fields ...[]byte) []byte {
+	return append([]byte{id}, bytes.Join(fields, nil)...)
+}
+
+// withLength puts the length of body in front of it, in n bytes
+func withLength(n int, body ...[]byte) []byte {
+	joined := bytes.Join(body, nil)
+	return append(le(n, uint32(len(joined))), joined...)
+}
+
+// sequence builds a pulse sequence block
+func sequence(lengths ...uint32) []byte {
+	b := []byte{0x13, byte(len(lengths))}
+	for _, length := range lengths {
+		b = append(b, le(2, length)...)
+	}
+	return b
+}
+
+// generalized is a generalized data block with a pilot of three 300
+// T-state pulses, then the data 1010 with 100 T-state pulses for a zero
+// and 200 T-state pulses for a one
+var generalized = tzxBlock(0x19, withLength(4,
+	le(2, 0),  // Pause
+	le(4, 1),  // Pilot stream entries
+	[]byte{1}, // Pulses per pilot symbol
+	[]byte{1}, // Pilot symbols
+	le(4, 4),  // Data symbols
+	[]byte{2}, // Pulses per data symbol
+	[]byte{2}, // Data alphabet
+	[]byte{0}, le(2, 300),
+	[]byte{0}, le(2, 3),
+	[]byte{0}, le(2, 100), le(2, 100),
+	[]byte{0}, le(2, 200), le(2, 200),
+	[]byte{0xA0},
+))
+
+func TestReadTZX(t *testing.T) {
+	tests := []struct {
+		name  string
+		block []byte
+		want  Block
+	}{
+		{"standard", tzxBlock(0x10, le(2, 500), le(2, 2), []byte{0xFF, 0x42}),
+			NewStandardBlock([]byte{0xFF, 0x42}, 500)},
+		{"turbo", tzxBlock(0x11, le(2, 2000), le(2, 600), le(2, 700), le(2, 800), le(2, 1600),
+			le(2, 3000), []byte{6}, le(2, 100), le(3, 1), []byte{0xFC}),
+			&DataBlock{PilotPulse: 2000, Sync1Pulse: 600, Sync2Pulse: 700, ZeroPulse: 800,
+				OnePulse: 1600, PilotLength: 3000, LastBits: 6, Pause: 100, Data: []byte{0xFC}}},
+		{"tone", tzxBlock(0x12, le(2, 500), le(2, 3)), &ToneBlock{PulseLength: 500, Count: 3}},
+		{"pulse sequence", sequence(100, 200), &PulseSequence{Lengths: []uint32{100, 200}}},
+		{"pure data", tzxBlock(0x14, le(2, 855), le(2, 1710), []byte{4}, le(2, 10), le(3, 2), []byte{1, 2}),
+			&DataBlock{ZeroPulse: 855, OnePulse: 1710, LastBits: 4, Pause: 10, Data: []byte{1, 2}}},
+		{"direct recording", tzxBlock(0x15, le(2, 79), le(2, 0), []byte{4}, le(3, 2), []byte{0xF0, 0x30}),
+			&DirectRecording{TStatesPerSample: 79, LastBits: 4, Data: []byte{0xF0, 0x30}}},
+		{"CSW recording", tzxBlock(0x18, withLength(4, le(2, 5), le(3, 44100), []byte{1}, le(4, 2),
+			[]byte{10, 0, 0x34, 0x12, 0, 0})),
+			&CSWRecording{SampleRate: 44100, Pause: 5, Lengths: []uint32{10, 0x1234}}},
+		{"generalized data", generalized, &GeneralizedData{
+			PilotSymbols: []Symbol{{Lengths: []uint32{300}}},
+			Pilot:        []SymbolRun{{Symbol: 0, Repeats: 3}},
+			DataSymbols:  []Symbol{{Lengths: []uint32{100, 100}}, {Lengths: []uint32{200, 200}}},
+			DataCount:    4,
+			Data:         []byte{0xA0},
+		}},
+		{"pause", tzxBlock(0x20, le(2, 1000)), &PauseBlock{Pause: 1000}},
+		{"group start", tzxBlock(0x21, []byte{4}, []byte("Game")), &GroupStart{Name: "Game"}},
+		{"group end", tzxBlock(0x22), &GroupEnd{}},
+		{"jump", tzxBlock(0x23, le(2, 0xFFFE)), &JumpBlock{Offset: -2}},
+		{"loop start", tzxBlock(0x24, le(2, 5)), &LoopStart{Count: 5}},
+		{"loop end", tzxBlock(0x25), &LoopEnd{}},
+		{"call sequence", tzxBlock(0x26, le(2, 2), le(2, 3), le(2, 0xFFFF)), &CallSequence{Offsets: []int{3, -1}}},
+		{"return", tzxBlock(0x27), &ReturnBlock{}},
+		{"select", tzxBlock(0x28, withLength(2, []byte{2}, le(2, 1), []byte{3}, []byte("One"),
+			le(2, 4), []byte{3}, []byte("Two"))),
+			&SelectBlock{Options: []SelectOption{{1, "One"}, {4, "Two"}}}},
+		{"stop if 48K", tzxBlock(0x2A, le(4, 0)), &Stop48KBlock{}},
+		{"set level", tzxBlock(0x2B, withLength(4, []byte{1})), &SetLevelBlock{Level: true}},
+		{"text", tzxBlock(0x30, []byte{5}, []byte("Hello")), &InfoBlock{ID: 0x30, Text: "Hello"}},
+		{"archive info", tzxBlock(0x32, withLength(2, []byte{2}, []byte{0x00, 4}, []byte("Game"),
+			[]byte{0x03, 4}, []byte("1984"))),
+			&InfoBlock{ID: 0x32, Text: "Title: Game; Year: 1984"}},
+		{"unknown", tzxBlock(0x4B, withLength(4, []byte{1, 2, 3})), &InfoBlock{ID: 0x4B}},
+	}
+
+	var all [][]byte
+	for _, test := range tests {
+		all = append(all, test.block)
+		t.Run(test.name, func(t *testing.T) {
+			blocks, err := ReadTZX(bytes.NewReader(tzxImage(test.block)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != 1 || !reflect.DeepEqual(blocks[0], test.want) {
+				t.Errorf("read %v; want %v", blocks, test.want)
+			}
+		})
+	}
+
+	// Cutting the image anywhere inside a block is an error
+	image := tzxImage(all...)
+	start := len(tzxImage())
+	for i, block := range all {
+		for cut := start + 1; cut < start+len(block); cut++ {
+			if _, err := ReadTZX(bytes.NewReader(image[:cut])); err == nil {
+				t.Errorf("%s block cut after %d bytes read without an error", tests[i].name, cut-start)
+			}
+		}
+		start += len(block)
+	}
+	if blocks, err := ReadTZX(bytes.NewReader(image)); err != nil || len(blocks) != len(all) {
+		t.Errorf("read %d blocks, error %v; want %d", len(blocks), err, len(all))
+	}
+}
+
+func TestReadTZXErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+		err   string
+	}{
+		{"not a TZX", []byte("ZXTape?\x1a\x01\x14"), "not a TZX file"},
+		{"too short", []byte(TZXSignature), "not a TZX file"},
+		{"version 2", []byte(TZXSignature + "\x02\x00"), "unsupported TZX version"},
+		{"bits in last byte", tzxImage(tzxBlock(0x14, le(2, 855), le(2, 1710), []byte{0}, le(2, 0), le(3, 1), []byte{0})),
+			"invalid number of bits"},
+		{"CSW compression", tzxImage(tzxBlock(0x18, withLength(4, le(2, 0), le(3, 44100), []byte{3}, le(4, 0)))),
+			"unknown CSW compression"},
+		{"CSW sample rate", tzxImage(tzxBlock(0x18, withLength(4, le(2, 0), le(3, 0), []byte{1}, le(4, 1), []byte{1}))),
+			"sample rate is zero"},
+		{"CSW long pulse", tzxImage(tzxBlock(0x18, withLength(4, le(2, 0), le(3, 44100), []byte{1}, le(4, 1), []byte{0, 1, 2}))),
+			"truncated pulse length"},
+		{"CSW zlib", tzxImage(tzxBlock(0x18, withLength(4, le(2, 0), le(3, 44100), []byte{2}, le(4, 1), []byte{1, 2, 3}))),
+			"CSW data"},
+		{"huge pilot stream", tzxImage(tzxBlock(0x19, withLength(4, le(2, 0), le(4, 0xFFFFFFFF), []byte{1, 1},
+			le(4, 0), []byte{0, 0}, []byte{0}, le(2, 100)))),
+			"unexpected EOF"},
+		{"huge data stream", tzxImage(tzxBlock(0x19, withLength(4, le(2, 0), le(4, 0), []byte{0, 0},
+			le(4, 0xFFFFFFFF), []byte{1, 2}, []byte{0}, le(2, 100), []byte{0}, le(2, 200)))),
+			"unexpected EOF"},
+		{"C64 block length", tzxImage(tzxBlock(0x16, le(4, 2))), "unexpected EOF"},
+		{"huge length", tzxImage(tzxBlock(0x4B, le(4, 0xFFFFFFFF))), "unexpected EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadTZX(bytes.NewReader(test.image))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v; want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// edges gives the signal of pulses of lengths, each flipping the level
+// from the one before, starting from low
+func edges(lengths ...uint32) []Pulse {
+	var pulses []Pulse
+	level := false
+	for _, length := range lengths {
+		level = !level
+		pulses = append(pulses, Pulse{Length: length, Level: level})
+	}
+	return pulses
+}
+
+// TestTZXPlayback reads small tapes and plays them until they stop,
+// checking the signal and where the tape stopped
+func TestTZXPlayback(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks [][]byte
+		is48K  bool
+		want   []Pulse
+		stop   int // Block index the tape stops at
+	}{
+		{"loop", [][]byte{
+			sequence(100),
+			tzxBlock(0x24, le(2, 3)),
+			sequence(200),
+			tzxBlock(0x25),
+			sequence(300),
+		}, true, edges(100, 200, 200, 200, 300), 5},
+		{"call and return", [][]byte{
+			sequence(100),
+			tzxBlock(0x26, le(2, 3), le(2, 3), le(2, 5), le(2, 3)),
+			sequence(300),
+			tzxBlock(0x23, le(2, 5)),
+			sequence(200),
+			tzxBlock(0x27),
+			sequence(250),
+			tzxBlock(0x27),
+		}, true, edges(100, 200, 250, 200, 300), 8},
+		{"jumps", [][]byte{
+			tzxBlock(0x23, le(2, 3)),
+			sequence(200),
+			tzxBlock(0x23, le(2, 3)),
+			sequence(100),
+			tzxBlock(0x23, le(2, 0xFFFD)),
+			sequence(999),
+		}, true, edges(100, 200, 999), 6},
+		{"stop if 48K", [][]byte{
+			sequence(100),
+			tzxBlock(0x2A, le(4, 0)),
+			sequence(200),
+		}, true, edges(100), 2},
+		{"no stop on 128K", [][]byte{
+			sequence(100),
+			tzxBlock(0x2A, le(4, 0)),
+			sequence(200),
+		}, false, edges(100, 200), 3},
+		{"pause", [][]byte{
+			sequence(100),
+			tzxBlock(0x20, le(2, 3)),
+			sequence(200),
+		}, true, []Pulse{{100, true}, {3 * TStatesPerMS, false}, {200, true}}, 3},
+		{"stop", [][]byte{
+			sequence(100),
+			tzxBlock(0x20, le(2, 0)),
+			sequence(200),
+		}, true, edges(100), 2},
+		{"set level", [][]byte{
+			tzxBlock(0x2B, withLength(4, []byte{1})),
+			sequence(100),
+			tzxBlock(0x2B, withLength(4, []byte{0})),
+			sequence(200),
+		}, true, []Pulse{{100, false}, {200, true}}, 4},
+		{"information", [][]byte{
+			tzxBlock(0x21, []byte{1}, []byte("A")),
+			sequence(100),
+			tzxBlock(0x30, []byte{1}, []byte("B")),
+			tzxBlock(0x22),
+			sequence(200),
+		}, true, edges(100, 200), 5},
+		{"generalized data", [][]byte{generalized},
+			true, edges(300, 300, 300, 200, 200, 100, 100, 200, 200, 100, 100), 1},
+		{"direct recording", [][]byte{
+			tzxBlock(0x15, le(2, 79), le(2, 0), []byte{4}, le(3, 2), []byte{0xF0, 0x30}),
+		}, true, []Pulse{{4 * 79, true}, {6 * 79, false}, {2 * 79, true}}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks, err := ReadTZX(bytes.NewReader(tzxImage(test.blocks...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := NewPlayer(ClockRate)
+			p.Is48K = test.is48K
+			p.Insert(blocks)
+			if got := play(t, p, 1_000_000); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("played %v; want %v", got, test.want)
+			}
+			if p.BlockIndex() != test.stop {
+				t.Errorf("stopped at block %d; want %d", p.BlockIndex(), test.stop)
+			}
+		})
+	}
+}
+
+// TestTZXJumpInCircles checks a tape that only jumps between its blocks
+// ends rather than hanging the player
+func TestTZXJumpInCircles(t *testing.T) {
+	blocks, err := ReadTZX(bytes.NewReader(tzxImage(
+		tzxBlock(0x23, le(2, 1)),
+		tzxBlock(0x23, le(2, 0xFFFF)),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlayer(ClockRate)
+	p.Insert(blocks)
+	if got := play(t, p, 1000); len(got) != 0 {
+		t.Errorf("played %v; want nothing", got)
+	}
+}
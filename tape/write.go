@@ -0,0 +1,179 @@
+package tape
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// WriteTAPBlock appends one block (flag, data and checksum) to a TAP file
+func WriteTAPBlock(w io.Writer, data []byte) error {
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("TAP block too long: %d bytes", len(data))
+	}
+	var length [2]byte
+	binary.LittleEndian.PutUint16(length[:], uint16(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// WriteTAP writes a TAP file. Only standard data blocks can be stored in
+// the format.
+func WriteTAP(w io.Writer, blocks []Block) error {
+	for i, block := range blocks {
+		data, ok := block.(*DataBlock)
+		if !ok || !data.IsStandard() {
+			return fmt.Errorf("block %d can't be stored in a TAP file: %v", i, block)
+		}
+		if err := WriteTAPBlock(w, data.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tzxWriter collects the bytes of a TZX block
+type tzxWriter []byte
+
+func (t *tzxWriter) byte(v uint32)   { *t = append(*t, byte(v)) }
+func (t *tzxWriter) word(v uint32)   { *t = binary.LittleEndian.AppendUint16(*t, uint16(v)) }
+func (t *tzxWriter) triple(v uint32) { *t = append(*t, byte(v), byte(v>>8), byte(v>>16)) }
+func (t *tzxWriter) dword(v uint32)  { *t = binary.LittleEndian.AppendUint32(*t, v) }
+func (t *tzxWriter) bytes(b []byte)  { *t = append(*t, b...) }
+
+// text writes a string preceded by its length as a byte
+func (t *tzxWriter) text(s string) {
+	if len(s) > 0xFF {
+		s = s[:0xFF]
+	}
+	t.byte(uint32(len(s)))
+	t.bytes([]byte(s))
+}
+
+// WriteTZX writes a version 1.20 TZX file
+func WriteTZX(w io.Writer, blocks []Block) error {
+	out := tzxWriter(TZXSignature + "\x01\x14")
+	for i, block := range blocks {
+		if err := out.block(block); err != nil {
+			return fmt.Errorf("TZX block %d: %v", i, err)
+		}
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+func (t *tzxWriter) block(block Block) error {
+	switch b := block.(type) {
+	case *DataBlock:
+		switch {
+		case b.IsStandard() && len(b.Data) <= 0xFFFF:
+			t.byte(0x10)
+			t.word(b.Pause)
+			t.word(uint32(len(b.Data)))
+		case b.PilotLength == 0 && b.Sync1Pulse == 0 && b.Sync2Pulse == 0:
+			t.byte(0x14)
+			t.word(b.ZeroPulse)
+			t.word(b.OnePulse)
+			t.byte(uint32(b.LastBits))
+			t.word(b.Pause)
+			t.triple(uint32(len(b.Data)))
+		default:
+			t.byte(0x11)
+			t.word(b.PilotPulse)
+			t.word(b.Sync1Pulse)
+			t.word(b.Sync2Pulse)
+			t.word(b.ZeroPulse)
+			t.word(b.OnePulse)
+			t.word(b.PilotLength)
+			t.byte(uint32(b.LastBits))
+			t.word(b.Pause)
+			t.triple(uint32(len(b.Data)))
+		}
+		t.bytes(b.Data)
+
+	case *ToneBlock:
+		t.byte(0x12)
+		t.word(b.PulseLength)
+		t.word(b.Count)
+
+	case *PulseSequence:
+		if len(b.Lengths) > 0xFF {
+			return fmt.Errorf("too many pulses in sequence: %d", len(b.Lengths))
+		}
+		t.byte(0x13)
+		t.byte(uint32(len(b.Lengths)))
+		for _, length := range b.Lengths {
+			t.word(length)
+		}
+
+	case *DirectRecording:
+		t.byte(0x15)
+		t.word(b.TStatesPerSample)
+		t.word(b.Pause)
+		t.byte(uint32(b.LastBits))
+		t.triple(uint32(len(b.Data)))
+		t.bytes(b.Data)
+
+	case *CSWRecording:
+		data, err := encodeCSW(b.Lengths, true)
+		if err != nil {
+			return err
+		}
+		t.byte(0x18)
+		t.dword(uint32(len(data) + 10))
+		t.word(b.Pause)
+		t.triple(b.SampleRate)
+		t.byte(2) // Z-RLE
+		t.dword(uint32(len(b.Lengths)))
+		t.bytes(data)
+
+	case *PauseBlock:
+		t.byte(0x20)
+		t.word(b.Pause)
+
+	case *GroupStart:
+		t.byte(0x21)
+		t.text(b.Name)
+
+	case *GroupEnd:
+		t.byte(0x22)
+
+	case *JumpBlock:
+		t.byte(0x23)
+		t.word(uint32(uint16(b.Offset)))
+
+	case *LoopStart:
+		t.byte(0x24)
+		t.word(uint32(b.Count))
+
+	case *LoopEnd:
+		t.byte(0x25)
+
+	case *Stop48KBlock:
+		t.byte(0x2A)
+		t.dword(0)
+
+	case *SetLevelBlock:
+		t.byte(0x2B)
+		t.dword(1)
+		if b.Level {
+			t.byte(1)
+		} else {
+			t.byte(0)
+		}
+
+	case *InfoBlock:
+		if b.ID != 0x30 {
+			return fmt.Errorf("can't write %v", b)
+		}
+		t.byte(0x30)
+		t.text(b.Text)
+
+	default:
+		return fmt.Errorf("can't write %v", block)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+// Package ula models the timing of the Sinclair ULA, the chip that shares
+// the Spectrum's lower RAM between the Z80 and the display.
+package ula
+
+import "github.com/imneme/chips-to-go/z80"
+
+// Timing describes when a Spectrum model's ULA holds up the CPU. All
+// T-states count from the start of the frame interrupt.
+type Timing struct {
+	TStatesPerLine uint32
+	LinesPerFrame  uint32
+	FirstContended uint32   // T-state of the first contended cycle
+	Pattern        [8]uint8 // Delay at each T-state of an 8 T-state fetch group
+
+	// MemoryOnly is set for the +2A and +3, whose gate array only holds up
+	// memory accesses, leaving internal and I/O cycles alone
+	MemoryOnly bool
+}
+
+// Timing48K is the timing of the 48K Spectrum
+var Timing48K = Timing{
+	TStatesPerLine: 224,
+	LinesPerFrame:  312,
+	FirstContended: 14335,
+	Pattern:        [8]uint8{6, 5, 4, 3, 2, 1, 0, 0},
+}
+
+// Timing128K is the timing of the 128K and +2, whose lines are four
+// T-states longer and whose frame is a line shorter
+var Timing128K = Timing{
+	TStatesPerLine: 228,
+	LinesPerFrame:  311,
+	FirstContended: 14361,
+	Pattern:        [8]uint8{6, 5, 4, 3, 2, 1, 0, 0},
+}
+
+// TimingPlus3 is the timing of the +2A and +3, which hold the CPU
+// until the fetch group ends and only for memory accesses
+var TimingPlus3 = Timing{
+	TStatesPerLine: 228,
+	LinesPerFrame:  311,
+	FirstContended: 14365,
+	Pattern:        [8]uint8{1, 0, 7, 6, 5, 4, 3, 2},
+	MemoryOnly:     true,
+}
+
+// Contention lasts for the 128 T-states of each of the 192 lines in
+// which the ULA fetches the screen
+const (
+	ContendedLines   = 192
+	ContendedTStates = 128
+)
+
+// FrameLength returns the number of T-states in a frame
+func (t *Timing) FrameLength() uint32 {
+	return t.TStatesPerLine * t.LinesPerFrame
+}
+
+// Delay returns how long a contended access starting at tstate waits
+func (t *Timing) Delay(tstate uint32) uint32 {
+	tstate %= t.FrameLength()
+	if tstate < t.FirstContended {
+		return 0
+	}
+	offset := tstate - t.FirstContended
+	if offset/t.TStatesPerLine >= ContendedLines {
+		return 0
+	}
+	column := offset % t.TStatesPerLine
+	if column >= ContendedTStates {
+		return 0
+	}
+	return uint32(t.Pattern[column%8])
+}
+
+// pendingTick is a CPU tick without bus activity, which could be the
+// start of a memory or I/O cycle or an internal cycle
+type pendingTick struct {
+	tstate uint32 // With the delays found so far
+	addr   uint16
+}
+
+// Contention works out how long the ULA stretches each CPU cycle from the
+// pins the CPU produces. The Z80 core only shows an access once it is
+// under way, and shows nothing for internal cycles (which the ULA still
+// contends by the address left on the bus), so ticks without bus activity
+// are kept until it is clear what they were.
+type Contention struct {
+	Timing *Timing
+
+	// Contended reports whether the ULA contends an address. It is also
+	// asked about the high byte of I/O ports.
+	Contended func(addr uint16) bool
+
+	busy    int    // Ticks left in the current memory or I/O cycle
+	late    uint32 // Delay in the current I/O cycle after the port access
+	pending []pendingTick
+}
+
+// NewContention creates a contention model for the given timing, with
+// the 48K's contended memory at 0x4000-0x7FFF
+func NewContention(timing *Timing) *Contention {
+	return &Contention{
+		Timing:    timing,
+		Contended: func(addr uint16) bool { return addr&0xC000 == 0x4000 },
+		pending:   make([]pendingTick, 0, 2),
+	}
+}
+
+// Reset forgets about any cycle in progress, for when the CPU is made to
+// start a new instruction
+func (c *Contention) Reset() {
+	c.busy = 0
+	c.late = 0
+	c.pending = c.pending[:0]
+}
+
+// Tick takes the pins returned by a CPU tick at tstate and returns how
+// many T-states the CPU must wait before its next tick. A memory or I/O
+// access shown by the pins should happen at the end of the wait. A port
+// write then happens in the same T-state as on a real Spectrum, and a port
+// read one T-state later.
+func (c *Contention) Tick(pins uint64, tstate uint32) uint32 {
+	if c.busy > 0 {
+		// Any wait after a port access comes once the access is done
+		c.busy--
+		late := c.late
+		c.late = 0
+		return late
+	}
+
+	var extra uint32
+	addr := z80.GetAddr(pins)
+	switch {
+	case pins&(z80.M1|z80.MREQ) == z80.M1|z80.MREQ:
+		// Opcode fetch, which the pins show in its first T-state
+		extra = c.internal(len(c.pending), 0)
+		if c.Contended(addr) {
+			extra += c.Timing.Delay(tstate + extra)
+		}
+		c.busy = 3
+
+	case pins&(z80.M1|z80.IORQ) == z80.M1|z80.IORQ:
+		// Interrupt acknowledge, which the ULA leaves alone
+		c.pending = c.pending[:0]
+		c.busy = 4
+
+	case pins&z80.MREQ != 0 && pins&(z80.RD|z80.WR) != 0:
+		// Memory read or write, shown in its second T-state
+		start, ok := c.start(1, &extra)
+		if !ok {
+			start = tstate - 1 + extra
+		}
+		if c.Contended(addr) {
+			extra += c.Timing.Delay(start)
+		}
+		c.busy = 1
+
+	case pins&z80.IORQ != 0 && pins&z80.WR != 0:
+		// Port write, shown in its second T-state
+		start, ok := c.start(1, &extra)
+		if !ok {
+			start = tstate - 1 + extra
+		}
+		early, late := c.ioDelay(start, addr)
+		extra += early
+		c.late = late
+		c.busy = 2
+
+	case pins&z80.IORQ != 0 && pins&z80.RD != 0:
+		// Port read, shown in its third T-state
+		start, ok := c.start(2, &extra)
+		if !ok {
+			start = tstate - 2 + extra
+		}
+		early, late := c.ioDelay(start, addr)
+		extra += early
+		c.late = late
+		c.busy = 1
+
+	default:
+		// Nothing on the bus yet. At most two ticks come before a cycle
+		// shows itself, so anything older was an internal cycle.
+		if len(c.pending) == cap(c.pending) {
+			extra = c.internal(1, 0)
+		}
+		c.pending = append(c.pending, pendingTick{tstate: tstate + extra, addr: addr})
+	}
+	return extra
+}
+
+// internal contends the first n pending ticks as internal cycles, each
+// held up by the address on the bus, and drops them. extra is the delay
+// found so far, which it returns with theirs added.
+func (c *Contention) internal(n int, extra uint32) uint32 {
+	var added uint32
+	for _, tick := range c.pending[:n] {
+		if c.Contended(tick.addr) && !c.Timing.MemoryOnly {
+			added += c.Timing.Delay(tick.tstate + added)
+		}
+	}
+	c.pending = c.pending[:copy(c.pending, c.pending[n:])]
+	for i := range c.pending {
+		c.pending[i].tstate += added
+	}
+	return extra + added
+}
+
+// start finds the first T-state of a cycle that showed itself after the
+// given number of ticks. Older pending ticks are contended as internal
+// cycles, adding to extra.
+func (c *Contention) start(ticks int, extra *uint32) (uint32, bool) {
+	if len(c.pending) < ticks {
+		*extra = c.internal(len(c.pending), *extra)
+		return 0, false
+	}
+	*extra = c.internal(len(c.pending)-ticks, *extra)
+	start := c.pending[0].tstate
+	c.pending = c.pending[:0]
+	return start, true
+}
+
+// ioDelay returns how long a port access starting at tstate waits before
+// and after the port is read or written. The ULA contends its own ports
+// (A0 reset) in the cycle's second T-state, and a high byte that looks
+// like a contended address in every T-state it is on the bus.
+func (c *Contention) ioDelay(tstate uint32, port uint16) (early, late uint32) {
+	if c.Timing.MemoryOnly {
+		return 0, 0
+	}
+	t := tstate
+	high := c.Contended(port)
+	if high {
+		early = c.Timing.Delay(t)
+		t += early
+	}
+	t++
+	switch {
+	case port&0x0001 == 0:
+		t += c.Timing.Delay(t) + 3
+	case high:
+		for range 3 {
+			t += c.Timing.Delay(t) + 1
+		}
+	default:
+		t += 3
+	}
+	return early, t - tstate - 4 - early
+}
+
+// ContentionState is the state of a contention model partway through a
+// memory or I/O cycle
+type ContentionState struct {
+	busy    int
+	late    uint32
+	pending []pendingTick
+}
+
+// State returns the model's state, to be put back with SetState
+func (c *Contention) State() ContentionState {
+	return ContentionState{c.busy, c.late, append([]pendingTick(nil), c.pending...)}
+}
+
+// SetState puts the model back in a state returned by State
+func (c *Contention) SetState(s ContentionState) {
+	c.busy = s.busy
+	c.late = s.late
+	c.pending = append(c.pending[:0], s.pending...)
+}
@@ -0,0 +1,267 @@
+package ula
+
+import (
+	"testing"
+
+	"github.com/imneme/chips-to-go/z80"
+)
+
+// machine is a Z80 with 64K of RAM, contended as on a 48K Spectrum, and
+// ports that read as 0xFF
+type machine struct {
+	cpu        *z80.CPU
+	pins       uint64
+	ram        [0x10000]byte
+	contention *Contention
+	now        uint32
+	portAt     uint32 // When the last port access happened
+}
+
+func newMachine() *machine {
+	cpu, pins := z80.New()
+	return &machine{cpu: cpu, pins: pins, contention: NewContention(&Timing48K)}
+}
+
+func (m *machine) transact() {
+	addr := z80.GetAddr(m.pins)
+	switch {
+	case m.pins&z80.MREQ != 0 && m.pins&z80.RD != 0:
+		z80.SetData(&m.pins, m.ram[addr])
+	case m.pins&z80.MREQ != 0 && m.pins&z80.WR != 0:
+		m.ram[addr] = z80.GetData(m.pins)
+	case m.pins&z80.IORQ != 0 && m.pins&z80.RD != 0:
+		z80.SetData(&m.pins, 0xFF)
+		m.portAt = m.now
+	case m.pins&z80.IORQ != 0 && m.pins&z80.WR != 0:
+		m.portAt = m.now
+	}
+}
+
+// run executes from pc, starting at tstate, until the opcode at end is
+// fetched, and returns the number of T-states taken
+func (m *machine) run(t *testing.T, pc, end uint16, tstate uint32) uint32 {
+	t.Helper()
+	m.pins = m.cpu.Prefetch(pc)
+	m.contention.Reset()
+	m.now = tstate
+	var stall uint32
+	for limit := 0; limit < 1000; limit++ {
+		if stall > 0 {
+			stall--
+			if stall == 0 {
+				m.transact()
+			}
+			m.now++
+			continue
+		}
+		m.pins = m.cpu.Tick(m.pins)
+		stall = m.contention.Tick(m.pins, m.now)
+		if m.pins&z80.M1 != 0 && m.pins&z80.MREQ != 0 && z80.GetAddr(m.pins) == end {
+			// Only delays from earlier cycles count, as the final fetch
+			// is uncontended
+			return m.now + stall - tstate
+		}
+		if stall == 0 {
+			m.transact()
+		}
+		m.now++
+	}
+	t.Fatalf("never reached 0x%04X", end)
+	return 0
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		tstate uint32
+		want   uint32
+	}{
+		{0, 0},
+		{14334, 0},
+		{14335, 6},
+		{14336, 5},
+		{14340, 1},
+		{14341, 0},
+		{14342, 0},
+		{14343, 6},
+		{14335 + 127, 0},
+		{14335 + 120, 6},
+		{14335 + 128, 0},
+		{14335 + 224, 6},
+		{14335 + 191*224 + 8, 6},
+		{14335 + 192*224, 0},
+		{69888 + 14335, 6},
+	}
+	for _, test := range tests {
+		if got := Timing48K.Delay(test.tstate); got != test.want {
+			t.Errorf("Delay(%d) = %d, want %d", test.tstate, got, test.want)
+		}
+	}
+}
+
+func TestDelay128K(t *testing.T) {
+	tests := []struct {
+		tstate uint32
+		want   uint32
+	}{
+		{14360, 0},
+		{14361, 6},
+		{14366, 1},
+		{14361 + 128, 0},
+		{14361 + 228, 6},
+		{14361 + 191*228 + 1, 5},
+		{14361 + 192*228, 0},
+		{70908 + 14361, 6},
+	}
+	for _, test := range tests {
+		if got := Timing128K.Delay(test.tstate); got != test.want {
+			t.Errorf("Delay(%d) = %d, want %d", test.tstate, got, test.want)
+		}
+	}
+}
+
+func TestInstructionTiming(t *testing.T) {
+	tests := []struct {
+		name   string
+		pc     uint16
+		code   []byte
+		setup  func(cpu *z80.CPU)
+		tstate uint32
+		want   uint32
+	}{
+		// NOP in uncontended memory, and in contended memory at each
+		// point of the pattern
+		{"NOP 0x8000", 0x8000, []byte{0x00}, nil, 14335, 4},
+		{"NOP 14334", 0x7FFF, []byte{0x00}, nil, 14334, 4},
+		{"NOP 14335", 0x7FFF, []byte{0x00}, nil, 14335, 10},
+		{"NOP 14336", 0x7FFF, []byte{0x00}, nil, 14336, 9},
+		{"NOP 14340", 0x7FFF, []byte{0x00}, nil, 14340, 5},
+		{"NOP 14341", 0x7FFF, []byte{0x00}, nil, 14341, 4},
+		{"NOP 14343", 0x7FFF, []byte{0x00}, nil, 14343, 10},
+		{"NOP right border", 0x7FFF, []byte{0x00}, nil, 14335 + 128, 4},
+		{"NOP next line", 0x7FFF, []byte{0x00}, nil, 14335 + 224, 10},
+		{"NOP bottom border", 0x7FFF, []byte{0x00}, nil, 14335 + 192*224, 4},
+
+		// LD A,(HL): pc:4, hl:3
+		{"LD A,(HL)", 0x8000, []byte{0x7E},
+			func(cpu *z80.CPU) { cpu.SetHL(0x4000) }, 14331, 13},
+		{"LD A,(HL) uncontended", 0x8000, []byte{0x7E},
+			func(cpu *z80.CPU) { cpu.SetHL(0x8000) }, 14331, 7},
+
+		// LD (HL),A: pc:4, hl:3
+		{"LD (HL),A", 0x8000, []byte{0x77},
+			func(cpu *z80.CPU) { cpu.SetHL(0x5000) }, 14332, 12},
+
+		// INC BC: pc:4, ir:1 x 2, contended when I points at 0x4000
+		{"INC BC", 0x8000, []byte{0x03},
+			func(cpu *z80.CPU) { cpu.SetI(0x40) }, 14331, 12},
+		{"INC BC I=0", 0x8000, []byte{0x03},
+			func(cpu *z80.CPU) { cpu.SetI(0x00) }, 14331, 6},
+
+		// INC (HL): pc:4, hl:3, hl:1, hl(write):3
+		{"INC (HL)", 0x8000, []byte{0x34},
+			func(cpu *z80.CPU) { cpu.SetHL(0x4000) }, 14331, 22},
+
+		// JR d: pc:4, pc+1:3, pc+1:1 x 5
+		{"JR", 0x7FFE, []byte{0x18, 0x00}, nil, 14335, 39},
+
+		// OUT (n),A to the ULA: pc:4, pc+1:3, N:1, C:3
+		{"OUT (n),A", 0x8000, []byte{0xD3, 0xFE},
+			func(cpu *z80.CPU) { cpu.SetA(0xFE) }, 14327, 17},
+
+		// IN A,(C) from an unattached port with a contended high byte:
+		// pc:4, pc+1:4, C:1, C:1, C:1, C:1
+		{"IN A,(C) contended", 0x8000, []byte{0xED, 0x78},
+			func(cpu *z80.CPU) { cpu.SetBC(0x40FF) }, 14327, 24},
+
+		// IN A,(C) from the ULA with a contended high byte:
+		// pc:4, pc+1:4, C:1, C:3
+		{"IN A,(C) ULA contended", 0x8000, []byte{0xED, 0x78},
+			func(cpu *z80.CPU) { cpu.SetBC(0x40FE) }, 14327, 18},
+
+		// IN A,(C) from an unattached, uncontended port: pc:4, pc+1:4, N:4
+		{"IN A,(C) uncontended", 0x8000, []byte{0xED, 0x78},
+			func(cpu *z80.CPU) { cpu.SetBC(0x80FF) }, 14327, 12},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMachine()
+			copy(m.ram[test.pc:], test.code)
+			if test.setup != nil {
+				test.setup(m.cpu)
+			}
+			end := test.pc + uint16(len(test.code))
+			if got := m.run(t, test.pc, end, test.tstate); got != test.want {
+				t.Errorf("took %d T-states, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// Ports are read and written after the delay for the high byte, in the
+// T-state Fuse (whose timings the floating bus is measured against) uses
+// for a write and one T-state later for a read
+func TestPortAccessTiming(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   []byte
+		bc     uint16
+		tstate uint32
+		want   uint32 // T-state of the access, from the start
+	}{
+		{"IN A,(C) uncontended", []byte{0xED, 0x78}, 0x80FF, 14327, 8 + 1 + 1},
+		{"IN A,(C) contended", []byte{0xED, 0x78}, 0x40FF, 14327, 8 + 6 + 1 + 1},
+		{"IN A,(C) ULA", []byte{0xED, 0x78}, 0x40FE, 14328, 8 + 5 + 1 + 1},
+		{"OUT (C),A uncontended", []byte{0xED, 0x79}, 0x80FE, 14327, 8 + 1},
+		{"OUT (C),A contended", []byte{0xED, 0x79}, 0x40FE, 14329, 8 + 4 + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMachine()
+			copy(m.ram[0x8000:], test.code)
+			m.cpu.SetBC(test.bc)
+			m.run(t, 0x8000, 0x8000+uint16(len(test.code)), test.tstate)
+			if got := m.portAt - test.tstate; got != test.want {
+				t.Errorf("port accessed after %d T-states, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// The +2A and +3 contend memory with their own pattern, and leave
+// internal and I/O cycles alone
+func TestPlus3Timing(t *testing.T) {
+	tests := []struct {
+		name   string
+		pc     uint16
+		code   []byte
+		setup  func(cpu *z80.CPU)
+		tstate uint32
+		want   uint32
+	}{
+		{"NOP 14364", 0x7FFF, []byte{0x00}, nil, 14364, 4},
+		{"NOP 14365", 0x7FFF, []byte{0x00}, nil, 14365, 5},
+		{"NOP 14366", 0x7FFF, []byte{0x00}, nil, 14366, 4},
+		{"NOP 14367", 0x7FFF, []byte{0x00}, nil, 14367, 11},
+		{"LD A,(HL)", 0x8000, []byte{0x7E},
+			func(cpu *z80.CPU) { cpu.SetHL(0x4000) }, 14361, 8},
+		{"INC BC", 0x8000, []byte{0x03},
+			func(cpu *z80.CPU) { cpu.SetI(0x40) }, 14365, 6},
+		{"IN A,(C) ULA", 0x8000, []byte{0xED, 0x78},
+			func(cpu *z80.CPU) { cpu.SetBC(0x40FE) }, 14361, 12},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMachine()
+			m.contention.Timing = &TimingPlus3
+			copy(m.ram[test.pc:], test.code)
+			if test.setup != nil {
+				test.setup(m.cpu)
+			}
+			end := test.pc + uint16(len(test.code))
+			if got := m.run(t, test.pc, end, test.tstate); got != test.want {
+				t.Errorf("took %d T-states, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package ula
+
+// FetchKind says what the ULA is fetching from screen memory
+type FetchKind int
+
+const (
+	FetchIdle      FetchKind = iota // Not reading the screen
+	FetchBitmap                     // Reading a byte of the bitmap
+	FetchAttribute                  // Reading an attribute
+)
+
+// Fetch returns what the ULA reads from screen memory at tstate, and the
+// screen line (0-191) and character column (0-31) it is reading for. In
+// each 8 T-state group it reads the bitmap and attribute bytes of two
+// columns and then leaves the bus idle; an idle bus floats high.
+func (t *Timing) Fetch(tstate uint32) (kind FetchKind, line, column uint32) {
+	tstate %= t.FrameLength()
+	if tstate < t.FirstContended {
+		return FetchIdle, 0, 0
+	}
+	offset := tstate - t.FirstContended
+	line = offset / t.TStatesPerLine
+	cycle := offset % t.TStatesPerLine
+	if line >= ContendedLines || cycle >= ContendedTStates {
+		return FetchIdle, 0, 0
+	}
+	column = cycle / 8 * 2
+	switch cycle % 8 {
+	case 3:
+		return FetchBitmap, line, column
+	case 4:
+		return FetchAttribute, line, column
+	case 5:
+		return FetchBitmap, line, column + 1
+	case 6:
+		return FetchAttribute, line, column + 1
+	}
+	return FetchIdle, 0, 0
+}
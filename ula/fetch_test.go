@@ -0,0 +1,32 @@
+package ula
+
+import "testing"
+
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		tstate uint32
+		kind   FetchKind
+		line   uint32
+		column uint32
+	}{
+		{14337, FetchIdle, 0, 0},
+		{14338, FetchBitmap, 0, 0},
+		{14339, FetchAttribute, 0, 0},
+		{14340, FetchBitmap, 0, 1},
+		{14341, FetchAttribute, 0, 1},
+		{14342, FetchIdle, 0, 0},
+		{14345, FetchIdle, 0, 0},
+		{14346, FetchBitmap, 0, 2},
+		{14338 + 120, FetchBitmap, 0, 30},
+		{14338 + 128, FetchIdle, 0, 0},
+		{14338 + 224*100 + 11, FetchAttribute, 100, 3},
+		{14338 + 224*192, FetchIdle, 0, 0},
+	}
+	for _, test := range tests {
+		kind, line, column := Timing48K.Fetch(test.tstate)
+		if kind != test.kind || line != test.line || column != test.column {
+			t.Errorf("Fetch(%d) = %d, %d, %d, want %d, %d, %d", test.tstate,
+				kind, line, column, test.kind, test.line, test.column)
+		}
+	}
+}
@@ -0,0 +1,715 @@
+// Package upd765 emulates the NEC µPD765A floppy disk controller, as
+// fitted to the Spectrum +3, working on disks held as .dsk images.
+//
+// The CPU drives the controller through two ports: a main status register
+// and a data register. A command is written to the data register one byte
+// at a time, any sector data is then moved through the same register (the
+// +3 doesn't use DMA), and the result bytes are read back. Seeks finish
+// at once and data is available as soon as it is asked for, so software
+// that polls the status register runs at full speed.
+//
+// The +3 doesn't connect the terminal count line, so reads and writes
+// always run to the end of the sectors asked for and finish with an "end
+// of cylinder" error, which +3DOS expects and ignores.
+package upd765
+
+import (
+	"bytes"
+
+	"github.com/imneme/chips-to-go/dsk"
+)
+
+// Main status register bits
+const (
+	StatusBusy0     = 0x01 // Drive 0 is seeking
+	StatusBusy1     = 0x02
+	StatusBusy      = 0x10 // A command is in progress
+	StatusExecution = 0x20 // Data is being transferred
+	StatusDataOut   = 0x40 // The data register is for the CPU to read
+	StatusReady     = 0x80 // The data register is ready
+)
+
+// Status register 0 bits
+const (
+	ST0Head           = 0x04
+	ST0NotReady       = 0x08
+	ST0EquipmentCheck = 0x10
+	ST0SeekEnd        = 0x20
+	ST0Abnormal       = 0x40 // The command failed
+	ST0Invalid        = 0x80 // The command wasn't recognised
+)
+
+// Status register 1 bits
+const (
+	ST1MissingAddress = 0x01
+	ST1NotWritable    = 0x02
+	ST1NoData         = 0x04
+	ST1Overrun        = 0x10
+	ST1DataError      = 0x20
+	ST1EndOfCylinder  = 0x80
+)
+
+// Status register 2 bits
+const (
+	ST2MissingData   = 0x01
+	ST2BadCylinder   = 0x02
+	ST2ScanNotMet    = 0x04
+	ST2WrongCylinder = 0x10
+	ST2DataError     = 0x20
+	ST2ControlMark   = 0x40 // A deleted data mark was found
+)
+
+// Status register 3 bits
+const (
+	ST3Head         = 0x04
+	ST3TwoSided     = 0x08
+	ST3Track0       = 0x10
+	ST3Ready        = 0x20
+	ST3WriteProtect = 0x40
+	ST3Fault        = 0x80
+)
+
+// Commands, in the low five bits of the first byte. The top three bits
+// are the multi-track, double density and skip flags.
+const (
+	CmdReadTrack        = 0x02
+	CmdSpecify          = 0x03
+	CmdSenseDriveStatus = 0x04
+	CmdWriteData        = 0x05
+	CmdReadData         = 0x06
+	CmdRecalibrate      = 0x07
+	CmdSenseInterrupt   = 0x08
+	CmdWriteDeletedData = 0x09
+	CmdReadID           = 0x0A
+	CmdReadDeletedData  = 0x0C
+	CmdFormatTrack      = 0x0D
+	CmdSeek             = 0x0F
+	CmdScanEqual        = 0x11
+	CmdScanLowOrEqual   = 0x19
+	CmdScanHighOrEqual  = 0x1D
+	commandMask         = 0x1F
+	flagSkip            = 0x20
+	flagMultiTrack      = 0x80
+)
+
+// commandLengths holds the number of bytes in each command, including the
+// first. Anything missing is invalid.
+var commandLengths = map[byte]int{
+	CmdReadTrack:        9,
+	CmdSpecify:          3,
+	CmdSenseDriveStatus: 2,
+	CmdWriteData:        9,
+	CmdReadData:         9,
+	CmdRecalibrate:      2,
+	CmdSenseInterrupt:   1,
+	CmdWriteDeletedData: 9,
+	CmdReadID:           2,
+	CmdReadDeletedData:  9,
+	CmdFormatTrack:      6,
+	CmdSeek:             3,
+	CmdScanEqual:        9,
+	CmdScanLowOrEqual:   9,
+	CmdScanHighOrEqual:  9,
+}
+
+// Cylinders a drive's head can reach
+const maxCylinder = 82
+
+// Drive is a floppy drive attached to the controller
+type Drive struct {
+	Disk         *dsk.Disk
+	WriteProtect bool
+	Modified     bool // The disk has been written to since it went in
+	cylinder     int  // Where the head is
+	index        int  // Sector passing under the head next
+	seekEnded    bool // A seek finished and hasn't been sensed
+	seekFailed   bool
+}
+
+// Insert puts a disk in the drive
+func (d *Drive) Insert(disk *dsk.Disk, writeProtect bool) {
+	d.Disk = disk
+	d.WriteProtect = writeProtect
+	d.Modified = false
+	d.index = 0
+}
+
+// Eject takes the disk out of the drive and returns it
+func (d *Drive) Eject() *dsk.Disk {
+	disk := d.Disk
+	d.Disk = nil
+	d.Modified = false
+	return disk
+}
+
+// Cylinder returns the cylinder the head is over
+func (d *Drive) Cylinder() int {
+	return d.cylinder
+}
+
+// phase is the stage a command has reached
+type phase int
+
+const (
+	phaseCommand phase = iota
+	phaseExecution
+	phaseResult
+)
+
+// FDC is one µPD765A with two drives
+type FDC struct {
+	Drives [2]Drive
+	motor  bool
+
+	phase   phase
+	command []byte
+	result  []byte
+
+	// Execution phase state. Reads gather all their data up front; writes
+	// fill data a sector (or, when formatting, an ID field) at a time.
+	data    []byte
+	pos     int
+	reading bool
+	sector  *dsk.Sector // Sector being written
+	st      [3]byte     // Status built up during the command
+	r       byte        // Sector being read or written
+}
+
+// New creates a controller with empty drives
+func New() *FDC {
+	f := &FDC{}
+	f.Reset()
+	return f
+}
+
+// Reset stops any command in progress
+func (f *FDC) Reset() {
+	f.phase = phaseCommand
+	f.command = f.command[:0]
+	f.result = nil
+	f.data = nil
+	for i := range f.Drives {
+		f.Drives[i].seekEnded = false
+	}
+}
+
+// State is where the controller is in a command and where the drives'
+// heads are, apart from the disks in the drives
+type State struct {
+	f FDC
+}
+
+// State returns the controller's state, to be put back with SetState
+func (f *FDC) State() State {
+	s := State{*f}
+	s.f.copyBuffers()
+	return s
+}
+
+// SetState puts the controller back in a state returned by State, with
+// the disks it has now. A transfer to or from a disk that has been
+// changed since is abandoned.
+func (f *FDC) SetState(s State) {
+	drives := f.Drives
+	*f = s.f
+	f.copyBuffers()
+	changed := false
+	for i := range f.Drives {
+		changed = changed || f.Drives[i].Disk != drives[i].Disk
+		f.Drives[i].Disk = drives[i].Disk
+		f.Drives[i].WriteProtect = drives[i].WriteProtect
+		f.Drives[i].Modified = drives[i].Modified
+	}
+	if changed && f.phase == phaseExecution {
+		f.Reset()
+	}
+}
+
+// copyBuffers gives the controller its own copies of the command, result
+// and data, so they aren't shared with a State
+func (f *FDC) copyBuffers() {
+	f.command = append([]byte(nil), f.command...)
+	f.result = append([]byte(nil), f.result...)
+	f.data = append([]byte(nil), f.data...)
+}
+
+// SetMotor turns the motors of all the drives on or off
+func (f *FDC) SetMotor(on bool) {
+	f.motor = on
+}
+
+// Motor returns whether the drive motors are on
+func (f *FDC) Motor() bool {
+	return f.motor
+}
+
+// Status returns the main status register
+func (f *FDC) Status() byte {
+	switch f.phase {
+	case phaseExecution:
+		if f.reading {
+			return StatusReady | StatusDataOut | StatusExecution | StatusBusy
+		}
+		return StatusReady | StatusExecution | StatusBusy
+	case phaseResult:
+		return StatusReady | StatusDataOut | StatusBusy
+	}
+	if len(f.command) > 0 {
+		return StatusReady | StatusBusy
+	}
+	return StatusReady
+}
+
+// Read reads the data register
+func (f *FDC) Read() byte {
+	switch {
+	case f.phase == phaseExecution && f.reading:
+		value := f.data[f.pos]
+		f.pos++
+		if f.pos == len(f.data) {
+			f.phase = phaseResult
+		}
+		return value
+	case f.phase == phaseResult:
+		value := f.result[0]
+		f.result = f.result[1:]
+		if len(f.result) == 0 {
+			f.phase = phaseCommand
+		}
+		return value
+	}
+	return 0xFF
+}
+
+// Write writes the data register
+func (f *FDC) Write(value byte) {
+	switch f.phase {
+	case phaseCommand:
+		f.command = append(f.command, value)
+		length, ok := commandLengths[f.command[0]&commandMask]
+		if !ok {
+			f.finish(ST0Invalid)
+			return
+		}
+		if len(f.command) == length {
+			f.execute()
+		}
+	case phaseExecution:
+		if f.reading {
+			return
+		}
+		f.data[f.pos] = value
+		f.pos++
+		if f.pos == len(f.data) {
+			if f.command[0]&commandMask == CmdFormatTrack {
+				f.formatSector()
+			} else {
+				f.writeSector()
+			}
+		}
+	}
+}
+
+// drive returns the drive the command selects
+func (f *FDC) drive() *Drive {
+	return &f.Drives[f.command[1]&1]
+}
+
+// head returns the head the command selects
+func (f *FDC) head() int {
+	return int(f.command[1]>>2) & 1
+}
+
+// unit returns the drive and head bits for status register 0
+func (f *FDC) unit() byte {
+	return f.command[1] & 0x07
+}
+
+// ready reports whether the selected drive can be used: it has a disk
+// and its motor is running
+func (f *FDC) ready() bool {
+	return f.motor && f.drive().Disk != nil
+}
+
+// finish ends a command with the given result bytes, if any
+func (f *FDC) finish(result ...byte) {
+	f.command = f.command[:0]
+	f.data = nil
+	f.sector = nil
+	if len(result) == 0 {
+		f.phase = phaseCommand
+		return
+	}
+	f.result = result
+	f.phase = phaseResult
+}
+
+// finishTransfer ends a read, write or format command with the standard
+// seven byte result
+func (f *FDC) finishTransfer(c, h, r, n byte) {
+	f.finish(f.st[0]|f.unit(), f.st[1], f.st[2], c, h, r, n)
+}
+
+// execute starts a complete command
+func (f *FDC) execute() {
+	cmd := f.command[0] & commandMask
+	f.st = [3]byte{}
+	switch cmd {
+	case CmdSpecify:
+		f.finish()
+
+	case CmdSenseDriveStatus:
+		d := f.drive()
+		st3 := f.unit() & 0x07
+		if d.cylinder == 0 {
+			st3 |= ST3Track0
+		}
+		if d.Disk != nil {
+			if d.Disk.Sides > 1 {
+				st3 |= ST3TwoSided
+			}
+			if f.motor {
+				st3 |= ST3Ready
+			}
+			if d.WriteProtect {
+				st3 |= ST3WriteProtect
+			}
+		}
+		f.finish(st3)
+
+	case CmdRecalibrate, CmdSeek:
+		d := f.drive()
+		target := 0
+		if cmd == CmdSeek {
+			target = int(f.command[2])
+		}
+		d.cylinder = min(target, maxCylinder)
+		d.seekEnded = true
+		d.seekFailed = target > maxCylinder
+		d.index = 0
+		f.finish()
+
+	case CmdSenseInterrupt:
+		for i := range f.Drives {
+			d := &f.Drives[i]
+			if !d.seekEnded {
+				continue
+			}
+			d.seekEnded = false
+			st0 := ST0SeekEnd | byte(i)
+			if d.seekFailed {
+				st0 |= ST0Abnormal | ST0EquipmentCheck
+			}
+			if d.Disk == nil || !f.motor {
+				st0 |= ST0NotReady
+			}
+			f.finish(st0, byte(d.cylinder))
+			return
+		}
+		f.finish(ST0Invalid)
+
+	case CmdReadID:
+		if !f.ready() {
+			f.st[0] = ST0Abnormal | ST0NotReady
+			f.finishTransfer(0, 0, 0, 0)
+			return
+		}
+		d := f.drive()
+		track := d.Disk.Track(d.cylinder, f.head())
+		if track == nil || len(track.Sectors) == 0 {
+			f.st[0] = ST0Abnormal
+			f.st[1] = ST1MissingAddress
+			f.finishTransfer(0, 0, 0, 0)
+			return
+		}
+		s := track.Sectors[d.index%len(track.Sectors)]
+		d.index++
+		f.finishTransfer(s.C, s.H, s.R, s.N)
+
+	case CmdReadData, CmdReadDeletedData, CmdReadTrack:
+		f.startRead()
+
+	case CmdWriteData, CmdWriteDeletedData:
+		f.startWrite()
+
+	case CmdFormatTrack:
+		f.startFormat()
+
+	case CmdScanEqual, CmdScanLowOrEqual, CmdScanHighOrEqual:
+		// Nothing on the Spectrum uses the scan commands
+		f.st[0] = ST0Abnormal
+		f.st[2] = ST2ScanNotMet
+		f.finishTransfer(f.command[2], f.command[3], f.command[4], f.command[5])
+	}
+}
+
+// findSector looks for a sector with the ID the command gives, but for
+// the head and sector numbers, setting the status bits for why if there
+// isn't one
+func (f *FDC) findSector(track *dsk.Track, h, r byte) *dsk.Sector {
+	c, n := f.command[2], f.command[5]
+	if track == nil {
+		f.st[0] = ST0Abnormal
+		f.st[1] = ST1MissingAddress
+		return nil
+	}
+	for i, s := range track.Sectors {
+		if s.R == r && s.C == c && s.H == h && s.N == n {
+			f.drive().index = i + 1
+			return s
+		}
+	}
+	f.st[0] = ST0Abnormal
+	f.st[1] = ST1NoData
+	for _, s := range track.Sectors {
+		if s.R == r && s.C != c {
+			f.st[2] |= ST2WrongCylinder
+			if s.C == 0xFF {
+				f.st[2] |= ST2BadCylinder
+			}
+		}
+	}
+	return nil
+}
+
+// transferLength returns the number of bytes moved for each sector
+func (f *FDC) transferLength() int {
+	n := f.command[5]
+	if n == 0 {
+		return int(f.command[8])
+	}
+	return dsk.SectorSize(n)
+}
+
+// startRead gathers the data for a read command, sector by sector until
+// the end of the track's sectors or an error. With the multi-track flag,
+// a read that reaches the last sector on head 0 carries on from sector 1
+// on head 1.
+func (f *FDC) startRead() {
+	c, h, r, n, eot := f.command[2], f.command[3], f.command[4], f.command[5], f.command[6]
+	cmd := f.command[0] & commandMask
+	if !f.ready() {
+		f.st[0] = ST0Abnormal | ST0NotReady
+		f.finishTransfer(c, h, r, n)
+		return
+	}
+	d := f.drive()
+	multiTrack := cmd != CmdReadTrack && f.command[0]&flagMultiTrack != 0
+	track := d.Disk.Track(d.cylinder, f.head())
+	length := f.transferLength()
+
+	var data []byte
+	for count := 1; ; count++ {
+		var s *dsk.Sector
+		if cmd == CmdReadTrack {
+			// Sectors are read in the order they pass the head from the
+			// index hole, whatever their IDs, until EOT of them are read
+			// or the index hole comes round again. An ID that doesn't
+			// match the one expected is only noted.
+			if track == nil || len(track.Sectors) == 0 {
+				f.st[0] = ST0Abnormal
+				f.st[1] = ST1MissingAddress
+				break
+			}
+			s = track.Sectors[(count-1)%len(track.Sectors)]
+			if s.C != c || s.H != h || s.R != r || s.N != n {
+				f.st[1] |= ST1NoData
+			}
+		} else if s = f.findSector(track, h, r); s == nil {
+			break
+		}
+
+		deleted := s.ST2&ST2ControlMark != 0
+		skip := false
+		if cmd != CmdReadTrack && deleted != (cmd == CmdReadDeletedData) {
+			f.st[2] |= ST2ControlMark
+			skip = f.command[0]&flagSkip != 0
+		}
+		if !skip {
+			data = append(data, f.sectorData(s, length)...)
+			if s.ST1&ST1DataError != 0 || s.ST2&ST2DataError != 0 {
+				f.st[0] = ST0Abnormal
+				f.st[1] |= ST1DataError
+				f.st[2] |= s.ST2 & ST2DataError
+				if cmd != CmdReadTrack {
+					// Read Track carries on past errors
+					break
+				}
+			}
+			if f.st[2]&ST2ControlMark != 0 {
+				break
+			}
+		}
+
+		last := r == eot
+		if cmd == CmdReadTrack {
+			last = count == int(eot) || count == len(track.Sectors)
+		}
+		if last && multiTrack && f.head() == 0 {
+			// On to the other side; the result reports the head in use
+			f.command[1] |= 0x04
+			track = d.Disk.Track(d.cylinder, 1)
+			h ^= 1
+			r = 1
+			continue
+		}
+		if last {
+			// Without terminal count the controller goes on looking
+			// for the next sector and gives up at the end of the track
+			f.st[0] = ST0Abnormal
+			f.st[1] |= ST1EndOfCylinder
+			c++
+			if multiTrack {
+				h ^= 1
+			}
+			r = 1
+			break
+		}
+		r++
+	}
+
+	if f.st[1]&ST1EndOfCylinder == 0 && f.st[0]&ST0Abnormal == 0 {
+		r++
+	}
+	f.finishTransfer(c, h, r, n)
+	if len(data) == 0 {
+		return
+	}
+	// The result waits until the data has been read
+	f.data = data
+	f.pos = 0
+	f.reading = true
+	f.phase = phaseExecution
+}
+
+// sectorData returns the bytes read from a sector, choosing among the
+// copies of a weak sector in turn
+func (f *FDC) sectorData(s *dsk.Sector, length int) []byte {
+	data := s.Data
+	if copies := s.Copies(); copies > 1 {
+		size := len(data) / copies
+		i := f.drive().index % copies
+		data = data[i*size : (i+1)*size]
+	}
+	out := make([]byte, length)
+	copy(out, data)
+	return out
+}
+
+// startWrite checks a write command can go ahead and waits for the data
+// of its first sector
+func (f *FDC) startWrite() {
+	c, h, r, n := f.command[2], f.command[3], f.command[4], f.command[5]
+	switch {
+	case !f.ready():
+		f.st[0] = ST0Abnormal | ST0NotReady
+	case f.drive().WriteProtect:
+		f.st[0] = ST0Abnormal
+		f.st[1] = ST1NotWritable
+	default:
+		f.r = r
+		if f.nextWriteSector() {
+			return
+		}
+	}
+	f.finishTransfer(c, h, f.r, n)
+}
+
+// nextWriteSector finds the sector f.r and starts taking its data,
+// returning false if it isn't there
+func (f *FDC) nextWriteSector() bool {
+	d := f.drive()
+	f.sector = f.findSector(d.Disk.Track(d.cylinder, f.head()), f.command[3], f.r)
+	if f.sector == nil {
+		return false
+	}
+	f.data = make([]byte, f.transferLength())
+	f.pos = 0
+	f.reading = false
+	f.phase = phaseExecution
+	return true
+}
+
+// writeSector stores a sector's worth of data and moves to the next
+func (f *FDC) writeSector() {
+	s := f.sector
+	size := dsk.SectorSize(s.N)
+	if len(s.Data) != size {
+		s.Data = make([]byte, size)
+	}
+	copy(s.Data, f.data)
+	s.ST1 &^= ST1DataError
+	s.ST2 &^= ST2DataError | ST2ControlMark
+	if f.command[0]&commandMask == CmdWriteDeletedData {
+		s.ST2 |= ST2ControlMark
+	}
+	f.drive().Modified = true
+
+	c, h, n, eot := f.command[2], f.command[3], f.command[5], f.command[6]
+	if f.r == eot {
+		f.st[0] = ST0Abnormal
+		f.st[1] = ST1EndOfCylinder
+		f.finishTransfer(c+1, h, 1, n)
+		return
+	}
+	f.r++
+	if !f.nextWriteSector() {
+		f.finishTransfer(c, h, f.r, n)
+	}
+}
+
+// startFormat checks a format command can go ahead and waits for the ID
+// field of the first sector
+func (f *FDC) startFormat() {
+	n := f.command[2]
+	switch {
+	case !f.ready():
+		f.st[0] = ST0Abnormal | ST0NotReady
+	case f.drive().WriteProtect, !dsk.Fits(int(f.command[3]), n):
+		// A track a .dsk image can't hold is treated as write protected,
+		// so the image can still be saved
+		f.st[0] = ST0Abnormal
+		f.st[1] = ST1NotWritable
+	default:
+		d := f.drive()
+		track := &dsk.Track{
+			Cylinder: byte(d.cylinder),
+			Side:     byte(f.head()),
+			N:        n,
+			Gap3:     f.command[4],
+			Filler:   f.command[5],
+		}
+		if err := d.Disk.SetTrack(d.cylinder, f.head(), track); err != nil {
+			f.st[0] = ST0Abnormal
+			f.st[1] = ST1NotWritable
+			break
+		}
+		d.Modified = true
+		if f.command[3] == 0 {
+			break
+		}
+		f.data = make([]byte, 4)
+		f.pos = 0
+		f.reading = false
+		f.phase = phaseExecution
+		return
+	}
+	f.finishTransfer(0, 0, 0, n)
+}
+
+// formatSector adds a sector with the ID field just written
+func (f *FDC) formatSector() {
+	d := f.drive()
+	track := d.Disk.Track(d.cylinder, f.head())
+	id := f.data
+	track.Sectors = append(track.Sectors, &dsk.Sector{
+		C: id[0], H: id[1], R: id[2], N: id[3],
+		Data: bytes.Repeat([]byte{track.Filler}, dsk.SectorSize(track.N)),
+	})
+	if len(track.Sectors) < int(f.command[3]) {
+		f.data = make([]byte, 4)
+		f.pos = 0
+		return
+	}
+	f.finishTransfer(id[0], id[1], id[2], id[3])
+}
@@ -0,0 +1,306 @@
+package upd765
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/imneme/chips-to-go/dsk"
+)
+
+// send writes a command, checking the controller is ready for each byte
+func send(t *testing.T, f *FDC, command ...byte) {
+	t.Helper()
+	for _, b := range command {
+		if f.Status()&(StatusReady|StatusDataOut) != StatusReady {
+			t.Fatalf("controller not ready for command byte, status 0x%02X", f.Status())
+		}
+		f.Write(b)
+	}
+}
+
+// transfer reads any data the command produces and then its result
+func transfer(t *testing.T, f *FDC) (data, result []byte) {
+	t.Helper()
+	for f.Status()&StatusExecution != 0 {
+		data = append(data, f.Read())
+	}
+	for f.Status()&StatusDataOut != 0 {
+		result = append(result, f.Read())
+	}
+	if f.Status() != StatusReady {
+		t.Fatalf("status 0x%02X after the result", f.Status())
+	}
+	return data, result
+}
+
+func newDrive() *FDC {
+	f := New()
+	d := dsk.Format(40, 1, 9, 1, 2, 0xE5)
+	for c := range 40 {
+		for _, s := range d.Track(c, 0).Sectors {
+			s.Data[0], s.Data[1] = byte(c), s.R
+		}
+	}
+	f.Drives[0].Insert(d, false)
+	f.SetMotor(true)
+	return f
+}
+
+func TestSeek(t *testing.T) {
+	f := newDrive()
+	send(t, f, CmdSenseInterrupt)
+	if _, result := transfer(t, f); !bytes.Equal(result, []byte{ST0Invalid}) {
+		t.Errorf("sense interrupt with nothing pending gave %v", result)
+	}
+	send(t, f, CmdSeek, 0, 12)
+	send(t, f, CmdSenseInterrupt)
+	if _, result := transfer(t, f); !bytes.Equal(result, []byte{ST0SeekEnd, 12}) {
+		t.Errorf("sense interrupt after seek gave %v", result)
+	}
+	send(t, f, CmdSenseDriveStatus, 0)
+	if _, result := transfer(t, f); !bytes.Equal(result, []byte{ST3Ready}) {
+		t.Errorf("drive status off track 0 is %v", result)
+	}
+	send(t, f, CmdRecalibrate, 0)
+	send(t, f, CmdSenseInterrupt)
+	transfer(t, f)
+	send(t, f, CmdSenseDriveStatus, 0)
+	if _, result := transfer(t, f); !bytes.Equal(result, []byte{ST3Ready | ST3Track0}) {
+		t.Errorf("drive status on track 0 is %v", result)
+	}
+}
+
+func TestReadData(t *testing.T) {
+	f := newDrive()
+	send(t, f, CmdSeek, 0, 3)
+	send(t, f, 0x40|CmdReadData, 0, 3, 0, 2, 2, 3, 0x2A, 0xFF)
+	data, result := transfer(t, f)
+	if len(data) != 1024 || data[0] != 3 || data[1] != 2 || data[512+1] != 3 {
+		t.Errorf("read %d bytes starting %v", len(data), data[:2])
+	}
+	// No terminal count, so the read ends with end of cylinder
+	want := []byte{ST0Abnormal, ST1EndOfCylinder, 0, 4, 0, 1, 2}
+	if !bytes.Equal(result, want) {
+		t.Errorf("result %v, want %v", result, want)
+	}
+
+	send(t, f, 0x40|CmdReadData, 0, 3, 0, 10, 2, 10, 0x2A, 0xFF)
+	data, result = transfer(t, f)
+	if len(data) != 0 || result[0] != ST0Abnormal || result[1] != ST1NoData {
+		t.Errorf("reading a missing sector gave %d bytes and %v", len(data), result)
+	}
+	send(t, f, 0x40|CmdReadData, 0, 5, 0, 1, 2, 1, 0x2A, 0xFF)
+	if _, result = transfer(t, f); result[1] != ST1NoData || result[2] != ST2WrongCylinder {
+		t.Errorf("reading the wrong cylinder gave %v", result)
+	}
+
+	f.SetMotor(false)
+	send(t, f, 0x40|CmdReadData, 0, 3, 0, 1, 2, 1, 0x2A, 0xFF)
+	if _, result = transfer(t, f); result[0] != ST0Abnormal|ST0NotReady {
+		t.Errorf("reading with the motor off gave %v", result)
+	}
+}
+
+func TestWriteData(t *testing.T) {
+	f := newDrive()
+	send(t, f, 0x40|CmdWriteData, 0, 0, 0, 5, 2, 6, 0x2A, 0xFF)
+	for i := range 1024 {
+		if f.Status() != StatusReady|StatusExecution|StatusBusy {
+			t.Fatalf("status 0x%02X writing byte %d", f.Status(), i)
+		}
+		f.Write(byte(i))
+	}
+	if _, result := transfer(t, f); result[0] != ST0Abnormal || result[1] != ST1EndOfCylinder {
+		t.Errorf("write gave %v", result)
+	}
+	track := f.Drives[0].Disk.Track(0, 0)
+	if track.Sectors[4].Data[3] != 3 || track.Sectors[5].Data[3] != 3 || track.Sectors[6].Data[0] != 0 {
+		t.Error("sectors weren't written")
+	}
+	if !f.Drives[0].Modified {
+		t.Error("disk isn't marked modified")
+	}
+
+	f.Drives[0].WriteProtect = true
+	send(t, f, 0x40|CmdWriteData, 0, 0, 0, 5, 2, 5, 0x2A, 0xFF)
+	if _, result := transfer(t, f); result[1] != ST1NotWritable {
+		t.Errorf("writing a protected disk gave %v", result)
+	}
+}
+
+func TestFormatAndReadID(t *testing.T) {
+	f := New()
+	f.Drives[0].Insert(dsk.New(40, 1), false)
+	f.SetMotor(true)
+	send(t, f, 0x40|CmdReadID, 0)
+	if _, result := transfer(t, f); result[1] != ST1MissingAddress {
+		t.Errorf("read ID of an unformatted track gave %v", result)
+	}
+
+	send(t, f, 0x40|CmdFormatTrack, 0, 2, 3, 0x52, 0xE5)
+	send(t, f, 0, 0, 0x41, 2, 0, 0, 0x42, 2, 0, 0, 0x43, 2)
+	if _, result := transfer(t, f); result[0] != 0 {
+		t.Errorf("format gave %v", result)
+	}
+	for _, r := range []byte{0x41, 0x42, 0x43, 0x41} {
+		send(t, f, 0x40|CmdReadID, 0)
+		if _, result := transfer(t, f); !bytes.Equal(result, []byte{0, 0, 0, 0, 0, r, 2}) {
+			t.Errorf("read ID gave %v, want sector 0x%02X", result, r)
+		}
+	}
+	s := f.Drives[0].Disk.Track(0, 0).Sectors[1]
+	if len(s.Data) != 512 || s.Data[511] != 0xE5 {
+		t.Error("formatted sector isn't filled")
+	}
+
+	// Tracks a .dsk image can't hold are refused, leaving the track alone
+	for _, format := range [][2]byte{{1, 30}, {6, 11}} {
+		send(t, f, 0x40|CmdFormatTrack, 0, format[0], format[1], 0x52, 0xE5)
+		if _, result := transfer(t, f); result[0]&ST0Abnormal == 0 || result[1] != ST1NotWritable {
+			t.Errorf("format of %d sectors of size %d gave %v", format[1], format[0], result)
+		}
+	}
+	if n := len(f.Drives[0].Disk.Track(0, 0).Sectors); n != 3 {
+		t.Errorf("track has %d sectors after refused formats, want 3", n)
+	}
+}
+
+func TestDeletedData(t *testing.T) {
+	f := newDrive()
+	f.Drives[0].Disk.Track(0, 0).Sectors[1].ST2 = ST2ControlMark
+	// Skipping the deleted sector reads the one after
+	send(t, f, 0x60|CmdReadData, 0, 0, 0, 2, 2, 3, 0x2A, 0xFF)
+	data, result := transfer(t, f)
+	if len(data) != 512 || data[1] != 3 || result[2] != ST2ControlMark {
+		t.Errorf("skipping read %d bytes and gave %v", len(data), result)
+	}
+	send(t, f, 0x40|CmdReadDeletedData, 0, 0, 0, 2, 2, 2, 0x2A, 0xFF)
+	if data, _ = transfer(t, f); len(data) != 512 || data[1] != 2 {
+		t.Errorf("read deleted data gave %d bytes", len(data))
+	}
+}
+
+func TestInvalidCommand(t *testing.T) {
+	f := newDrive()
+	send(t, f, 0x1F)
+	if _, result := transfer(t, f); !bytes.Equal(result, []byte{ST0Invalid}) {
+		t.Errorf("invalid command gave %v", result)
+	}
+}
+
+// TestReadTrack reads a track of CPC-style sectors, numbered from 0xC1
+// and interleaved, checking they come in the order they are on the disk
+func TestReadTrack(t *testing.T) {
+	f := New()
+	d := dsk.Format(40, 1, 9, 0xC1, 2, 0xE5)
+	track := d.Track(0, 0)
+	var interleaved []*dsk.Sector
+	for i := range 9 {
+		interleaved = append(interleaved, track.Sectors[i*5%9])
+	}
+	track.Sectors = interleaved
+	for _, s := range track.Sectors {
+		s.Data[1] = s.R
+	}
+	f.Drives[0].Insert(d, false)
+	f.SetMotor(true)
+
+	send(t, f, 0x40|CmdReadTrack, 0, 0, 0, 0xC1, 2, 9, 0x2A, 0xFF)
+	data, result := transfer(t, f)
+	if len(data) != 9*512 {
+		t.Fatalf("read %d bytes; want %d", len(data), 9*512)
+	}
+	for i, s := range track.Sectors {
+		if data[i*512+1] != s.R {
+			t.Errorf("sector %d read is 0x%02X; want 0x%02X", i, data[i*512+1], s.R)
+		}
+	}
+	// The IDs don't count up from 0xC1 in that order
+	if result[0] != ST0Abnormal || result[1] != ST1EndOfCylinder|ST1NoData {
+		t.Errorf("result %v; want end of cylinder and no data", result)
+	}
+
+	// Fewer sectors than the track has, and the ID of the first matches
+	send(t, f, 0x40|CmdReadTrack, 0, 0, 0, 0xC1, 2, 1, 0x2A, 0xFF)
+	data, result = transfer(t, f)
+	if len(data) != 512 || data[1] != 0xC1 {
+		t.Errorf("read %d bytes of sector 0x%02X; want 512 of sector C1", len(data), data[1])
+	}
+	if want := []byte{ST0Abnormal, ST1EndOfCylinder, 0, 1, 0, 1, 2}; !bytes.Equal(result, want) {
+		t.Errorf("result %v; want %v", result, want)
+	}
+
+	// More sectors than the track has, or none, stop at the index hole
+	for _, eot := range []byte{0, 10, 0xFF} {
+		send(t, f, 0x40|CmdReadTrack, 0, 0, 0, 0xC1, 2, eot, 0x2A, 0xFF)
+		data, result = transfer(t, f)
+		if len(data) != 9*512 || result[1]&ST1EndOfCylinder == 0 {
+			t.Errorf("EOT %d read %d bytes, result %v; want %d bytes and end of cylinder",
+				eot, len(data), result, 9*512)
+		}
+	}
+}
+
+// TestMultiTrack reads across both sides of a cylinder with the
+// multi-track flag, and checks the read stops at the end of the side
+// without it
+func TestMultiTrack(t *testing.T) {
+	f := New()
+	d := dsk.Format(40, 2, 9, 1, 2, 0xE5)
+	for h := range 2 {
+		for _, s := range d.Track(0, h).Sectors {
+			s.Data[0], s.Data[1] = byte(h), s.R
+		}
+	}
+	f.Drives[0].Insert(d, false)
+	f.SetMotor(true)
+
+	send(t, f, 0x80|0x40|CmdReadData, 0, 0, 0, 8, 2, 9, 0x2A, 0xFF)
+	data, result := transfer(t, f)
+	if len(data) != 11*512 {
+		t.Fatalf("read %d bytes; want %d", len(data), 11*512)
+	}
+	for i, want := range [][2]byte{{0, 8}, {0, 9}, {1, 1}, {1, 2}, {1, 9}} {
+		sector := i
+		if i == 4 {
+			sector = 10
+		}
+		if got := [2]byte(data[sector*512:]); got != want {
+			t.Errorf("sector %d read is head %d sector %d; want %v", sector, got[0], got[1], want)
+		}
+	}
+	if want := []byte{ST0Abnormal | ST0Head, ST1EndOfCylinder, 0, 1, 0, 1, 2}; !bytes.Equal(result, want) {
+		t.Errorf("result %v; want %v", result, want)
+	}
+
+	send(t, f, 0x40|CmdReadData, 0, 0, 0, 8, 2, 9, 0x2A, 0xFF)
+	if data, _ = transfer(t, f); len(data) != 2*512 {
+		t.Errorf("read %d bytes without the multi-track flag; want %d", len(data), 2*512)
+	}
+}
+
+// TestState puts the controller back partway through a read, and checks a
+// read from a disk changed since is abandoned
+func TestState(t *testing.T) {
+	f := newDrive()
+	send(t, f, 0x40|CmdReadData, 0, 0, 0, 1, 2, 2, 0x2A, 0xFF)
+	f.Read()
+	s := f.State()
+	first, result := transfer(t, f)
+	if len(first) != 1023 {
+		t.Fatalf("read %d bytes after the first; want 1023", len(first))
+	}
+
+	f.SetState(s)
+	again, again2 := transfer(t, f)
+	if !bytes.Equal(again, first) || !bytes.Equal(again2, result) {
+		t.Error("read differently after going back")
+	}
+
+	f.SetState(s)
+	f.Drives[0].Insert(dsk.Format(40, 1, 9, 1, 2, 0xE5), false)
+	f.SetState(s)
+	if f.Status() != StatusReady {
+		t.Errorf("status 0x%02X going back to a read from another disk", f.Status())
+	}
+}
@@ -0,0 +1,250 @@
+package video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// APNGWriter writes an animated PNG that loops forever. The frame count
+// goes in the header, so Close seeks back to fill it in. There is one
+// palette for every frame, so frames must have palettes of the same size,
+// and Close fills in the palette of the last: a palette that only grows
+// new colours, as a Framebuffer's does, suits every frame.
+type APNGWriter struct {
+	w        io.WriteSeeker
+	start    int64 // Offset of the stream in w
+	timer    timer
+	prev     *image.Paletted
+	pending  image.Rectangle
+	frames   int    // Frames pending, all showing prev
+	written  uint32 // Frames written
+	sequence uint32 // Next fcTL or fdAT sequence number
+	plte     []byte // The PLTE chunk written
+	buf      bytes.Buffer
+}
+
+// Offsets of the acTL chunk, after the signature and IHDR, and of the
+// PLTE chunk after it
+const (
+	actlOffset = len(pngSignature) + 12 + 13
+	plteOffset = actlOffset + 12 + 8
+)
+
+// NewAPNGWriter returns an APNGWriter writing to w at the given frame rate
+func NewAPNGWriter(w io.WriteSeeker, rate FrameRate) (*APNGWriter, error) {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("APNG needs a seekable file: %v", err)
+	}
+	return &APNGWriter{
+		w:     w,
+		start: start,
+		timer: timer{rate: rate, unit: 1000}, // Delays in milliseconds
+	}, nil
+}
+
+// WriteFrame adds a frame
+func (a *APNGWriter) WriteFrame(img *image.Paletted) error {
+	if a.prev == nil {
+		a.prev = copyFrame(nil, img)
+		a.pending = img.Bounds()
+		a.frames = 1
+		return nil
+	}
+	if img.Bounds() != a.prev.Bounds() {
+		return fmt.Errorf("frame is %v, not %v", img.Bounds(), a.prev.Bounds())
+	}
+	if len(img.Palette) != len(a.prev.Palette) {
+		return fmt.Errorf("frame has %d colours, not %d", len(img.Palette), len(a.prev.Palette))
+	}
+	r := changed(a.prev, img)
+	if r.Empty() {
+		if a.frames < maxMerge {
+			a.frames++
+			return nil
+		}
+		r = image.Rect(0, 0, 1, 1).Add(img.Bounds().Min)
+	}
+	if err := a.flush(); err != nil {
+		return err
+	}
+	copyFrame(a.prev, img)
+	a.pending = r
+	a.frames = 1
+	return nil
+}
+
+// Close writes any frames still pending and the end of the APNG, then
+// fills in the frame count and the last frame's palette
+func (a *APNGWriter) Close() error {
+	if a.prev == nil {
+		return fmt.Errorf("APNG has no frames")
+	}
+	if err := a.flush(); err != nil {
+		return err
+	}
+	if err := a.writeChunk("IEND", nil); err != nil {
+		return err
+	}
+	end, err := a.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := a.w.Seek(a.start+int64(actlOffset), io.SeekStart); err != nil {
+		return err
+	}
+	if err := a.writeChunk("acTL", a.actl()); err != nil {
+		return err
+	}
+	if plte := a.palette(); !bytes.Equal(plte, a.plte) {
+		if _, err := a.w.Seek(a.start+int64(plteOffset), io.SeekStart); err != nil {
+			return err
+		}
+		if err := a.writeChunk("PLTE", plte); err != nil {
+			return err
+		}
+	}
+	_, err = a.w.Seek(end, io.SeekStart)
+	return err
+}
+
+// palette returns the contents of the PLTE chunk for prev's palette
+func (a *APNGWriter) palette() []byte {
+	var plte []byte
+	for _, c := range a.prev.Palette {
+		rgb := color.NRGBAModel.Convert(c).(color.NRGBA)
+		plte = append(plte, rgb.R, rgb.G, rgb.B)
+	}
+	return plte
+}
+
+// actl returns the animation control chunk: the frame count and zero
+// plays, meaning forever
+func (a *APNGWriter) actl() []byte {
+	data := binary.BigEndian.AppendUint32(nil, a.written)
+	return binary.BigEndian.AppendUint32(data, 0)
+}
+
+// flush writes the pending part of prev, shown for the pending frames
+func (a *APNGWriter) flush() error {
+	r := a.pending
+	a.buf.Reset()
+	if err := png.Encode(&a.buf, a.prev.SubImage(r)); err != nil {
+		return err
+	}
+	chunks, err := readChunks(a.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	first := a.written == 0
+	if first {
+		// The header and palette come from the first frame, which is
+		// also the image shown by viewers without APNG support
+		if _, err := io.WriteString(a.w, pngSignature); err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			if c.kind == "IHDR" {
+				if err := a.writeChunk(c.kind, c.data); err != nil {
+					return err
+				}
+			}
+		}
+		if err := a.writeChunk("acTL", a.actl()); err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			if c.kind == "PLTE" || c.kind == "tRNS" {
+				if err := a.writeChunk(c.kind, c.data); err != nil {
+					return err
+				}
+			}
+			if c.kind == "PLTE" {
+				a.plte = append([]byte(nil), c.data...)
+			}
+		}
+	}
+
+	b := a.prev.Bounds()
+	delay := a.timer.advance(a.frames)
+	fctl := binary.BigEndian.AppendUint32(nil, a.sequence)
+	fctl = binary.BigEndian.AppendUint32(fctl, uint32(r.Dx()))
+	fctl = binary.BigEndian.AppendUint32(fctl, uint32(r.Dy()))
+	fctl = binary.BigEndian.AppendUint32(fctl, uint32(r.Min.X-b.Min.X))
+	fctl = binary.BigEndian.AppendUint32(fctl, uint32(r.Min.Y-b.Min.Y))
+	fctl = binary.BigEndian.AppendUint16(fctl, uint16(delay))
+	fctl = binary.BigEndian.AppendUint16(fctl, uint16(a.timer.unit))
+	fctl = append(fctl, 0, 0) // Leave the frame in place, no blending
+	a.sequence++
+	if err := a.writeChunk("fcTL", fctl); err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		if c.kind != "IDAT" {
+			continue
+		}
+		if first {
+			err = a.writeChunk("IDAT", c.data)
+		} else {
+			fdat := binary.BigEndian.AppendUint32(nil, a.sequence)
+			a.sequence++
+			err = a.writeChunk("fdAT", append(fdat, c.data...))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	a.written++
+	return nil
+}
+
+func (a *APNGWriter) writeChunk(kind string, data []byte) error {
+	_, err := a.w.Write(chunkBytes(kind, data))
+	return err
+}
+
+// chunkBytes returns a PNG chunk with its length and CRC
+func chunkBytes(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// chunk is a PNG chunk
+type chunk struct {
+	kind string
+	data []byte
+}
+
+// readChunks splits a PNG file into its chunks
+func readChunks(file []byte) ([]chunk, error) {
+	if !bytes.HasPrefix(file, []byte(pngSignature)) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+	file = file[len(pngSignature):]
+	var chunks []chunk
+	for len(file) > 0 {
+		if len(file) < 12 {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+		n := binary.BigEndian.Uint32(file)
+		if uint64(n)+12 > uint64(len(file)) {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+		chunks = append(chunks, chunk{string(file[4:8]), file[8 : 8+n]})
+		file = file[12+n:]
+	}
+	return chunks, nil
+}
@@ -0,0 +1,220 @@
+package video
+
+import (
+	"bufio"
+	"compress/lzw"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// minGIFDelay is the shortest delay, in centiseconds, browsers show as
+// written; they slow shorter ones down to a tenth of a second
+const minGIFDelay = 2
+
+// GIFWriter writes an animated GIF that loops forever. The palette of the
+// first frame is the global colour table; frames with another palette
+// carry a local one.
+type GIFWriter struct {
+	w       *bufio.Writer
+	timer   timer
+	global  color.Palette   // The global colour table
+	bits    int             // log2 of the global colour table size
+	prev    *image.Paletted // The last frame seen
+	pending image.Rectangle // Part of prev still to be written
+	frames  int             // Frames pending, all showing prev
+}
+
+// NewGIFWriter returns a GIFWriter writing to w at the given frame rate
+func NewGIFWriter(w io.Writer, rate FrameRate) *GIFWriter {
+	return &GIFWriter{
+		w:     bufio.NewWriter(w),
+		timer: timer{rate: rate, unit: 100}, // GIF delays are in centiseconds
+	}
+}
+
+// WriteFrame adds a frame
+func (g *GIFWriter) WriteFrame(img *image.Paletted) error {
+	if g.prev == nil {
+		if err := g.writeHeader(img); err != nil {
+			return err
+		}
+		g.prev = copyFrame(nil, img)
+		g.pending = img.Bounds()
+		g.frames = 1
+		return nil
+	}
+	if img.Bounds() != g.prev.Bounds() {
+		return fmt.Errorf("frame is %v, not %v", img.Bounds(), g.prev.Bounds())
+	}
+	r := changed(g.prev, img)
+	if r.Empty() {
+		if g.frames < maxMerge {
+			g.frames++
+			return nil
+		}
+		r = image.Rect(0, 0, 1, 1).Add(img.Bounds().Min)
+	}
+	if g.timer.peek(g.frames) < minGIFDelay {
+		// Too short to show, so the new frame replaces it
+		copyFrame(g.prev, img)
+		g.pending = g.pending.Union(r)
+		g.frames++
+		return nil
+	}
+	if err := g.flush(); err != nil {
+		return err
+	}
+	copyFrame(g.prev, img)
+	g.pending = r
+	g.frames = 1
+	return nil
+}
+
+// Close writes any frames still pending and the end of the GIF
+func (g *GIFWriter) Close() error {
+	if g.prev == nil {
+		return fmt.Errorf("GIF has no frames")
+	}
+	if err := g.flush(); err != nil {
+		return err
+	}
+	g.w.WriteByte(0x3B) // Trailer
+	return g.w.Flush()
+}
+
+func (g *GIFWriter) writeHeader(img *image.Paletted) error {
+	if len(img.Palette) > 256 {
+		return fmt.Errorf("GIF can't have %d colours", len(img.Palette))
+	}
+	g.global = append(color.Palette(nil), img.Palette...)
+	g.bits = tableBits(g.global)
+	size := img.Bounds().Size()
+	header := []byte("GIF89a")
+	header = binary.LittleEndian.AppendUint16(header, uint16(size.X))
+	header = binary.LittleEndian.AppendUint16(header, uint16(size.Y))
+	// Global colour table, 8 bits per primary
+	header = append(header, 0xF0|byte(g.bits-1), 0, 0)
+	header = appendTable(header, g.global, g.bits)
+	// Loop forever
+	header = append(header, 0x21, 0xFF, 0x0B)
+	header = append(header, "NETSCAPE2.0"...)
+	header = append(header, 0x03, 0x01, 0x00, 0x00, 0x00)
+	_, err := g.w.Write(header)
+	return err
+}
+
+// flush writes the pending part of prev, shown for the pending frames
+func (g *GIFWriter) flush() error {
+	delay := g.timer.advance(g.frames)
+	r := g.pending
+	b := g.prev.Bounds()
+
+	// Graphic control extension: leave the frame in place for the next
+	frame := []byte{0x21, 0xF9, 0x04, 0x04}
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(delay))
+	frame = append(frame, 0x00, 0x00)
+
+	// Image descriptor, using the global colour table if it is the
+	// frame's palette
+	frame = append(frame, 0x2C)
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(r.Min.X-b.Min.X))
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(r.Min.Y-b.Min.Y))
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(r.Dx()))
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(r.Dy()))
+	bits := g.bits
+	if samePalette(g.prev.Palette, g.global) {
+		frame = append(frame, 0x00)
+	} else {
+		if len(g.prev.Palette) > 256 {
+			return fmt.Errorf("GIF can't have %d colours", len(g.prev.Palette))
+		}
+		bits = tableBits(g.prev.Palette)
+		frame = append(frame, 0x80|byte(bits-1))
+		frame = appendTable(frame, g.prev.Palette, bits)
+	}
+
+	// LZW needs codes of at least 2 bits
+	litWidth := max(bits, 2)
+	frame = append(frame, byte(litWidth))
+	if _, err := g.w.Write(frame); err != nil {
+		return err
+	}
+	blocks := &blockWriter{w: g.w}
+	lzww := lzw.NewWriter(blocks, lzw.LSB, litWidth)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if _, err := lzww.Write(g.prev.Pix[g.prev.PixOffset(r.Min.X, y):][:r.Dx()]); err != nil {
+			return err
+		}
+	}
+	if err := lzww.Close(); err != nil {
+		return err
+	}
+	return blocks.close()
+}
+
+// tableBits returns log2 of the size of the colour table for a palette
+func tableBits(palette color.Palette) int {
+	bits := 1
+	for 1<<bits < len(palette) {
+		bits++
+	}
+	return bits
+}
+
+// appendTable appends a colour table of 1<<bits entries holding palette,
+// 8 bits per primary
+func appendTable(b []byte, palette color.Palette, bits int) []byte {
+	for i := range 1 << bits {
+		var r, g, bl uint32
+		if i < len(palette) {
+			r, g, bl, _ = palette[i].RGBA()
+		}
+		b = append(b, byte(r>>8), byte(g>>8), byte(bl>>8))
+	}
+	return b
+}
+
+// blockWriter splits data into the GIF's sub-blocks of up to 255 bytes
+type blockWriter struct {
+	w   io.Writer
+	buf [256]byte
+	n   int
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(b.buf[1+b.n:], p)
+		b.n += n
+		p = p[n:]
+		written += n
+		if b.n == 255 {
+			if err := b.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *blockWriter) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.buf[0] = byte(b.n)
+	_, err := b.w.Write(b.buf[:1+b.n])
+	b.n = 0
+	return err
+}
+
+// close writes the last sub-block and the terminator
+func (b *blockWriter) close() error {
+	if err := b.flush(); err != nil {
+		return err
+	}
+	_, err := b.w.Write([]byte{0x00})
+	return err
+}
@@ -0,0 +1,112 @@
+// Package video writes a sequence of paletted frames as an animated GIF
+// or APNG image, or as a raw YUV4MPEG2 stream for external encoders.
+//
+// The GIF and APNG writers only store the part of each frame that changed
+// and merge runs of identical frames into one, so a mostly still screen
+// makes a small file.
+package video
+
+import (
+	"image"
+	"image/color"
+)
+
+// FrameRate is a number of frames a second, as the fraction Num/Den
+type FrameRate struct {
+	Num, Den int
+}
+
+// Writer writes frames to a video stream
+type Writer interface {
+	// WriteFrame adds a frame. Every frame must be the same size. The
+	// frame is not kept, so the caller may draw on it again at once.
+	WriteFrame(img *image.Paletted) error
+
+	// Close finishes the stream. It does not close the underlying writer.
+	Close() error
+}
+
+// maxMerge is the most identical frames merged into one, keeping delays
+// well within the 16 bits GIF and APNG allow
+const maxMerge = 1000
+
+// timer turns frame counts into whole ticks of a clock with unit ticks a
+// second, carrying the remainders so that the average rate is exact
+type timer struct {
+	rate   FrameRate
+	unit   int
+	frames int
+}
+
+// advance counts frames and returns how many ticks they last
+func (t *timer) advance(frames int) int {
+	before := t.ticks(t.frames)
+	t.frames += frames
+	return t.ticks(t.frames) - before
+}
+
+// peek returns how many ticks frames more frames would last
+func (t *timer) peek(frames int) int {
+	return t.ticks(t.frames+frames) - t.ticks(t.frames)
+}
+
+func (t *timer) ticks(frames int) int {
+	return int(int64(frames) * int64(t.unit) * int64(t.rate.Den) / int64(t.rate.Num))
+}
+
+// changed returns the smallest rectangle holding every pixel that differs
+// between two frames of the same size, or an empty rectangle. A change of
+// palette changes the whole frame.
+func changed(prev, img *image.Paletted) image.Rectangle {
+	var r image.Rectangle
+	b := img.Bounds()
+	if !samePalette(prev.Palette, img.Palette) {
+		return b
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		a := prev.Pix[prev.PixOffset(b.Min.X, y):][:b.Dx()]
+		c := img.Pix[img.PixOffset(b.Min.X, y):][:b.Dx()]
+		first := -1
+		last := 0
+		for x := range c {
+			if a[x] != c[x] {
+				if first < 0 {
+					first = x
+				}
+				last = x
+			}
+		}
+		if first >= 0 {
+			r = r.Union(image.Rect(b.Min.X+first, y, b.Min.X+last+1, y+1))
+		}
+	}
+	return r
+}
+
+// copyFrame copies img into dst, allocating dst if it is nil
+func copyFrame(dst, img *image.Paletted) *image.Paletted {
+	if dst == nil {
+		dst = image.NewPaletted(img.Bounds(), nil)
+	}
+	dst.Palette = append(color.Palette(nil), img.Palette...)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		copy(dst.Pix[dst.PixOffset(b.Min.X, y):][:b.Dx()], img.Pix[img.PixOffset(b.Min.X, y):])
+	}
+	return dst
+}
+
+// samePalette reports whether two palettes hold the same colours
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		r1, g1, b1, a1 := a[i].RGBA()
+		r2, g2, b2, a2 := b[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return false
+		}
+	}
+	return true
+}
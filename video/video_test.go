@@ -0,0 +1,314 @@
+package video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testPalette = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xFF},
+	color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+	color.RGBA{0xFF, 0x00, 0x00, 0xFF},
+}
+
+// testFrames returns a frame, the same again, and one with a small
+// change
+func testFrames() []*image.Paletted {
+	a := image.NewPaletted(image.Rect(0, 0, 16, 8), testPalette)
+	a.SetColorIndex(3, 2, 1)
+	b := copyFrame(nil, a)
+	c := copyFrame(nil, a)
+	c.SetColorIndex(5, 6, 2)
+	c.SetColorIndex(9, 4, 2)
+	return []*image.Paletted{a, b, c}
+}
+
+func TestGIF(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewGIFWriter(&buf, FrameRate{50, 1})
+	for _, frame := range testFrames() {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 {
+		t.Fatalf("GIF has %d frames, want 2", len(g.Image))
+	}
+	if g.Delay[0] != 4 || g.Delay[1] != 2 {
+		t.Errorf("delays are %v, want [4 2]", g.Delay)
+	}
+	if g.LoopCount != 0 {
+		t.Errorf("loop count is %d, want forever", g.LoopCount)
+	}
+	if got, want := g.Image[1].Bounds(), image.Rect(5, 4, 10, 7); got != want {
+		t.Errorf("second frame covers %v, want %v", got, want)
+	}
+	if g.Image[0].ColorIndexAt(3, 2) != 1 || g.Image[1].ColorIndexAt(9, 4) != 2 {
+		t.Error("wrong pixels")
+	}
+}
+
+func TestGIFDelays(t *testing.T) {
+	// At 50.08 frames a second, a frame sometimes lasts only 1cs
+	rate := FrameRate{3_500_000, 69888}
+	var buf bytes.Buffer
+	w := NewGIFWriter(&buf, rate)
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), testPalette)
+	const frames = 500
+	for i := range frames {
+		frame.Pix[0] = byte(i & 1)
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for i, delay := range g.Delay {
+		if delay < minGIFDelay {
+			t.Errorf("frame %d lasts %dcs", i, delay)
+		}
+		total += delay
+	}
+	if want := frames * 100 * rate.Den / rate.Num; total != want {
+		t.Errorf("GIF lasts %dcs, want %d", total, want)
+	}
+}
+
+func TestAPNG(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.png")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w, err := NewAPNGWriter(file, FrameRate{50, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := testFrames()
+	for _, frame := range frames {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Viewers without APNG support see the first frame
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != frames[0].Bounds() || img.(*image.Paletted).ColorIndexAt(3, 2) != 1 {
+		t.Error("default image isn't the first frame")
+	}
+
+	chunks, err := readChunks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	var ihdr, plte, fctl, fdat []byte
+	for _, c := range chunks {
+		kinds = append(kinds, c.kind)
+		switch c.kind {
+		case "IHDR":
+			ihdr = c.data
+		case "PLTE":
+			plte = c.data
+		case "acTL":
+			if n := binary.BigEndian.Uint32(c.data); n != 2 {
+				t.Errorf("acTL counts %d frames, want 2", n)
+			}
+		case "fcTL":
+			fctl = c.data
+		case "fdAT":
+			fdat = c.data
+		}
+	}
+	if got, want := strings.Join(kinds, " "), "IHDR acTL PLTE fcTL IDAT fcTL fdAT IEND"; got != want {
+		t.Errorf("chunks are %s, want %s", got, want)
+	}
+	if seq := binary.BigEndian.Uint32(fdat); seq != 2 {
+		t.Errorf("fdAT sequence number is %d, want 2", seq)
+	}
+	if delay := binary.BigEndian.Uint16(fctl[20:]); delay != 20 {
+		t.Errorf("second frame lasts %dms, want 20", delay)
+	}
+
+	// The second frame is a PNG of its own with the fcTL's size
+	x, y := int(binary.BigEndian.Uint32(fctl[12:])), int(binary.BigEndian.Uint32(fctl[16:]))
+	ihdr = append([]byte(nil), ihdr...)
+	copy(ihdr, fctl[4:12])
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	for _, c := range []chunk{{"IHDR", ihdr}, {"PLTE", plte}, {"IDAT", fdat[4:]}, {"IEND", nil}} {
+		buf.Write(chunkBytes(c.kind, c.data))
+	}
+	img, err = png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.Bounds().Add(image.Pt(x, y)), image.Rect(5, 4, 10, 7); got != want {
+		t.Errorf("second frame covers %v, want %v", got, want)
+	}
+	if img.(*image.Paletted).ColorIndexAt(9-x, 4-y) != 2 {
+		t.Error("wrong pixels in second frame")
+	}
+}
+
+// TestPaletteChange checks a frame with a new colour in its palette shows
+// it: GIF gives the frame a colour table of its own and APNG takes the
+// last frame's palette
+func TestPaletteChange(t *testing.T) {
+	blue := color.RGBA{0x00, 0x00, 0xFF, 0xFF}
+	frames := testFrames()
+	frames[2].Palette = append(color.Palette(nil), testPalette...)
+	frames[2].Palette[2] = blue
+
+	var buf bytes.Buffer
+	g := NewGIFWriter(&buf, FrameRate{50, 1})
+	file, err := os.Create(filepath.Join(t.TempDir(), "test.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	a, err := NewAPNGWriter(file, FrameRate{50, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []Writer{g, a} {
+		for _, frame := range frames {
+			if err := w.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decoded, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Image) != 2 {
+		t.Fatalf("GIF has %d frames, want 2", len(decoded.Image))
+	}
+	first, second := decoded.Image[0], decoded.Image[1]
+	if second.Bounds() != frames[2].Bounds() {
+		t.Errorf("second frame covers %v, want the whole frame", second.Bounds())
+	}
+	if got := first.At(3, 2); got != testPalette[1] {
+		t.Errorf("first frame's pixel is %v, want %v", got, testPalette[1])
+	}
+	if got := second.At(9, 4); got != blue {
+		t.Errorf("second frame's pixel is %v, want %v", got, blue)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.(*image.Paletted).Palette[2]; got != blue {
+		t.Errorf("APNG palette entry 2 is %v, want %v", got, blue)
+	}
+
+	// APNG can't change the number of colours
+	frames[2].Palette = frames[2].Palette[:2]
+	a, err = NewAPNGWriter(file, FrameRate{50, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteFrame(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteFrame(frames[2]); err == nil {
+		t.Error("APNG took frames with different numbers of colours")
+	}
+}
+
+func TestY4M(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewY4MWriter(&buf, FrameRate{50, 1})
+	frames := testFrames()
+	frames[0].SetColorIndex(0, 0, 1)
+	for _, frame := range frames {
+		if err := w.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, data, _ := strings.Cut(buf.String(), "\n")
+	if want := "YUV4MPEG2 W16 H8 F50:1 Ip A1:1 C420jpeg XCOLORRANGE=FULL"; header != want {
+		t.Errorf("header is %q, want %q", header, want)
+	}
+	frameSize := len("FRAME\n") + 16*8 + 2*8*4
+	if len(data) != 3*frameSize {
+		t.Fatalf("%d bytes of frames, want %d", len(data), 3*frameSize)
+	}
+	frame := data[len("FRAME\n"):]
+	if frame[0] != 0xFF || frame[1] != 0x00 {
+		t.Errorf("luma is %d, %d, want 255, 0", frame[0], frame[1])
+	}
+	// Grey has no colour
+	if cb, cr := frame[16*8], frame[16*8+8*4]; cb != 128 || cr != 128 {
+		t.Errorf("chroma is %d, %d, want 128, 128", cb, cr)
+	}
+}
+
+func TestWrongSize(t *testing.T) {
+	small := image.NewPaletted(image.Rect(0, 0, 2, 2), testPalette)
+	big := image.NewPaletted(image.Rect(0, 0, 4, 4), testPalette)
+	file, err := os.Create(filepath.Join(t.TempDir(), "test.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	apng, err := NewAPNGWriter(file, FrameRate{50, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []Writer{NewGIFWriter(&bytes.Buffer{}, FrameRate{50, 1}), apng, NewY4MWriter(&bytes.Buffer{}, FrameRate{50, 1})} {
+		if err := w.WriteFrame(small); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteFrame(big); err == nil {
+			t.Errorf("%T took frames of different sizes", w)
+		}
+	}
+}
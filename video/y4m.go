@@ -0,0 +1,83 @@
+package video
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Y4MWriter writes a YUV4MPEG2 stream, uncompressed 4:2:0 video that
+// encoders such as ffmpeg read directly. The colours are full range.
+type Y4MWriter struct {
+	w      *bufio.Writer
+	rate   FrameRate
+	bounds image.Rectangle
+	y      []byte
+	cb, cr []byte
+}
+
+// NewY4MWriter returns a Y4MWriter writing to w at the given frame rate
+func NewY4MWriter(w io.Writer, rate FrameRate) *Y4MWriter {
+	return &Y4MWriter{w: bufio.NewWriter(w), rate: rate}
+}
+
+// WriteFrame adds a frame
+func (v *Y4MWriter) WriteFrame(img *image.Paletted) error {
+	b := img.Bounds()
+	if v.y == nil {
+		v.bounds = b
+		fmt.Fprintf(v.w, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C420jpeg XCOLORRANGE=FULL\n",
+			b.Dx(), b.Dy(), v.rate.Num, v.rate.Den)
+		v.y = make([]byte, b.Dx()*b.Dy())
+		cw, ch := (b.Dx()+1)/2, (b.Dy()+1)/2
+		v.cb = make([]byte, cw*ch)
+		v.cr = make([]byte, cw*ch)
+	} else if b != v.bounds {
+		return fmt.Errorf("frame is %v, not %v", b, v.bounds)
+	}
+
+	// Convert the palette once rather than every pixel
+	var ys, cbs, crs [256]byte
+	for i, c := range img.Palette {
+		r, g, b, _ := c.RGBA()
+		ys[i], cbs[i], crs[i] = color.RGBToYCbCr(byte(r>>8), byte(g>>8), byte(b>>8))
+	}
+
+	w, h := b.Dx(), b.Dy()
+	cw := (w + 1) / 2
+	for y := range h {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):][:w]
+		for x, p := range row {
+			v.y[y*w+x] = ys[p]
+		}
+	}
+	// Each chroma sample is the average of up to four pixels
+	for cy := range (h + 1) / 2 {
+		for cx := range cw {
+			var cb, cr, n int
+			for y := cy * 2; y < min(cy*2+2, h); y++ {
+				for x := cx * 2; x < min(cx*2+2, w); x++ {
+					p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y)]
+					cb += int(cbs[p])
+					cr += int(crs[p])
+					n++
+				}
+			}
+			v.cb[cy*cw+cx] = byte((cb + n/2) / n)
+			v.cr[cy*cw+cx] = byte((cr + n/2) / n)
+		}
+	}
+
+	v.w.WriteString("FRAME\n")
+	v.w.Write(v.y)
+	v.w.Write(v.cb)
+	_, err := v.w.Write(v.cr)
+	return err
+}
+
+// Close flushes the stream
+func (v *Y4MWriter) Close() error {
+	return v.w.Flush()
+}
@@ -0,0 +1,89 @@
+// Package wav writes 16-bit PCM WAV files
+package wav
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const headerSize = 44
+
+// Writer writes samples to a WAV stream. If the underlying writer can
+// seek, Close fills in the sizes in the header; otherwise the sizes are
+// left at their maximum, which streaming readers accept.
+type Writer struct {
+	w          io.Writer
+	sampleRate int
+	channels   int
+	dataBytes  uint32
+	buf        []byte
+}
+
+// NewWriter writes a WAV header to w and returns a Writer for the samples
+func NewWriter(w io.Writer, sampleRate, channels int) (*Writer, error) {
+	if sampleRate <= 0 || channels <= 0 {
+		return nil, fmt.Errorf("invalid WAV format: %d Hz, %d channels", sampleRate, channels)
+	}
+	ww := &Writer{w: w, sampleRate: sampleRate, channels: channels}
+	if err := ww.writeHeader(math.MaxUint32 - headerSize); err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+func (w *Writer) writeHeader(dataBytes uint32) error {
+	blockAlign := w.channels * 2
+	var h [headerSize]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], dataBytes+headerSize-8)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(h[20:], 1)  // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(w.channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(w.sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(w.sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(h[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(h[34:], 16) // bits per sample
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataBytes)
+	_, err := w.w.Write(h[:])
+	return err
+}
+
+// WriteSamples writes interleaved samples in the range -1 to 1. Samples
+// outside the range are clipped.
+func (w *Writer) WriteSamples(samples []float32) error {
+	w.buf = w.buf[:0]
+	for _, s := range samples {
+		v := int32(s * 32767)
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		w.buf = binary.LittleEndian.AppendUint16(w.buf, uint16(int16(v)))
+	}
+	n, err := w.w.Write(w.buf)
+	w.dataBytes += uint32(n)
+	return err
+}
+
+// Close finishes the WAV stream. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	ws, ok := w.w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		// Files such as pipes have a Seek method that always fails
+		return nil
+	}
+	if err := w.writeHeader(w.dataBytes); err != nil {
+		return err
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
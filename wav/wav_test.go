@@ -0,0 +1,112 @@
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkHeader checks the fields of a 16-bit PCM header
+func checkHeader(t *testing.T, h []byte, sampleRate, channels int, dataBytes uint32) {
+	t.Helper()
+	if len(h) < headerSize {
+		t.Fatalf("header is %d bytes; want %d", len(h), headerSize)
+	}
+	le := binary.LittleEndian
+	for offset, id := range map[int]string{0: "RIFF", 8: "WAVE", 12: "fmt ", 36: "data"} {
+		if got := string(h[offset : offset+4]); got != id {
+			t.Errorf("chunk ID at %d = %q; want %q", offset, got, id)
+		}
+	}
+	fields := []struct {
+		name      string
+		got, want uint32
+	}{
+		{"RIFF size", le.Uint32(h[4:]), dataBytes + headerSize - 8},
+		{"fmt size", le.Uint32(h[16:]), 16},
+		{"format", uint32(le.Uint16(h[20:])), 1},
+		{"channels", uint32(le.Uint16(h[22:])), uint32(channels)},
+		{"sample rate", le.Uint32(h[24:]), uint32(sampleRate)},
+		{"byte rate", le.Uint32(h[28:]), uint32(sampleRate * channels * 2)},
+		{"block align", uint32(le.Uint16(h[32:])), uint32(channels * 2)},
+		{"bits per sample", uint32(le.Uint16(h[34:])), 16},
+		{"data size", le.Uint32(h[40:]), dataBytes},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("%s = %d; want %d", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestSamples(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 44100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteSamples([]float32{0, 1, -1, 0.5, 2, -2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not seekable, so the sizes stay at their maximum
+	checkHeader(t, buf.Bytes(), 44100, 2, math.MaxUint32-headerSize)
+	want := []int16{0, 32767, -32767, 16383, 32767, -32768}
+	data := buf.Bytes()[headerSize:]
+	if len(data) != len(want)*2 {
+		t.Fatalf("%d bytes of data; want %d", len(data), len(want)*2)
+	}
+	for i, sample := range want {
+		if got := int16(binary.LittleEndian.Uint16(data[i*2:])); got != sample {
+			t.Errorf("sample %d = %d; want %d", i, got, sample)
+		}
+	}
+}
+
+func TestCloseFillsInSizes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.wav")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(file, 48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := w.WriteSamples(make([]float32, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Writing carries on at the end, not over the header
+	if _, err := file.Write([]byte("LIST")); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeader(t, data, 48000, 1, 600)
+	if len(data) != headerSize+600+4 {
+		t.Errorf("file is %d bytes; want %d", len(data), headerSize+604)
+	}
+}
+
+func TestBadFormat(t *testing.T) {
+	for _, f := range [][2]int{{0, 1}, {44100, 0}, {-1, 2}} {
+		if _, err := NewWriter(&bytes.Buffer{}, f[0], f[1]); err == nil {
+			t.Errorf("NewWriter(%d Hz, %d channels) succeeded; want an error", f[0], f[1])
+		}
+	}
+}
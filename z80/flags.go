@@ -0,0 +1,13 @@
+package z80
+
+// Flag bits in the F register
+const (
+	FlagC  = uint8(1) << 0 // carry
+	FlagN  = uint8(1) << 1 // add/subtract
+	FlagPV = uint8(1) << 2 // parity/overflow
+	FlagX  = uint8(1) << 3 // undocumented bit 3
+	FlagH  = uint8(1) << 4 // half carry
+	FlagY  = uint8(1) << 5 // undocumented bit 5
+	FlagZ  = uint8(1) << 6 // zero
+	FlagS  = uint8(1) << 7 // sign
+)
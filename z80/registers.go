@@ -17,6 +17,7 @@ static uint16_t z80_get_af2(z80_t* cpu) { return cpu->af2; }
 static uint16_t z80_get_bc2(z80_t* cpu) { return cpu->bc2; }
 static uint16_t z80_get_de2(z80_t* cpu) { return cpu->de2; }
 static uint16_t z80_get_hl2(z80_t* cpu) { return cpu->hl2; }
+static uint16_t z80_get_wz(z80_t* cpu) { return cpu->wz; }
 
 static uint8_t z80_get_a(z80_t* cpu) { return cpu->a; }
 static uint8_t z80_get_f(z80_t* cpu) { return cpu->f; }
@@ -46,6 +47,7 @@ static void z80_set_af2(z80_t* cpu, uint16_t af2) { cpu->af2 = af2; }
 static void z80_set_bc2(z80_t* cpu, uint16_t bc2) { cpu->bc2 = bc2; }
 static void z80_set_de2(z80_t* cpu, uint16_t de2) { cpu->de2 = de2; }
 static void z80_set_hl2(z80_t* cpu, uint16_t hl2) { cpu->hl2 = hl2; }
+static void z80_set_wz(z80_t* cpu, uint16_t wz) { cpu->wz = wz; }
 
 static void z80_set_a(z80_t* cpu, uint8_t a) { cpu->a = a; }
 static void z80_set_f(z80_t* cpu, uint8_t f) { cpu->f = f; }
@@ -83,6 +85,9 @@ func (c *CPU) BC2() uint16 { return uint16(C.z80_get_bc2(&c.cpu)) }
 func (c *CPU) DE2() uint16 { return uint16(C.z80_get_de2(&c.cpu)) }
 func (c *CPU) HL2() uint16 { return uint16(C.z80_get_hl2(&c.cpu)) }
 
+// WZ returns the internal MEMPTR register
+func (c *CPU) WZ() uint16 { return uint16(C.z80_get_wz(&c.cpu)) }
+
 // Individual register access
 func (c *CPU) A() uint8   { return uint8(C.z80_get_a(&c.cpu)) }
 func (c *CPU) F() uint8   { return uint8(C.z80_get_f(&c.cpu)) }
@@ -112,6 +117,7 @@ func (c *CPU) SetAF2(af2 uint16) { C.z80_set_af2(&c.cpu, C.uint16_t(af2)) }
 func (c *CPU) SetBC2(bc2 uint16) { C.z80_set_bc2(&c.cpu, C.uint16_t(bc2)) }
 func (c *CPU) SetDE2(de2 uint16) { C.z80_set_de2(&c.cpu, C.uint16_t(de2)) }
 func (c *CPU) SetHL2(hl2 uint16) { C.z80_set_hl2(&c.cpu, C.uint16_t(hl2)) }
+func (c *CPU) SetWZ(wz uint16)   { C.z80_set_wz(&c.cpu, C.uint16_t(wz)) }
 
 // Individual register access
 func (c *CPU) SetA(a uint8)  { C.z80_set_a(&c.cpu, C.uint8_t(a)) }
@@ -39,3 +39,20 @@ func (c *CPU) Prefetch(newPC uint16) uint64 {
 func (c *CPU) OpDone() bool {
 	return bool(C.z80_opdone(&c.cpu))
 }
+
+// State is the complete state of a CPU, down to where it is within an
+// instruction
+type State struct {
+	cpu C.z80_t
+}
+
+// State returns the CPU's state, to be put back with SetState
+func (c *CPU) State() State {
+	return State{c.cpu}
+}
+
+// SetState puts the CPU back in a state returned by State. Given the same
+// pins it then carries on exactly as it did from that state.
+func (c *CPU) SetState(s State) {
+	c.cpu = s.cpu
+}